@@ -18,4 +18,10 @@ const (
 	SourceKey     string = "external-source"
 	DatacenterKey string = "consul.hashicorp.com/source-datacenter"
 	SourceValue   string = "kubernetes"
+
+	// ManagedByKey is the meta key of config entries written by consul-k8s
+	// components other than the CRD controller. The controller overwrites
+	// them when a custom resource for the same entry is created.
+	ManagedByKey              string = "consul.hashicorp.com/managed-by"
+	ManagedByLifecycleSidecar string = "consul-k8s-lifecycle-sidecar"
 )
@@ -8,6 +8,7 @@ import (
 	"net/http"
 
 	"github.com/go-logr/logr"
+	"github.com/hashicorp/consul-k8s/namespaces"
 	capi "github.com/hashicorp/consul/api"
 	"gomodules.xyz/jsonpatch/v2"
 	"k8s.io/api/admission/v1beta1"
@@ -26,6 +27,8 @@ type ServiceIntentionsWebhook struct {
 	EnableNSMirroring          bool
 	ConsulDestinationNamespace string
 	NSMirroringPrefix          string
+	NamespaceMapping           *namespaces.Mapping
+	NamespaceLabels            namespaces.LabelsFunc
 }
 
 // NOTE: The path value in the below line is the path to the webhook.
@@ -50,7 +53,7 @@ func (v *ServiceIntentionsWebhook) Handle(ctx context.Context, req admission.Req
 		return admission.Errored(http.StatusInternalServerError, err)
 	}
 
-	singleConsulDestNS := !(v.EnableConsulNamespaces && v.EnableNSMirroring)
+	singleConsulDestNS := !(v.EnableConsulNamespaces && (v.EnableNSMirroring || v.NamespaceMapping != nil))
 	if req.Operation == v1beta1.Create {
 		v.Logger.Info("validate create", "name", svcIntentions.KubernetesName())
 
@@ -112,7 +115,18 @@ func (v *ServiceIntentionsWebhook) defaultingPatches(err error, svcIntentions *S
 	if err != nil {
 		return nil, fmt.Errorf("marshalling input: %s", err)
 	}
-	svcIntentions.Default(v.EnableConsulNamespaces, v.ConsulDestinationNamespace, v.EnableNSMirroring, v.NSMirroringPrefix)
+	if v.NamespaceMapping != nil {
+		// Resolve the namespace mapping here and default to the namespace it
+		// maps to, since Default doesn't know about mappings.
+		consulNS, err := namespaces.MappedConsulNamespace(v.NamespaceMapping, v.NamespaceLabels, svcIntentions.Namespace,
+			v.EnableConsulNamespaces, v.ConsulDestinationNamespace, v.EnableNSMirroring, v.NSMirroringPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("determining consul namespace: %s", err)
+		}
+		svcIntentions.Default(v.EnableConsulNamespaces, consulNS, false, "")
+	} else {
+		svcIntentions.Default(v.EnableConsulNamespaces, v.ConsulDestinationNamespace, v.EnableNSMirroring, v.NSMirroringPrefix)
+	}
 	afterDefaulting, err := json.Marshal(svcIntentions)
 	if err != nil {
 		return nil, fmt.Errorf("marshalling after defaulting: %s", err)
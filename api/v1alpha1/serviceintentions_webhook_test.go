@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul-k8s/namespaces"
 	"github.com/stretchr/testify/require"
 	"gomodules.xyz/jsonpatch/v2"
 	"k8s.io/api/admission/v1beta1"
@@ -628,3 +629,61 @@ func TestHandle_ServiceIntentions_Patches(t *testing.T) {
 		}
 	}
 }
+
+// Test that destination.namespace defaults to the Consul namespace the
+// resource's k8s namespace is mapped to.
+func TestHandle_ServiceIntentions_PatchesNamespaceMapping(t *testing.T) {
+	mapping, err := namespaces.ParseMapping([]byte(`{"rules": [{"namespace": "bar", "consulNamespace": "mapped"}]}`))
+	require.NoError(t, err)
+	resource := &ServiceIntentions{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo-intention",
+			Namespace: "bar",
+		},
+		Spec: ServiceIntentionsSpec{
+			Destination: Destination{
+				Name: "foo",
+			},
+			Sources: SourceIntentions{
+				{
+					Name:   "baz",
+					Action: "allow",
+				},
+			},
+		},
+	}
+	marshalledRequestObject, err := json.Marshal(resource)
+	require.NoError(t, err)
+	s := runtime.NewScheme()
+	s.AddKnownTypes(GroupVersion, &ServiceIntentions{}, &ServiceIntentionsList{})
+	client := fake.NewFakeClientWithScheme(s)
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(t, err)
+
+	validator := &ServiceIntentionsWebhook{
+		Client:                     client,
+		Logger:                     logrtest.TestLogger{T: t},
+		decoder:                    decoder,
+		EnableConsulNamespaces:     true,
+		ConsulDestinationNamespace: "default",
+		NamespaceMapping:           mapping,
+	}
+	response := validator.Handle(context.Background(), admission.Request{
+		AdmissionRequest: v1beta1.AdmissionRequest{
+			Name:      resource.KubernetesName(),
+			Namespace: "bar",
+			Operation: v1beta1.Create,
+			Object: runtime.RawExtension{
+				Raw: marshalledRequestObject,
+			},
+		},
+	})
+	require.True(t, response.Allowed, response.AdmissionResponse.Result.Message)
+	require.ElementsMatch(t, []jsonpatch.Operation{
+		{
+			Operation: "add",
+			Path:      "/spec/destination/namespace",
+			Value:     "mapped",
+		},
+	}, response.Patches)
+}
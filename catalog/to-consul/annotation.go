@@ -15,6 +15,13 @@ const (
 	// service or an integer value.
 	annotationServicePort = "consul.hashicorp.com/service-port"
 
+	// annotationServicePortMode sets how a service with more than one port
+	// is synced: "single" registers a service with a single port, "services"
+	// registers a service for each port and "tags" registers an instance for
+	// each port tagged with the port name. It's ignored if the port is set
+	// with annotationServicePort.
+	annotationServicePortMode = "consul.hashicorp.com/service-port-mode"
+
 	// annotationServiceTags specifies the tags for the registered service
 	// instance. Multiple tags should be comma separated. Whitespace around
 	// the tags is automatically trimmed.
@@ -23,4 +30,10 @@ const (
 	// annotationServiceMetaPrefix is the prefix for setting meta key/value
 	// for a service. The remainder of the key is the meta key.
 	annotationServiceMetaPrefix = "consul.hashicorp.com/service-meta-"
+
+	// annotationServicePodHostname is set to "true" on headless services to
+	// register the endpoints that have a hostname, such as the pods of a
+	// StatefulSet, with the stable DNS name of their pod as the address
+	// rather than their IP.
+	annotationServicePodHostname = "consul.hashicorp.com/service-pod-hostname"
 )
@@ -23,6 +23,10 @@ type ConsulNodeServicesClient interface {
 	// query options in the API call to consul. It returns the list of services
 	// (not service instances) and the query meta from the API call.
 	NodeServices(tag string, nodeName string, opts api.QueryOptions) ([]ConsulService, *api.QueryMeta, error)
+
+	// NodeServiceInstances is like NodeServices but returns the service
+	// instances rather than the services.
+	NodeServiceInstances(tag string, nodeName string, opts api.QueryOptions) ([]*api.AgentService, *api.QueryMeta, error)
 }
 
 // PreNamespacesNodeServicesClient implements ConsulNodeServicesClient
@@ -39,6 +43,23 @@ func (s *PreNamespacesNodeServicesClient) NodeServices(
 	tag string,
 	nodeName string,
 	opts api.QueryOptions) ([]ConsulService, *api.QueryMeta, error) {
+	instances, meta, err := s.NodeServiceInstances(tag, nodeName, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	// If namespaces are not enabled we use empty string.
+	for _, instance := range instances {
+		instance.Namespace = ""
+	}
+	return uniqueServices(instances), meta, nil
+}
+
+// NodeServiceInstances returns the Consul service instances tagged with tag
+// registered on nodeName using the same API as NodeServices.
+func (s *PreNamespacesNodeServicesClient) NodeServiceInstances(
+	tag string,
+	nodeName string,
+	opts api.QueryOptions) ([]*api.AgentService, *api.QueryMeta, error) {
 	// NOTE: We're not using tag filtering here so we can support Consul
 	// < 1.5.
 	node, meta, err := s.Client.Catalog().Node(nodeName, &opts)
@@ -49,30 +70,16 @@ func (s *PreNamespacesNodeServicesClient) NodeServices(
 		return nil, meta, nil
 	}
 
-	var svcs []ConsulService
-	// seenServices is used to ensure the svcs list is unique.
-	seenServices := make(map[string]bool)
+	var instances []*api.AgentService
 	for _, svcInstance := range node.Services {
-		svcName := svcInstance.Service
-		if _, ok := seenServices[svcName]; ok {
-			continue
-		}
 		for _, svcTag := range svcInstance.Tags {
 			if svcTag == tag {
-				if _, ok := seenServices[svcName]; !ok {
-					svcs = append(svcs, ConsulService{
-						// If namespaces are not enabled we use empty
-						// string.
-						Namespace: "",
-						Name:      svcName,
-					})
-					seenServices[svcName] = true
-				}
+				instances = append(instances, svcInstance)
 				break
 			}
 		}
 	}
-	return svcs, meta, nil
+	return instances, meta, nil
 }
 
 // NamespacesNodeServicesClient implements ConsulNodeServicesClient
@@ -89,17 +96,37 @@ func (s *NamespacesNodeServicesClient) NodeServices(
 	tag string,
 	nodeName string,
 	opts api.QueryOptions) ([]ConsulService, *api.QueryMeta, error) {
+	instances, meta, err := s.NodeServiceInstances(tag, nodeName, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return uniqueServices(instances), meta, nil
+}
+
+// NodeServiceInstances returns the Consul service instances tagged with tag
+// registered on nodeName using the same API as NodeServices.
+func (s *NamespacesNodeServicesClient) NodeServiceInstances(
+	tag string,
+	nodeName string,
+	opts api.QueryOptions) ([]*api.AgentService, *api.QueryMeta, error) {
 	opts.Filter = fmt.Sprintf("\"%s\" in Tags", tag)
 	nodeCatalog, meta, err := s.Client.Catalog().NodeServiceList(nodeName, &opts)
 	if err != nil {
 		return nil, nil, err
 	}
+	if nodeCatalog == nil {
+		return nil, meta, nil
+	}
+	return nodeCatalog.Services, meta, nil
+}
 
+// uniqueServices returns the services of the given service instances.
+func uniqueServices(instances []*api.AgentService) []ConsulService {
 	var svcs []ConsulService
 	// seenServices is used to ensure the svcs list is unique. Its keys are
 	// <namespace>/<service name>.
 	seenSvcs := make(map[string]bool)
-	for _, svcInstance := range nodeCatalog.Services {
+	for _, svcInstance := range instances {
 		svcName := svcInstance.Service
 		key := fmt.Sprintf("%s/%s", svcInstance.Namespace, svcName)
 		if _, ok := seenSvcs[key]; !ok {
@@ -110,5 +137,5 @@ func (s *NamespacesNodeServicesClient) NodeServices(
 			seenSvcs[key] = true
 		}
 	}
-	return svcs, meta, nil
+	return svcs
 }
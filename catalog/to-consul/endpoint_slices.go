@@ -0,0 +1,278 @@
+package catalog
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	apiv1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// ConsulK8SNode and ConsulK8SZone are the keys used in the meta to
+	// record the k8s node and zone of service instances synced from
+	// endpoint slices.
+	ConsulK8SNode = "external-k8s-node"
+	ConsulK8SZone = "external-k8s-zone"
+)
+
+// EndpointSlicesSupported returns true if the cluster serves the
+// discovery.k8s.io/v1beta1 API that endpoint slices are synced from.
+func EndpointSlicesSupported(client kubernetes.Interface) (bool, error) {
+	groups, err := client.Discovery().ServerGroups()
+	if err != nil {
+		return false, err
+	}
+	for _, group := range groups.Groups {
+		if group.Name != discoveryv1beta1.GroupName {
+			continue
+		}
+		for _, version := range group.Versions {
+			if version.Version == discoveryv1beta1.SchemeGroupVersion.Version {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// endpointTopology is the k8s node and zone of an endpoint.
+type endpointTopology struct {
+	Node string
+	Zone string
+}
+
+// serviceEndpoints returns the endpoints of the service with the given key,
+// aggregated from its endpoint slices if EnableEndpointSlices is set. The
+// topology of each endpoint address is also returned if it's known, which
+// is only the case for endpoint slices. It returns nil if the endpoints
+// haven't been loaded.
+//
+// Precondition: the lock t.lock is held.
+func (t *ServiceResource) serviceEndpoints(key string) (*apiv1.Endpoints, map[string]endpointTopology) {
+	if !t.EnableEndpointSlices {
+		return t.endpointsMap[key], nil
+	}
+	slices, ok := t.endpointSlicesMap[key]
+	if !ok {
+		return nil, nil
+	}
+	return endpointsFromSlices(slices)
+}
+
+// loadEndpointSlices loads the endpoint slices of the service.
+//
+// Precondition: the lock t.lock is held.
+func (t *ServiceResource) loadEndpointSlices(key string, svc *apiv1.Service) error {
+	list, err := t.Client.DiscoveryV1beta1().
+		EndpointSlices(svc.Namespace).
+		List(context.TODO(), metav1.ListOptions{
+			LabelSelector: discoveryv1beta1.LabelServiceName + "=" + svc.Name,
+		})
+	if err != nil {
+		return err
+	}
+	if t.endpointSlicesMap == nil {
+		t.endpointSlicesMap = make(map[string]map[string]*discoveryv1beta1.EndpointSlice)
+	}
+	slices := make(map[string]*discoveryv1beta1.EndpointSlice)
+	for i := range list.Items {
+		slices[list.Items[i].Name] = &list.Items[i]
+	}
+	t.endpointSlicesMap[key] = slices
+	return nil
+}
+
+// endpointsFromSlices aggregates the endpoint slices of a service into a
+// single Endpoints with a subset for each slice, so that they're registered
+// in the same way as Endpoints. The topology of each address is returned
+// alongside.
+func endpointsFromSlices(slices map[string]*discoveryv1beta1.EndpointSlice) (*apiv1.Endpoints, map[string]endpointTopology) {
+	// Sort the slices so that the registrations are generated in the same
+	// order every time.
+	var names []string
+	for name := range slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	endpoints := &apiv1.Endpoints{}
+	topology := make(map[string]endpointTopology)
+	for _, name := range names {
+		slice := slices[name]
+		var subset apiv1.EndpointSubset
+		for _, p := range slice.Ports {
+			// A nil port means all ports, which can't be registered.
+			if p.Port == nil {
+				continue
+			}
+			port := apiv1.EndpointPort{Port: *p.Port}
+			if p.Name != nil {
+				port.Name = *p.Name
+			}
+			if p.Protocol != nil {
+				port.Protocol = *p.Protocol
+			}
+			subset.Ports = append(subset.Ports, port)
+		}
+
+		for _, ep := range slice.Endpoints {
+			// Like kube-proxy, only the first address is used.
+			if len(ep.Addresses) == 0 {
+				continue
+			}
+			addr := apiv1.EndpointAddress{
+				IP:        ep.Addresses[0],
+				TargetRef: ep.TargetRef,
+			}
+			if ep.Hostname != nil {
+				addr.Hostname = *ep.Hostname
+			}
+			epTopology := endpointTopology{
+				Node: ep.Topology[apiv1.LabelHostname],
+				Zone: ep.Topology[apiv1.LabelZoneFailureDomainStable],
+			}
+			if epTopology.Zone == "" {
+				epTopology.Zone = ep.Topology[apiv1.LabelZoneFailureDomain]
+			}
+			if epTopology.Node != "" {
+				nodeName := epTopology.Node
+				addr.NodeName = &nodeName
+			}
+			topology[addr.IP] = epTopology
+
+			// Endpoints without a ready condition are ready.
+			if ep.Conditions.Ready == nil || *ep.Conditions.Ready {
+				subset.Addresses = append(subset.Addresses, addr)
+			} else {
+				subset.NotReadyAddresses = append(subset.NotReadyAddresses, addr)
+			}
+		}
+		endpoints.Subsets = append(endpoints.Subsets, subset)
+	}
+	return endpoints, topology
+}
+
+// setTopologyMeta adds the endpoint's topology to the service meta. The
+// meta is copied since it's shared with the other service instances.
+func setTopologyMeta(svc *consulapi.AgentService, topology endpointTopology) {
+	if topology == (endpointTopology{}) {
+		return
+	}
+	meta := make(map[string]string, len(svc.Meta)+2)
+	for k, v := range svc.Meta {
+		meta[k] = v
+	}
+	if topology.Node != "" {
+		meta[ConsulK8SNode] = topology.Node
+	}
+	if topology.Zone != "" {
+		meta[ConsulK8SZone] = topology.Zone
+	}
+	svc.Meta = meta
+}
+
+// serviceEndpointSlicesResource implements controller.Resource and starts
+// a background watcher on endpoint slices that is used by the
+// ServiceResource to keep track of changing endpoints for registered
+// services when EnableEndpointSlices is set.
+type serviceEndpointSlicesResource struct {
+	Service *ServiceResource
+}
+
+func (t *serviceEndpointSlicesResource) Informer() cache.SharedIndexInformer {
+	// Watch all k8s namespaces. Events will be filtered out as appropriate in the
+	// `shouldTrackEndpoints` function.
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return t.Service.Client.DiscoveryV1beta1().
+					EndpointSlices(metav1.NamespaceAll).
+					List(context.TODO(), options)
+			},
+
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return t.Service.Client.DiscoveryV1beta1().
+					EndpointSlices(metav1.NamespaceAll).
+					Watch(context.TODO(), options)
+			},
+		},
+		&discoveryv1beta1.EndpointSlice{},
+		0,
+		cache.Indexers{},
+	)
+}
+
+func (t *serviceEndpointSlicesResource) Upsert(key string, raw interface{}) error {
+	svc := t.Service
+	slice, ok := raw.(*discoveryv1beta1.EndpointSlice)
+	if !ok {
+		svc.Log.Warn("upsert got invalid type", "raw", raw)
+		return nil
+	}
+
+	// Slices not managed for a service are ignored.
+	serviceName, ok := slice.Labels[discoveryv1beta1.LabelServiceName]
+	if !ok {
+		return nil
+	}
+	serviceKey := slice.Namespace + "/" + serviceName
+
+	svc.serviceLock.Lock()
+	defer svc.serviceLock.Unlock()
+
+	// Check if we care about endpoints for this service
+	if !svc.shouldTrackEndpoints(serviceKey) {
+		return nil
+	}
+
+	// We are tracking this service so let's keep track of the slice
+	if svc.endpointSlicesMap == nil {
+		svc.endpointSlicesMap = make(map[string]map[string]*discoveryv1beta1.EndpointSlice)
+	}
+	if svc.endpointSlicesMap[serviceKey] == nil {
+		svc.endpointSlicesMap[serviceKey] = make(map[string]*discoveryv1beta1.EndpointSlice)
+	}
+	svc.endpointSlicesMap[serviceKey][slice.Name] = slice
+
+	// Update the registration and trigger a sync
+	svc.generateRegistrations(serviceKey)
+	svc.sync()
+	svc.Log.Info("upsert endpoint slice", "key", key, "service", serviceKey)
+	return nil
+}
+
+func (t *serviceEndpointSlicesResource) Delete(key string) error {
+	svc := t.Service
+	svc.serviceLock.Lock()
+	defer svc.serviceLock.Unlock()
+
+	// The service of a deleted slice is no longer known, so look for the
+	// slice in the services of its namespace.
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return nil
+	}
+	namespace, name := key[:i], key[i+1:]
+	for serviceKey, slices := range svc.endpointSlicesMap {
+		if !strings.HasPrefix(serviceKey, namespace+"/") {
+			continue
+		}
+		if _, ok := slices[name]; !ok {
+			continue
+		}
+		delete(slices, name)
+		svc.generateRegistrations(serviceKey)
+		svc.sync()
+		svc.Log.Info("delete endpoint slice", "key", key, "service", serviceKey)
+		return nil
+	}
+	return nil
+}
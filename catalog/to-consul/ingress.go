@@ -0,0 +1,230 @@
+package catalog
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// ConsulK8SIngress is the key used in the meta to record the name of
+	// the ingress a service was synced from.
+	ConsulK8SIngress = "external-k8s-ingress"
+
+	// ingressHTTPPort and ingressHTTPSPort are the ports of the services
+	// synced from ingress hosts without and with TLS.
+	ingressHTTPPort  = 80
+	ingressHTTPSPort = 443
+)
+
+// serviceIngressResource implements controller.Resource and starts a
+// background watcher on ingresses that is used by the ServiceResource to
+// register the hosts of ingresses as services when SyncIngress is set.
+type serviceIngressResource struct {
+	Service *ServiceResource
+}
+
+func (t *serviceIngressResource) Informer() cache.SharedIndexInformer {
+	// Watch all k8s namespaces. Events will be filtered out as appropriate
+	// based on the allow and deny lists in the `syncEnabled` function.
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return t.Service.Client.NetworkingV1beta1().
+					Ingresses(metav1.NamespaceAll).
+					List(context.TODO(), options)
+			},
+
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return t.Service.Client.NetworkingV1beta1().
+					Ingresses(metav1.NamespaceAll).
+					Watch(context.TODO(), options)
+			},
+		},
+		&networkingv1beta1.Ingress{},
+		0,
+		cache.Indexers{},
+	)
+}
+
+func (t *serviceIngressResource) Upsert(key string, raw interface{}) error {
+	svc := t.Service
+	ingress, ok := raw.(*networkingv1beta1.Ingress)
+	if !ok {
+		svc.Log.Warn("upsert got invalid type", "raw", raw)
+		return nil
+	}
+
+	svc.serviceLock.Lock()
+	defer svc.serviceLock.Unlock()
+
+	if !svc.syncEnabled(&ingress.ObjectMeta) {
+		t.doDelete(key)
+		return nil
+	}
+
+	// Update the registration and trigger a sync
+	svc.generateIngressRegistrations(ingressKey(key), ingress)
+	svc.sync()
+	svc.Log.Info("upsert ingress", "key", key)
+	return nil
+}
+
+func (t *serviceIngressResource) Delete(key string) error {
+	t.Service.serviceLock.Lock()
+	defer t.Service.serviceLock.Unlock()
+	t.doDelete(key)
+	t.Service.Log.Info("delete ingress", "key", key)
+	return nil
+}
+
+// doDelete removes the registrations of the ingress.
+//
+// Precondition: assumes t.Service.serviceLock is held
+func (t *serviceIngressResource) doDelete(key string) {
+	if _, ok := t.Service.consulMap[ingressKey(key)]; ok {
+		delete(t.Service.consulMap, ingressKey(key))
+		t.Service.sync()
+	}
+}
+
+// ingressKey returns the key of the registrations of the ingress with the
+// given key in consulMap. It can't clash with the key of a service since it
+// has two slashes.
+func ingressKey(key string) string {
+	return "ingress/" + key
+}
+
+// generateIngressRegistrations generates the registrations of the hosts of
+// the ingress. Each host is registered as a service named after the host,
+// with the dots replaced by dashes, or as an instance of the service named
+// by the service-name annotation. There's an instance for each address of
+// the ingress' load balancer, on port 443 if the host has TLS and 80
+// otherwise. Instances are tagged with their host and paths.
+//
+// Precondition: assumes t.serviceLock is held
+func (t *ServiceResource) generateIngressRegistrations(key string, ingress *networkingv1beta1.Ingress) {
+	if t.consulMap == nil {
+		t.consulMap = make(map[string][]*consulapi.CatalogRegistration)
+	}
+	delete(t.consulMap, key)
+
+	baseNode := t.baseNode()
+	baseService, err := t.baseService(ingress.Name, ingress.Namespace)
+	if err != nil {
+		t.Log.Warn("error determining Consul namespace, not syncing ingress", "key", key, "err", err)
+		return
+	}
+	baseService.Meta[ConsulK8SIngress] = ingress.Name
+	addAnnotationTagsAndMeta(&baseService, ingress.Annotations)
+	serviceName, named := ingress.Annotations[annotationServiceName]
+
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, lb := range ingress.Status.LoadBalancer.Ingress {
+		addr := lb.IP
+		if addr == "" {
+			addr = lb.Hostname
+		}
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	for _, host := range ingressHosts(ingress) {
+		svc := baseService
+		switch {
+		case named:
+			svc.Service = strings.TrimSpace(serviceName)
+		case host != "":
+			svc.Service = t.addPrefixAndK8SNamespace(strings.Replace(host, ".", "-", -1), ingress.Namespace)
+		}
+		svc.Port = ingressHTTPPort
+		if ingressHostHasTLS(ingress, host) {
+			svc.Port = ingressHTTPSPort
+		}
+		svc.Tags = append([]string{}, svc.Tags...)
+		if host != "" {
+			svc.Tags = append(svc.Tags, "host="+host)
+		}
+		for _, path := range ingressHostPaths(ingress, host) {
+			svc.Tags = append(svc.Tags, "path="+path)
+		}
+
+		for _, addr := range addrs {
+			r := baseNode
+			rs := svc
+			r.Service = &rs
+			r.Service.ID = serviceID(r.Service.Service, host+"-"+addr)
+			r.Service.Address = addr
+			t.consulMap[key] = append(t.consulMap[key], &r)
+		}
+	}
+
+	t.Log.Debug("generated ingress registrations",
+		"key", key,
+		"namespace", baseService.Namespace,
+		"instances", len(t.consulMap[key]))
+}
+
+// ingressHosts returns the sorted hosts of the rules of the ingress. The
+// host of rules without one, and of the default backend, is empty.
+func ingressHosts(ingress *networkingv1beta1.Ingress) []string {
+	seen := make(map[string]bool)
+	var hosts []string
+	if ingress.Spec.Backend != nil {
+		seen[""] = true
+		hosts = append(hosts, "")
+	}
+	for _, rule := range ingress.Spec.Rules {
+		if !seen[rule.Host] {
+			seen[rule.Host] = true
+			hosts = append(hosts, rule.Host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// ingressHostPaths returns the sorted paths of the rules for the host.
+func ingressHostPaths(ingress *networkingv1beta1.Ingress, host string) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, rule := range ingress.Spec.Rules {
+		if rule.Host != host || rule.HTTP == nil {
+			continue
+		}
+		for _, p := range rule.HTTP.Paths {
+			if p.Path != "" && !seen[p.Path] {
+				seen[p.Path] = true
+				paths = append(paths, p.Path)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// ingressHostHasTLS returns true if the ingress terminates TLS for the
+// host. TLS entries without hosts apply to every host.
+func ingressHostHasTLS(ingress *networkingv1beta1.Ingress, host string) bool {
+	for _, tls := range ingress.Spec.TLS {
+		if len(tls.Hosts) == 0 {
+			return true
+		}
+		for _, h := range tls.Hosts {
+			if h == host {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -13,6 +13,7 @@ import (
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-hclog"
 	apiv1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
@@ -29,6 +30,39 @@ const (
 	// ConsulK8SNS is the key used in the meta to record the namespace
 	// of the service/node registration.
 	ConsulK8SNS = "external-k8s-ns"
+
+	// ConsulReadinessCheckName is the name of the check registered with
+	// service instances synced from endpoints when not ready endpoints are
+	// synced. Its ID is the service ID followed by a slash and
+	// ConsulReadinessCheckID.
+	ConsulReadinessCheckName = "Kubernetes Readiness Check"
+	ConsulReadinessCheckID   = "kubernetes-readiness"
+
+	// ConsulK8SSyncNode is the key used in the meta of the Consul nodes
+	// registered for k8s nodes to record the name of the sync node of the
+	// syncer that owns them.
+	ConsulK8SSyncNode = "external-k8s-sync-node"
+
+	// ConsulK8SCluster is the key used in the service and node meta to
+	// record the name of the k8s cluster the registration was synced from.
+	ConsulK8SCluster = "external-k8s-cluster"
+)
+
+// PortSyncMode is how services with more than one port are synced.
+type PortSyncMode string
+
+const (
+	// SinglePort registers a single service with the first port of the
+	// service or the port set by the service-port annotation.
+	SinglePort PortSyncMode = "single"
+
+	// ServicePerPort registers a service for each port, named after the
+	// service followed by a dash and the port name.
+	ServicePerPort PortSyncMode = "services"
+
+	// TaggedPorts registers an instance for each port of each address of
+	// the service, tagged with the port name.
+	TaggedPorts PortSyncMode = "tags"
 )
 
 type NodePortSyncType string
@@ -116,9 +150,60 @@ type ServiceResource struct {
 	// `k8s-default` namespace.
 	K8SNSMirroringPrefix string
 
+	// NamespaceMapping maps k8s namespaces to Consul namespaces. Its rules
+	// take precedence over ConsulDestinationNamespace and mirroring. May be
+	// nil.
+	NamespaceMapping *namespaces.Mapping
+
+	// NamespaceLabels returns the labels of a k8s namespace. Only needed if
+	// NamespaceMapping has selector rules.
+	NamespaceLabels namespaces.LabelsFunc
+
 	// The Consul node name to register service with.
 	ConsulNodeName string
 
+	// ClusterName identifies the k8s cluster when several clusters sync
+	// into the same Consul datacenter. If set, it's added to the meta of
+	// the registered services and nodes under ConsulK8SCluster, and the
+	// ConsulSyncer only removes registrations with the same ClusterName.
+	ClusterName string
+
+	// EnableEndpointSlices tracks the endpoints of services using their
+	// discovery.k8s.io/v1beta1 EndpointSlices rather than their Endpoints.
+	// Service instances are registered with the node and zone of their
+	// endpoint in the service meta.
+	EnableEndpointSlices bool
+
+	// SyncNotReadyEndpoints registers the endpoints of services that aren't
+	// ready along with those that are. Every service instance registered
+	// from an endpoint gets a check whose status is passing if the endpoint
+	// is ready and critical otherwise.
+	SyncNotReadyEndpoints bool
+
+	// RegisterOnK8SNodes registers the service instances synced from
+	// endpoints on a Consul node for the k8s node hosting the endpoint
+	// rather than on ConsulNodeName. The Consul node is named after the k8s
+	// node followed by a dash and ConsulNodeName, so that it doesn't clash
+	// with the node of a Consul client on the k8s node, and has the address
+	// and zone of the k8s node.
+	RegisterOnK8SNodes bool
+
+	// PortSyncMode is how services with more than one port are synced
+	// unless overridden by the service-port-mode annotation. It defaults to
+	// SinglePort.
+	PortSyncMode PortSyncMode
+
+	// ClusterDomain is the DNS domain of the k8s cluster, used to build the
+	// DNS names of the pods of headless services. It defaults to
+	// cluster.local.
+	ClusterDomain string
+
+	// SyncIngress registers the hosts of networking.k8s.io/v1beta1
+	// Ingresses as services, with an instance for each address of the
+	// ingress' load balancer. Ingresses are synced under the same namespace
+	// and annotation rules as services.
+	SyncIngress bool
+
 	// serviceLock must be held for any read/write to these maps.
 	serviceLock sync.RWMutex
 
@@ -130,10 +215,21 @@ type ServiceResource struct {
 	// of each service.
 	endpointsMap map[string]*apiv1.Endpoints
 
+	// endpointSlicesMap uses the same keys as serviceMap but maps to the
+	// endpoint slices of each service, keyed by their name. It's used
+	// instead of endpointsMap if EnableEndpointSlices is set.
+	endpointSlicesMap map[string]map[string]*discoveryv1beta1.EndpointSlice
+
 	// consulMap holds the services in Consul that we've registered from kube.
 	// It's populated via Consul's API and lets us diff what is actually in
 	// Consul vs. what we expect to be there.
 	consulMap map[string][]*consulapi.CatalogRegistration
+
+	// controllersLock guards controllers.
+	controllersLock sync.Mutex
+	// controllers are the controllers of the ingresses and endpoints started
+	// by Run.
+	controllers []*controller.Controller
 }
 
 // Informer implements the controller.Resource interface.
@@ -188,7 +284,13 @@ func (t *ServiceResource) Upsert(key string, raw interface{}) error {
 	t.Log.Debug("[ServiceResource.Upsert] adding service to serviceMap", "key", key, "service", service)
 
 	// If we care about endpoints, we should do the initial endpoints load.
-	if t.shouldTrackEndpoints(key) {
+	if t.shouldTrackEndpoints(key) && t.EnableEndpointSlices {
+		if err := t.loadEndpointSlices(key, service); err != nil {
+			t.Log.Warn("error loading initial endpoint slices",
+				"key", key,
+				"err", err)
+		}
+	} else if t.shouldTrackEndpoints(key) {
 		endpoints, err := t.Client.CoreV1().
 			Endpoints(service.Namespace).
 			Get(context.TODO(), service.Name, metav1.GetOptions{})
@@ -229,6 +331,7 @@ func (t *ServiceResource) doDelete(key string) {
 	t.Log.Debug("[doDelete] deleting service from serviceMap", "key", key)
 	delete(t.endpointsMap, key)
 	t.Log.Debug("[doDelete] deleting endpoints from endpointsMap", "key", key)
+	delete(t.endpointSlicesMap, key)
 	// If there were registrations related to this service, then
 	// delete them and sync.
 	if _, ok := t.consulMap[key]; ok {
@@ -239,35 +342,131 @@ func (t *ServiceResource) doDelete(key string) {
 
 // Run implements the controller.Backgrounder interface.
 func (t *ServiceResource) Run(ch <-chan struct{}) {
-	t.Log.Info("starting runner for endpoints")
-	(&controller.Controller{
-		Log:      t.Log.Named("controller/endpoints"),
-		Resource: &serviceEndpointsResource{Service: t},
-	}).Run(ch)
+	var ingresses *controller.Controller
+	if t.SyncIngress {
+		ingresses = &controller.Controller{
+			Log:      t.Log.Named("controller/ingresses"),
+			Resource: &serviceIngressResource{Service: t},
+		}
+	}
+
+	var endpoints *controller.Controller
+	if t.EnableEndpointSlices {
+		endpoints = &controller.Controller{
+			Log:      t.Log.Named("controller/endpointslices"),
+			Resource: &serviceEndpointSlicesResource{Service: t},
+		}
+	} else {
+		endpoints = &controller.Controller{
+			Log:      t.Log.Named("controller/endpoints"),
+			Resource: &serviceEndpointsResource{Service: t},
+		}
+	}
+
+	t.controllersLock.Lock()
+	t.controllers = []*controller.Controller{endpoints}
+	if ingresses != nil {
+		t.controllers = append(t.controllers, ingresses)
+	}
+	t.controllersLock.Unlock()
+
+	if ingresses != nil {
+		t.Log.Info("starting runner for ingresses")
+		go ingresses.Run(ch)
+	}
+	if t.EnableEndpointSlices {
+		t.Log.Info("starting runner for endpoint slices")
+	} else {
+		t.Log.Info("starting runner for endpoints")
+	}
+	endpoints.Run(ch)
 }
 
-// shouldSync returns true if resyncing should be enabled for the given service.
-func (t *ServiceResource) shouldSync(svc *apiv1.Service) bool {
-	// Namespace logic
-	// If in deny list, don't sync
-	if t.DenyK8sNamespacesSet.Contains(svc.Namespace) {
-		t.Log.Debug("[shouldSync] service is in the deny list", "svc.Namespace", svc.Namespace, "service", svc)
+// Ready returns true once the controllers started by Run have processed the
+// initial list of ingresses and endpoints. Together with the Ready of the
+// services' controller, it means every object that existed when syncing
+// started has been upserted, so the ConsulSyncer can remove the
+// registrations that are no longer needed.
+func (t *ServiceResource) Ready() bool {
+	t.controllersLock.Lock()
+	defer t.controllersLock.Unlock()
+	if len(t.controllers) == 0 {
 		return false
 	}
+	for _, ctl := range t.controllers {
+		if !ctl.Ready() {
+			return false
+		}
+	}
+	return true
+}
 
-	// If not in allow list or allow list is not *, don't sync
-	if !t.AllowK8sNamespacesSet.Contains("*") && !t.AllowK8sNamespacesSet.Contains(svc.Namespace) {
-		t.Log.Debug("[shouldSync] service not in allow list", "svc.Namespace", svc.Namespace, "service", svc)
-		return false
+// SyncAll lists the services, and the ingresses if SyncIngress is set, and
+// upserts each of them. It's used to generate the registrations once
+// without running the controller.
+func (t *ServiceResource) SyncAll(ctx context.Context) error {
+	services, err := t.Client.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range services.Items {
+		key, err := cache.MetaNamespaceKeyFunc(&services.Items[i])
+		if err != nil {
+			return err
+		}
+		if err := t.Upsert(key, &services.Items[i]); err != nil {
+			return err
+		}
 	}
 
+	if !t.SyncIngress {
+		return nil
+	}
+	ingresses, err := t.Client.NetworkingV1beta1().Ingresses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	ingressResource := &serviceIngressResource{Service: t}
+	for i := range ingresses.Items {
+		key, err := cache.MetaNamespaceKeyFunc(&ingresses.Items[i])
+		if err != nil {
+			return err
+		}
+		if err := ingressResource.Upsert(key, &ingresses.Items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shouldSync returns true if resyncing should be enabled for the given service.
+func (t *ServiceResource) shouldSync(svc *apiv1.Service) bool {
 	// Ignore ClusterIP services if ClusterIP sync is disabled
 	if svc.Spec.Type == apiv1.ServiceTypeClusterIP && !t.ClusterIPSync {
 		t.Log.Debug("[shouldSync] ignoring clusterip service", "svc.Namespace", svc.Namespace, "service", svc)
 		return false
 	}
 
-	raw, ok := svc.Annotations[annotationServiceSync]
+	return t.syncEnabled(&svc.ObjectMeta)
+}
+
+// syncEnabled returns true if the k8s object is in a namespace that is
+// synced and syncing it is enabled by default or by annotation.
+func (t *ServiceResource) syncEnabled(obj *metav1.ObjectMeta) bool {
+	// Namespace logic
+	// If in deny list, don't sync
+	if t.DenyK8sNamespacesSet.Contains(obj.Namespace) {
+		t.Log.Debug("[shouldSync] object is in the deny list", "namespace", obj.Namespace, "name", obj.Name)
+		return false
+	}
+
+	// If not in allow list or allow list is not *, don't sync
+	if !t.AllowK8sNamespacesSet.Contains("*") && !t.AllowK8sNamespacesSet.Contains(obj.Namespace) {
+		t.Log.Debug("[shouldSync] object not in allow list", "namespace", obj.Namespace, "name", obj.Name)
+		return false
+	}
+
+	raw, ok := obj.Annotations[annotationServiceSync]
 	if !ok {
 		// If there is no explicit value, then set it to our current default.
 		return !t.ExplicitEnable
@@ -276,7 +475,7 @@ func (t *ServiceResource) shouldSync(svc *apiv1.Service) bool {
 	v, err := strconv.ParseBool(raw)
 	if err != nil {
 		t.Log.Warn("error parsing service-sync annotation",
-			"service-name", t.addPrefixAndK8SNamespace(svc.Name, svc.Namespace),
+			"service-name", t.addPrefixAndK8SNamespace(obj.Name, obj.Namespace),
 			"err", err)
 
 		// Fallback to default
@@ -334,38 +533,19 @@ func (t *ServiceResource) generateRegistrations(key string) {
 	// baseNode and baseService are the base that should be modified with
 	// service-type specific changes. These are not pointers, they should be
 	// shallow copied for each instance.
-	baseNode := consulapi.CatalogRegistration{
-		SkipNodeUpdate: true,
-		Node:           t.ConsulNodeName,
-		Address:        "127.0.0.1",
-		NodeMeta: map[string]string{
-			ConsulSourceKey: ConsulSourceValue,
-		},
-	}
-
-	baseService := consulapi.AgentService{
-		Service: t.addPrefixAndK8SNamespace(svc.Name, svc.Namespace),
-		Tags:    []string{t.ConsulK8STag},
-		Meta: map[string]string{
-			ConsulSourceKey: ConsulSourceValue,
-			ConsulK8SNS:     svc.Namespace,
-		},
+	baseNode := t.baseNode()
+	baseService, err := t.baseService(svc.Name, svc.Namespace)
+	if err != nil {
+		t.Log.Warn("error determining Consul namespace, not syncing service", "key", key, "err", err)
+		return
 	}
 
 	// If the name is explicitly annotated, adopt that name
 	if v, ok := svc.Annotations[annotationServiceName]; ok {
 		baseService.Service = strings.TrimSpace(v)
 	}
-
-	// Update the Consul namespace based on namespace settings
-	consulNS := namespaces.ConsulNamespace(svc.Namespace,
-		t.EnableNamespaces,
-		t.ConsulDestinationNamespace,
-		t.EnableK8SNSMirroring,
-		t.K8SNSMirroringPrefix)
-	if consulNS != "" {
-		t.Log.Debug("[generateRegistrations] namespace being used", "key", key, "namespace", consulNS)
-		baseService.Namespace = consulNS
+	if baseService.Namespace != "" {
+		t.Log.Debug("[generateRegistrations] namespace being used", "key", key, "namespace", baseService.Namespace)
 	}
 
 	// Determine the default port and set port annotations
@@ -430,20 +610,7 @@ func (t *ServiceResource) generateRegistrations(key string) {
 		}
 	}
 
-	// Parse any additional tags
-	if tags, ok := svc.Annotations[annotationServiceTags]; ok {
-		for _, t := range strings.Split(tags, ",") {
-			baseService.Tags = append(baseService.Tags, strings.TrimSpace(t))
-		}
-	}
-
-	// Parse any additional meta
-	for k, v := range svc.Annotations {
-		if strings.HasPrefix(k, annotationServiceMetaPrefix) {
-			k = strings.TrimPrefix(k, annotationServiceMetaPrefix)
-			baseService.Meta[k] = v
-		}
-	}
+	addAnnotationTagsAndMeta(&baseService, svc.Annotations)
 
 	// Always log what we generated
 	defer func() {
@@ -454,6 +621,55 @@ func (t *ServiceResource) generateRegistrations(key string) {
 			"instances", len(t.consulMap[key]))
 	}()
 
+	// nodes caches the k8s nodes hosting the endpoints.
+	nodes := make(map[string]*apiv1.Node)
+
+	mode := t.portSyncMode(svc)
+	if mode == SinglePort || len(svc.Spec.Ports) < 2 {
+		t.generateInstances(key, svc, baseNode, baseService, overridePortName, overridePortNumber, nodes)
+		return
+	}
+
+	// Otherwise every port is registered as a separate service, or as
+	// separate instances tagged with the port name.
+	for _, p := range svc.Spec.Ports {
+		portService := baseService
+		portService.Tags = append([]string{}, baseService.Tags...)
+		portService.Port = int(p.Port)
+		if svc.Spec.Type == apiv1.ServiceTypeNodePort && p.NodePort > 0 {
+			portService.Port = int(p.NodePort)
+		}
+		if mode == ServicePerPort {
+			portService.Service = baseService.Service + "-" + p.Name
+		} else {
+			portService.Tags = append(portService.Tags, p.Name)
+		}
+
+		start := len(t.consulMap[key])
+		t.generateInstances(key, svc, baseNode, portService, p.Name, 0, nodes)
+		if mode == TaggedPorts {
+			// The instances of each port have the same address, so the
+			// port name makes their IDs unique.
+			for _, r := range t.consulMap[key][start:] {
+				setServiceID(r, r.Service.ID+"-"+p.Name)
+			}
+		}
+	}
+}
+
+// generateInstances generates the service instances of the service with
+// the given base registration and port.
+//
+// Precondition: assumes t.serviceLock is held
+func (t *ServiceResource) generateInstances(
+	key string,
+	svc *apiv1.Service,
+	baseNode consulapi.CatalogRegistration,
+	baseService consulapi.AgentService,
+	overridePortName string,
+	overridePortNumber int,
+	nodes map[string]*apiv1.Node) {
+
 	// If there are external IPs then those become the instance registrations
 	// for any type of service.
 	if ips := svc.Spec.ExternalIPs; len(ips) > 0 {
@@ -476,7 +692,7 @@ func (t *ServiceResource) generateRegistrations(key string) {
 	// If LoadBalancerEndpointsSync is true sync LB endpoints instead of loadbalancer ingress.
 	case apiv1.ServiceTypeLoadBalancer:
 		if t.LoadBalancerEndpointsSync {
-			t.registerServiceInstance(baseNode, baseService, key, overridePortName, overridePortNumber, false)
+			t.registerServiceInstance(baseNode, baseService, key, overridePortName, overridePortNumber, false, nodes)
 		} else {
 			seen := map[string]struct{}{}
 			for _, ingress := range svc.Status.LoadBalancer.Ingress {
@@ -508,17 +724,13 @@ func (t *ServiceResource) generateRegistrations(key string) {
 	// pods are running on. This way we don't register _every_ K8S
 	// node as part of the service.
 	case apiv1.ServiceTypeNodePort:
-		if t.endpointsMap == nil {
-			return
-		}
-
-		endpoints := t.endpointsMap[key]
+		endpoints, topology := t.serviceEndpoints(key)
 		if endpoints == nil {
 			return
 		}
 
 		for _, subset := range endpoints.Subsets {
-			for _, subsetAddr := range subset.Addresses {
+			for _, subsetAddr := range t.subsetAddresses(subset) {
 				// Check that the node name exists
 				// subsetAddr.NodeName is of type *string
 				if subsetAddr.NodeName == nil {
@@ -526,7 +738,7 @@ func (t *ServiceResource) generateRegistrations(key string) {
 				}
 
 				// Look up the node's ip address by getting node info
-				node, err := t.Client.CoreV1().Nodes().Get(context.TODO(), *subsetAddr.NodeName, metav1.GetOptions{})
+				node, err := t.k8sNode(*subsetAddr.NodeName, nodes)
 				if err != nil {
 					t.Log.Warn("error getting node info", "error", err)
 					continue
@@ -551,6 +763,9 @@ func (t *ServiceResource) generateRegistrations(key string) {
 						r.Service = &rs
 						r.Service.ID = serviceID(r.Service.Service, subsetAddr.IP)
 						r.Service.Address = address.Address
+						t.setK8SNode(&r, subsetAddr.NodeName, nodes)
+						setTopologyMeta(r.Service, topology[subsetAddr.IP])
+						t.setReadinessCheck(&r, subsetAddr.Ready)
 
 						t.consulMap[key] = append(t.consulMap[key], &r)
 					}
@@ -566,6 +781,9 @@ func (t *ServiceResource) generateRegistrations(key string) {
 							r.Service = &rs
 							r.Service.ID = serviceID(r.Service.Service, subsetAddr.IP)
 							r.Service.Address = address.Address
+							t.setK8SNode(&r, subsetAddr.NodeName, nodes)
+							setTopologyMeta(r.Service, topology[subsetAddr.IP])
+							t.setReadinessCheck(&r, subsetAddr.Ready)
 
 							t.consulMap[key] = append(t.consulMap[key], &r)
 						}
@@ -577,7 +795,23 @@ func (t *ServiceResource) generateRegistrations(key string) {
 	// For ClusterIP services, we register a service instance
 	// for each endpoint.
 	case apiv1.ServiceTypeClusterIP:
-		t.registerServiceInstance(baseNode, baseService, key, overridePortName, overridePortNumber, true)
+		t.registerServiceInstance(baseNode, baseService, key, overridePortName, overridePortNumber, true, nodes)
+
+	// For ExternalName services, we create a single service instance with
+	// the external name as the address.
+	case apiv1.ServiceTypeExternalName:
+		// Services synced from Consul by the to-k8s sink are labeled and
+		// point back at Consul, so they're not synced.
+		if svc.Labels["consul"] == "true" || svc.Spec.ExternalName == "" {
+			return
+		}
+
+		r := baseNode
+		rs := baseService
+		r.Service = &rs
+		r.Service.ID = serviceID(r.Service.Service, svc.Spec.ExternalName)
+		r.Service.Address = svc.Spec.ExternalName
+		t.consulMap[key] = append(t.consulMap[key], &r)
 	}
 }
 
@@ -587,16 +821,14 @@ func (t *ServiceResource) registerServiceInstance(
 	key string,
 	overridePortName string,
 	overridePortNumber int,
-	useHostname bool) {
+	useHostname bool,
+	nodes map[string]*apiv1.Node) {
 
-	if t.endpointsMap == nil {
-		return
-	}
-
-	endpoints := t.endpointsMap[key]
+	endpoints, topology := t.serviceEndpoints(key)
 	if endpoints == nil {
 		return
 	}
+	hostnameDomain := t.podHostnameDomain(t.serviceMap[key])
 
 	seen := map[string]struct{}{}
 	for _, subset := range endpoints.Subsets {
@@ -620,9 +852,11 @@ func (t *ServiceResource) registerServiceInstance(
 				break
 			}
 		}
-		for _, subsetAddr := range subset.Addresses {
+		for _, subsetAddr := range t.subsetAddresses(subset) {
 			addr := subsetAddr.IP
-			if addr == "" && useHostname {
+			if hostnameDomain != "" && subsetAddr.Hostname != "" {
+				addr = subsetAddr.Hostname + "." + hostnameDomain
+			} else if addr == "" && useHostname {
 				addr = subsetAddr.Hostname
 			}
 			if addr == "" {
@@ -643,12 +877,246 @@ func (t *ServiceResource) registerServiceInstance(
 			r.Service.ID = serviceID(r.Service.Service, addr)
 			r.Service.Address = addr
 			r.Service.Port = epPort
+			t.setK8SNode(&r, subsetAddr.NodeName, nodes)
+			setTopologyMeta(r.Service, topology[subsetAddr.IP])
+			t.setReadinessCheck(&r, subsetAddr.Ready)
 
 			t.consulMap[key] = append(t.consulMap[key], &r)
 		}
 	}
 }
 
+// portSyncMode returns how the ports of the service are synced.
+func (t *ServiceResource) portSyncMode(svc *apiv1.Service) PortSyncMode {
+	mode := t.PortSyncMode
+	if raw, ok := svc.Annotations[annotationServicePortMode]; ok {
+		switch v := PortSyncMode(strings.TrimSpace(raw)); v {
+		case SinglePort, ServicePerPort, TaggedPorts:
+			mode = v
+		default:
+			t.Log.Warn("invalid service-port-mode annotation, using default",
+				"service-name", svc.Name,
+				"service-namespace", svc.Namespace,
+				"mode", raw)
+		}
+	}
+	// The port set by annotation takes precedence.
+	if _, ok := svc.Annotations[annotationServicePort]; ok || mode == "" {
+		return SinglePort
+	}
+	return mode
+}
+
+// setServiceID sets the ID of the registered service instance, along with
+// the ID of its readiness check.
+func setServiceID(r *consulapi.CatalogRegistration, id string) {
+	r.Service.ID = id
+	if r.Check != nil {
+		r.Check.ServiceID = id
+		r.Check.CheckID = id + "/" + ConsulReadinessCheckID
+	}
+}
+
+// podHostnameDomain returns the domain of the DNS names of the pods of the
+// service if it's headless and annotated to register its endpoints with
+// their pod's DNS name, or an empty string otherwise.
+func (t *ServiceResource) podHostnameDomain(svc *apiv1.Service) string {
+	if svc == nil || svc.Spec.ClusterIP != apiv1.ClusterIPNone {
+		return ""
+	}
+	if v, _ := strconv.ParseBool(svc.Annotations[annotationServicePodHostname]); !v {
+		return ""
+	}
+	domain := t.ClusterDomain
+	if domain == "" {
+		domain = "cluster.local"
+	}
+	return fmt.Sprintf("%s.%s.svc.%s", svc.Name, svc.Namespace, domain)
+}
+
+// baseNode returns the registration of the sync node that service instances
+// are registered on. The node may be shared by several clusters, so it's
+// never updated and its meta is only set if it doesn't exist yet. Ownership
+// of the instances is decided by their service meta.
+func (t *ServiceResource) baseNode() consulapi.CatalogRegistration {
+	r := consulapi.CatalogRegistration{
+		SkipNodeUpdate: true,
+		Node:           t.ConsulNodeName,
+		Address:        "127.0.0.1",
+		NodeMeta: map[string]string{
+			ConsulSourceKey: ConsulSourceValue,
+		},
+	}
+	if t.ClusterName != "" {
+		r.NodeMeta[ConsulK8SCluster] = t.ClusterName
+	}
+	return r
+}
+
+// baseService returns the service synced from the k8s object with the given
+// name and namespace, in the Consul namespace the k8s namespace maps to.
+func (t *ServiceResource) baseService(name, k8sNamespace string) (consulapi.AgentService, error) {
+	svc := consulapi.AgentService{
+		Service: t.addPrefixAndK8SNamespace(name, k8sNamespace),
+		Tags:    []string{t.ConsulK8STag},
+		Meta: map[string]string{
+			ConsulSourceKey: ConsulSourceValue,
+			ConsulK8SNS:     k8sNamespace,
+		},
+	}
+	if t.ClusterName != "" {
+		svc.Meta[ConsulK8SCluster] = t.ClusterName
+	}
+
+	// Update the Consul namespace based on namespace settings
+	consulNS, err := namespaces.MappedConsulNamespace(t.NamespaceMapping,
+		t.NamespaceLabels,
+		k8sNamespace,
+		t.EnableNamespaces,
+		t.ConsulDestinationNamespace,
+		t.EnableK8SNSMirroring,
+		t.K8SNSMirroringPrefix)
+	if err != nil {
+		return consulapi.AgentService{}, err
+	}
+	svc.Namespace = consulNS
+	return svc, nil
+}
+
+// addAnnotationTagsAndMeta adds the tags and meta set by annotations to the
+// service.
+func addAnnotationTagsAndMeta(svc *consulapi.AgentService, annotations map[string]string) {
+	// Parse any additional tags
+	if tags, ok := annotations[annotationServiceTags]; ok {
+		for _, t := range strings.Split(tags, ",") {
+			svc.Tags = append(svc.Tags, strings.TrimSpace(t))
+		}
+	}
+
+	// Parse any additional meta
+	for k, v := range annotations {
+		if strings.HasPrefix(k, annotationServiceMetaPrefix) {
+			k = strings.TrimPrefix(k, annotationServiceMetaPrefix)
+			svc.Meta[k] = v
+		}
+	}
+}
+
+// k8sNode returns the k8s node with the given name, caching it in nodes.
+func (t *ServiceResource) k8sNode(name string, nodes map[string]*apiv1.Node) (*apiv1.Node, error) {
+	if node, ok := nodes[name]; ok {
+		return node, nil
+	}
+	node, err := t.Client.CoreV1().Nodes().Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	nodes[name] = node
+	return node, nil
+}
+
+// setK8SNode moves the registration of an endpoint to the Consul node of
+// the k8s node hosting it if RegisterOnK8SNodes is set. Endpoints whose
+// node isn't known stay on ConsulNodeName.
+func (t *ServiceResource) setK8SNode(r *consulapi.CatalogRegistration, nodeName *string, nodes map[string]*apiv1.Node) {
+	if !t.RegisterOnK8SNodes || nodeName == nil {
+		return
+	}
+	node, err := t.k8sNode(*nodeName, nodes)
+	if err != nil {
+		t.Log.Warn("error getting node info", "node", *nodeName, "error", err)
+		return
+	}
+
+	// Prefer the internal IP since that's the address the node is reached
+	// at from within the cluster.
+	var address string
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == apiv1.NodeInternalIP {
+			address = addr.Address
+			break
+		}
+		if address == "" && addr.Type == apiv1.NodeExternalIP {
+			address = addr.Address
+		}
+	}
+	if address == "" {
+		t.Log.Warn("node has no IP address", "node", *nodeName)
+		return
+	}
+
+	r.Node = K8SNodeConsulName(node.Name, t.ConsulNodeName)
+	r.Address = address
+	// The node is owned by the syncer, so it's kept up to date.
+	r.SkipNodeUpdate = false
+	r.NodeMeta = map[string]string{
+		ConsulSourceKey:   ConsulSourceValue,
+		ConsulK8SNode:     node.Name,
+		ConsulK8SSyncNode: t.ConsulNodeName,
+	}
+	zone := node.Labels[apiv1.LabelZoneFailureDomainStable]
+	if zone == "" {
+		zone = node.Labels[apiv1.LabelZoneFailureDomain]
+	}
+	if zone != "" {
+		r.NodeMeta[ConsulK8SZone] = zone
+	}
+	if t.ClusterName != "" {
+		r.NodeMeta[ConsulK8SCluster] = t.ClusterName
+	}
+}
+
+// K8SNodeConsulName returns the name of the Consul node that services on
+// the k8s node are registered on when RegisterOnK8SNodes is set.
+func K8SNodeConsulName(k8sNode, consulNodeName string) string {
+	return k8sNode + "-" + consulNodeName
+}
+
+// endpointAddress is an address of an endpoint subset and whether it's
+// ready.
+type endpointAddress struct {
+	apiv1.EndpointAddress
+	Ready bool
+}
+
+// subsetAddresses returns the ready addresses of the subset followed by its
+// addresses that aren't ready if SyncNotReadyEndpoints is set.
+func (t *ServiceResource) subsetAddresses(subset apiv1.EndpointSubset) []endpointAddress {
+	addrs := make([]endpointAddress, 0, len(subset.Addresses))
+	for _, addr := range subset.Addresses {
+		addrs = append(addrs, endpointAddress{EndpointAddress: addr, Ready: true})
+	}
+	if t.SyncNotReadyEndpoints {
+		for _, addr := range subset.NotReadyAddresses {
+			addrs = append(addrs, endpointAddress{EndpointAddress: addr})
+		}
+	}
+	return addrs
+}
+
+// setReadinessCheck adds a check to the registration of an endpoint whose
+// status reflects whether the endpoint is ready, if SyncNotReadyEndpoints
+// is set.
+func (t *ServiceResource) setReadinessCheck(r *consulapi.CatalogRegistration, ready bool) {
+	if !t.SyncNotReadyEndpoints {
+		return
+	}
+	status, output := consulapi.HealthCritical, "Kubernetes endpoint is not ready"
+	if ready {
+		status, output = consulapi.HealthPassing, "Kubernetes endpoint is ready"
+	}
+	r.Check = &consulapi.AgentCheck{
+		Node:        r.Node,
+		CheckID:     r.Service.ID + "/" + ConsulReadinessCheckID,
+		Name:        ConsulReadinessCheckName,
+		Status:      status,
+		Output:      output,
+		ServiceID:   r.Service.ID,
+		ServiceName: r.Service.Service,
+		Namespace:   r.Service.Namespace,
+	}
+}
+
 // sync calls the Syncer.Sync function from the generated registrations.
 //
 // Precondition: lock must be held
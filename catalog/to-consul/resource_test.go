@@ -2,18 +2,26 @@ package catalog
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/deckarep/golang-set"
 	"github.com/hashicorp/consul-k8s/helper/controller"
+	"github.com/hashicorp/consul-k8s/namespaces"
+	consulapi "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/sdk/testutil/retry"
 	"github.com/hashicorp/go-hclog"
 	"github.com/stretchr/testify/require"
 	apiv1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
 )
 
 const nodeName1 = "ip-10-11-12-13.ec2.internal"
@@ -1453,6 +1461,188 @@ func TestServiceResource_MirroredPrefixNamespace(t *testing.T) {
 	})
 }
 
+// Test that services are created in the Consul namespace their k8s namespace
+// is mapped to, and that unmapped namespaces fall back to mirroring.
+func TestServiceResource_MappedNamespace(t *testing.T) {
+	t.Parallel()
+	mapping, err := namespaces.ParseMapping([]byte(`{
+  "rules": [
+    {"namespace": "foo", "consulNamespace": "mapped-foo"},
+    {"glob": "team-*", "consulNamespace": "teams"}
+  ]
+}`))
+	require.NoError(t, err)
+	client := fake.NewSimpleClientset()
+	syncer := newTestSyncer()
+	serviceResource := defaultServiceResource(client, syncer)
+	serviceResource.EnableK8SNSMirroring = true
+	serviceResource.EnableNamespaces = true
+	serviceResource.NamespaceMapping = mapping
+	closer := controller.TestControllerRun(&serviceResource)
+	defer closer()
+
+	expected := map[string]string{
+		"foo":    "mapped-foo",
+		"team-a": "teams",
+		"bar":    "bar",
+	}
+	for ns := range expected {
+		_, err := client.CoreV1().Services(ns).
+			Create(context.Background(), lbService(ns, ns, "1.2.3.4"), metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	retry.Run(t, func(r *retry.R) {
+		syncer.Lock()
+		defer syncer.Unlock()
+		actual := syncer.Registrations
+		require.Len(r, actual, 3)
+		for _, reg := range actual {
+			require.Equal(r, expected[reg.Service.Service], reg.Service.Namespace)
+		}
+	})
+}
+
+// Test that not ready endpoints are registered with a critical check when
+// SyncNotReadyEndpoints is set.
+func TestServiceResource_clusterIPNotReadyEndpoints(t *testing.T) {
+	t.Parallel()
+	client := fake.NewSimpleClientset()
+	syncer := newTestSyncer()
+	serviceResource := defaultServiceResource(client, syncer)
+	serviceResource.ClusterIPSync = true
+	serviceResource.SyncNotReadyEndpoints = true
+
+	// Start the controller
+	closer := controller.TestControllerRun(&serviceResource)
+	defer closer()
+
+	// Insert the service
+	svc := clusterIPService("foo", metav1.NamespaceDefault)
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), svc, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// Insert the endpoints with one address that isn't ready
+	_, err = client.CoreV1().Endpoints(metav1.NamespaceDefault).Create(
+		context.Background(),
+		&apiv1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: metav1.NamespaceDefault,
+			},
+			Subsets: []apiv1.EndpointSubset{
+				{
+					Addresses:         []apiv1.EndpointAddress{{IP: "1.1.1.1"}},
+					NotReadyAddresses: []apiv1.EndpointAddress{{IP: "2.2.2.2"}},
+					Ports:             []apiv1.EndpointPort{{Name: "http", Port: 8080}},
+				},
+			},
+		},
+		metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// Verify what we got
+	retry.Run(t, func(r *retry.R) {
+		syncer.Lock()
+		defer syncer.Unlock()
+		actual := syncer.Registrations
+		require.Len(r, actual, 2)
+		require.Equal(r, "1.1.1.1", actual[0].Service.Address)
+		require.NotNil(r, actual[0].Check)
+		require.Equal(r, consulapi.HealthPassing, actual[0].Check.Status)
+		require.Equal(r, actual[0].Service.ID, actual[0].Check.ServiceID)
+		require.Equal(r, actual[0].Service.ID+"/"+ConsulReadinessCheckID, actual[0].Check.CheckID)
+		require.Equal(r, "2.2.2.2", actual[1].Service.Address)
+		require.NotNil(r, actual[1].Check)
+		require.Equal(r, consulapi.HealthCritical, actual[1].Check.Status)
+	})
+}
+
+// Test that ClusterIP services are registered from their endpoint slices
+// with the topology of their endpoints.
+func TestServiceResource_clusterIPEndpointSlices(t *testing.T) {
+	t.Parallel()
+	client := fake.NewSimpleClientset()
+	syncer := newTestSyncer()
+	serviceResource := defaultServiceResource(client, syncer)
+	serviceResource.ClusterIPSync = true
+	serviceResource.EnableEndpointSlices = true
+
+	// Start the controller
+	closer := controller.TestControllerRun(&serviceResource)
+	defer closer()
+
+	// Insert the service and its slices. The slices are split so that
+	// each holds one endpoint. Endpoints that aren't ready aren't
+	// registered.
+	svc := clusterIPService("foo", metav1.NamespaceDefault)
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), svc, metav1.CreateOptions{})
+	require.NoError(t, err)
+	notReady := false
+	createEndpointSlice(t, client, "foo-1", "foo", discoveryv1beta1.Endpoint{
+		Addresses: []string{"1.1.1.1"},
+		Topology: map[string]string{
+			apiv1.LabelHostname:                nodeName1,
+			apiv1.LabelZoneFailureDomainStable: "us-east-1a",
+		},
+	})
+	createEndpointSlice(t, client, "foo-2", "foo",
+		discoveryv1beta1.Endpoint{
+			Addresses: []string{"2.2.2.2"},
+			Topology: map[string]string{
+				apiv1.LabelHostname: nodeName2,
+			},
+		},
+		discoveryv1beta1.Endpoint{
+			Addresses:  []string{"3.3.3.3"},
+			Conditions: discoveryv1beta1.EndpointConditions{Ready: &notReady},
+		})
+
+	// Verify what we got
+	retry.Run(t, func(r *retry.R) {
+		syncer.Lock()
+		defer syncer.Unlock()
+		actual := syncer.Registrations
+		require.Len(r, actual, 2)
+		require.Equal(r, "1.1.1.1", actual[0].Service.Address)
+		require.Equal(r, 8080, actual[0].Service.Port)
+		require.Equal(r, nodeName1, actual[0].Service.Meta[ConsulK8SNode])
+		require.Equal(r, "us-east-1a", actual[0].Service.Meta[ConsulK8SZone])
+		require.Equal(r, "2.2.2.2", actual[1].Service.Address)
+		require.Equal(r, nodeName2, actual[1].Service.Meta[ConsulK8SNode])
+		require.NotContains(r, actual[1].Service.Meta, ConsulK8SZone)
+	})
+
+	// Deleting a slice removes its endpoints.
+	err = client.DiscoveryV1beta1().EndpointSlices(metav1.NamespaceDefault).Delete(context.Background(), "foo-1", metav1.DeleteOptions{})
+	require.NoError(t, err)
+	retry.Run(t, func(r *retry.R) {
+		syncer.Lock()
+		defer syncer.Unlock()
+		actual := syncer.Registrations
+		require.Len(r, actual, 1)
+		require.Equal(r, "2.2.2.2", actual[0].Service.Address)
+	})
+}
+
+func TestEndpointSlicesSupported(t *testing.T) {
+	t.Parallel()
+	client := fake.NewSimpleClientset()
+	supported, err := EndpointSlicesSupported(client)
+	require.NoError(t, err)
+	require.False(t, supported)
+
+	client.Fake.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: discoveryv1beta1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{{Name: "endpointslices"}},
+		},
+	}
+	supported, err = EndpointSlicesSupported(client)
+	require.NoError(t, err)
+	require.True(t, supported)
+}
+
 // lbService returns a Kubernetes service of type LoadBalancer.
 func lbService(name, namespace, lbIP string) *apiv1.Service {
 	return &apiv1.Service{
@@ -1590,6 +1780,33 @@ func createEndpoints(t *testing.T, client *fake.Clientset, serviceName string, n
 	require.NoError(t, err)
 }
 
+// createEndpointSlice calls the fake k8s client to create an endpoint slice
+// of the service with the given endpoints.
+func createEndpointSlice(t *testing.T, client *fake.Clientset, name, serviceName string, endpoints ...discoveryv1beta1.Endpoint) {
+	httpName, rpcName := "http", "rpc"
+	httpPort, rpcPort := int32(8080), int32(2000)
+	_, err := client.DiscoveryV1beta1().EndpointSlices(metav1.NamespaceDefault).Create(
+		context.Background(),
+		&discoveryv1beta1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: metav1.NamespaceDefault,
+				Labels: map[string]string{
+					discoveryv1beta1.LabelServiceName: serviceName,
+				},
+			},
+			AddressType: discoveryv1beta1.AddressTypeIPv4,
+			Endpoints:   endpoints,
+			Ports: []discoveryv1beta1.EndpointPort{
+				{Name: &httpName, Port: &httpPort},
+				{Name: &rpcName, Port: &rpcPort},
+			},
+		},
+		metav1.CreateOptions{})
+
+	require.NoError(t, err)
+}
+
 func defaultServiceResource(client kubernetes.Interface, syncer Syncer) ServiceResource {
 	return ServiceResource{
 		Log:                   hclog.Default(),
@@ -1600,3 +1817,431 @@ func defaultServiceResource(client kubernetes.Interface, syncer Syncer) ServiceR
 		ConsulNodeName:        ConsulSyncNodeName,
 	}
 }
+
+// Test that endpoints are registered on the Consul nodes of the k8s nodes
+// hosting them when RegisterOnK8SNodes is set.
+func TestServiceResource_registerOnK8SNodes(t *testing.T) {
+	t.Parallel()
+	client := fake.NewSimpleClientset()
+	syncer := newTestSyncer()
+	serviceResource := defaultServiceResource(client, syncer)
+	serviceResource.ClusterIPSync = true
+	serviceResource.RegisterOnK8SNodes = true
+
+	// Start the controller
+	closer := controller.TestControllerRun(&serviceResource)
+	defer closer()
+
+	// Insert the node hosting the first endpoint
+	_, err := client.CoreV1().Nodes().Create(context.Background(), &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "k8s-node-1",
+			Labels: map[string]string{apiv1.LabelZoneFailureDomainStable: "us-east-1a"},
+		},
+		Status: apiv1.NodeStatus{
+			Addresses: []apiv1.NodeAddress{
+				{Type: apiv1.NodeExternalIP, Address: "5.5.5.5"},
+				{Type: apiv1.NodeInternalIP, Address: "10.0.0.1"},
+			},
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// Insert the service
+	svc := clusterIPService("foo", metav1.NamespaceDefault)
+	_, err = client.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), svc, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// Insert the endpoints. The node of the second endpoint doesn't exist
+	// and the third endpoint has no node.
+	node1, node2 := "k8s-node-1", "k8s-node-2"
+	_, err = client.CoreV1().Endpoints(metav1.NamespaceDefault).Create(
+		context.Background(),
+		&apiv1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: metav1.NamespaceDefault,
+			},
+			Subsets: []apiv1.EndpointSubset{
+				{
+					Addresses: []apiv1.EndpointAddress{
+						{IP: "1.1.1.1", NodeName: &node1},
+						{IP: "2.2.2.2", NodeName: &node2},
+						{IP: "3.3.3.3"},
+					},
+					Ports: []apiv1.EndpointPort{{Name: "http", Port: 8080}},
+				},
+			},
+		},
+		metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// Verify what we got
+	retry.Run(t, func(r *retry.R) {
+		syncer.Lock()
+		defer syncer.Unlock()
+		actual := syncer.Registrations
+		require.Len(r, actual, 3)
+		require.Equal(r, "k8s-node-1-"+ConsulSyncNodeName, actual[0].Node)
+		require.Equal(r, "10.0.0.1", actual[0].Address)
+		require.False(r, actual[0].SkipNodeUpdate)
+		require.Equal(r, map[string]string{
+			ConsulSourceKey:   ConsulSourceValue,
+			ConsulK8SNode:     "k8s-node-1",
+			ConsulK8SZone:     "us-east-1a",
+			ConsulK8SSyncNode: ConsulSyncNodeName,
+		}, actual[0].NodeMeta)
+		require.Equal(r, ConsulSyncNodeName, actual[1].Node)
+		require.Equal(r, ConsulSyncNodeName, actual[2].Node)
+		require.True(r, actual[2].SkipNodeUpdate)
+	})
+}
+
+// Test that the cluster name is added to the service and node meta.
+func TestServiceResource_clusterName(t *testing.T) {
+	t.Parallel()
+	client := fake.NewSimpleClientset()
+	syncer := newTestSyncer()
+	serviceResource := defaultServiceResource(client, syncer)
+	serviceResource.ClusterName = "east"
+
+	// Start the controller
+	closer := controller.TestControllerRun(&serviceResource)
+	defer closer()
+
+	// Insert an LB service
+	svc := lbService("foo", metav1.NamespaceDefault, "1.2.3.4")
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), svc, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// Verify what we got
+	retry.Run(t, func(r *retry.R) {
+		syncer.Lock()
+		defer syncer.Unlock()
+		actual := syncer.Registrations
+		require.Len(r, actual, 1)
+		require.Equal(r, "east", actual[0].Service.Meta[ConsulK8SCluster])
+		require.Equal(r, "east", actual[0].NodeMeta[ConsulK8SCluster])
+	})
+}
+
+// Test that the hosts of ingresses are registered when ingresses are synced.
+func TestServiceResource_ingress(t *testing.T) {
+	t.Parallel()
+	client := fake.NewSimpleClientset()
+	syncer := newTestSyncer()
+	serviceResource := defaultServiceResource(client, syncer)
+	serviceResource.SyncIngress = true
+	serviceResource.ConsulK8STag = TestConsulK8STag
+
+	// Start the controller
+	closer := controller.TestControllerRun(&serviceResource)
+	defer closer()
+
+	// Insert an ingress with a TLS host and a plain host
+	ingress := &networkingv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: metav1.NamespaceDefault,
+			Annotations: map[string]string{
+				annotationServiceTags:                "public",
+				annotationServiceMetaPrefix + "team": "web",
+			},
+		},
+		Spec: networkingv1beta1.IngressSpec{
+			TLS: []networkingv1beta1.IngressTLS{{Hosts: []string{"shop.example.com"}}},
+			Rules: []networkingv1beta1.IngressRule{
+				{
+					Host: "shop.example.com",
+					IngressRuleValue: networkingv1beta1.IngressRuleValue{
+						HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+							Paths: []networkingv1beta1.HTTPIngressPath{{Path: "/cart"}, {Path: "/api"}},
+						},
+					},
+				},
+				{Host: "blog.example.com"},
+			},
+		},
+		Status: networkingv1beta1.IngressStatus{
+			LoadBalancer: apiv1.LoadBalancerStatus{
+				Ingress: []apiv1.LoadBalancerIngress{{IP: "1.2.3.4"}},
+			},
+		},
+	}
+	_, err := client.NetworkingV1beta1().Ingresses(metav1.NamespaceDefault).Create(context.Background(), ingress, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// Verify what we got
+	retry.Run(t, func(r *retry.R) {
+		syncer.Lock()
+		defer syncer.Unlock()
+		actual := syncer.Registrations
+		require.Len(r, actual, 2)
+		sort.Slice(actual, func(i, j int) bool { return actual[i].Service.Service < actual[j].Service.Service })
+		require.Equal(r, "blog-example-com", actual[0].Service.Service)
+		require.Equal(r, "1.2.3.4", actual[0].Service.Address)
+		require.Equal(r, 80, actual[0].Service.Port)
+		require.Equal(r, []string{"k8s", "public", "host=blog.example.com"}, actual[0].Service.Tags)
+		require.Equal(r, "shop-example-com", actual[1].Service.Service)
+		require.Equal(r, 443, actual[1].Service.Port)
+		require.Equal(r, []string{"k8s", "public", "host=shop.example.com", "path=/api", "path=/cart"}, actual[1].Service.Tags)
+		require.Equal(r, "web", actual[1].Service.Meta[ConsulK8SIngress])
+		require.Equal(r, "web", actual[1].Service.Meta["team"])
+	})
+
+	// Disabling the sync removes the registrations
+	ingress.Annotations[annotationServiceSync] = "false"
+	_, err = client.NetworkingV1beta1().Ingresses(metav1.NamespaceDefault).Update(context.Background(), ingress, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	retry.Run(t, func(r *retry.R) {
+		syncer.Lock()
+		defer syncer.Unlock()
+		require.Len(r, syncer.Registrations, 0)
+	})
+}
+
+// Test that the resource and its controller are only ready once the
+// services and ingresses that existed when they started are registered.
+func TestServiceResource_ready(t *testing.T) {
+	t.Parallel()
+	client := fake.NewSimpleClientset()
+	syncer := newTestSyncer()
+	serviceResource := defaultServiceResource(client, syncer)
+	serviceResource.SyncIngress = true
+
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), lbService("foo", metav1.NamespaceDefault, "1.2.3.4"), metav1.CreateOptions{})
+	require.NoError(t, err)
+	ingress := &networkingv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: metav1.NamespaceDefault},
+		Spec: networkingv1beta1.IngressSpec{
+			Rules: []networkingv1beta1.IngressRule{{Host: "blog.example.com"}},
+		},
+		Status: networkingv1beta1.IngressStatus{
+			LoadBalancer: apiv1.LoadBalancerStatus{
+				Ingress: []apiv1.LoadBalancerIngress{{IP: "5.6.7.8"}},
+			},
+		},
+	}
+	_, err = client.NetworkingV1beta1().Ingresses(metav1.NamespaceDefault).Create(context.Background(), ingress, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	ctl := &controller.Controller{Log: hclog.Default(), Resource: &serviceResource}
+	require.False(t, serviceResource.Ready())
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go ctl.Run(stopCh)
+	require.True(t, cache.WaitForCacheSync(stopCh, ctl.Ready, serviceResource.Ready))
+
+	syncer.Lock()
+	defer syncer.Unlock()
+	var names []string
+	for _, r := range syncer.Registrations {
+		names = append(names, r.Service.Service)
+	}
+	sort.Strings(names)
+	require.Equal(t, []string{"blog-example-com", "foo"}, names)
+}
+
+// Test that ExternalName services are registered with their external name
+// as the address, unless they were synced from Consul.
+func TestServiceResource_externalName(t *testing.T) {
+	t.Parallel()
+	client := fake.NewSimpleClientset()
+	syncer := newTestSyncer()
+	serviceResource := defaultServiceResource(client, syncer)
+
+	// Start the controller
+	closer := controller.TestControllerRun(&serviceResource)
+	defer closer()
+
+	// Insert the services
+	svc := &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db",
+			Namespace: metav1.NamespaceDefault,
+		},
+		Spec: apiv1.ServiceSpec{
+			Type:         apiv1.ServiceTypeExternalName,
+			ExternalName: "db.example.com",
+			Ports:        []apiv1.ServicePort{{Name: "postgres", Port: 5432}},
+		},
+	}
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), svc, metav1.CreateOptions{})
+	require.NoError(t, err)
+	fromConsul := &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: metav1.NamespaceDefault,
+			Labels:    map[string]string{"consul": "true"},
+		},
+		Spec: apiv1.ServiceSpec{
+			Type:         apiv1.ServiceTypeExternalName,
+			ExternalName: "web.service.consul",
+		},
+	}
+	_, err = client.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), fromConsul, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// Verify what we got
+	retry.Run(t, func(r *retry.R) {
+		syncer.Lock()
+		defer syncer.Unlock()
+		actual := syncer.Registrations
+		require.Len(r, actual, 1)
+		require.Equal(r, "db", actual[0].Service.Service)
+		require.Equal(r, "db.example.com", actual[0].Service.Address)
+		require.Equal(r, 5432, actual[0].Service.Port)
+	})
+}
+
+// Test that the endpoints of headless services are registered with the DNS
+// names of their pods when annotated.
+func TestServiceResource_headlessPodHostnames(t *testing.T) {
+	t.Parallel()
+	client := fake.NewSimpleClientset()
+	syncer := newTestSyncer()
+	serviceResource := defaultServiceResource(client, syncer)
+	serviceResource.ClusterIPSync = true
+	serviceResource.ClusterDomain = "example.local"
+
+	// Start the controller
+	closer := controller.TestControllerRun(&serviceResource)
+	defer closer()
+
+	// Insert the service
+	svc := clusterIPService("foo", metav1.NamespaceDefault)
+	svc.Spec.ClusterIP = apiv1.ClusterIPNone
+	svc.Annotations[annotationServicePodHostname] = "true"
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), svc, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// Insert the endpoints. Only the first has a hostname.
+	_, err = client.CoreV1().Endpoints(metav1.NamespaceDefault).Create(
+		context.Background(),
+		&apiv1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: metav1.NamespaceDefault,
+			},
+			Subsets: []apiv1.EndpointSubset{
+				{
+					Addresses: []apiv1.EndpointAddress{
+						{IP: "1.1.1.1", Hostname: "foo-0"},
+						{IP: "2.2.2.2"},
+					},
+					Ports: []apiv1.EndpointPort{{Name: "http", Port: 8080}},
+				},
+			},
+		},
+		metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// Verify what we got
+	retry.Run(t, func(r *retry.R) {
+		syncer.Lock()
+		defer syncer.Unlock()
+		actual := syncer.Registrations
+		require.Len(r, actual, 2)
+		require.Equal(r, "foo-0.foo.default.svc.example.local", actual[0].Service.Address)
+		require.Equal(r, 8080, actual[0].Service.Port)
+		require.Equal(r, "2.2.2.2", actual[1].Service.Address)
+	})
+}
+
+// Test that every port of services with more than one port is synced when
+// the port sync mode is set globally or by annotation.
+func TestServiceResource_portSyncMode(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		Mode       PortSyncMode
+		Annotation string
+		Expected   map[string]string
+	}{
+		"default": {
+			Expected: map[string]string{
+				"foo 8080": "k8s",
+			},
+		},
+		"services": {
+			Mode: ServicePerPort,
+			Expected: map[string]string{
+				"foo-http 8080": "k8s",
+				"foo-rpc 2000":  "k8s",
+			},
+		},
+		"tags by annotation": {
+			Annotation: "tags",
+			Expected: map[string]string{
+				"foo 8080": "k8s,http",
+				"foo 2000": "k8s,rpc",
+			},
+		},
+		"single by annotation": {
+			Mode:       ServicePerPort,
+			Annotation: "single",
+			Expected: map[string]string{
+				"foo 8080": "k8s",
+			},
+		},
+	}
+
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			syncer := newTestSyncer()
+			serviceResource := defaultServiceResource(client, syncer)
+			serviceResource.ClusterIPSync = true
+			serviceResource.ConsulK8STag = TestConsulK8STag
+			serviceResource.PortSyncMode = c.Mode
+
+			// Start the controller
+			closer := controller.TestControllerRun(&serviceResource)
+			defer closer()
+
+			// Insert the service
+			svc := clusterIPService("foo", metav1.NamespaceDefault)
+			if c.Annotation != "" {
+				svc.Annotations[annotationServicePortMode] = c.Annotation
+			}
+			_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), svc, metav1.CreateOptions{})
+			require.NoError(t, err)
+
+			// Insert the endpoints
+			_, err = client.CoreV1().Endpoints(metav1.NamespaceDefault).Create(
+				context.Background(),
+				&apiv1.Endpoints{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "foo",
+						Namespace: metav1.NamespaceDefault,
+					},
+					Subsets: []apiv1.EndpointSubset{
+						{
+							Addresses: []apiv1.EndpointAddress{{IP: "1.1.1.1"}},
+							Ports: []apiv1.EndpointPort{
+								{Name: "http", Port: 8080},
+								{Name: "rpc", Port: 2000},
+							},
+						},
+					},
+				},
+				metav1.CreateOptions{})
+			require.NoError(t, err)
+
+			// Verify what we got
+			retry.Run(t, func(r *retry.R) {
+				syncer.Lock()
+				defer syncer.Unlock()
+				actual := make(map[string]string)
+				ids := make(map[string]bool)
+				for _, reg := range syncer.Registrations {
+					actual[fmt.Sprintf("%s %d", reg.Service.Service, reg.Service.Port)] = strings.Join(reg.Service.Tags, ",")
+					ids[reg.Service.ID] = true
+				}
+				require.Equal(r, c.Expected, actual)
+				require.Len(r, ids, len(c.Expected))
+			})
+		})
+	}
+}
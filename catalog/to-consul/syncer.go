@@ -2,6 +2,9 @@ package catalog
 
 import (
 	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 
@@ -17,9 +20,14 @@ const (
 	// reconcile the expected service states with the remote Consul server.
 	ConsulSyncPeriod = 30 * time.Second
 
-	// ConsulServicePollPeriod is how often a service is checked for
-	// whether it has instances to reap.
-	ConsulServicePollPeriod = 60 * time.Second
+	// ConsulTxnMaxOps is the maximum number of operations Consul accepts
+	// in a single transaction.
+	ConsulTxnMaxOps = 64
+
+	// ConsulTxnMaxSize is the default maximum size in bytes of a
+	// transaction request accepted by Consul, set by its txn_max_req_len
+	// config.
+	ConsulTxnMaxSize = 512 * 1024
 )
 
 // Syncer is responsible for syncing a set of Consul catalog registrations.
@@ -50,18 +58,24 @@ type ConsulSyncer struct {
 	// Only necessary if ACLs are enabled.
 	CrossNamespaceACLPolicy string
 
-	// SyncPeriod is the interval between full catalog syncs. These will
-	// re-register all services to prevent overwrites of data. This should
-	// happen relatively infrequently and default to 30 seconds.
-	//
-	// ServicePollPeriod is the interval to look for invalid services to
-	// deregister. One request will be made for each synced service in
-	// Kubernetes.
-	//
-	// For both syncs, smaller more frequent and focused syncs may be
-	// triggered by known drift or changes.
-	SyncPeriod        time.Duration
-	ServicePollPeriod time.Duration
+	// EnableK8SNSMirroring and K8SNSMirroringPrefix are the mirroring
+	// settings of the ServiceResource. The Consul namespaces created for
+	// mirrored k8s namespaces are marked with ClusterName so that the
+	// controller of the same cluster can delete them.
+	EnableK8SNSMirroring bool
+	K8SNSMirroringPrefix string
+
+	// SyncPeriod is the interval between syncs. Each sync only writes the
+	// registrations and deregistrations that changed since the last sync,
+	// or that were changed in Consul since they were written. This should
+	// default to 30 seconds.
+	SyncPeriod time.Duration
+
+	// TxnMaxOps and TxnMaxSize limit the number of operations and the size
+	// in bytes of each transaction used to write the changes. They default
+	// to ConsulTxnMaxOps and ConsulTxnMaxSize.
+	TxnMaxOps  int
+	TxnMaxSize int
 
 	// ConsulK8STag is the tag value for services registered.
 	ConsulK8STag string
@@ -69,6 +83,25 @@ type ConsulSyncer struct {
 	// The Consul node name to register services with.
 	ConsulNodeName string
 
+	// ClusterName is the name of the k8s cluster the services are synced
+	// from. The syncer only removes service instances and nodes whose
+	// ConsulK8SCluster meta matches it, so that clusters syncing into the
+	// same Consul datacenter with the same ConsulK8STag don't remove each
+	// other's registrations. Instances without the meta are owned by
+	// syncers without a ClusterName.
+	ClusterName string
+
+	// AdoptUnnamedCluster makes the syncer also own the service instances
+	// and nodes without the ConsulK8SCluster meta. It's set once when a
+	// ClusterName is added to a cluster that synced without one, so that
+	// its existing registrations are rewritten with the meta, or reaped if
+	// they're no longer synced, rather than left behind.
+	AdoptUnnamedCluster bool
+
+	// DryRun computes the changes to Consul without making them. The changes
+	// are logged whenever they change and returned by Plan.
+	DryRun bool
+
 	// ConsulNodeServicesClient is used to list services for a node. We use a
 	// separate client for this API call that handles older version of Consul.
 	ConsulNodeServicesClient ConsulNodeServicesClient
@@ -91,15 +124,31 @@ type ConsulSyncer struct {
 	// namespaces is all namespaces mapped to a map of Consul service
 	// ids mapped to their CatalogRegistrations
 	namespaces map[string]map[string]*api.CatalogRegistration
-	deregs     map[string]*api.CatalogDeregistration
+	deregs     map[string]*deregistration
+
+	// written is the registrations last written to Consul, keyed by
+	// registrationKey. Registrations are removed when they're found to
+	// have been changed or removed in Consul so that they're written again.
+	written map[string]*api.CatalogRegistration
+
+	// nodes is the set of nodes known to exist in Consul. Services can only
+	// be registered in a transaction on existing nodes, so the first
+	// service on any other node is registered with the catalog API.
+	nodes map[string]bool
+
+	// ownedNodes is the set of nodes registered for k8s nodes that were
+	// found in Consul with the ConsulK8SSyncNode meta of this syncer. Owned
+	// nodes that no service is synced to anymore are deleted.
+	ownedNodes map[string]bool
 
-	// watchers is all namespaces mapped to a map of Consul service
-	// names mapped to a cancel function for watcher routines
-	watchers map[string]map[string]context.CancelFunc
+	// plan is the changes last recorded if DryRun is set.
+	plan *SyncPlan
 }
 
 // Sync implements Syncer
 func (s *ConsulSyncer) Sync(rs []*api.CatalogRegistration) {
+	s.once.Do(s.init)
+
 	// Grab the lock so we can replace the sync state
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -138,8 +187,8 @@ func (s *ConsulSyncer) Sync(rs []*api.CatalogRegistration) {
 func (s *ConsulSyncer) Run(ctx context.Context) {
 	s.once.Do(s.init)
 
-	// Start the background watchers
-	go s.watchReapableServices(ctx)
+	// Start the background watcher
+	go s.watchServices(ctx)
 
 	reconcileTimer := time.NewTimer(s.SyncPeriod)
 	defer reconcileTimer.Stop()
@@ -157,19 +206,25 @@ func (s *ConsulSyncer) Run(ctx context.Context) {
 	}
 }
 
-// watchReapableServices is a long-running task started by Run that
-// holds blocking queries to the Consul server to watch for any services
-// tagged with k8s that are no longer valid and need to be deleted.
-// This task only marks them for deletion but doesn't perform the actual
-// deletion.
-func (s *ConsulSyncer) watchReapableServices(ctx context.Context) {
+// watchServices is a long-running task started by Run that holds a
+// blocking query to the Consul server to watch the service instances
+// tagged with k8s on the sync node. Instances that are no longer valid are
+// marked for deletion, and valid instances whose service or check was
+// changed or removed are marked to be registered again. This task doesn't
+// perform the actual writes. Instances synced to other nodes are watched
+// by watchOtherNodes.
+func (s *ConsulSyncer) watchServices(ctx context.Context) {
 	// We must wait for the initial sync to be complete and our maps to be
 	// populated. If we don't wait, we will reap all services tagged with k8s
 	// because we have no tracked services in our maps yet.
 	select {
 	case <-s.initialSync:
+	case <-ctx.Done():
+		return
 	}
 
+	go s.watchOtherNodes(ctx)
+
 	opts := &api.QueryOptions{
 		AllowStale: true,
 		WaitIndex:  1,
@@ -185,19 +240,27 @@ func (s *ConsulSyncer) watchReapableServices(ctx context.Context) {
 	minWait := s.SyncPeriod / 4
 	minWaitCh := time.After(0)
 	for {
-		var services []ConsulService
+		var instances []*api.AgentService
+		var checks api.HealthChecks
 		var meta *api.QueryMeta
 		err := backoff.Retry(func() error {
 			var err error
-			services, meta, err = s.ConsulNodeServicesClient.NodeServices(s.ConsulK8STag, s.ConsulNodeName, *opts)
+			instances, meta, err = s.ConsulNodeServicesClient.NodeServiceInstances(s.ConsulK8STag, s.ConsulNodeName, *opts)
+			if err != nil {
+				return err
+			}
+			checks, _, err = s.Client.Health().Node(s.ConsulNodeName, (&api.QueryOptions{
+				AllowStale: true,
+				Namespace:  opts.Namespace,
+			}).WithContext(ctx))
 			return err
 		}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
 
 		if err != nil {
 			s.Log.Warn("error querying services, will retry", "err", err)
 		} else {
-			s.Log.Debug("[watchReapableServices] services returned from catalog",
-				"services", services)
+			s.Log.Debug("[watchServices] service instances returned from catalog",
+				"instances", len(instances))
 		}
 
 		// Wait our minimum time before continuing or retrying
@@ -217,102 +280,276 @@ func (s *ConsulSyncer) watchReapableServices(ctx context.Context) {
 
 		// Lock so we can modify the stored state
 		s.lock.Lock()
-
-		// Go through the service array and find services that should be reaped
-		for _, service := range services {
-			// Check that the namespace exists in the valid service names map
-			// before checking whether it contains the service
-			if _, ok := s.serviceNames[service.Namespace]; ok {
-				// We only care if we don't know about this service at all.
-				if s.serviceNames[service.Namespace].Contains(service.Name) {
-					s.Log.Debug("[watchReapableServices] serviceNames contains service",
-						"namespace", service.Namespace,
-						"service-name", service.Name)
-					continue
-				}
-			}
-
-			s.Log.Info("invalid service found, scheduling for delete",
-				"service-name", service.Name, "service-consul-namespace", service.Namespace)
-			if err := s.scheduleReapServiceLocked(service.Name, service.Namespace); err != nil {
-				s.Log.Info("error querying service for delete",
-					"service-name", service.Name,
-					"service-consul-namespace", service.Namespace,
-					"err", err)
-			}
-		}
-
+		s.reconcileNodeLocked(s.ConsulNodeName, instances, s.serviceChecks(checks)[s.ConsulNodeName])
 		s.lock.Unlock()
 	}
 }
 
-// watchService watches all instances of a service by name for changes
-// and schedules re-registration or deletion if necessary.
-func (s *ConsulSyncer) watchService(ctx context.Context, name, namespace string) {
-	s.Log.Info("starting service watcher", "service-name", name, "service-consul-namespace", namespace)
-	defer s.Log.Info("stopping service watcher", "service-name", name, "service-consul-namespace", namespace)
+// watchOtherNodes is a long-running task started by watchServices that
+// holds a single blocking query for the services on the nodes registered
+// for k8s nodes by the syncer. The nodes' instances and checks are only
+// listed and reconciled when the query returns, at most once every
+// SyncPeriod.
+func (s *ConsulSyncer) watchOtherNodes(ctx context.Context) {
+	opts := &api.QueryOptions{
+		AllowStale: true,
+		WaitIndex:  1,
+		WaitTime:   1 * time.Minute,
+		NodeMeta:   map[string]string{ConsulK8SSyncNode: s.ConsulNodeName},
+	}
+
+	if s.EnableNamespaces {
+		opts.Namespace = "*"
+	}
 
+	minWaitCh := time.After(0)
 	for {
+		var meta *api.QueryMeta
+		err := backoff.Retry(func() error {
+			var err error
+			_, meta, err = s.Client.Catalog().Services(opts.WithContext(ctx))
+			return err
+		}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
+
+		if err != nil {
+			s.Log.Warn("error querying services, will retry", "err", err)
+		}
+
+		// Wait our minimum time before continuing or retrying
 		select {
-		// Quit if our context is over
+		case <-minWaitCh:
+			if err != nil {
+				continue
+			}
+
+			minWaitCh = time.After(s.SyncPeriod)
 		case <-ctx.Done():
 			return
+		}
 
-		// Wait for our poll period
-		case <-time.After(s.SyncPeriod):
+		// Update our blocking index
+		opts.WaitIndex = meta.LastIndex
+
+		// Nodes owned by the syncer may have been registered before it
+		// started, so they're looked up to reap what's left on them.
+		owned, err := s.listOwnedNodes(ctx)
+		if err != nil {
+			s.Log.Warn("error querying owned nodes, will retry", "err", err)
 		}
 
-		// Set up query options
-		queryOpts := &api.QueryOptions{
-			AllowStale: true,
+		s.lock.Lock()
+		if err == nil {
+			s.ownedNodes = owned
 		}
-		if s.EnableNamespaces {
-			// Sets the Consul namespace to query the catalog
-			queryOpts.Namespace = namespace
+		otherNodes := s.otherNodesLocked()
+		s.lock.Unlock()
+		if len(otherNodes) == 0 {
+			continue
 		}
 
-		// Wait for service changes
-		var services []*api.CatalogService
-		err := backoff.Retry(func() error {
-			var err error
-			services, _, err = s.Client.Catalog().Service(name, s.ConsulK8STag, queryOpts)
-			return err
-		}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
+		stateOpts := (&api.QueryOptions{
+			AllowStale: true,
+			Namespace:  opts.Namespace,
+			NodeMeta:   opts.NodeMeta,
+		}).WithContext(ctx)
+		states, _, err := s.Client.Health().State(api.HealthAny, stateOpts)
 		if err != nil {
-			s.Log.Warn("error querying service, will retry",
-				"service-name", name,
-				"service-namespace", namespace, // will be "" if namespaces aren't enabled
-				"err", err)
+			s.Log.Warn("error querying checks, will retry", "err", err)
+			// Query again on the next run.
+			opts.WaitIndex = 1
 			continue
 		}
+		checks := s.serviceChecks(states)
+
+		nodeInstances := make(map[string][]*api.AgentService)
+		for _, node := range otherNodes {
+			nodeOpts := (&api.QueryOptions{AllowStale: true, Namespace: opts.Namespace}).WithContext(ctx)
+			instances, _, err := s.ConsulNodeServicesClient.NodeServiceInstances(s.ConsulK8STag, node, *nodeOpts)
+			if err != nil {
+				s.Log.Warn("error querying services, will retry", "node-name", node, "err", err)
+				opts.WaitIndex = 1
+				continue
+			}
+			nodeInstances[node] = instances
+		}
 
-		// Lock so we can modify the set of actions to take
+		// Lock so we can modify the stored state
 		s.lock.Lock()
+		for node, instances := range nodeInstances {
+			s.reconcileNodeLocked(node, instances, checks[node])
+		}
+		s.lock.Unlock()
+	}
+}
 
-		for _, svc := range services {
-			// Make sure the namespace exists before we run checks against it
-			if _, ok := s.serviceNames[namespace]; ok {
-				// If the service is valid and its info isn't nil, we don't deregister it
-				if s.serviceNames[namespace].Contains(svc.ServiceName) && s.namespaces[namespace][svc.ServiceID] != nil {
-					continue
-				}
+// serviceChecks returns the service checks keyed by node and then by the
+// registrationKey of their namespace and check ID.
+func (s *ConsulSyncer) serviceChecks(checks api.HealthChecks) map[string]map[string]*api.HealthCheck {
+	byNode := make(map[string]map[string]*api.HealthCheck)
+	for _, c := range checks {
+		if c.ServiceID == "" {
+			continue
+		}
+		// Consul Enterprise returns the default namespace even if
+		// namespaces aren't enabled.
+		ns := c.Namespace
+		if !s.EnableNamespaces {
+			ns = ""
+		}
+		if byNode[c.Node] == nil {
+			byNode[c.Node] = make(map[string]*api.HealthCheck)
+		}
+		byNode[c.Node][registrationKey(ns, c.CheckID)] = c
+	}
+	return byNode
+}
+
+// otherNodesLocked returns the nodes other than the sync node that services
+// are synced or were written to.
+//
+// Precondition: lock must be held
+func (s *ConsulSyncer) otherNodesLocked() []string {
+	seen := map[string]bool{s.ConsulNodeName: true}
+	var nodes []string
+	add := func(node string) {
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	for _, services := range s.namespaces {
+		for _, r := range services {
+			add(r.Node)
+		}
+	}
+	for _, r := range s.written {
+		add(r.Node)
+	}
+	for node := range s.ownedNodes {
+		add(node)
+	}
+	return nodes
+}
+
+// listOwnedNodes returns the set of nodes in Consul registered for k8s
+// nodes by this syncer.
+func (s *ConsulSyncer) listOwnedNodes(ctx context.Context) (map[string]bool, error) {
+	nodes, _, err := s.Client.Catalog().Nodes((&api.QueryOptions{
+		AllowStale: true,
+		NodeMeta:   map[string]string{ConsulK8SSyncNode: s.ConsulNodeName},
+	}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		if s.ownsMeta(n.Meta) {
+			owned[n.Node] = true
+		}
+	}
+	return owned, nil
+}
+
+// ownsMeta returns true if the service instance or node with the given
+// meta was synced from the syncer's cluster.
+func (s *ConsulSyncer) ownsMeta(meta map[string]string) bool {
+	cluster, ok := meta[ConsulK8SCluster]
+	if !ok && s.AdoptUnnamedCluster {
+		return true
+	}
+	return cluster == s.ClusterName
+}
+
+// reconcileNodeLocked compares the service instances tagged with k8s
+// registered on the node with the synced services. Instances that aren't
+// synced are scheduled for deletion, and synced instances whose service or
+// check was changed or removed since they were written are forgotten so
+// that the next sync writes them again. checks are the node's service
+// checks, keyed by the registrationKey of their namespace and check ID.
+//
+// Precondition: lock must be held
+func (s *ConsulSyncer) reconcileNodeLocked(node string, instances []*api.AgentService, checks map[string]*api.HealthCheck) {
+	if len(instances) == 0 {
+		// The node may have been removed along with its services.
+		delete(s.nodes, node)
+	}
+
+	seen := make(map[string]bool)
+	reaped := make(map[string]bool)
+	for _, svc := range instances {
+		// Instances synced from other clusters are left alone.
+		if !s.ownsMeta(svc.Meta) {
+			continue
+		}
+		// Consul Enterprise returns the default namespace even if
+		// namespaces aren't enabled.
+		if !s.EnableNamespaces {
+			svc.Namespace = ""
+		}
+		// Check that the namespace exists in the valid service names map
+		// before checking whether it contains the service
+		if names, ok := s.serviceNames[svc.Namespace]; !ok || !names.Contains(svc.Service) {
+			// We don't know about this service at all, so all of its
+			// instances are reaped, not only those on this node.
+			if reaped[svc.Namespace+"/"+svc.Service] {
+				continue
+			}
+			reaped[svc.Namespace+"/"+svc.Service] = true
+			s.Log.Info("invalid service found, scheduling for delete",
+				"service-name", svc.Service, "service-consul-namespace", svc.Namespace)
+			if err := s.scheduleReapServiceLocked(svc.Service, svc.Namespace); err != nil {
+				s.Log.Info("error querying service for delete",
+					"service-name", svc.Service,
+					"service-consul-namespace", svc.Namespace,
+					"err", err)
 			}
+			continue
+		}
 
-			s.deregs[svc.ServiceID] = &api.CatalogDeregistration{
-				Node:      svc.Node,
-				ServiceID: svc.ServiceID,
+		key := registrationKey(svc.Namespace, svc.ID)
+		r := s.namespaces[svc.Namespace][svc.ID]
+		if r == nil || r.Node != node {
+			s.deregs[svc.ID] = &deregistration{
+				CatalogDeregistration: api.CatalogDeregistration{
+					Node:      node,
+					ServiceID: svc.ID,
+				},
+				ServiceName: svc.Service,
 			}
 			if s.EnableNamespaces {
-				s.deregs[svc.ServiceID].Namespace = namespace
+				s.deregs[svc.ID].Namespace = svc.Namespace
 			}
-			s.Log.Debug("[watchService] service being scheduled for deregistration",
-				"namespace", namespace,
-				"service name", svc.ServiceName,
-				"service id", svc.ServiceID,
-				"service dereg", s.deregs[svc.ServiceID])
+			s.Log.Debug("[reconcileNodeLocked] service being scheduled for deregistration",
+				"namespace", svc.Namespace,
+				"service name", svc.Service,
+				"service id", svc.ID,
+				"service dereg", s.deregs[svc.ID])
+			continue
 		}
 
-		s.lock.Unlock()
+		seen[key] = true
+		// Nothing is written in a dry run, so instances that are already
+		// registered as synced are treated as written.
+		if _, ok := s.written[key]; !ok && s.DryRun && registrationMatches(r, svc, checks) {
+			s.written[key] = r
+		}
+		if w, ok := s.written[key]; ok && w.Node == node && !registrationMatches(w, svc, checks) {
+			s.Log.Info("service instance changed in Consul, scheduling for re-registration",
+				"node-name", node,
+				"service-id", svc.ID,
+				"service-consul-namespace", svc.Namespace)
+			delete(s.written, key)
+		}
+	}
+
+	for key, w := range s.written {
+		if w.Node == node && !seen[key] {
+			s.Log.Info("service instance removed from Consul, scheduling for re-registration",
+				"node-name", node,
+				"service-id", w.Service.ID,
+				"service-consul-namespace", w.Service.Namespace)
+			delete(s.written, key)
+		}
 	}
 }
 
@@ -335,9 +572,15 @@ func (s *ConsulSyncer) scheduleReapServiceLocked(name, namespace string) error {
 
 	// Create deregistrations for all of these
 	for _, svc := range services {
-		s.deregs[svc.ServiceID] = &api.CatalogDeregistration{
-			Node:      svc.Node,
-			ServiceID: svc.ServiceID,
+		if !s.ownsMeta(svc.ServiceMeta) {
+			continue
+		}
+		s.deregs[svc.ServiceID] = &deregistration{
+			CatalogDeregistration: api.CatalogDeregistration{
+				Node:      svc.Node,
+				ServiceID: svc.ServiceID,
+			},
+			ServiceName: svc.ServiceName,
 		}
 		if s.EnableNamespaces {
 			s.deregs[svc.ServiceID].Namespace = namespace
@@ -353,99 +596,555 @@ func (s *ConsulSyncer) scheduleReapServiceLocked(name, namespace string) error {
 }
 
 // syncFull is called periodically to perform all the write-based API
-// calls to sync the data with Consul. This may also start background
-// watchers for specific services.
+// calls to sync the data with Consul. Only registrations that differ from
+// what was last written and the scheduled deregistrations are written, in
+// as few transactions as the limits allow. If DryRun is set, the changes
+// are only recorded.
 func (s *ConsulSyncer) syncFull(ctx context.Context) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	groups := s.planLocked()
+	if s.DryRun {
+		s.recordPlanLocked(groups)
+		return
+	}
+
 	s.Log.Info("registering services")
 
-	// Update the service watchers
-	for ns, watchers := range s.watchers {
-		// If the service the watcher is watching is no longer valid,
-		// cancel the watcher
-		for svc, cf := range watchers {
-			if s.serviceNames[ns] == nil || !s.serviceNames[ns].Contains(svc) {
-				cf()
-				delete(s.watchers[ns], svc)
-				s.Log.Debug("[syncFull] deleting service watcher", "namespace", ns, "service", svc)
+	// Register the services that changed, on nodes that don't exist yet
+	// along with their node.
+	var txnGroups []txnGroup
+	ensuredNamespaces := make(map[string]bool)
+	for _, g := range groups {
+		r := g.reg
+		if r == nil {
+			txnGroups = append(txnGroups, g)
+			continue
+		}
+
+		if s.EnableNamespaces && !ensuredNamespaces[r.Service.Namespace] {
+			meta := namespaces.MirroredByClusterMeta(r.Service.Namespace, r.Service.Meta[ConsulK8SNS],
+				s.EnableK8SNSMirroring, s.K8SNSMirroringPrefix, s.ClusterName)
+			_, err := namespaces.EnsureExistsWithMeta(s.Client, r.Service.Namespace, s.CrossNamespaceACLPolicy, meta)
+			if err != nil {
+				s.Log.Warn("error checking and creating Consul namespace",
+					"node-name", r.Node,
+					"service-name", r.Service.Service,
+					"consul-namespace-name", r.Service.Namespace,
+					"err", err)
+				continue
 			}
+			ensuredNamespaces[r.Service.Namespace] = true
 		}
+
+		if s.nodes[r.Node] {
+			txnGroups = append(txnGroups, g)
+			continue
+		}
+
+		// Register the service along with its node
+		_, err := s.Client.Catalog().Register(r, nil)
+		if err != nil {
+			s.Log.Warn("error registering service",
+				"node-name", r.Node,
+				"service-name", r.Service.Service,
+				"service", r.Service,
+				"err", err)
+			continue
+		}
+		s.nodes[r.Node] = true
+		s.written[registrationKey(r.Service.Namespace, r.Service.ID)] = r
+
+		s.Log.Debug("registered service instance",
+			"node-name", r.Node,
+			"service-name", r.Service.Service,
+			"consul-namespace-name", r.Service.Namespace,
+			"service", r.Service)
 	}
 
-	// Start watchers for all services if they're not already running
-	for ns, services := range s.serviceNames {
-		for svc := range services.Iter() {
-			if _, ok := s.watchers[ns][svc.(string)]; !ok {
-				svcCtx, cancelF := context.WithCancel(ctx)
-				go s.watchService(svcCtx, svc.(string), ns)
-				s.Log.Debug("[syncFull] starting watchService routine", "namespace", ns, "service", svc)
+	for _, batch := range batchTxnGroups(txnGroups, s.TxnMaxOps, s.TxnMaxSize) {
+		if ctx.Err() != nil {
+			return
+		}
+		s.writeBatchLocked(batch)
+	}
+}
 
-				// Create watcher map if it doesn't exist for this namespace
-				if s.watchers[ns] == nil {
-					s.watchers[ns] = make(map[string]context.CancelFunc)
-				}
+// planLocked returns the groups of operations that bring Consul in sync:
+// the deletions of unused owned nodes and the deregistrations first, then
+// the registrations that changed. Changes made to the registered services
+// in Consul are detected by watchServices, which forgets them so that
+// they're registered again. The scheduled deregistrations are cleared.
+//
+// Precondition: lock must be held
+func (s *ConsulSyncer) planLocked() []txnGroup {
+	var groups []txnGroup
 
-				// Add the watcher to our tracking
-				s.watchers[ns][svc.(string)] = cancelF
-			}
+	// Delete the owned nodes that no service is synced to anymore along
+	// with everything registered on them.
+	usedNodes := make(map[string]bool)
+	for _, services := range s.namespaces {
+		for _, r := range services {
+			usedNodes[r.Node] = true
+		}
+	}
+	nodeDeregs := make(map[string]bool)
+	for node := range s.ownedNodes {
+		if !usedNodes[node] && node != s.ConsulNodeName {
+			nodeDeregs[node] = true
+			groups = append(groups, nodeDeregistrationGroup(node))
 		}
 	}
 
-	// Do all deregistrations first
-	for _, r := range s.deregs {
-		s.Log.Info("deregistering service",
-			"node-name", r.Node,
-			"service-id", r.ServiceID,
-			"service-consul-namespace", r.Namespace)
-		_, err := s.Client.Catalog().Deregister(r, nil)
-		if err != nil {
-			s.Log.Warn("error deregistering service",
-				"node-name", r.Node,
-				"service-id", r.ServiceID,
-				"service-consul-namespace", r.Namespace,
-				"err", err)
+	// Services that were synced but have since been removed are
+	// deregistered along with the scheduled deregistrations.
+	deregs := make(map[string]*deregistration)
+	for _, d := range s.deregs {
+		deregs[d.Node+"/"+registrationKey(d.Namespace, d.ServiceID)] = d
+	}
+	for _, w := range s.written {
+		d := &deregistration{
+			CatalogDeregistration: api.CatalogDeregistration{
+				Node:      w.Node,
+				ServiceID: w.Service.ID,
+				Namespace: w.Service.Namespace,
+			},
+			ServiceName: w.Service.Service,
+		}
+		deregs[d.Node+"/"+registrationKey(d.Namespace, d.ServiceID)] = d
+	}
+	for _, d := range deregs {
+		// Skip services that are still synced, which includes services
+		// synced again since they were scheduled for deregistration.
+		if r := s.namespaces[d.Namespace][d.ServiceID]; r != nil && r.Node == d.Node {
+			continue
+		}
+		// Services on deleted nodes are deleted with the node.
+		if nodeDeregs[d.Node] {
+			continue
 		}
+		groups = append(groups, deregistrationGroup(d))
 	}
 
 	// Always clear deregistrations, they'll repopulate if we had errors
-	s.deregs = make(map[string]*api.CatalogDeregistration)
+	s.deregs = make(map[string]*deregistration)
 
-	// Register all the services. This will overwrite any changes that
-	// may have been made to the registered services.
 	for _, services := range s.namespaces {
 		for _, r := range services {
-			if s.EnableNamespaces {
-				_, err := namespaces.EnsureExists(s.Client, r.Service.Namespace, s.CrossNamespaceACLPolicy)
-				if err != nil {
-					s.Log.Warn("error checking and creating Consul namespace",
-						"node-name", r.Node,
-						"service-name", r.Service.Service,
-						"consul-namespace-name", r.Service.Namespace,
-						"err", err)
-					continue
-				}
+			key := registrationKey(r.Service.Namespace, r.Service.ID)
+			if w, ok := s.written[key]; ok && reflect.DeepEqual(w, r) {
+				continue
 			}
+			groups = append(groups, registrationGroup(r))
+		}
+	}
+	return groups
+}
 
-			// Register the service
-			_, err := s.Client.Catalog().Register(r, nil)
-			if err != nil {
-				s.Log.Warn("error registering service",
-					"node-name", r.Node,
-					"service-name", r.Service.Service,
-					"service", r.Service,
-					"err", err)
-				continue
+// recordPlanLocked records the changes that would be made by the groups
+// and logs them if they differ from the last ones recorded.
+//
+// Precondition: lock must be held
+func (s *ConsulSyncer) recordPlanLocked(groups []txnGroup) {
+	plan := newSyncPlan(groups)
+	if reflect.DeepEqual(plan, s.plan) {
+		return
+	}
+	s.plan = plan
+
+	s.Log.Info("dry run: changes to Consul",
+		"registrations", len(plan.Registrations),
+		"deregistrations", len(plan.Deregistrations),
+		"node-deregistrations", len(plan.NodeDeregistrations))
+	for _, r := range plan.Registrations {
+		s.Log.Info("dry run: would register service instance",
+			"node-name", r.Node,
+			"service-name", r.Service.Service,
+			"service-id", r.Service.ID,
+			"consul-namespace-name", r.Service.Namespace,
+			"address", r.Service.Address,
+			"port", r.Service.Port)
+	}
+	for _, d := range plan.Deregistrations {
+		s.Log.Info("dry run: would deregister service instance",
+			"node-name", d.Node,
+			"service-id", d.ServiceID,
+			"service-consul-namespace", d.Namespace)
+	}
+	for _, node := range plan.NodeDeregistrations {
+		s.Log.Info("dry run: would deregister node", "node-name", node)
+	}
+}
+
+// Plan returns the changes to Consul last recorded when DryRun is set.
+func (s *ConsulSyncer) Plan() *SyncPlan {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.plan == nil {
+		return &SyncPlan{}
+	}
+	return s.plan
+}
+
+// Diff returns the changes that syncing the registrations last passed to
+// Sync would make to Consul, comparing them with a single read of the
+// catalog. It's meant to be used instead of Run and sets DryRun, so nothing
+// is written.
+func (s *ConsulSyncer) Diff(ctx context.Context) (*SyncPlan, error) {
+	s.once.Do(s.init)
+
+	owned, err := s.listOwnedNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	s.DryRun = true
+	s.ownedNodes = owned
+	nodes := append([]string{s.ConsulNodeName}, s.otherNodesLocked()...)
+	s.lock.Unlock()
+
+	opts := (&api.QueryOptions{AllowStale: true}).WithContext(ctx)
+	if s.EnableNamespaces {
+		opts.Namespace = "*"
+	}
+	nodeInstances := make(map[string][]*api.AgentService)
+	for _, node := range nodes {
+		instances, _, err := s.ConsulNodeServicesClient.NodeServiceInstances(s.ConsulK8STag, node, *opts)
+		if err != nil {
+			return nil, err
+		}
+		nodeInstances[node] = instances
+	}
+	checks, _, err := s.Client.Health().Node(s.ConsulNodeName, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) > 1 {
+		stateOpts := *opts
+		stateOpts.NodeMeta = map[string]string{ConsulK8SSyncNode: s.ConsulNodeName}
+		states, _, err := s.Client.Health().State(api.HealthAny, &stateOpts)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, states...)
+	}
+	nodeChecks := s.serviceChecks(checks)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, node := range nodes {
+		s.reconcileNodeLocked(node, nodeInstances[node], nodeChecks[node])
+	}
+	return newSyncPlan(s.planLocked()), nil
+}
+
+// writeBatchLocked writes the groups in a single transaction and records
+// what was written if it succeeds.
+//
+// Precondition: lock must be held
+func (s *ConsulSyncer) writeBatchLocked(batch []txnGroup) {
+	var ops api.TxnOps
+	for _, g := range batch {
+		ops = append(ops, g.ops...)
+	}
+
+	ok, resp, _, err := s.Client.Txn().Txn(ops, nil)
+	if err == nil && !ok {
+		for _, e := range resp.Errors {
+			s.Log.Warn("error in transaction", "op-index", e.OpIndex, "err", e.What)
+		}
+	}
+	if err != nil || !ok {
+		s.Log.Warn("error writing services, will retry",
+			"registrations", countRegistrations(batch),
+			"deregistrations", len(batch)-countRegistrations(batch),
+			"err", err)
+		// The registrations may have failed because their node no longer
+		// exists, so they're registered along with their node next time.
+		for _, g := range batch {
+			if g.reg != nil {
+				delete(s.nodes, g.reg.Node)
 			}
+		}
+		return
+	}
 
+	for _, g := range batch {
+		if g.reg != nil {
+			s.written[registrationKey(g.reg.Service.Namespace, g.reg.Service.ID)] = g.reg
 			s.Log.Debug("registered service instance",
-				"node-name", r.Node,
-				"service-name", r.Service.Service,
-				"consul-namespace-name", r.Service.Namespace,
-				"service", r.Service)
+				"node-name", g.reg.Node,
+				"service-name", g.reg.Service.Service,
+				"consul-namespace-name", g.reg.Service.Namespace,
+				"service", g.reg.Service)
+			continue
+		}
+		if g.nodeDereg != "" {
+			delete(s.nodes, g.nodeDereg)
+			delete(s.ownedNodes, g.nodeDereg)
+			for key, w := range s.written {
+				if w.Node == g.nodeDereg {
+					delete(s.written, key)
+				}
+			}
+			s.Log.Info("deregistered node", "node-name", g.nodeDereg)
+			continue
+		}
+		key := registrationKey(g.dereg.Namespace, g.dereg.ServiceID)
+		if w, ok := s.written[key]; ok && w.Node == g.dereg.Node {
+			delete(s.written, key)
+		}
+		s.Log.Info("deregistered service",
+			"node-name", g.dereg.Node,
+			"service-id", g.dereg.ServiceID,
+			"service-consul-namespace", g.dereg.Namespace)
+	}
+}
+
+// deregistrationGroup returns the transaction operations that deregister
+// the service.
+func deregistrationGroup(d *deregistration) txnGroup {
+	return newTxnGroup(nil, d, api.TxnOps{
+		{
+			Service: &api.ServiceTxnOp{
+				Verb: api.ServiceDelete,
+				Node: d.Node,
+				Service: api.AgentService{
+					ID:        d.ServiceID,
+					Service:   d.ServiceName,
+					Namespace: d.Namespace,
+				},
+			},
+		},
+	})
+}
+
+// nodeDeregistrationGroup returns the transaction operations that delete
+// the node and everything registered on it.
+func nodeDeregistrationGroup(node string) txnGroup {
+	g := newTxnGroup(nil, nil, api.TxnOps{
+		{
+			Node: &api.NodeTxnOp{
+				Verb: api.NodeDelete,
+				Node: api.Node{Node: node},
+			},
+		},
+	})
+	g.nodeDereg = node
+	return g
+}
+
+// registrationGroup returns the transaction operations that register the
+// service and its checks on its existing node, and the node itself unless
+// SkipNodeUpdate is set.
+func registrationGroup(r *api.CatalogRegistration) txnGroup {
+	svc := *r.Service
+	// The catalog API defaults the weights of services registered without
+	// them but the transaction API doesn't.
+	if svc.Weights.Passing == 0 {
+		svc.Weights = api.AgentWeights{Passing: 1, Warning: 1}
+	}
+	var ops api.TxnOps
+	if !r.SkipNodeUpdate {
+		ops = append(ops, &api.TxnOp{
+			Node: &api.NodeTxnOp{
+				Verb: api.NodeSet,
+				Node: api.Node{
+					ID:              r.ID,
+					Node:            r.Node,
+					Address:         r.Address,
+					Datacenter:      r.Datacenter,
+					TaggedAddresses: r.TaggedAddresses,
+					Meta:            r.NodeMeta,
+				},
+			},
+		})
+	}
+	ops = append(ops, &api.TxnOp{
+		Service: &api.ServiceTxnOp{
+			Verb:    api.ServiceSet,
+			Node:    r.Node,
+			Service: svc,
+		},
+	})
+
+	checks := r.Checks
+	if r.Check != nil {
+		checks = append(api.HealthChecks{
+			{
+				Node:        r.Check.Node,
+				CheckID:     r.Check.CheckID,
+				Name:        r.Check.Name,
+				Status:      r.Check.Status,
+				Notes:       r.Check.Notes,
+				Output:      r.Check.Output,
+				ServiceID:   r.Check.ServiceID,
+				ServiceName: r.Check.ServiceName,
+				Type:        r.Check.Type,
+				Definition:  r.Check.Definition,
+				Namespace:   r.Check.Namespace,
+			},
+		}, checks...)
+	}
+	for _, check := range checks {
+		c := *check
+		if c.Node == "" {
+			c.Node = r.Node
+		}
+		ops = append(ops, &api.TxnOp{
+			Check: &api.CheckTxnOp{
+				Verb:  api.CheckSet,
+				Check: c,
+			},
+		})
+	}
+	return newTxnGroup(r, nil, ops)
+}
+
+// deregistration is a service instance to deregister. Unlike the catalog
+// API, the transaction API needs the name of the service.
+type deregistration struct {
+	api.CatalogDeregistration
+	ServiceName string
+}
+
+// SyncPlan is the changes a sync makes to Consul.
+type SyncPlan struct {
+	// Registrations is the service instances to register or update.
+	Registrations []*api.CatalogRegistration
+
+	// Deregistrations is the service instances to deregister.
+	Deregistrations []*api.CatalogDeregistration
+
+	// NodeDeregistrations is the names of the nodes to deregister along
+	// with their service instances.
+	NodeDeregistrations []string
+}
+
+// newSyncPlan returns the plan of the changes made by the groups, sorted
+// by node and service ID.
+func newSyncPlan(groups []txnGroup) *SyncPlan {
+	plan := &SyncPlan{}
+	for _, g := range groups {
+		switch {
+		case g.reg != nil:
+			plan.Registrations = append(plan.Registrations, g.reg)
+		case g.dereg != nil:
+			plan.Deregistrations = append(plan.Deregistrations, &g.dereg.CatalogDeregistration)
+		default:
+			plan.NodeDeregistrations = append(plan.NodeDeregistrations, g.nodeDereg)
+		}
+	}
+	sort.Slice(plan.Registrations, func(i, j int) bool {
+		a, b := plan.Registrations[i], plan.Registrations[j]
+		if a.Node != b.Node {
+			return a.Node < b.Node
+		}
+		return registrationKey(a.Service.Namespace, a.Service.ID) < registrationKey(b.Service.Namespace, b.Service.ID)
+	})
+	sort.Slice(plan.Deregistrations, func(i, j int) bool {
+		a, b := plan.Deregistrations[i], plan.Deregistrations[j]
+		if a.Node != b.Node {
+			return a.Node < b.Node
+		}
+		return registrationKey(a.Namespace, a.ServiceID) < registrationKey(b.Namespace, b.ServiceID)
+	})
+	sort.Strings(plan.NodeDeregistrations)
+	return plan
+}
+
+// txnGroup is the transaction operations that write a single registration
+// or deregistration of a service or node. Groups aren't split across
+// transactions.
+type txnGroup struct {
+	reg       *api.CatalogRegistration
+	dereg     *deregistration
+	nodeDereg string
+	ops       api.TxnOps
+
+	// size is the size in bytes of the encoded operations, including the
+	// separators between them.
+	size int
+}
+
+func newTxnGroup(reg *api.CatalogRegistration, dereg *deregistration, ops api.TxnOps) txnGroup {
+	g := txnGroup{reg: reg, dereg: dereg, ops: ops}
+	for _, op := range ops {
+		// The operations can always be encoded.
+		b, _ := json.Marshal(op)
+		g.size += len(b) + 1
+	}
+	return g
+}
+
+// batchTxnGroups splits the groups into batches with at most maxOps
+// operations whose encoded size is at most maxSize. Groups that exceed the
+// limits on their own are put in a batch of their own.
+func batchTxnGroups(groups []txnGroup, maxOps, maxSize int) [][]txnGroup {
+	var batches [][]txnGroup
+	var batch []txnGroup
+	// The encoded list of operations is wrapped in brackets.
+	ops, size := 0, 2
+	for _, g := range groups {
+		if len(batch) > 0 && (ops+len(g.ops) > maxOps || size+g.size > maxSize) {
+			batches = append(batches, batch)
+			batch, ops, size = nil, 0, 2
+		}
+		batch = append(batch, g)
+		ops += len(g.ops)
+		size += g.size
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func countRegistrations(batch []txnGroup) int {
+	n := 0
+	for _, g := range batch {
+		if g.reg != nil {
+			n++
 		}
 	}
+	return n
+}
+
+// registrationKey returns the key of the service instance in the written
+// map.
+func registrationKey(namespace, id string) string {
+	return namespace + "/" + id
+}
+
+// registrationMatches returns true if the service instance and its check
+// in Consul have the fields of the registration. checks is keyed by the
+// registrationKey of the checks' namespace and check ID.
+func registrationMatches(r *api.CatalogRegistration, got *api.AgentService, checks map[string]*api.HealthCheck) bool {
+	if !serviceMatches(r.Service, got) {
+		return false
+	}
+	return r.Check == nil || checkMatches(r.Check, checks[registrationKey(got.Namespace, r.Check.CheckID)])
+}
+
+// checkMatches returns true if the check in Consul has the fields of the
+// registered check.
+func checkMatches(want *api.AgentCheck, got *api.HealthCheck) bool {
+	return got != nil && want.Name == got.Name && want.Status == got.Status &&
+		want.Output == got.Output && want.Notes == got.Notes
+}
+
+// serviceMatches returns true if the service instance in Consul has the
+// fields of the registered service.
+func serviceMatches(want, got *api.AgentService) bool {
+	if want.Service != got.Service || want.Address != got.Address || want.Port != got.Port {
+		return false
+	}
+	if len(want.Tags) != len(got.Tags) || (len(want.Tags) > 0 && !reflect.DeepEqual(want.Tags, got.Tags)) {
+		return false
+	}
+	return len(want.Meta) == len(got.Meta) && (len(want.Meta) == 0 || reflect.DeepEqual(want.Meta, got.Meta))
 }
 
 func (s *ConsulSyncer) init() {
@@ -458,16 +1157,25 @@ func (s *ConsulSyncer) init() {
 		s.namespaces = make(map[string]map[string]*api.CatalogRegistration)
 	}
 	if s.deregs == nil {
-		s.deregs = make(map[string]*api.CatalogDeregistration)
+		s.deregs = make(map[string]*deregistration)
+	}
+	if s.written == nil {
+		s.written = make(map[string]*api.CatalogRegistration)
 	}
-	if s.watchers == nil {
-		s.watchers = make(map[string]map[string]context.CancelFunc)
+	if s.nodes == nil {
+		s.nodes = make(map[string]bool)
+	}
+	if s.ownedNodes == nil {
+		s.ownedNodes = make(map[string]bool)
 	}
 	if s.SyncPeriod == 0 {
 		s.SyncPeriod = ConsulSyncPeriod
 	}
-	if s.ServicePollPeriod == 0 {
-		s.ServicePollPeriod = ConsulServicePollPeriod
+	if s.TxnMaxOps == 0 {
+		s.TxnMaxOps = ConsulTxnMaxOps
+	}
+	if s.TxnMaxSize == 0 {
+		s.TxnMaxSize = ConsulTxnMaxSize
 	}
 	if s.initialSync == nil {
 		s.initialSync = make(chan bool)
@@ -264,6 +264,610 @@ func TestConsulSyncer_stopsGracefully(t *testing.T) {
 	require.LessOrEqual(t, callCount-beforeStopAPICount, 2)
 }
 
+// Test that the syncer only writes registrations that changed and
+// deregisters services that are no longer synced.
+func TestConsulSyncer_writesChanges(t *testing.T) {
+	t.Parallel()
+
+	a, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer a.Stop()
+	client, err := api.NewClient(&api.Config{
+		Address: a.HTTPAddr,
+	})
+	require.NoError(t, err)
+	s, closer := testConsulSyncerWithConfig(client, func(s *ConsulSyncer) {
+		s.SyncPeriod = 20 * time.Millisecond
+		// Force the registrations to be split across transactions.
+		s.TxnMaxOps = 2
+	})
+	defer closer()
+
+	var regs []*api.CatalogRegistration
+	for i := 0; i < 5; i++ {
+		regs = append(regs, testRegistration(ConsulSyncNodeName, fmt.Sprintf("svc%d", i), "default"))
+	}
+	s.Sync(regs)
+
+	var modifyIndex uint64
+	retry.Run(t, func(r *retry.R) {
+		for _, reg := range regs {
+			instances, _, err := client.Catalog().Service(reg.Service.Service, "", nil)
+			require.NoError(r, err)
+			require.Len(r, instances, 1)
+		}
+		instances, _, err := client.Catalog().Service("svc0", "", nil)
+		require.NoError(r, err)
+		modifyIndex = instances[0].ModifyIndex
+	})
+
+	// Unchanged registrations aren't written again.
+	time.Sleep(100 * time.Millisecond)
+	instances, _, err := client.Catalog().Service("svc0", "", nil)
+	require.NoError(t, err)
+	require.Len(t, instances, 1)
+	require.Equal(t, modifyIndex, instances[0].ModifyIndex)
+
+	// Changed registrations are written and removed registrations are
+	// deregistered.
+	changed := testRegistration(ConsulSyncNodeName, "svc0", "default")
+	changed.Service.Port = 8080
+	s.Sync([]*api.CatalogRegistration{changed})
+	retry.Run(t, func(r *retry.R) {
+		instances, _, err := client.Catalog().Service("svc0", "", nil)
+		require.NoError(r, err)
+		require.Len(r, instances, 1)
+		require.Equal(r, 8080, instances[0].ServicePort)
+		for _, reg := range regs[1:] {
+			instances, _, err := client.Catalog().Service(reg.Service.Service, "", nil)
+			require.NoError(r, err)
+			require.Len(r, instances, 0)
+		}
+	})
+}
+
+// Test that the syncer overwrites changes made to synced services in Consul
+// and registers them again if they're deregistered.
+func TestConsulSyncer_overwritesChanges(t *testing.T) {
+	t.Parallel()
+
+	a, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer a.Stop()
+	client, err := api.NewClient(&api.Config{
+		Address: a.HTTPAddr,
+	})
+	require.NoError(t, err)
+	s, closer := testConsulSyncerWithConfig(client, func(s *ConsulSyncer) {
+		s.SyncPeriod = 20 * time.Millisecond
+	})
+	defer closer()
+
+	s.Sync([]*api.CatalogRegistration{
+		testRegistration(ConsulSyncNodeName, "bar", "default"),
+	})
+	retry.Run(t, func(r *retry.R) {
+		instances, _, err := client.Catalog().Service("bar", "", nil)
+		require.NoError(r, err)
+		require.Len(r, instances, 1)
+	})
+
+	changed := testRegistration(ConsulSyncNodeName, "bar", "default")
+	changed.Service.Port = 8080
+	_, err = client.Catalog().Register(changed, nil)
+	require.NoError(t, err)
+	retry.Run(t, func(r *retry.R) {
+		instances, _, err := client.Catalog().Service("bar", "", nil)
+		require.NoError(r, err)
+		require.Len(r, instances, 1)
+		require.Equal(r, 0, instances[0].ServicePort)
+	})
+
+	_, err = client.Catalog().Deregister(&api.CatalogDeregistration{
+		Node:      ConsulSyncNodeName,
+		ServiceID: serviceID(ConsulSyncNodeName, "bar"),
+	}, nil)
+	require.NoError(t, err)
+	retry.Run(t, func(r *retry.R) {
+		instances, _, err := client.Catalog().Service("bar", "", nil)
+		require.NoError(r, err)
+		require.Len(r, instances, 1)
+	})
+}
+
+// Test that the syncer registers the checks of services and updates them
+// when they change.
+func TestConsulSyncer_registersChecks(t *testing.T) {
+	t.Parallel()
+
+	a, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer a.Stop()
+	client, err := api.NewClient(&api.Config{
+		Address: a.HTTPAddr,
+	})
+	require.NoError(t, err)
+	s, closer := testConsulSyncerWithConfig(client, func(s *ConsulSyncer) {
+		s.SyncPeriod = 20 * time.Millisecond
+	})
+	defer closer()
+
+	withCheck := func(service, status string) *api.CatalogRegistration {
+		r := testRegistration(ConsulSyncNodeName, service, "default")
+		r.Check = &api.AgentCheck{
+			Node:        ConsulSyncNodeName,
+			CheckID:     r.Service.ID + "/check",
+			Name:        "check",
+			Status:      status,
+			ServiceID:   r.Service.ID,
+			ServiceName: service,
+		}
+		return r
+	}
+	requireStatus := func(service, status string) {
+		retry.Run(t, func(r *retry.R) {
+			checks, _, err := client.Health().Checks(service, nil)
+			require.NoError(r, err)
+			require.Len(r, checks, 1)
+			require.Equal(r, status, checks[0].Status)
+		})
+	}
+
+	// The first service is registered along with the node and the second
+	// in a transaction.
+	s.Sync([]*api.CatalogRegistration{withCheck("foo", api.HealthPassing)})
+	requireStatus("foo", api.HealthPassing)
+	s.Sync([]*api.CatalogRegistration{
+		withCheck("foo", api.HealthPassing),
+		withCheck("bar", api.HealthCritical),
+	})
+	requireStatus("bar", api.HealthCritical)
+
+	s.Sync([]*api.CatalogRegistration{
+		withCheck("foo", api.HealthCritical),
+		withCheck("bar", api.HealthPassing),
+	})
+	requireStatus("foo", api.HealthCritical)
+	requireStatus("bar", api.HealthPassing)
+
+	// A check changed in Consul is written again.
+	changed := withCheck("bar", api.HealthCritical)
+	_, err = client.Catalog().Register(changed, nil)
+	require.NoError(t, err)
+	requireStatus("bar", api.HealthPassing)
+}
+
+// Test that services are registered on nodes owned by the syncer, that the
+// owned nodes are kept up to date and that they're deleted once nothing is
+// synced to them, including nodes left by a previous run.
+func TestConsulSyncer_ownedNodes(t *testing.T) {
+	t.Parallel()
+
+	a, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer a.Stop()
+	client, err := api.NewClient(&api.Config{
+		Address: a.HTTPAddr,
+	})
+	require.NoError(t, err)
+
+	ownedNode := func(node, address string) *api.CatalogRegistration {
+		r := testRegistration(node, "foo", "default")
+		r.Address = address
+		r.SkipNodeUpdate = false
+		r.NodeMeta = map[string]string{
+			ConsulSourceKey:   TestConsulK8STag,
+			ConsulK8SSyncNode: ConsulSyncNodeName,
+		}
+		return r
+	}
+
+	// A node left by a previous run
+	_, err = client.Catalog().Register(ownedNode("stale", "10.0.0.9"), nil)
+	require.NoError(t, err)
+
+	s, closer := testConsulSyncerWithConfig(client, func(s *ConsulSyncer) {
+		s.SyncPeriod = 20 * time.Millisecond
+	})
+	defer closer()
+
+	requireNode := func(node, address string) {
+		retry.Run(t, func(r *retry.R) {
+			n, _, err := client.Catalog().Node(node, nil)
+			require.NoError(r, err)
+			if address == "" {
+				require.Nil(r, n)
+				return
+			}
+			require.NotNil(r, n)
+			require.Equal(r, address, n.Node.Address)
+			require.Len(r, n.Services, 1)
+		})
+	}
+
+	// The first service is registered along with its node and the second
+	// in a transaction that updates the node.
+	s.Sync([]*api.CatalogRegistration{ownedNode("a", "10.0.0.1")})
+	requireNode("a", "10.0.0.1")
+	requireNode("stale", "")
+	s.Sync([]*api.CatalogRegistration{
+		ownedNode("a", "10.0.0.2"),
+		testRegistration(ConsulSyncNodeName, "bar", "default"),
+	})
+	requireNode("a", "10.0.0.2")
+
+	// The owned node is deleted along with its service once it's unused,
+	// but the sync node isn't.
+	s.Sync([]*api.CatalogRegistration{testRegistration(ConsulSyncNodeName, "bar", "default")})
+	requireNode("a", "")
+	requireNode(ConsulSyncNodeName, "127.0.0.1")
+}
+
+// Test that only service instances synced from the syncer's cluster are
+// reaped.
+func TestConsulSyncer_reapsOwnClusterOnly(t *testing.T) {
+	t.Parallel()
+
+	a, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer a.Stop()
+	client, err := api.NewClient(&api.Config{
+		Address: a.HTTPAddr,
+	})
+	require.NoError(t, err)
+
+	inCluster := func(service, cluster string) *api.CatalogRegistration {
+		r := testRegistration(ConsulSyncNodeName, service, "default")
+		if cluster != "" {
+			r.Service.Meta[ConsulK8SCluster] = cluster
+		}
+		return r
+	}
+
+	// Register instances of unknown services from this cluster, another
+	// cluster and a syncer without a cluster name.
+	for _, r := range []*api.CatalogRegistration{
+		inCluster("mine", "a"),
+		inCluster("theirs", "b"),
+		inCluster("unnamed", ""),
+	} {
+		_, err = client.Catalog().Register(r, nil)
+		require.NoError(t, err)
+	}
+
+	s, closer := testConsulSyncerWithConfig(client, func(s *ConsulSyncer) {
+		s.SyncPeriod = 20 * time.Millisecond
+		s.ClusterName = "a"
+	})
+	defer closer()
+	s.Sync([]*api.CatalogRegistration{inCluster("foo", "a")})
+
+	retry.Run(t, func(r *retry.R) {
+		services, _, err := client.Catalog().Services(nil)
+		require.NoError(r, err)
+		require.NotContains(r, services, "mine")
+		require.Contains(r, services, "foo")
+		require.Contains(r, services, "theirs")
+		require.Contains(r, services, "unnamed")
+	})
+}
+
+// Test that setting a cluster name on a cluster that synced without one
+// rewrites its synced instances with the cluster name and reaps the others
+// when AdoptUnnamedCluster is set.
+func TestConsulSyncer_adoptsUnnamedCluster(t *testing.T) {
+	t.Parallel()
+
+	a, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer a.Stop()
+	client, err := api.NewClient(&api.Config{
+		Address: a.HTTPAddr,
+	})
+	require.NoError(t, err)
+
+	inCluster := func(service, cluster string) *api.CatalogRegistration {
+		r := testRegistration(ConsulSyncNodeName, service, "default")
+		if cluster != "" {
+			r.Service.Meta[ConsulK8SCluster] = cluster
+		}
+		return r
+	}
+
+	// Register the instances written before the cluster name was set.
+	for _, r := range []*api.CatalogRegistration{
+		inCluster("foo", ""),
+		inCluster("removed", ""),
+		inCluster("theirs", "b"),
+	} {
+		_, err = client.Catalog().Register(r, nil)
+		require.NoError(t, err)
+	}
+
+	s, closer := testConsulSyncerWithConfig(client, func(s *ConsulSyncer) {
+		s.SyncPeriod = 20 * time.Millisecond
+		s.ClusterName = "a"
+		s.AdoptUnnamedCluster = true
+	})
+	defer closer()
+	s.Sync([]*api.CatalogRegistration{inCluster("foo", "a")})
+
+	retry.Run(t, func(r *retry.R) {
+		services, _, err := client.Catalog().Services(nil)
+		require.NoError(r, err)
+		require.NotContains(r, services, "removed")
+		require.Contains(r, services, "theirs")
+		instances, _, err := client.Catalog().Service("foo", "", nil)
+		require.NoError(r, err)
+		require.Len(r, instances, 1)
+		require.Equal(r, "a", instances[0].ServiceMeta[ConsulK8SCluster])
+	})
+}
+
+func TestConsulSyncer_ownsMeta(t *testing.T) {
+	cases := map[string]struct {
+		ClusterName string
+		Adopt       bool
+		Meta        map[string]string
+		Exp         bool
+	}{
+		"unnamed syncer, unnamed instance": {
+			Meta: map[string]string{},
+			Exp:  true,
+		},
+		"unnamed syncer, named instance": {
+			Meta: map[string]string{ConsulK8SCluster: "a"},
+		},
+		"named syncer, own instance": {
+			ClusterName: "a",
+			Meta:        map[string]string{ConsulK8SCluster: "a"},
+			Exp:         true,
+		},
+		"named syncer, other cluster's instance": {
+			ClusterName: "a",
+			Meta:        map[string]string{ConsulK8SCluster: "b"},
+		},
+		"named syncer, unnamed instance": {
+			ClusterName: "a",
+			Meta:        map[string]string{},
+		},
+		"named syncer adopting, unnamed instance": {
+			ClusterName: "a",
+			Adopt:       true,
+			Meta:        map[string]string{},
+			Exp:         true,
+		},
+		"named syncer adopting, other cluster's instance": {
+			ClusterName: "a",
+			Adopt:       true,
+			Meta:        map[string]string{ConsulK8SCluster: "b"},
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := &ConsulSyncer{ClusterName: c.ClusterName, AdoptUnnamedCluster: c.Adopt}
+			require.Equal(t, c.Exp, s.ownsMeta(c.Meta))
+		})
+	}
+}
+
+func TestRegistrationMatches(t *testing.T) {
+	registration := func() *api.CatalogRegistration {
+		r := testRegistration(ConsulSyncNodeName, "foo", "default")
+		r.Check = &api.AgentCheck{
+			CheckID: r.Service.ID + "/check",
+			Name:    "check",
+			Status:  api.HealthPassing,
+			Output:  "ready",
+		}
+		return r
+	}
+	check := func() *api.HealthCheck {
+		return &api.HealthCheck{
+			CheckID: registration().Check.CheckID,
+			Name:    "check",
+			Status:  api.HealthPassing,
+			Output:  "ready",
+		}
+	}
+	cases := map[string]struct {
+		Service func(*api.AgentService)
+		Check   func(*api.HealthCheck)
+		NoCheck bool
+		Exp     bool
+	}{
+		"unchanged": {
+			Exp: true,
+		},
+		"port changed": {
+			Service: func(svc *api.AgentService) { svc.Port = 8080 },
+		},
+		"check status changed": {
+			Check: func(c *api.HealthCheck) { c.Status = api.HealthCritical },
+		},
+		"check output changed": {
+			Check: func(c *api.HealthCheck) { c.Output = "not ready" },
+		},
+		"check notes changed": {
+			Check: func(c *api.HealthCheck) { c.Notes = "notes" },
+		},
+		"check removed": {
+			NoCheck: true,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := registration()
+			svc := *r.Service
+			if c.Service != nil {
+				c.Service(&svc)
+			}
+			checks := map[string]*api.HealthCheck{}
+			if !c.NoCheck {
+				hc := check()
+				if c.Check != nil {
+					c.Check(hc)
+				}
+				checks[registrationKey("", hc.CheckID)] = hc
+			}
+			require.Equal(t, c.Exp, registrationMatches(r, &svc, checks))
+		})
+	}
+}
+
+// Test that a dry run records the changes it would make without writing
+// them to Consul.
+func TestConsulSyncer_dryRun(t *testing.T) {
+	t.Parallel()
+
+	a, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer a.Stop()
+	client, err := api.NewClient(&api.Config{
+		Address: a.HTTPAddr,
+	})
+	require.NoError(t, err)
+
+	// Register an instance of an unknown service that would be reaped.
+	_, err = client.Catalog().Register(testRegistration(ConsulSyncNodeName, "stale", "default"), nil)
+	require.NoError(t, err)
+
+	s, closer := testConsulSyncerWithConfig(client, func(s *ConsulSyncer) {
+		s.SyncPeriod = 20 * time.Millisecond
+		s.DryRun = true
+	})
+	defer closer()
+	s.Sync([]*api.CatalogRegistration{testRegistration(ConsulSyncNodeName, "foo", "default")})
+
+	retry.Run(t, func(r *retry.R) {
+		plan := s.Plan()
+		require.Len(r, plan.Registrations, 1)
+		require.Equal(r, "foo", plan.Registrations[0].Service.Service)
+		require.Len(r, plan.Deregistrations, 1)
+		require.Equal(r, serviceID(ConsulSyncNodeName, "stale"), plan.Deregistrations[0].ServiceID)
+	})
+
+	services, _, err := client.Catalog().Services(nil)
+	require.NoError(t, err)
+	require.NotContains(t, services, "foo")
+	require.Contains(t, services, "stale")
+}
+
+// Test that Diff only returns the instances that differ from the catalog.
+func TestConsulSyncer_diff(t *testing.T) {
+	t.Parallel()
+
+	a, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer a.Stop()
+	client, err := api.NewClient(&api.Config{
+		Address: a.HTTPAddr,
+	})
+	require.NoError(t, err)
+
+	for _, name := range []string{"stale", "synced"} {
+		_, err = client.Catalog().Register(testRegistration(ConsulSyncNodeName, name, "default"), nil)
+		require.NoError(t, err)
+	}
+
+	s := &ConsulSyncer{
+		Client:         client,
+		Log:            hclog.Default(),
+		ConsulK8STag:   TestConsulK8STag,
+		ConsulNodeName: ConsulSyncNodeName,
+		ConsulNodeServicesClient: &PreNamespacesNodeServicesClient{
+			Client: client,
+		},
+	}
+	s.Sync([]*api.CatalogRegistration{
+		testRegistration(ConsulSyncNodeName, "synced", "default"),
+		testRegistration(ConsulSyncNodeName, "foo", "default"),
+	})
+
+	plan, err := s.Diff(context.Background())
+	require.NoError(t, err)
+	require.Len(t, plan.Registrations, 1)
+	require.Equal(t, "foo", plan.Registrations[0].Service.Service)
+	require.Len(t, plan.Deregistrations, 1)
+	require.Equal(t, serviceID(ConsulSyncNodeName, "stale"), plan.Deregistrations[0].ServiceID)
+	require.Empty(t, plan.NodeDeregistrations)
+
+	services, _, err := client.Catalog().Services(nil)
+	require.NoError(t, err)
+	require.NotContains(t, services, "foo")
+	require.Contains(t, services, "stale")
+}
+
+func TestBatchTxnGroups(t *testing.T) {
+	t.Parallel()
+
+	op := &api.TxnOp{Service: &api.ServiceTxnOp{Verb: api.ServiceDelete}}
+	group := func(ops int) txnGroup {
+		var g api.TxnOps
+		for i := 0; i < ops; i++ {
+			g = append(g, op)
+		}
+		return newTxnGroup(nil, &deregistration{}, g)
+	}
+	size := group(1).size
+
+	cases := map[string]struct {
+		Groups []int
+		MaxOps int
+		// MaxSize is the number of operations whose size fits in the
+		// size limit.
+		MaxSize int
+		Exp     [][]int
+	}{
+		"no groups": {
+			MaxOps:  64,
+			MaxSize: 64,
+		},
+		"single batch": {
+			Groups:  []int{1, 2, 3},
+			MaxOps:  64,
+			MaxSize: 64,
+			Exp:     [][]int{{1, 2, 3}},
+		},
+		"ops limit": {
+			Groups:  []int{1, 2, 3, 1},
+			MaxOps:  3,
+			MaxSize: 64,
+			Exp:     [][]int{{1, 2}, {3}, {1}},
+		},
+		"size limit": {
+			Groups:  []int{1, 1, 1},
+			MaxOps:  64,
+			MaxSize: 2,
+			Exp:     [][]int{{1, 1}, {1}},
+		},
+		"group over limit": {
+			Groups:  []int{1, 4, 1},
+			MaxOps:  3,
+			MaxSize: 64,
+			Exp:     [][]int{{1}, {4}, {1}},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			var groups []txnGroup
+			for _, ops := range c.Groups {
+				groups = append(groups, group(ops))
+			}
+			var actual [][]int
+			for _, batch := range batchTxnGroups(groups, c.MaxOps, c.MaxSize*size+2) {
+				var b []int
+				for _, g := range batch {
+					b = append(b, len(g.ops))
+				}
+				actual = append(actual, b)
+			}
+			require.Equal(t, c.Exp, actual)
+		})
+	}
+}
+
 func testRegistration(node, service, k8sSrcNamespace string) *api.CatalogRegistration {
 	return &api.CatalogRegistration{
 		Node:           node,
@@ -290,12 +894,11 @@ func testConsulSyncer(client *api.Client) (*ConsulSyncer, func()) {
 // prior to starting via the configurator method.
 func testConsulSyncerWithConfig(client *api.Client, configurator func(*ConsulSyncer)) (*ConsulSyncer, func()) {
 	s := &ConsulSyncer{
-		Client:            client,
-		Log:               hclog.Default(),
-		SyncPeriod:        200 * time.Millisecond,
-		ServicePollPeriod: 50 * time.Millisecond,
-		ConsulK8STag:      TestConsulK8STag,
-		ConsulNodeName:    ConsulSyncNodeName,
+		Client:         client,
+		Log:            hclog.Default(),
+		SyncPeriod:     200 * time.Millisecond,
+		ConsulK8STag:   TestConsulK8STag,
+		ConsulNodeName: ConsulSyncNodeName,
 		ConsulNodeServicesClient: &PreNamespacesNodeServicesClient{
 			Client: client,
 		},
@@ -100,6 +100,15 @@ func (s *K8SSink) SetServices(svcs map[string]string) {
 	s.trigger() // Any service change probably requires syncing
 }
 
+// HasSynced returns true once the services to create have been set. The
+// sink's writes can't run before that without deleting every service it
+// created.
+func (s *K8SSink) HasSynced() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sourceServices != nil
+}
+
 // Informer implements the controller.Resource interface.
 // It tells Kubernetes that we want to watch for changes to Services.
 func (s *K8SSink) Informer() cache.SharedIndexInformer {
@@ -63,6 +63,19 @@ func TestK8SSink_create(t *testing.T) {
 }
 
 // Test that we lowercase service names.
+// Test that the sink has synced once it's been given services, even if
+// there are none.
+func TestK8SSink_hasSynced(t *testing.T) {
+	t.Parallel()
+	sink := &K8SSink{
+		Client: fake.NewSimpleClientset(),
+		Log:    hclog.Default(),
+	}
+	require.False(t, sink.HasSynced())
+	sink.SetServices(map[string]string{})
+	require.True(t, sink.HasSynced())
+}
+
 func TestK8SSink_createUppercase(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
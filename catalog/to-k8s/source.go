@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/cenkalti/backoff"
+	toconsul "github.com/hashicorp/consul-k8s/catalog/to-consul"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-hclog"
 )
@@ -19,6 +20,13 @@ type Source struct {
 	Prefix       string       // Prefix is a prefix to prepend to services
 	Log          hclog.Logger // Logger
 	ConsulK8STag string       // The tag value for services registered
+
+	// ClusterName is the name of this k8s cluster when several clusters
+	// sync into the same Consul datacenter. Services with the ConsulK8STag
+	// are normally ignored, but if ClusterName is set, services synced from
+	// another named cluster are synced to k8s too. Services synced without
+	// a cluster name are still ignored since they may be from this cluster.
+	ClusterName string
 }
 
 // Run is the long-running runloop for watching Consul services and
@@ -32,10 +40,18 @@ func (s *Source) Run(ctx context.Context) {
 	for {
 		// Get all services with tags.
 		var serviceMap map[string][]string
+		var ownK8SServices map[string][]string
 		var meta *api.QueryMeta
 		err := backoff.Retry(func() error {
 			var err error
 			serviceMap, meta, err = s.Client.Catalog().Services(opts)
+			if err != nil || s.ClusterName == "" {
+				return err
+			}
+			ownK8SServices, _, err = s.Client.Catalog().Services((&api.QueryOptions{
+				AllowStale: true,
+				Filter:     s.ownK8SServicesFilter(),
+			}).WithContext(ctx))
 			return err
 		}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
 
@@ -68,7 +84,7 @@ func (s *Source) Run(ctx context.Context) {
 				}
 			}
 
-			if !k8s {
+			if !k8s || s.fromOtherCluster(name, ownK8SServices) {
 				services[s.Prefix+name] = fmt.Sprintf("%s.service.%s", name, s.Domain)
 			}
 		}
@@ -77,3 +93,23 @@ func (s *Source) Run(ctx context.Context) {
 		s.Sink.SetServices(services)
 	}
 }
+
+// fromOtherCluster returns true if ClusterName is set and the service with
+// the ConsulK8STag isn't in ownK8SServices, i.e. every instance with the tag
+// was synced from another named cluster.
+func (s *Source) fromOtherCluster(name string, ownK8SServices map[string][]string) bool {
+	if s.ClusterName == "" {
+		return false
+	}
+	_, ok := ownK8SServices[name]
+	return !ok
+}
+
+// ownK8SServicesFilter returns the filter that selects the service
+// instances with the ConsulK8STag that weren't synced from another named
+// cluster. Consul versions that don't support filtering the services
+// return all of them, so no services synced from k8s are synced back.
+func (s *Source) ownK8SServicesFilter() string {
+	return fmt.Sprintf("%q in ServiceTags and (%q not in ServiceMeta or ServiceMeta[%q] == %q)",
+		s.ConsulK8STag, toconsul.ConsulK8SCluster, toconsul.ConsulK8SCluster, s.ClusterName)
+}
@@ -146,6 +146,63 @@ func TestSource_ignoreK8S(t *testing.T) {
 	require.Equal(expected, actual)
 }
 
+// Test that services synced from other named clusters are synced to k8s
+// when the cluster name is set.
+func TestSource_otherClusters(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Set up server, client
+	a, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(err)
+	defer a.Stop()
+
+	client, err := api.NewClient(&api.Config{
+		Address: a.HTTPAddr,
+	})
+	require.NoError(err)
+
+	inCluster := func(node, service, cluster string) *api.CatalogRegistration {
+		r := testRegistration(node, service, []string{toconsul.TestConsulK8STag})
+		if cluster != "" {
+			r.Service.Meta = map[string]string{toconsul.ConsulK8SCluster: cluster}
+		}
+		return r
+	}
+	for _, r := range []*api.CatalogRegistration{
+		inCluster("hostA", "svcA", "a"),
+		inCluster("hostA", "svcB", "b"),
+		inCluster("hostA", "svcC", ""),
+		// Services that are also synced from this cluster are ignored.
+		inCluster("hostA", "svcD", "b"),
+		inCluster("hostB", "svcD", "a"),
+	} {
+		_, err = client.Catalog().Register(r, nil)
+		require.NoError(err)
+	}
+
+	_, sink, closer := testSourceWithConfig(client, func(s *Source) {
+		s.ClusterName = "a"
+	})
+	defer closer()
+
+	var actual map[string]string
+	retry.Run(t, func(r *retry.R) {
+		sink.Lock()
+		defer sink.Unlock()
+		actual = sink.Services
+		if len(actual) != 2 {
+			r.Fatal("services not found")
+		}
+	})
+
+	expected := map[string]string{
+		"consul": "consul.service.test",
+		"svcB":   "svcB.service.test",
+	}
+	require.Equal(expected, actual)
+}
+
 // Test that the source deletes services properly.
 func TestSource_deleteService(t *testing.T) {
 	// Unable to be run in parallel with other tests that
@@ -46,6 +46,10 @@ func init() {
 			return &cmdSyncCatalog.Command{UI: ui}, nil
 		},
 
+		"sync-catalog diff": func() (cli.Command, error) {
+			return &cmdSyncCatalog.DiffCommand{UI: ui}, nil
+		},
+
 		"delete-completed-job": func() (cli.Command, error) {
 			return &cmdDeleteCompletedJob.Command{UI: ui}, nil
 		},
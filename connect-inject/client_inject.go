@@ -0,0 +1,319 @@
+package connectinject
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/consul-k8s/namespaces"
+	"github.com/mattbaird/jsonpatch"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// annotationClientInject is the key of the annotation that injects the
+	// pod with the address of the Consul client and, if ACLs are enabled, an
+	// ACL token, rather than with the Connect sidecars. No service is
+	// registered.
+	annotationClientInject = "consul.hashicorp.com/client-inject"
+
+	// annotationClientInjectStatus is set on pods injected with the Consul
+	// client config. Pods with this annotation are not injected again.
+	annotationClientInjectStatus = "consul.hashicorp.com/client-inject-status"
+
+	// ClientInjectInitContainerName is the name of the init container that
+	// writes the CA certificate and ACL token of client-injected pods.
+	ClientInjectInitContainerName = "consul-client-inject-init"
+)
+
+type clientInjectInitCommandData struct {
+	AuthMethod string
+	// AuthMethodNamespace is the Consul namespace the auth method is
+	// defined in, or empty if namespaces are disabled.
+	AuthMethodNamespace string
+	ConsulCACert        string
+}
+
+// isClientInject returns true if the pod is annotated to be injected with
+// the Consul client config only. Like shouldInject, the annotation of pods
+// in namespaces that aren't injected is ignored.
+func (h *Handler) isClientInject(pod *corev1.Pod, namespace string) (bool, error) {
+	if !h.namespaceAllowed(namespace) {
+		return false, nil
+	}
+	raw, ok := pod.Annotations[annotationClientInject]
+	if !ok {
+		return false, nil
+	}
+	return strconv.ParseBool(raw)
+}
+
+// clientInjectPatches returns the patches that inject the pod with the
+// Consul client config: the init container that writes the CA certificate
+// and logs in to the auth method, the environment variables and read-only
+// mount of the shared volume for every container, and if ConsulDNSAddress
+// is set, a DNS config that resolves through Consul. It returns no patches
+// if the pod shouldn't be injected.
+//
+// The token is readable by every container of the pod, whatever user it
+// runs as, since the shared volume is mounted into all of them. It's only
+// logged out when the init container runs again after a pod restart, not
+// when the pod is deleted.
+func (h *Handler) clientInjectPatches(pod *corev1.Pod, k8sNamespace string) ([]jsonpatch.JsonPatchOperation, error) {
+	if pod.Annotations[annotationClientInjectStatus] != "" {
+		return nil, nil
+	}
+	if raw, ok := pod.Annotations[annotationInject]; ok {
+		if inject, _ := strconv.ParseBool(raw); inject {
+			return nil, fmt.Errorf("annotations %s and %s can't both be true", annotationInject, annotationClientInject)
+		}
+	}
+	consulNS, err := h.consulNamespace(k8sNamespace)
+	if err != nil {
+		return nil, fmt.Errorf("determining Consul namespace: %s", err)
+	}
+
+	container, err := h.containerClientInjectInit(pod, consulNS)
+	if err != nil {
+		return nil, err
+	}
+
+	var patches []jsonpatch.JsonPatchOperation
+	patches = append(patches, addVolume(
+		pod.Spec.Volumes,
+		[]corev1.Volume{h.containerVolume()},
+		"/spec/volumes")...)
+
+	// The pod's own init containers can use the client too, since the
+	// injected init container runs first.
+	envVars := h.clientInjectEnvVars(consulNS)
+	for i, c := range pod.Spec.InitContainers {
+		patches = append(patches, addVolumeMount(
+			c.VolumeMounts,
+			[]corev1.VolumeMount{sharedVolumeMount()},
+			fmt.Sprintf("/spec/initContainers/%d/volumeMounts", i))...)
+		patches = append(patches, addEnvVar(
+			c.Env,
+			envVars,
+			fmt.Sprintf("/spec/initContainers/%d/env", i))...)
+	}
+	for i, c := range pod.Spec.Containers {
+		patches = append(patches, addVolumeMount(
+			c.VolumeMounts,
+			[]corev1.VolumeMount{sharedVolumeMount()},
+			fmt.Sprintf("/spec/containers/%d/volumeMounts", i))...)
+		patches = append(patches, addEnvVar(
+			c.Env,
+			envVars,
+			fmt.Sprintf("/spec/containers/%d/env", i))...)
+	}
+	if len(pod.Spec.InitContainers) == 0 {
+		patches = append(patches, addContainer(
+			pod.Spec.InitContainers,
+			[]corev1.Container{container},
+			"/spec/initContainers")...)
+	} else {
+		patches = append(patches, jsonpatch.JsonPatchOperation{
+			Operation: "add",
+			Path:      "/spec/initContainers/0",
+			Value:     container,
+		})
+	}
+
+	if h.usesConsulDNS(pod) {
+		patches = append(patches,
+			jsonpatch.JsonPatchOperation{
+				Operation: "add",
+				Path:      "/spec/dnsPolicy",
+				Value:     corev1.DNSNone,
+			},
+			jsonpatch.JsonPatchOperation{
+				Operation: "add",
+				Path:      "/spec/dnsConfig",
+				Value:     h.consulDNSConfig(k8sNamespace),
+			})
+	}
+
+	patches = append(patches, updateAnnotation(
+		pod.Annotations,
+		map[string]string{
+			annotationClientInjectStatus: injected,
+		})...)
+
+	// Logging in creates the token in the Consul namespace, so it must
+	// exist. This is done last so that Consul is only changed if the pod
+	// is injected.
+	if h.EnableNamespaces && h.AuthMethod != "" {
+		if err := h.ensureNamespace(consulNS, k8sNamespace); err != nil {
+			return nil, fmt.Errorf("checking or creating namespace: %s", err)
+		}
+	}
+	return patches, nil
+}
+
+// containerClientInjectInit returns the init container of client-injected
+// pods.
+func (h *Handler) containerClientInjectInit(pod *corev1.Pod, consulNS string) (corev1.Container, error) {
+	data := clientInjectInitCommandData{
+		AuthMethod:   h.AuthMethod,
+		ConsulCACert: h.ConsulCACert,
+	}
+	volMounts := []corev1.VolumeMount{
+		{
+			Name:      volumeName,
+			MountPath: "/consul/connect-inject",
+		},
+	}
+	if data.AuthMethod != "" {
+		data.AuthMethodNamespace = consulNS
+		if consulNS != "" && h.authMethodInDefaultNamespace() {
+			data.AuthMethodNamespace = namespaces.DefaultNamespace
+		}
+		saTokenVolumeMount, err := findServiceAccountVolumeMount(pod)
+		if err != nil {
+			return corev1.Container{}, err
+		}
+		volMounts = append(volMounts, saTokenVolumeMount)
+	}
+
+	var buf bytes.Buffer
+	tpl := template.Must(template.New("root").Parse(strings.TrimSpace(
+		clientInjectInitCommandTpl)))
+	if err := tpl.Execute(&buf, &data); err != nil {
+		return corev1.Container{}, err
+	}
+
+	return corev1.Container{
+		Name:  ClientInjectInitContainerName,
+		Image: h.ImageConsul,
+		Env: []corev1.EnvVar{
+			{
+				Name: "HOST_IP",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
+				},
+			},
+			{
+				Name: "POD_NAME",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+				},
+			},
+			{
+				Name: "POD_NAMESPACE",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+				},
+			},
+		},
+		Resources:    h.InitContainerResources,
+		VolumeMounts: volMounts,
+		Command:      []string{"/bin/sh", "-ec", buf.String()},
+	}, nil
+}
+
+// clientInjectEnvVars returns the environment variables that point the
+// Consul CLI and API clients at the Consul client on the pod's node.
+func (h *Handler) clientInjectEnvVars(consulNS string) []corev1.EnvVar {
+	envVars := []corev1.EnvVar{
+		{
+			Name: "HOST_IP",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
+			},
+		},
+	}
+	if h.ConsulCACert != "" {
+		envVars = append(envVars,
+			// Kubernetes will interpolate HOST_IP when creating this
+			// environment variable.
+			corev1.EnvVar{
+				Name:  "CONSUL_HTTP_ADDR",
+				Value: "https://$(HOST_IP):8501",
+			},
+			corev1.EnvVar{
+				Name:  "CONSUL_CACERT",
+				Value: "/consul/connect-inject/consul-ca.pem",
+			})
+	} else {
+		envVars = append(envVars, corev1.EnvVar{
+			Name:  "CONSUL_HTTP_ADDR",
+			Value: "$(HOST_IP):8500",
+		})
+	}
+	if h.AuthMethod != "" {
+		envVars = append(envVars, corev1.EnvVar{
+			Name:  "CONSUL_HTTP_TOKEN_FILE",
+			Value: "/consul/connect-inject/acl-token",
+		})
+	}
+	if consulNS != "" {
+		envVars = append(envVars, corev1.EnvVar{
+			Name:  "CONSUL_NAMESPACE",
+			Value: consulNS,
+		})
+	}
+	return envVars
+}
+
+// usesConsulDNS returns true if the pod's DNS config should be replaced
+// with one that resolves through Consul. Pods that configure their own DNS
+// or use the host's network are left alone.
+func (h *Handler) usesConsulDNS(pod *corev1.Pod) bool {
+	if h.ConsulDNSAddress == "" || pod.Spec.HostNetwork || pod.Spec.DNSConfig != nil {
+		return false
+	}
+	return pod.Spec.DNSPolicy == "" || pod.Spec.DNSPolicy == corev1.DNSClusterFirst
+}
+
+// consulDNSConfig returns the DNS config that uses Consul's DNS interface as
+// the nameserver, with the same search domains and options as the
+// ClusterFirst policy. Consul must be configured with recursors that resolve
+// cluster names.
+func (h *Handler) consulDNSConfig(k8sNamespace string) *corev1.PodDNSConfig {
+	ndots := "5"
+	return &corev1.PodDNSConfig{
+		Nameservers: []string{h.ConsulDNSAddress},
+		Searches: []string{
+			fmt.Sprintf("%s.svc.%s", k8sNamespace, h.ClusterDomain),
+			fmt.Sprintf("svc.%s", h.ClusterDomain),
+			h.ClusterDomain,
+		},
+		Options: []corev1.PodDNSConfigOption{
+			{Name: "ndots", Value: &ndots},
+		},
+	}
+}
+
+// clientInjectInitCommandTpl is the template for the command executed by
+// the init container of client-injected pods.
+const clientInjectInitCommandTpl = `
+{{- if .ConsulCACert}}
+export CONSUL_HTTP_ADDR="https://${HOST_IP}:8501"
+export CONSUL_CACERT=/consul/connect-inject/consul-ca.pem
+cat <<EOF >/consul/connect-inject/consul-ca.pem
+{{ .ConsulCACert }}
+EOF
+{{- else}}
+export CONSUL_HTTP_ADDR="${HOST_IP}:8500"
+{{- end}}
+{{- if .AuthMethod }}
+{{- /* The pod was restarted: log out the token of the previous run. */}}
+
+if [ -f /consul/connect-inject/acl-token ]; then
+  /bin/consul logout -token-file="/consul/connect-inject/acl-token" || true
+  rm -f /consul/connect-inject/acl-token
+fi
+/bin/consul login -method="{{ .AuthMethod }}" \
+  -bearer-token-file="/var/run/secrets/kubernetes.io/serviceaccount/token" \
+  -token-sink-file="/consul/connect-inject/acl-token" \
+  {{- if .AuthMethodNamespace }}
+  -namespace="{{ .AuthMethodNamespace }}" \
+  {{- end }}
+  -meta="pod=${POD_NAMESPACE}/${POD_NAME}"
+{{- /* The application containers may not run as root. */}}
+chmod 444 /consul/connect-inject/acl-token
+{{- end }}
+`
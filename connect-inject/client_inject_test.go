@@ -0,0 +1,334 @@
+package connectinject
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/deckarep/golang-set"
+	"github.com/hashicorp/go-hclog"
+	"github.com/mattbaird/jsonpatch"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHandlerHandle_ClientInject(t *testing.T) {
+	basicPod := func(annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: annotations,
+			},
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{
+					{Name: "migrate"},
+				},
+				Containers: []corev1.Container{
+					{Name: "web"},
+				},
+			},
+		}
+	}
+	handler := func() Handler {
+		return Handler{
+			Log:                   hclog.Default().Named("handler"),
+			AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+			DenyK8sNamespacesSet:  mapset.NewSet(),
+		}
+	}
+
+	cases := []struct {
+		Name    string
+		Handler func() Handler
+		Pod     *corev1.Pod
+		Err     string // expected error string, not exact
+		Patches []jsonpatch.JsonPatchOperation
+	}{
+		{
+			"client inject",
+			handler,
+			basicPod(map[string]string{annotationClientInject: "true"}),
+			"",
+			[]jsonpatch.JsonPatchOperation{
+				{
+					Operation: "add",
+					Path:      "/spec/volumes",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers/0/volumeMounts",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers/0/env",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers/0/env/-",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/0/volumeMounts",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/0/env",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/0/env/-",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers/0",
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationClientInjectStatus),
+				},
+			},
+		},
+		{
+			"client inject with Consul DNS",
+			func() Handler {
+				h := handler()
+				h.ConsulDNSAddress = "10.0.0.10"
+				h.ClusterDomain = "cluster.local"
+				return h
+			},
+			basicPod(map[string]string{annotationClientInject: "true"}),
+			"",
+			[]jsonpatch.JsonPatchOperation{
+				{
+					Operation: "add",
+					Path:      "/spec/volumes",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers/0/volumeMounts",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers/0/env",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers/0/env/-",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/0/volumeMounts",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/0/env",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/0/env/-",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers/0",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/dnsPolicy",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/dnsConfig",
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationClientInjectStatus),
+				},
+			},
+		},
+		{
+			"already client injected",
+			handler,
+			basicPod(map[string]string{annotationClientInject: "true", annotationClientInjectStatus: injected}),
+			"",
+			nil,
+		},
+		{
+			"client inject disabled",
+			func() Handler {
+				h := handler()
+				h.RequireAnnotation = true
+				return h
+			},
+			basicPod(map[string]string{annotationClientInject: "false"}),
+			"",
+			nil,
+		},
+		{
+			"client inject and connect inject",
+			handler,
+			basicPod(map[string]string{annotationClientInject: "true", annotationInject: "true"}),
+			"annotations consul.hashicorp.com/connect-inject and consul.hashicorp.com/client-inject can't both be true",
+			nil,
+		},
+		{
+			"invalid client inject annotation",
+			handler,
+			basicPod(map[string]string{annotationClientInject: "not-a-bool"}),
+			"Error parsing client-inject annotation",
+			nil,
+		},
+		{
+			"invalid client inject annotation in denied namespace",
+			func() Handler {
+				h := handler()
+				h.DenyK8sNamespacesSet = mapset.NewSetWith("default")
+				return h
+			},
+			basicPod(map[string]string{annotationClientInject: "not-a-bool"}),
+			"",
+			nil,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+			h := tt.Handler()
+			resp := h.Mutate(&v1beta1.AdmissionRequest{
+				Namespace: "default",
+				Object:    encodeRaw(t, tt.Pod),
+			})
+			if (tt.Err == "") != resp.Allowed {
+				t.Fatalf("allowed: %v, expected err: %v", resp.Allowed, tt.Err)
+			}
+			if tt.Err != "" {
+				require.Contains(resp.Result.Message, tt.Err)
+				return
+			}
+
+			var actual []jsonpatch.JsonPatchOperation
+			if len(resp.Patch) > 0 {
+				require.NoError(json.Unmarshal(resp.Patch, &actual))
+				for i := range actual {
+					actual[i].Value = nil
+				}
+			}
+			require.Equal(tt.Patches, actual)
+		})
+	}
+}
+
+// Test that the shared volume holding the ACL token is mounted read-only
+// into the pod's containers and that no container is added.
+func TestHandlerHandle_ClientInjectACLs(t *testing.T) {
+	require := require.New(t)
+	saMount := corev1.VolumeMount{
+		Name:      "default-token-podid",
+		MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{annotationClientInject: "true"},
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{Name: "migrate"},
+			},
+			Containers: []corev1.Container{
+				{Name: "web", VolumeMounts: []corev1.VolumeMount{saMount}},
+				{Name: "worker"},
+			},
+		},
+	}
+	h := Handler{
+		Log:                   hclog.Default().Named("handler"),
+		AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+		DenyK8sNamespacesSet:  mapset.NewSet(),
+		AuthMethod:            "auth-method",
+	}
+	resp := h.Mutate(&v1beta1.AdmissionRequest{
+		Namespace: "default",
+		Object:    encodeRaw(t, pod),
+	})
+	require.True(resp.Allowed)
+
+	var patches []jsonpatch.JsonPatchOperation
+	require.NoError(json.Unmarshal(resp.Patch, &patches))
+	mountPaths := make(map[string]bool)
+	for _, patch := range patches {
+		raw, err := json.Marshal(patch.Value)
+		require.NoError(err)
+		switch {
+		case strings.HasSuffix(patch.Path, "/volumeMounts"):
+			var mounts []corev1.VolumeMount
+			require.NoError(json.Unmarshal(raw, &mounts))
+			require.Equal([]corev1.VolumeMount{sharedVolumeMount()}, mounts)
+			mountPaths[patch.Path] = true
+		case strings.HasSuffix(patch.Path, "/volumeMounts/-"):
+			var mount corev1.VolumeMount
+			require.NoError(json.Unmarshal(raw, &mount))
+			require.Equal(sharedVolumeMount(), mount)
+			mountPaths[strings.TrimSuffix(patch.Path, "/-")] = true
+		}
+		require.NotEqual("/spec/containers/-", patch.Path)
+	}
+	require.True(sharedVolumeMount().ReadOnly)
+	require.Equal(map[string]bool{
+		"/spec/initContainers/0/volumeMounts": true,
+		"/spec/containers/0/volumeMounts":     true,
+		"/spec/containers/1/volumeMounts":     true,
+	}, mountPaths)
+}
+
+func TestHandlerContainerClientInjectInit(t *testing.T) {
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      "default-token-podid",
+							MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+						},
+					},
+				},
+			},
+		},
+	}
+	h := Handler{
+		AuthMethod:           "auth-method",
+		ConsulCACert:         "ca-cert",
+		EnableNamespaces:     true,
+		EnableK8SNSMirroring: true,
+	}
+	container, err := h.containerClientInjectInit(pod, "k8s-default")
+	require.NoError(t, err)
+	require.Equal(t, ClientInjectInitContainerName, container.Name)
+	require.Len(t, container.VolumeMounts, 2)
+	require.Equal(t, `
+export CONSUL_HTTP_ADDR="https://${HOST_IP}:8501"
+export CONSUL_CACERT=/consul/connect-inject/consul-ca.pem
+cat <<EOF >/consul/connect-inject/consul-ca.pem
+ca-cert
+EOF
+
+if [ -f /consul/connect-inject/acl-token ]; then
+  /bin/consul logout -token-file="/consul/connect-inject/acl-token" || true
+  rm -f /consul/connect-inject/acl-token
+fi
+/bin/consul login -method="auth-method" \
+  -bearer-token-file="/var/run/secrets/kubernetes.io/serviceaccount/token" \
+  -token-sink-file="/consul/connect-inject/acl-token" \
+  -namespace="default" \
+  -meta="pod=${POD_NAMESPACE}/${POD_NAME}"
+chmod 444 /consul/connect-inject/acl-token`, container.Command[2])
+
+	envVars := h.clientInjectEnvVars("k8s-default")
+	var names []string
+	for _, e := range envVars {
+		names = append(names, e.Name)
+	}
+	require.Equal(t, []string{"HOST_IP", "CONSUL_HTTP_ADDR", "CONSUL_CACERT", "CONSUL_HTTP_TOKEN_FILE", "CONSUL_NAMESPACE"}, names)
+}
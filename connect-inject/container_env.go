@@ -3,35 +3,78 @@ package connectinject
 import (
 	"fmt"
 	"strconv"
-	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
+// containerEnvVars returns the environment variables with the address of
+// each upstream, named after envVarPrefix and, where it differs, the
+// deprecated legacyEnvVarPrefix.
 func (h *Handler) containerEnvVars(pod *corev1.Pod) []corev1.EnvVar {
-	raw, ok := pod.Annotations[annotationUpstreams]
-	if !ok || raw == "" {
+	ups := upstreams(pod, h.EnableNamespaces)
+	if len(ups) == 0 {
 		return []corev1.EnvVar{}
 	}
 
 	var result []corev1.EnvVar
-	for _, raw := range strings.Split(raw, ",") {
-		parts := strings.SplitN(raw, ":", 3)
-		port, _ := portValue(pod, strings.TrimSpace(parts[1]))
-		if port > 0 {
-			name := strings.TrimSpace(parts[0])
-			name = strings.ToUpper(strings.Replace(name, "-", "_", -1))
-			portStr := strconv.Itoa(int(port))
-
-			result = append(result, corev1.EnvVar{
-				Name:  fmt.Sprintf("%s_CONNECT_SERVICE_HOST", name),
-				Value: "127.0.0.1",
-			}, corev1.EnvVar{
-				Name:  fmt.Sprintf("%s_CONNECT_SERVICE_PORT", name),
-				Value: portStr,
-			})
-		}
+	for _, u := range ups {
+		result = append(result, upstreamEnvVars(u.envVarPrefix(), u.LocalPort)...)
 	}
 
+	// The deprecated names are kept so that existing applications keep
+	// working, unless they aren't valid environment variable names in which
+	// case the pod couldn't have been created before either.
+	for _, u := range ups {
+		legacy := u.legacyEnvVarPrefix()
+		if legacy == "" || legacy == u.envVarPrefix() || len(validation.IsEnvVarName(legacy+"_CONNECT_SERVICE_HOST")) > 0 {
+			continue
+		}
+		result = append(result, upstreamEnvVars(legacy, u.LocalPort)...)
+	}
 	return result
 }
+
+// upstreamEnvVars returns the environment variables with the address of an
+// upstream listening on port, named with the given prefix.
+func upstreamEnvVars(prefix string, port int32) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{
+			Name:  fmt.Sprintf("%s_CONNECT_SERVICE_HOST", prefix),
+			Value: "127.0.0.1",
+		},
+		{
+			Name:  fmt.Sprintf("%s_CONNECT_SERVICE_PORT", prefix),
+			Value: strconv.Itoa(int(port)),
+		},
+	}
+}
+
+// upstreamsFileEnvVar returns the environment variable pointing
+// applications at the upstreams file written by the lifecycle sidecar.
+func upstreamsFileEnvVar() corev1.EnvVar {
+	return corev1.EnvVar{
+		Name:  "CONSUL_UPSTREAMS_FILE",
+		Value: upstreamsFile,
+	}
+}
+
+// connectNativeEnvVars returns the environment variables pointing
+// Connect-native applications at the certificates written to the shared
+// volume by the lifecycle sidecar.
+func connectNativeEnvVars() []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{
+			Name:  "CONSUL_CONNECT_LEAF_CERT_FILE",
+			Value: "/consul/connect-inject/leaf-cert.pem",
+		},
+		{
+			Name:  "CONSUL_CONNECT_LEAF_KEY_FILE",
+			Value: "/consul/connect-inject/leaf-key.pem",
+		},
+		{
+			Name:  "CONSUL_CONNECT_ROOT_CERTS_FILE",
+			Value: "/consul/connect-inject/root-certs.pem",
+		},
+	}
+}
@@ -50,3 +50,68 @@ func TestContainerEnvVars(t *testing.T) {
 		})
 	}
 }
+
+func TestContainerEnvVars_names(t *testing.T) {
+	cases := map[string]struct {
+		upstreams         string
+		namespacesEnabled bool
+		expPrefixes       []string
+		expLegacyPrefixes []string
+	}{
+		"service": {
+			upstreams:   "static-server:1234",
+			expPrefixes: []string{"STATIC_SERVER"},
+		},
+		"prepared query": {
+			upstreams:   "prepared_query:my-query:1234",
+			expPrefixes: []string{"MY_QUERY"},
+		},
+		"prepared queries": {
+			upstreams:   "prepared_query:q1:1234,prepared_query:q2:1235",
+			expPrefixes: []string{"Q1", "Q2"},
+		},
+		"namespaced services": {
+			upstreams:         "db.ns1:1234,db.ns2:1235",
+			namespacesEnabled: true,
+			expPrefixes:       []string{"DB_NS1", "DB_NS2"},
+			expLegacyPrefixes: []string{"DB.NS1", "DB.NS2"},
+		},
+		"dots without namespaces": {
+			upstreams:         "db.v1:1234",
+			expPrefixes:       []string{"DB_V1"},
+			expLegacyPrefixes: []string{"DB.V1"},
+		},
+		// The legacy name isn't a valid environment variable name.
+		"leading digit": {
+			upstreams:   "3scale:1234",
+			expPrefixes: []string{"_3SCALE"},
+		},
+		"invalid port": {
+			upstreams: "db:not-a-port",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			h := Handler{EnableNamespaces: c.namespacesEnabled}
+			envVars := h.containerEnvVars(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService:   "foo",
+						annotationUpstreams: c.upstreams,
+					},
+				},
+			})
+
+			var names []string
+			for _, env := range envVars {
+				names = append(names, env.Name)
+			}
+			var expNames []string
+			for _, prefix := range append(c.expPrefixes, c.expLegacyPrefixes...) {
+				expNames = append(expNames, prefix+"_CONNECT_SERVICE_HOST", prefix+"_CONNECT_SERVICE_PORT")
+			}
+			require.Equal(t, expNames, names)
+		})
+	}
+}
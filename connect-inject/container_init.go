@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 )
@@ -32,11 +34,54 @@ type initContainerCommandData struct {
 	Tags                      string
 	Meta                      map[string]string
 
+	// ConnectNative controls whether the service is registered as a
+	// Connect-native service, in which case no proxy service is registered
+	// and no Envoy bootstrap config is generated.
+	ConnectNative bool
+
+	// GatewayKind is the kind of gateway to register the pod as, e.g.
+	// "mesh-gateway", or empty if the pod is a service. Gateways don't have
+	// a proxy service since Envoy is the gateway.
+	GatewayKind string
+	// EnvoyGateway is the value of the -gateway flag of
+	// `consul connect envoy`, e.g. "mesh".
+	EnvoyGateway string
+	// GatewayWANAddressFromFile is true if the gateway's WAN address is read
+	// from the file written by the gateway address init container. If false,
+	// the pod IP is used.
+	GatewayWANAddressFromFile bool
+	GatewayWANAddressFile     string
+	GatewayWANPort            int32
+
+	// EnableTagOverride and Weights are set on both the service and proxy
+	// registrations. Weights is nil if the weights are not customized.
+	EnableTagOverride bool
+	Weights           *initContainerCommandWeightsData
+
+	// CheckInterval, CheckTimeout and DeregisterCriticalServiceAfter
+	// configure the proxy's public listener check, or the gateway's
+	// listener check. CheckTimeout is optional.
+	CheckInterval                  string
+	CheckTimeout                   string
+	DeregisterCriticalServiceAfter string
+
+	// ProxyConfig is the proxy's config, with the values already quoted
+	// as HCL strings.
+	ProxyConfig map[string]string
+	// EnvoyAdminBind is passed to `consul connect envoy` as -admin-bind
+	// if set.
+	EnvoyAdminBind string
+
 	// The PEM-encoded CA certificate to use when
 	// communicating with Consul clients
 	ConsulCACert string
 }
 
+type initContainerCommandWeightsData struct {
+	Passing int
+	Warning int
+}
+
 type initContainerCommandUpstreamData struct {
 	Name                    string
 	LocalPort               int32
@@ -59,14 +104,19 @@ func (h *Handler) containerInit(pod *corev1.Pod, k8sNamespace string) (corev1.Co
 	// write the config if a protocol is explicitly set.
 	writeServiceDefaults := h.WriteServiceDefaults && protocol != ""
 
+	consulNS, err := h.consulNamespace(k8sNamespace)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
 	data := initContainerCommandData{
 		ServiceName:               pod.Annotations[annotationService],
 		ProxyServiceName:          fmt.Sprintf("%s-sidecar-proxy", pod.Annotations[annotationService]),
 		ServiceProtocol:           protocol,
-		AuthMethod:                h.AuthMethod,
+		AuthMethod:                h.authMethod(pod),
 		WriteServiceDefaults:      writeServiceDefaults,
-		ConsulNamespace:           h.consulNamespace(k8sNamespace),
-		NamespaceMirroringEnabled: h.EnableK8SNSMirroring,
+		ConsulNamespace:           consulNS,
+		NamespaceMirroringEnabled: h.authMethodInDefaultNamespace(),
 		ConsulCACert:              h.ConsulCACert,
 	}
 	if data.ServiceName == "" {
@@ -75,9 +125,41 @@ func (h *Handler) containerInit(pod *corev1.Pod, k8sNamespace string) (corev1.Co
 		panic("No service found. This should be impossible since we default it.")
 	}
 
+	connectNative, err := isConnectNative(pod)
+	if err != nil {
+		return corev1.Container{}, fmt.Errorf("parsing annotation %s: %s", annotationConnectNative, err)
+	}
+	data.ConnectNative = connectNative
+
+	kind, err := gatewayKind(pod)
+	if err != nil {
+		return corev1.Container{}, fmt.Errorf("parsing annotation %s: %s", annotationGatewayKind, err)
+	}
+	data.GatewayKind = kind
+	data.EnvoyGateway = strings.TrimSuffix(kind, "-gateway")
+	if kind != "" {
+		// Service defaults don't apply to gateways.
+		data.WriteServiceDefaults = false
+	}
+
+	if err := parseRegistrationAnnotations(pod, &data); err != nil {
+		return corev1.Container{}, err
+	}
+
+	data.ProxyConfig, err = envoyProxyConfig(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+	data.EnvoyAdminBind, err = envoyAdminBind(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
 	// When ACLs are enabled, the ACL token returned from `consul login` is only
 	// valid for a service with the same name as the ServiceAccountName.
-	if data.AuthMethod != "" && data.ServiceName != pod.Spec.ServiceAccountName {
+	// Gateways logging in to the gateway auth method get their permissions
+	// from its binding rules instead.
+	if data.AuthMethod != "" && data.AuthMethod == h.AuthMethod && data.ServiceName != pod.Spec.ServiceAccountName {
 		return corev1.Container{}, fmt.Errorf("serviceAccountName %q does not match service name %q", pod.Spec.ServiceAccountName, data.ServiceName)
 	}
 
@@ -89,6 +171,22 @@ func (h *Handler) containerInit(pod *corev1.Pod, k8sNamespace string) (corev1.Co
 		}
 	}
 
+	if kind != "" {
+		if data.ServicePort == 0 {
+			return corev1.Container{}, fmt.Errorf("%s must be set to the port the gateway listens on", annotationPort)
+		}
+		_, data.GatewayWANAddressFromFile = pod.Annotations[annotationGatewayWANAddressService]
+		data.GatewayWANAddressFile = gatewayWANAddressFile
+		data.GatewayWANPort = data.ServicePort
+		if raw, ok := pod.Annotations[annotationGatewayWANPort]; ok {
+			port, err := strconv.ParseInt(raw, 10, 32)
+			if err != nil {
+				return corev1.Container{}, fmt.Errorf("parsing annotation %s: %s", annotationGatewayWANPort, err)
+			}
+			data.GatewayWANPort = int32(port)
+		}
+	}
+
 	var tags []string
 	if raw, ok := pod.Annotations[annotationTags]; ok && raw != "" {
 		tags = strings.Split(raw, ",")
@@ -98,6 +196,13 @@ func (h *Handler) containerInit(pod *corev1.Pod, k8sNamespace string) (corev1.Co
 		tags = append(tags, strings.Split(raw, ",")...)
 	}
 
+	tags = append(tags, h.podLabelTags(pod)...)
+
+	ordinal, statefulSetIdentity := h.statefulSetIdentity(pod)
+	if statefulSetIdentity {
+		tags = append(tags, StatefulSetServiceName(data.ServiceName, ordinal))
+	}
+
 	if len(tags) > 0 {
 		// Create json array from the annotations since we're going to output
 		// this in an HCL config file and HCL arrays are json formatted.
@@ -109,63 +214,24 @@ func (h *Handler) containerInit(pod *corev1.Pod, k8sNamespace string) (corev1.Co
 		}
 	}
 
+	// Start with the meta taken from the pod's labels and information so
+	// that it can be overridden by annotations.
+	data.Meta = h.podMeta(pod)
+
 	// If there is metadata specified split into a map and create.
-	data.Meta = make(map[string]string)
 	for k, v := range pod.Annotations {
 		if strings.HasPrefix(k, annotationMeta) && strings.TrimPrefix(k, annotationMeta) != "" {
 			data.Meta[strings.TrimPrefix(k, annotationMeta)] = v
 		}
 	}
-
-	// If upstreams are specified, configure those
-	if raw, ok := pod.Annotations[annotationUpstreams]; ok && raw != "" {
-		for _, raw := range strings.Split(raw, ",") {
-			parts := strings.SplitN(raw, ":", 3)
-
-			var datacenter, service_name, prepared_query, namespace string
-			var port int32
-			if strings.TrimSpace(parts[0]) == "prepared_query" {
-				port, _ = portValue(pod, strings.TrimSpace(parts[2]))
-				prepared_query = strings.TrimSpace(parts[1])
-			} else {
-				port, _ = portValue(pod, strings.TrimSpace(parts[1]))
-
-				// Parse the namespace if provided
-				if data.ConsulNamespace != "" {
-					pieces := strings.SplitN(parts[0], ".", 2)
-					service_name = pieces[0]
-
-					if len(pieces) > 1 {
-						namespace = pieces[1]
-					}
-				} else {
-					service_name = strings.TrimSpace(parts[0])
-				}
-
-				// parse the optional datacenter
-				if len(parts) > 2 {
-					datacenter = strings.TrimSpace(parts[2])
-				}
-			}
-
-			if port > 0 {
-				upstream := initContainerCommandUpstreamData{
-					Name:       service_name,
-					LocalPort:  port,
-					Datacenter: datacenter,
-					Query:      prepared_query,
-				}
-
-				// Add namespace to upstream
-				if namespace != "" {
-					upstream.ConsulUpstreamNamespace = namespace
-				}
-
-				data.Upstreams = append(data.Upstreams, upstream)
-			}
-		}
+	// The ordinal can't be overridden since the service-resolver subsets
+	// filter on it.
+	if statefulSetIdentity {
+		data.Meta[MetaKeyStatefulSetOrdinal] = ordinal
 	}
 
+	data.Upstreams = upstreams(pod, data.ConsulNamespace != "")
+
 	// Create expected volume mounts
 	volMounts := []corev1.VolumeMount{
 		corev1.VolumeMount{
@@ -174,7 +240,7 @@ func (h *Handler) containerInit(pod *corev1.Pod, k8sNamespace string) (corev1.Co
 		},
 	}
 
-	if h.AuthMethod != "" {
+	if data.AuthMethod != "" {
 		// Extract the service account token's volume mount
 		saTokenVolumeMount, err := findServiceAccountVolumeMount(pod)
 		if err != nil {
@@ -189,54 +255,128 @@ func (h *Handler) containerInit(pod *corev1.Pod, k8sNamespace string) (corev1.Co
 	var buf bytes.Buffer
 	tpl := template.Must(template.New("root").Parse(strings.TrimSpace(
 		initContainerCommandTpl)))
-	err := tpl.Execute(&buf, &data)
+	err = tpl.Execute(&buf, &data)
 	if err != nil {
 		return corev1.Container{}, err
 	}
 
-	return corev1.Container{
-		Name:  InjectInitContainerName,
-		Image: h.ImageConsul,
-		Env: []corev1.EnvVar{
-			{
-				Name: "HOST_IP",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
-				},
-			},
-			{
-				Name: "POD_IP",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"},
-				},
+	envVars := []corev1.EnvVar{
+		{
+			Name: "HOST_IP",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
 			},
-			{
-				Name: "POD_NAME",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
-				},
-			},
-			{
-				Name: "POD_NAMESPACE",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
-				},
+		},
+		{
+			Name: "POD_IP",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"},
 			},
-			{
-				Name:  "SERVICE_ID",
-				Value: fmt.Sprintf("$(POD_NAME)-%s", data.ServiceName),
+		},
+		{
+			Name: "POD_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
 			},
-			{
-				Name:  "PROXY_SERVICE_ID",
-				Value: fmt.Sprintf("$(POD_NAME)-%s", data.ProxyServiceName),
+		},
+		{
+			Name: "POD_NAMESPACE",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
 			},
 		},
+		{
+			Name:  "SERVICE_ID",
+			Value: fmt.Sprintf("$(POD_NAME)-%s", data.ServiceName),
+		},
+		{
+			Name:  "PROXY_SERVICE_ID",
+			Value: fmt.Sprintf("$(POD_NAME)-%s", data.ProxyServiceName),
+		},
+	}
+	if h.podInfoEnabled(PodInfoNodeName) {
+		// The pod is only scheduled onto a node after it's been admitted
+		// so the node name can only be read from the downward API.
+		envVars = append(envVars, corev1.EnvVar{
+			Name: "NODE_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"},
+			},
+		})
+	}
+
+	return corev1.Container{
+		Name:         InjectInitContainerName,
+		Image:        h.ImageConsul,
+		Env:          envVars,
 		Resources:    h.InitContainerResources,
 		VolumeMounts: volMounts,
 		Command:      []string{"/bin/sh", "-ec", buf.String()},
 	}, nil
 }
 
+// parseRegistrationAnnotations sets the service weights, tag override and
+// check options in data from the pod's annotations, or to their defaults if
+// not set. data.GatewayKind must already be set since gateways are
+// deregistered later than proxies by default.
+func parseRegistrationAnnotations(pod *corev1.Pod, data *initContainerCommandData) error {
+	if raw, ok := pod.Annotations[annotationServiceEnableTagOverride]; ok {
+		enable, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("parsing annotation %s: %s", annotationServiceEnableTagOverride, err)
+		}
+		data.EnableTagOverride = enable
+	}
+
+	// Consul defaults both weights to 1 so we do the same if only one of
+	// them is set.
+	rawPassing, passingOK := pod.Annotations[annotationServiceWeightsPassing]
+	rawWarning, warningOK := pod.Annotations[annotationServiceWeightsWarning]
+	if passingOK || warningOK {
+		weights := initContainerCommandWeightsData{Passing: 1, Warning: 1}
+		if passingOK {
+			passing, err := strconv.Atoi(rawPassing)
+			if err != nil || passing < 1 {
+				return fmt.Errorf("annotation %s %q must be an integer greater than 0", annotationServiceWeightsPassing, rawPassing)
+			}
+			weights.Passing = passing
+		}
+		if warningOK {
+			warning, err := strconv.Atoi(rawWarning)
+			if err != nil || warning < 0 {
+				return fmt.Errorf("annotation %s %q must be an integer greater than or equal to 0", annotationServiceWeightsWarning, rawWarning)
+			}
+			weights.Warning = warning
+		}
+		data.Weights = &weights
+	}
+
+	data.CheckInterval = "10s"
+	data.DeregisterCriticalServiceAfter = "10m"
+	if data.GatewayKind != "" {
+		data.DeregisterCriticalServiceAfter = "6h"
+	}
+	durations := []struct {
+		annotation string
+		value      *string
+	}{
+		{annotationProxyCheckInterval, &data.CheckInterval},
+		{annotationProxyCheckTimeout, &data.CheckTimeout},
+		{annotationDeregisterCriticalServiceAfter, &data.DeregisterCriticalServiceAfter},
+	}
+	for _, d := range durations {
+		raw, ok := pod.Annotations[d.annotation]
+		if !ok {
+			continue
+		}
+		if duration, err := time.ParseDuration(raw); err != nil || duration <= 0 {
+			return fmt.Errorf("annotation %s %q must be a duration greater than 0, e.g. \"10s\"", d.annotation, raw)
+		}
+		*d.value = raw
+	}
+	return nil
+}
+
 // initContainerCommandTpl is the template for the command executed by
 // the init container.
 // Note: the order of the services in the service.hcl file is important,
@@ -261,6 +401,9 @@ cat <<EOF >/consul/connect-inject/service.hcl
 services {
   id   = "${SERVICE_ID}"
   name = "{{ .ServiceName }}"
+  {{- if .GatewayKind }}
+  kind = "{{ .GatewayKind }}"
+  {{- end }}
   address = "${POD_IP}"
   port = {{ .ServicePort }}
   {{- if .ConsulNamespace }}
@@ -269,6 +412,15 @@ services {
   {{- if .Tags}}
   tags = {{.Tags}}
   {{- end}}
+  {{- if .EnableTagOverride }}
+  enable_tag_override = true
+  {{- end }}
+  {{- with .Weights }}
+  weights {
+    passing = {{ .Passing }}
+    warning = {{ .Warning }}
+  }
+  {{- end }}
   meta = {
     {{- if .Meta}}
     {{- range $key, $value := .Meta }}
@@ -277,7 +429,52 @@ services {
     {{- end }}
     pod-name = "${POD_NAME}"
   }
+  {{- if .ConnectNative }}
+  connect {
+    native = true
+  }
+  {{- end }}
+  {{- if .GatewayKind }}
+  tagged_addresses {
+    lan {
+      address = "${POD_IP}"
+      port = {{ .ServicePort }}
+    }
+    {{- if ne .GatewayKind "terminating-gateway" }}
+    wan {
+      {{- if .GatewayWANAddressFromFile }}
+      address = "$(cat {{ .GatewayWANAddressFile }})"
+      {{- else }}
+      address = "${POD_IP}"
+      {{- end }}
+      port = {{ .GatewayWANPort }}
+    }
+    {{- end }}
+  }
+
+  {{- if .ProxyConfig }}
+
+  proxy {
+    config = {
+      {{- range $key, $value := .ProxyConfig }}
+      {{ $key }} = {{ $value }}
+      {{- end }}
+    }
+  }
+  {{- end }}
+
+  checks {
+    name = "Gateway Listener"
+    tcp = "${POD_IP}:{{ .ServicePort }}"
+    interval = "{{ .CheckInterval }}"
+    {{- if .CheckTimeout }}
+    timeout = "{{ .CheckTimeout }}"
+    {{- end }}
+    deregister_critical_service_after = "{{ .DeregisterCriticalServiceAfter }}"
+  }
+  {{- end }}
 }
+{{- if not (or .ConnectNative .GatewayKind) }}
 
 services {
   id   = "${PROXY_SERVICE_ID}"
@@ -291,6 +488,15 @@ services {
   {{- if .Tags}}
   tags = {{.Tags}}
   {{- end}}
+  {{- if .EnableTagOverride }}
+  enable_tag_override = true
+  {{- end }}
+  {{- with .Weights }}
+  weights {
+    passing = {{ .Passing }}
+    warning = {{ .Warning }}
+  }
+  {{- end }}
   meta = {
     {{- if .Meta}}
     {{- range $key, $value := .Meta }}
@@ -307,6 +513,13 @@ services {
     local_service_address = "127.0.0.1"
     local_service_port = {{ .ServicePort }}
     {{- end }}
+    {{- if .ProxyConfig }}
+    config = {
+      {{- range $key, $value := .ProxyConfig }}
+      {{ $key }} = {{ $value }}
+      {{- end }}
+    }
+    {{- end }}
     {{- range .Upstreams }}
     upstreams {
       {{- if .Name }}
@@ -331,8 +544,11 @@ services {
   checks {
     name = "Proxy Public Listener"
     tcp = "${POD_IP}:20000"
-    interval = "10s"
-    deregister_critical_service_after = "10m"
+    interval = "{{ .CheckInterval }}"
+    {{- if .CheckTimeout }}
+    timeout = "{{ .CheckTimeout }}"
+    {{- end }}
+    deregister_critical_service_after = "{{ .DeregisterCriticalServiceAfter }}"
   }
 
   checks {
@@ -340,6 +556,7 @@ services {
     alias_service = "${SERVICE_ID}"
   }
 }
+{{- end }}
 EOF
 
 {{- if .WriteServiceDefaults }}
@@ -394,10 +611,19 @@ chmod 444 /consul/connect-inject/acl-token
   -namespace="{{ .ConsulNamespace }}" \
   {{- end }}
   /consul/connect-inject/service.hcl
+{{- if not .ConnectNative }}
 
 # Generate the envoy bootstrap code
 /bin/consul connect envoy \
+  {{- if .GatewayKind }}
+  -gateway="{{ .EnvoyGateway }}" \
+  -proxy-id="${SERVICE_ID}" \
+  {{- else }}
   -proxy-id="${PROXY_SERVICE_ID}" \
+  {{- end }}
+  {{- if .EnvoyAdminBind }}
+  -admin-bind="{{ .EnvoyAdminBind }}" \
+  {{- end }}
   {{- if .AuthMethod }}
   -token-file="/consul/connect-inject/acl-token" \
   {{- end }}
@@ -405,6 +631,7 @@ chmod 444 /consul/connect-inject/acl-token
   -namespace="{{ .ConsulNamespace }}" \
   {{- end }}
   -bootstrap > /consul/connect-inject/envoy-bootstrap.yaml
+{{- end }}
 
 # Copy the Consul binary
 cp /bin/consul /consul/connect-inject/consul
@@ -583,6 +583,126 @@ services {
 `,
 			"",
 		},
+
+		{
+			"Envoy JSON annotations are added to the proxy config",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				pod.Annotations[annotationEnvoyTracingJSON] = `{
+  "http": {
+    "name": "envoy.zipkin",
+    "config": {"collector_cluster": "zipkin", "collector_endpoint": "/api/$1"}
+  }
+}`
+				pod.Annotations[annotationEnvoyStatsSinksJSON] = `[{"name": "envoy.statsd"}]`
+				pod.Annotations[annotationEnvoyExtraStaticClustersJSON] = `{"name": "zipkin"}`
+				return pod
+			},
+			`  proxy {
+    destination_service_name = "web"
+    destination_service_id = "${SERVICE_ID}"
+    config = {
+      envoy_extra_static_clusters_json = "{\\"name\\":\\"zipkin\\"}"
+      envoy_stats_sinks_json = "[{\\"name\\":\\"envoy.statsd\\"}]"
+      envoy_tracing_json = "{\\"http\\":{\\"name\\":\\"envoy.zipkin\\",\\"config\\":{\\"collector_cluster\\":\\"zipkin\\",\\"collector_endpoint\\":\\"/api/\$1\\"}}}"
+    }
+  }`,
+			"",
+		},
+
+		{
+			"Envoy admin bind annotation",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				pod.Annotations[annotationEnvoyAdminBind] = "0.0.0.0:19000"
+				return pod
+			},
+			`/bin/consul connect envoy \
+  -proxy-id="${PROXY_SERVICE_ID}" \
+  -admin-bind="0.0.0.0:19000" \
+  -bootstrap > /consul/connect-inject/envoy-bootstrap.yaml`,
+			"",
+		},
+
+		{
+			"Connect native registers the service as native",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				pod.Annotations[annotationConnectNative] = "true"
+				return pod
+			},
+			`  meta = {
+    pod-name = "${POD_NAME}"
+  }
+  connect {
+    native = true
+  }
+}
+EOF`,
+			`kind = "connect-proxy"`,
+		},
+
+		{
+			"Connect native doesn't generate the Envoy bootstrap",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				pod.Annotations[annotationConnectNative] = "true"
+				return pod
+			},
+			`/bin/consul services register \
+  /consul/connect-inject/service.hcl`,
+			`/bin/consul connect envoy`,
+		},
+
+		{
+			"Service weights and tag override on the service and proxy",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				pod.Annotations[annotationServiceWeightsPassing] = "10"
+				pod.Annotations[annotationServiceEnableTagOverride] = "true"
+				return pod
+			},
+			`  name = "web-sidecar-proxy"
+  kind = "connect-proxy"
+  address = "${POD_IP}"
+  port = 20000
+  enable_tag_override = true
+  weights {
+    passing = 10
+    warning = 1
+  }`,
+			"",
+		},
+
+		{
+			"Proxy public listener check options",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				pod.Annotations[annotationProxyCheckInterval] = "30s"
+				pod.Annotations[annotationProxyCheckTimeout] = "5s"
+				pod.Annotations[annotationDeregisterCriticalServiceAfter] = "1h"
+				return pod
+			},
+			`  checks {
+    name = "Proxy Public Listener"
+    tcp = "${POD_IP}:20000"
+    interval = "30s"
+    timeout = "5s"
+    deregister_critical_service_after = "1h"
+  }`,
+			"",
+		},
+
+		{
+			"Connect native false",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				pod.Annotations[annotationConnectNative] = "false"
+				return pod
+			},
+			`/bin/consul connect envoy`,
+			`native = true`,
+		},
 	}
 
 	for _, tt := range cases {
@@ -1530,6 +1650,153 @@ func TestHandlerContainerInit_Resources(t *testing.T) {
 	}, container.Resources)
 }
 
+func TestHandlerContainerInit_podMetadata(t *testing.T) {
+	require := require.New(t)
+	controller := true
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService:       "web",
+				annotationTags:          "abc",
+				annotationMeta + "team": "from-annotation",
+			},
+			Labels: map[string]string{
+				"app.kubernetes.io/version": "v2",
+				"team":                      "from-label",
+				"pod-template-hash":         "5d4f8c7b9",
+				"ignored":                   "ignored",
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					Kind:       "ReplicaSet",
+					Name:       "web-5d4f8c7b9",
+					Controller: &controller,
+				},
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+
+	h := Handler{
+		PodLabelsToMeta: map[string]string{
+			"app.kubernetes.io/version": "version",
+			"team":                      "team",
+		},
+		PodLabelsToTags: []string{"app.kubernetes.io/version"},
+		PodInfoToMeta:   []string{PodInfoNodeName, PodInfoNamespace, PodInfoController},
+	}
+	container, err := h.containerInit(pod, k8sNamespace)
+	require.NoError(err)
+	actual := strings.Join(container.Command, " ")
+	require.Contains(actual, `
+  tags = ["abc","v2"]
+  meta = {
+    k8s-controller-kind = "Deployment"
+    k8s-controller-name = "web"
+    k8s-namespace = "${POD_NAMESPACE}"
+    k8s-node-name = "${NODE_NAME}"
+    team = "from-annotation"
+    version = "v2"
+    pod-name = "${POD_NAME}"
+  }`)
+	require.NotContains(actual, "ignored")
+	require.Contains(container.Env, corev1.EnvVar{
+		Name: "NODE_NAME",
+		ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"},
+		},
+	})
+}
+
+func TestHandlerContainerInit_invalidConnectNative(t *testing.T) {
+	require := require.New(t)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService:       "foo",
+				annotationConnectNative: "not-a-bool",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "foo",
+				},
+			},
+		},
+	}
+
+	var h Handler
+	_, err := h.containerInit(pod, k8sNamespace)
+	require.Error(err)
+	require.Contains(err.Error(), annotationConnectNative)
+}
+
+func TestHandlerContainerInit_invalidRegistrationAnnotations(t *testing.T) {
+	cases := map[string]struct {
+		annotation string
+		value      string
+		expErr     string
+	}{
+		"tag override not a bool": {
+			annotation: annotationServiceEnableTagOverride,
+			value:      "yes please",
+			expErr:     "parsing annotation consul.hashicorp.com/service-enable-tag-override",
+		},
+		"passing weight zero": {
+			annotation: annotationServiceWeightsPassing,
+			value:      "0",
+			expErr:     `annotation consul.hashicorp.com/service-weights-passing "0" must be an integer greater than 0`,
+		},
+		"negative warning weight": {
+			annotation: annotationServiceWeightsWarning,
+			value:      "-1",
+			expErr:     `annotation consul.hashicorp.com/service-weights-warning "-1" must be an integer greater than or equal to 0`,
+		},
+		"invalid check interval": {
+			annotation: annotationProxyCheckInterval,
+			value:      "10",
+			expErr:     `annotation consul.hashicorp.com/proxy-public-listener-check-interval "10" must be a duration greater than 0`,
+		},
+		"zero deregister duration": {
+			annotation: annotationDeregisterCriticalServiceAfter,
+			value:      "0s",
+			expErr:     `annotation consul.hashicorp.com/deregister-critical-service-after "0s" must be a duration greater than 0`,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "foo",
+						c.annotation:      c.value,
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "foo",
+						},
+					},
+				},
+			}
+
+			var h Handler
+			_, err := h.containerInit(pod, k8sNamespace)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.expErr)
+		})
+	}
+}
+
 func TestHandlerContainerInit_MismatchedServiceNameServiceAccountNameWithACLsEnabled(t *testing.T) {
 	require := require.New(t)
 	h := Handler{
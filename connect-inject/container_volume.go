@@ -18,3 +18,15 @@ func (h *Handler) containerVolume() corev1.Volume {
 		},
 	}
 }
+
+// sharedVolumeMount returns the read-only mount of the shared volume added
+// to the application containers so that they can read the files written by
+// the lifecycle sidecar, i.e. the certificates of Connect-native pods and
+// the upstreams file.
+func sharedVolumeMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      volumeName,
+		MountPath: "/consul/connect-inject",
+		ReadOnly:  true,
+	}
+}
@@ -0,0 +1,92 @@
+package connectinject
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// envoyJSONAnnotations maps the annotations containing Envoy JSON config to
+// the proxy config options they set.
+var envoyJSONAnnotations = map[string]string{
+	annotationEnvoyTracingJSON:             "envoy_tracing_json",
+	annotationEnvoyStatsSinksJSON:          "envoy_stats_sinks_json",
+	annotationEnvoyExtraStaticClustersJSON: "envoy_extra_static_clusters_json",
+}
+
+// envoyLogLevels are the log levels accepted by Envoy's --log-level flag.
+var envoyLogLevels = []string{"trace", "debug", "info", "warning", "warn", "error", "critical", "off"}
+
+// envoyProxyConfig returns the proxy config options set by the pod's
+// annotations. The values are quoted so that they can be rendered as HCL
+// strings into the service config written by the init container's shell
+// script.
+func envoyProxyConfig(pod *corev1.Pod) (map[string]string, error) {
+	config := make(map[string]string)
+	for annotation, option := range envoyJSONAnnotations {
+		raw, ok := pod.Annotations[annotation]
+		if !ok {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, []byte(raw)); err != nil {
+			return nil, fmt.Errorf("annotation %s must be valid JSON: %s", annotation, err)
+		}
+		config[option] = heredocHCLString(buf.String())
+	}
+	return config, nil
+}
+
+// envoyAdminBind returns the address from the envoy-admin-bind annotation,
+// or an empty string if it isn't set.
+func envoyAdminBind(pod *corev1.Pod) (string, error) {
+	raw, ok := pod.Annotations[annotationEnvoyAdminBind]
+	if !ok {
+		return "", nil
+	}
+	if _, _, err := net.SplitHostPort(raw); err != nil {
+		return "", fmt.Errorf("annotation %s must be formatted as <host>:<port>: %s", annotationEnvoyAdminBind, err)
+	}
+	return raw, nil
+}
+
+// envoyLogLevel returns the log level from the envoy-log-level annotation,
+// or an empty string if it isn't set.
+func envoyLogLevel(pod *corev1.Pod) (string, error) {
+	raw, ok := pod.Annotations[annotationEnvoyLogLevel]
+	if !ok {
+		return "", nil
+	}
+	for _, level := range envoyLogLevels {
+		if raw == level {
+			return raw, nil
+		}
+	}
+	return "", fmt.Errorf("annotation %s %q is invalid: must be one of %s",
+		annotationEnvoyLogLevel, raw, strings.Join(envoyLogLevels, ", "))
+}
+
+// validateEnvoyAnnotations returns an error if any of the annotations
+// customizing Envoy are invalid so that the pod is rejected at admission.
+func validateEnvoyAnnotations(pod *corev1.Pod) error {
+	if _, err := envoyProxyConfig(pod); err != nil {
+		return err
+	}
+	if _, err := envoyAdminBind(pod); err != nil {
+		return err
+	}
+	_, err := envoyLogLevel(pod)
+	return err
+}
+
+// heredocHCLString quotes s as an HCL string that is safe to write inside
+// an unquoted shell heredoc, where backslashes, dollar signs and backticks
+// would otherwise be interpreted by the shell.
+func heredocHCLString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "$", `\$`, "`", "\\`").Replace(strconv.Quote(s))
+}
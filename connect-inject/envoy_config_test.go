@@ -0,0 +1,78 @@
+package connectinject
+
+import (
+	"os/exec"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateEnvoyAnnotations(t *testing.T) {
+	cases := map[string]struct {
+		annotations map[string]string
+		expErr      string
+	}{
+		"no annotations": {},
+		"valid annotations": {
+			annotations: map[string]string{
+				annotationEnvoyTracingJSON:             `{"http": {"name": "envoy.zipkin"}}`,
+				annotationEnvoyStatsSinksJSON:          `[]`,
+				annotationEnvoyExtraStaticClustersJSON: `{"name": "zipkin"}`,
+				annotationEnvoyAdminBind:               "0.0.0.0:19000",
+				annotationEnvoyLogLevel:                "trace",
+			},
+		},
+		"invalid tracing JSON": {
+			annotations: map[string]string{
+				annotationEnvoyTracingJSON: `{"http": `,
+			},
+			expErr: "annotation consul.hashicorp.com/envoy-tracing-json must be valid JSON",
+		},
+		"invalid stats sinks JSON": {
+			annotations: map[string]string{
+				annotationEnvoyStatsSinksJSON: `statsd`,
+			},
+			expErr: "annotation consul.hashicorp.com/envoy-stats-sinks-json must be valid JSON",
+		},
+		"invalid admin bind": {
+			annotations: map[string]string{
+				annotationEnvoyAdminBind: "0.0.0.0",
+			},
+			expErr: "annotation consul.hashicorp.com/envoy-admin-bind must be formatted as <host>:<port>",
+		},
+		"invalid log level": {
+			annotations: map[string]string{
+				annotationEnvoyLogLevel: "verbose",
+			},
+			expErr: `annotation consul.hashicorp.com/envoy-log-level "verbose" is invalid`,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := validateEnvoyAnnotations(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: c.annotations,
+				},
+			})
+			if c.expErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.expErr)
+			}
+		})
+	}
+}
+
+// Test that strings quoted by heredocHCLString are written unchanged by an
+// unquoted heredoc, as used by the init container.
+func TestHeredocHCLString(t *testing.T) {
+	value := "{\"path\":\"/$1\",\"cmd\":\"`ls` \\\\n\"}"
+	out, err := exec.Command("/bin/sh", "-ec", "cat <<EOF\n"+heredocHCLString(value)+"\nEOF").Output()
+	require.NoError(t, err)
+	require.Equal(t, strconv.Quote(value)+"\n", string(out))
+}
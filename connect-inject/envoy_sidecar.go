@@ -12,22 +12,29 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 )
 
+// envoySidecarContainerName is the name of the Envoy sidecar container.
+const envoySidecarContainerName = "consul-connect-envoy-sidecar"
+
 type sidecarContainerCommandData struct {
 	AuthMethod      string
 	ConsulNamespace string
 }
 
 func (h *Handler) envoySidecar(pod *corev1.Pod, k8sNamespace string) (corev1.Container, error) {
+	consulNS, err := h.consulNamespace(k8sNamespace)
+	if err != nil {
+		return corev1.Container{}, err
+	}
 	templateData := sidecarContainerCommandData{
-		AuthMethod:      h.AuthMethod,
-		ConsulNamespace: h.consulNamespace(k8sNamespace),
+		AuthMethod:      h.authMethod(pod),
+		ConsulNamespace: consulNS,
 	}
 
 	// Render the command
 	var buf bytes.Buffer
 	tpl := template.Must(template.New("root").Parse(strings.TrimSpace(
 		sidecarPreStopCommandTpl)))
-	err := tpl.Execute(&buf, &templateData)
+	err = tpl.Execute(&buf, &templateData)
 	if err != nil {
 		return corev1.Container{}, err
 	}
@@ -43,7 +50,7 @@ func (h *Handler) envoySidecar(pod *corev1.Pod, k8sNamespace string) (corev1.Con
 	}
 
 	container := corev1.Container{
-		Name:  "consul-connect-envoy-sidecar",
+		Name:  envoySidecarContainerName,
 		Image: h.ImageEnvoy,
 		Env: []corev1.EnvVar{
 			{
@@ -97,6 +104,14 @@ func (h *Handler) getContainerSidecarCommand(pod *corev1.Pod) ([]string, error)
 		"--config-path", "/consul/connect-inject/envoy-bootstrap.yaml",
 	}
 
+	logLevel, err := envoyLogLevel(pod)
+	if err != nil {
+		return []string{}, err
+	}
+	if logLevel != "" {
+		cmd = append(cmd, "--log-level", logLevel)
+	}
+
 	extraArgs, annotationSet := pod.Annotations[annotationEnvoyExtraArgs]
 
 	if annotationSet || h.EnvoyExtraArgs != "" {
@@ -117,6 +117,23 @@ func TestHandlerEnvoySidecar_EnvoyExtraArgs(t *testing.T) {
 				"--admin-address-path", "\"/tmp/consul/foo bar\"",
 			},
 		},
+		{
+			name:           "via log level annotation",
+			envoyExtraArgs: "--concurrency 2",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationEnvoyLogLevel: "debug",
+					},
+				},
+			},
+			expectedContainerCommand: []string{
+				"envoy",
+				"--config-path", "/consul/connect-inject/envoy-bootstrap.yaml",
+				"--log-level", "debug",
+				"--concurrency", "2",
+			},
+		},
 		{
 			name:           "via flag and annotation: should prefer setting via the annotation",
 			envoyExtraArgs: "this should be overwritten",
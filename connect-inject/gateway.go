@@ -0,0 +1,96 @@
+package connectinject
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Gateway kinds that can be set via annotationGatewayKind.
+const (
+	gatewayKindMesh        = "mesh-gateway"
+	gatewayKindIngress     = "ingress-gateway"
+	gatewayKindTerminating = "terminating-gateway"
+)
+
+// GatewayAddressInitContainerName is the name of the init container that
+// waits for the gateway's Kubernetes Service to have an address.
+const GatewayAddressInitContainerName = "consul-connect-gateway-address-init"
+
+// gatewayWANAddressFile is the file in the shared volume that the gateway's
+// WAN address is written to.
+const gatewayWANAddressFile = "/consul/connect-inject/gateway-wan-address"
+
+// gatewayKind returns the gateway kind the pod is annotated with, or an
+// empty string if the pod isn't a gateway.
+func gatewayKind(pod *corev1.Pod) (string, error) {
+	kind, ok := pod.Annotations[annotationGatewayKind]
+	if !ok {
+		return "", nil
+	}
+	switch kind {
+	case gatewayKindMesh, gatewayKindIngress, gatewayKindTerminating:
+		return kind, nil
+	default:
+		return "", fmt.Errorf("%q is not a valid gateway kind: must be one of %q, %q or %q",
+			kind, gatewayKindMesh, gatewayKindIngress, gatewayKindTerminating)
+	}
+}
+
+// validateGateway validates the gateway annotations of a pod annotated
+// with a gateway kind.
+func validateGateway(pod *corev1.Pod, kind string) error {
+	if native, _ := isConnectNative(pod); native {
+		return fmt.Errorf("%s and %s cannot both be set", annotationGatewayKind, annotationConnectNative)
+	}
+	if kind == gatewayKindTerminating {
+		// Terminating gateways are only reachable from within the
+		// datacenter so have no WAN address.
+		if _, ok := pod.Annotations[annotationGatewayWANAddressService]; ok {
+			return fmt.Errorf("%s cannot be set for %s", annotationGatewayWANAddressService, kind)
+		}
+	}
+	if raw, ok := pod.Annotations[annotationGatewayWANPort]; ok {
+		if port, err := strconv.ParseInt(raw, 10, 32); err != nil || port < 1 {
+			return fmt.Errorf("%s %q is not a valid port", annotationGatewayWANPort, raw)
+		}
+	}
+	return nil
+}
+
+// authMethod returns the auth method the pod logs in to when ACLs are
+// enabled. Gateways need different policies to services so they may use a
+// different auth method.
+func (h *Handler) authMethod(pod *corev1.Pod) string {
+	if kind, _ := gatewayKind(pod); kind != "" && h.GatewayAuthMethod != "" {
+		return h.GatewayAuthMethod
+	}
+	return h.AuthMethod
+}
+
+// containerGatewayAddressInit returns the init container that uses the
+// service-address command to wait until the Kubernetes Service set by
+// annotationGatewayWANAddressService has an address and writes it to the
+// shared volume so that it can be registered as the gateway's WAN address.
+func (h *Handler) containerGatewayAddressInit(pod *corev1.Pod, k8sNamespace string) corev1.Container {
+	return corev1.Container{
+		Name:  GatewayAddressInitContainerName,
+		Image: h.ImageConsulK8S,
+		Command: []string{
+			"consul-k8s",
+			"service-address",
+			"-k8s-namespace=" + k8sNamespace,
+			"-name=" + strings.TrimSpace(pod.Annotations[annotationGatewayWANAddressService]),
+			"-output-file=" + gatewayWANAddressFile,
+		},
+		Resources: h.InitContainerResources,
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      volumeName,
+				MountPath: "/consul/connect-inject",
+			},
+		},
+	}
+}
@@ -0,0 +1,326 @@
+package connectinject
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHandlerContainerInit_gateway(t *testing.T) {
+	minimal := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					annotationService: "gateway",
+					annotationPort:    "8443",
+				},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name: "gateway",
+					},
+				},
+			},
+		}
+	}
+
+	cases := []struct {
+		Name   string
+		Pod    func(*corev1.Pod) *corev1.Pod
+		Cmd    string // Strings.Contains test
+		CmdNot string // Not contains
+	}{
+		{
+			"Mesh gateway with WAN address service, whole service",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationGatewayKind] = "mesh-gateway"
+				pod.Annotations[annotationGatewayWANAddressService] = "mesh-gateway"
+				pod.Annotations[annotationGatewayWANPort] = "443"
+				return pod
+			},
+			`cat <<EOF >/consul/connect-inject/service.hcl
+services {
+  id   = "${SERVICE_ID}"
+  name = "gateway"
+  kind = "mesh-gateway"
+  address = "${POD_IP}"
+  port = 8443
+  meta = {
+    pod-name = "${POD_NAME}"
+  }
+  tagged_addresses {
+    lan {
+      address = "${POD_IP}"
+      port = 8443
+    }
+    wan {
+      address = "$(cat /consul/connect-inject/gateway-wan-address)"
+      port = 443
+    }
+  }
+
+  checks {
+    name = "Gateway Listener"
+    tcp = "${POD_IP}:8443"
+    interval = "10s"
+    deregister_critical_service_after = "6h"
+  }
+}
+EOF`,
+			`kind = "connect-proxy"`,
+		},
+
+		{
+			"Ingress gateway without WAN address service uses the pod IP",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationGatewayKind] = "ingress-gateway"
+				return pod
+			},
+			`    wan {
+      address = "${POD_IP}"
+      port = 8443
+    }`,
+			"gateway-wan-address",
+		},
+
+		{
+			"Terminating gateway has no WAN address",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationGatewayKind] = "terminating-gateway"
+				return pod
+			},
+			`  kind = "terminating-gateway"`,
+			"wan {",
+		},
+
+		{
+			"Gateway listener check options",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationGatewayKind] = "mesh-gateway"
+				pod.Annotations[annotationProxyCheckInterval] = "5s"
+				pod.Annotations[annotationDeregisterCriticalServiceAfter] = "30m"
+				return pod
+			},
+			`    name = "Gateway Listener"
+    tcp = "${POD_IP}:8443"
+    interval = "5s"
+    deregister_critical_service_after = "30m"`,
+			"",
+		},
+
+		{
+			"Envoy is bootstrapped as a gateway",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationGatewayKind] = "ingress-gateway"
+				return pod
+			},
+			`/bin/consul connect envoy \
+  -gateway="ingress" \
+  -proxy-id="${SERVICE_ID}" \
+  -bootstrap > /consul/connect-inject/envoy-bootstrap.yaml`,
+			"PROXY_SERVICE_ID}\" \\",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			require := require.New(t)
+
+			h := Handler{
+				WriteServiceDefaults: true,
+				DefaultProtocol:      "http",
+			}
+			container, err := h.containerInit(tt.Pod(minimal()), k8sNamespace)
+			require.NoError(err)
+			actual := strings.Join(container.Command, " ")
+			require.Contains(actual, tt.Cmd)
+			if tt.CmdNot != "" {
+				require.NotContains(actual, tt.CmdNot)
+			}
+			// Service defaults don't apply to gateways.
+			require.NotContains(actual, "service-defaults")
+		})
+	}
+}
+
+func TestHandlerContainerInit_gatewayErrors(t *testing.T) {
+	cases := map[string]struct {
+		annotations map[string]string
+		expErr      string
+	}{
+		"invalid kind": {
+			annotations: map[string]string{
+				annotationPort:        "8443",
+				annotationGatewayKind: "api-gateway",
+			},
+			expErr: `"api-gateway" is not a valid gateway kind`,
+		},
+		"no port": {
+			annotations: map[string]string{
+				annotationGatewayKind: "mesh-gateway",
+			},
+			expErr: "consul.hashicorp.com/connect-service-port must be set to the port the gateway listens on",
+		},
+		"invalid WAN port": {
+			annotations: map[string]string{
+				annotationPort:           "8443",
+				annotationGatewayKind:    "mesh-gateway",
+				annotationGatewayWANPort: "https",
+			},
+			expErr: "parsing annotation consul.hashicorp.com/gateway-wan-port",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationService: "gateway",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "gateway",
+						},
+					},
+				},
+			}
+			for k, v := range c.annotations {
+				pod.Annotations[k] = v
+			}
+
+			var h Handler
+			_, err := h.containerInit(pod, k8sNamespace)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.expErr)
+		})
+	}
+}
+
+func TestValidateGateway(t *testing.T) {
+	cases := map[string]struct {
+		kind        string
+		annotations map[string]string
+		expErr      string
+	}{
+		"valid": {
+			kind: gatewayKindMesh,
+			annotations: map[string]string{
+				annotationGatewayWANAddressService: "mesh-gateway",
+				annotationGatewayWANPort:           "443",
+			},
+		},
+		"connect native": {
+			kind: gatewayKindIngress,
+			annotations: map[string]string{
+				annotationConnectNative: "true",
+			},
+			expErr: "consul.hashicorp.com/gateway-kind and consul.hashicorp.com/connect-native cannot both be set",
+		},
+		"terminating gateway with WAN address": {
+			kind: gatewayKindTerminating,
+			annotations: map[string]string{
+				annotationGatewayWANAddressService: "terminating-gateway",
+			},
+			expErr: "consul.hashicorp.com/gateway-wan-address-service cannot be set for terminating-gateway",
+		},
+		"invalid WAN port": {
+			kind: gatewayKindMesh,
+			annotations: map[string]string{
+				annotationGatewayWANPort: "0",
+			},
+			expErr: `consul.hashicorp.com/gateway-wan-port "0" is not a valid port`,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := validateGateway(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: c.annotations,
+				},
+			}, c.kind)
+			if c.expErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, c.expErr)
+			}
+		})
+	}
+}
+
+// Test that gateways log in to the gateway auth method and that their
+// service name doesn't need to match their service account.
+func TestHandlerContainerInit_gatewayAuthMethod(t *testing.T) {
+	require := require.New(t)
+	h := Handler{
+		AuthMethod:        "release-name-consul-k8s-auth-method",
+		GatewayAuthMethod: "release-name-consul-k8s-gateway-auth-method",
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService:     "mesh-gateway",
+				annotationPort:        "8443",
+				annotationGatewayKind: "mesh-gateway",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "gateway",
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      "default-token-podid",
+							ReadOnly:  true,
+							MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+						},
+					},
+				},
+			},
+			ServiceAccountName: "consul-mesh-gateway",
+		},
+	}
+	container, err := h.containerInit(pod, k8sNamespace)
+	require.NoError(err)
+	actual := strings.Join(container.Command, " ")
+	require.Contains(actual, `/bin/consul login -method="release-name-consul-k8s-gateway-auth-method"`)
+
+	lifecycle, err := h.lifecycleSidecar(pod, k8sNamespace)
+	require.NoError(err)
+	require.Contains(lifecycle.Command, "-auth-method=release-name-consul-k8s-gateway-auth-method")
+
+	// Without a gateway auth method the service identity of the service
+	// account is used so the names must match.
+	h.GatewayAuthMethod = ""
+	_, err = h.containerInit(pod, k8sNamespace)
+	require.EqualError(err, `serviceAccountName "consul-mesh-gateway" does not match service name "mesh-gateway"`)
+}
+
+func TestHandlerContainerGatewayAddressInit(t *testing.T) {
+	h := Handler{
+		ImageConsulK8S: "hashicorp/consul-k8s:9.9.9",
+	}
+	container := h.containerGatewayAddressInit(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationGatewayWANAddressService: "mesh-gateway",
+			},
+		},
+	}, k8sNamespace)
+	require.Equal(t, GatewayAddressInitContainerName, container.Name)
+	require.Equal(t, "hashicorp/consul-k8s:9.9.9", container.Image)
+	require.Equal(t, []string{
+		"consul-k8s",
+		"service-address",
+		"-k8s-namespace=k8snamespace",
+		"-name=mesh-gateway",
+		"-output-file=/consul/connect-inject/gateway-wan-address",
+	}, container.Command)
+}
@@ -69,11 +69,41 @@ const (
 	// e.g. consul.hashicorp.com/service-meta-foo:bar
 	annotationMeta = "consul.hashicorp.com/service-meta-"
 
+	// annotationServiceWeightsPassing and annotationServiceWeightsWarning
+	// set the weights of the service and proxy registrations used in DNS SRV
+	// responses when their checks are passing or warning.
+	annotationServiceWeightsPassing = "consul.hashicorp.com/service-weights-passing"
+	annotationServiceWeightsWarning = "consul.hashicorp.com/service-weights-warning"
+
+	// annotationServiceEnableTagOverride sets enable_tag_override on the
+	// service and proxy registrations so that their tags can be updated
+	// via the catalog. This should be set to a truthy or falsy value, as
+	// parseable by strconv.ParseBool.
+	annotationServiceEnableTagOverride = "consul.hashicorp.com/service-enable-tag-override"
+
+	// annotationProxyCheckInterval and annotationProxyCheckTimeout set the
+	// interval and timeout of the proxy's public listener check, or the
+	// gateway's listener check, e.g. "10s".
+	annotationProxyCheckInterval = "consul.hashicorp.com/proxy-public-listener-check-interval"
+	annotationProxyCheckTimeout  = "consul.hashicorp.com/proxy-public-listener-check-timeout"
+
+	// annotationDeregisterCriticalServiceAfter is how long the proxy's
+	// public listener check, or the gateway's listener check, may be
+	// critical before Consul deregisters the service. Defaults to 10m for
+	// proxies and 6h for gateways.
+	annotationDeregisterCriticalServiceAfter = "consul.hashicorp.com/deregister-critical-service-after"
+
 	// annotationSyncPeriod controls the -sync-period flag passed to the
 	// consul-k8s lifecycle-sidecar command. This flag controls how often the
 	// service is synced (i.e. re-registered) with the local agent.
 	annotationSyncPeriod = "consul.hashicorp.com/connect-sync-period"
 
+	// annotationLifecycleSidecarPort is the port the lifecycle sidecar
+	// serves its health check and metrics endpoints on. It overrides
+	// Handler.LifecycleSidecarPort for pods whose containers already use
+	// that port.
+	annotationLifecycleSidecarPort = "consul.hashicorp.com/lifecycle-sidecar-port"
+
 	// annotations for sidecar proxy resource limits
 	annotationSidecarProxyCPULimit      = "consul.hashicorp.com/sidecar-proxy-cpu-limit"
 	annotationSidecarProxyCPURequest    = "consul.hashicorp.com/sidecar-proxy-cpu-request"
@@ -87,6 +117,51 @@ const (
 	// passed via the -envoy-extra-args flag.
 	annotationEnvoyExtraArgs = "consul.hashicorp.com/envoy-extra-args"
 
+	// annotationConnectNative controls whether the service is registered as
+	// a Connect-native service. Connect-native services talk to other
+	// services in the mesh directly so no Envoy sidecar is injected.
+	// Instead, the lifecycle sidecar writes the service's leaf certificate
+	// and the Connect CA roots to the shared volume which is mounted into
+	// the application containers. This should be set to a truthy or falsy
+	// value, as parseable by strconv.ParseBool.
+	annotationConnectNative = "consul.hashicorp.com/connect-native"
+
+	// annotationGatewayKind deploys the pod as a gateway of the given kind
+	// rather than a service with a sidecar proxy. Valid values are
+	// "mesh-gateway", "ingress-gateway" and "terminating-gateway". The
+	// injected Envoy container is the gateway and listens on the port set by
+	// annotationPort.
+	annotationGatewayKind = "consul.hashicorp.com/gateway-kind"
+
+	// annotationGatewayWANAddressService is the name of the Kubernetes
+	// Service, in the pod's namespace, whose address is registered as the
+	// gateway's WAN address. The address is determined the same way as the
+	// service-address command, waiting for load balancers to be provisioned.
+	// If not set, the pod IP is used.
+	annotationGatewayWANAddressService = "consul.hashicorp.com/gateway-wan-address-service"
+
+	// annotationGatewayWANPort is the port registered as the gateway's WAN
+	// port. Defaults to the gateway's port.
+	annotationGatewayWANPort = "consul.hashicorp.com/gateway-wan-port"
+
+	// annotationEnvoyTracingJSON, annotationEnvoyStatsSinksJSON and
+	// annotationEnvoyExtraStaticClustersJSON set the envoy_tracing_json,
+	// envoy_stats_sinks_json and envoy_extra_static_clusters_json options in
+	// the proxy's config so that they can be customized per workload rather
+	// than in a global proxy-defaults config entry. Their values must be
+	// valid JSON.
+	annotationEnvoyTracingJSON             = "consul.hashicorp.com/envoy-tracing-json"
+	annotationEnvoyStatsSinksJSON          = "consul.hashicorp.com/envoy-stats-sinks-json"
+	annotationEnvoyExtraStaticClustersJSON = "consul.hashicorp.com/envoy-extra-static-clusters-json"
+
+	// annotationEnvoyAdminBind is the address Envoy's admin API binds to,
+	// e.g. "0.0.0.0:19000". It is passed to `consul connect envoy` as
+	// -admin-bind. Defaults to localhost:19000.
+	annotationEnvoyAdminBind = "consul.hashicorp.com/envoy-admin-bind"
+
+	// annotationEnvoyLogLevel is Envoy's log level, e.g. "debug".
+	annotationEnvoyLogLevel = "consul.hashicorp.com/envoy-log-level"
+
 	// injected is used as the annotation value for annotationInjected
 	injected = "injected"
 
@@ -130,6 +205,12 @@ type Handler struct {
 	// use for identity with connectInjection if ACLs are enabled
 	AuthMethod string
 
+	// GatewayAuthMethod is the name of the Kubernetes Auth Method gateways
+	// log in to if ACLs are enabled. Its binding rules must grant the
+	// policies gateways need, e.g. by binding to roles. If not set,
+	// AuthMethod is used.
+	GatewayAuthMethod string
+
 	// WriteServiceDefaults controls whether injection should write a
 	// service-defaults config entry for each service.
 	// Requires an additional `protocol` parameter.
@@ -178,11 +259,59 @@ type Handler struct {
 	// `k8s-default` namespace.
 	K8SNSMirroringPrefix string
 
+	// NamespaceMapping maps Kubernetes namespaces to Consul namespaces. Its
+	// rules take precedence over ConsulDestinationNamespace and mirroring.
+	// May be nil.
+	NamespaceMapping *namespaces.Mapping
+
+	// NamespaceLabels returns the labels of a Kubernetes namespace. Only
+	// needed if NamespaceMapping has selector rules.
+	NamespaceLabels namespaces.LabelsFunc
+
 	// CrossNamespaceACLPolicy is the name of the ACL policy to attach to
 	// any created Consul namespaces to allow cross namespace service discovery.
 	// Only necessary if ACLs are enabled.
 	CrossNamespaceACLPolicy string
 
+	// ClusterName is set as the namespaces.MirroredByClusterKey meta of the
+	// Consul namespaces created for mirrored k8s namespaces, so that the
+	// controller of the same cluster can delete them. Optional.
+	ClusterName string
+
+	// PodLabelsToMeta maps the keys of pod labels that are added to the
+	// service meta to the meta keys they're added as.
+	PodLabelsToMeta map[string]string
+
+	// PodLabelsToTags is the list of pod label keys whose values are added
+	// to the service tags.
+	PodLabelsToTags []string
+
+	// PodInfoToMeta is the list of pod information added to the service
+	// meta. Valid values are PodInfoNodeName, PodInfoNamespace and
+	// PodInfoController.
+	PodInfoToMeta []string
+
+	// ValidationAllowList is the set of usernames and groups whose requests
+	// aren't rejected by the validating webhook, e.g. controllers that
+	// legitimately update the Consul annotations of pods.
+	ValidationAllowList mapset.Set
+
+	// StatefulSetIdentity registers pods managed by a StatefulSet with
+	// their ordinal in the service meta and a "<service>-<ordinal>" tag,
+	// and has the lifecycle sidecar write the service-resolver subsets and
+	// redirects that allow an upstream to target a single pod, e.g.
+	// kafka-0.
+	StatefulSetIdentity bool
+
+	// ConsulDNSAddress is the IP address of Consul's DNS interface, e.g.
+	// the cluster IP of the consul-dns Service. If set, pods injected with
+	// the Consul client config resolve names through it.
+	ConsulDNSAddress string
+
+	// ClusterDomain is the Kubernetes cluster domain, used for the search
+	// domains of the DNS config of pods that resolve names through Consul.
+	ClusterDomain string
+
 	// Default resource settings for sidecar proxies. Some of these
 	// fields may be empty.
 	DefaultProxyCPURequest    resource.Quantity
@@ -198,14 +327,29 @@ type Handler struct {
 	// will be populated by the defaults provided in the initial flags.
 	LifecycleSidecarResources corev1.ResourceRequirements
 
+	// LifecycleSidecarPort is the port the lifecycle sidecar serves its
+	// health check and metrics endpoints on. Defaults to
+	// DefaultLifecycleSidecarPort if zero.
+	LifecycleSidecarPort int
+
 	// Log
 	Log hclog.Logger
 }
 
-// Handle is the http.HandlerFunc implementation that actually handles the
-// webhook request for admission control. This should be registered or
-// served via an HTTP server.
+// Handle is the HTTP handler of the mutating webhook that injects pods.
 func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
+	h.handleAdmission(w, r, h.Mutate)
+}
+
+// HandleValidate is the HTTP handler of the validating webhook that
+// rejects pods tampering with injection.
+func (h *Handler) HandleValidate(w http.ResponseWriter, r *http.Request) {
+	h.handleAdmission(w, r, h.Validate)
+}
+
+// handleAdmission decodes the admission review in the request body, passes
+// it to review and writes the response.
+func (h *Handler) handleAdmission(w http.ResponseWriter, r *http.Request, review func(*v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse) {
 	h.Log.Info("Request received", "Method", r.Method, "URL", r.URL)
 
 	if ct := r.Header.Get("Content-Type"); ct != "application/json" {
@@ -238,7 +382,7 @@ func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 		h.Log.Error("Could not decode admission request", "err", err)
 		admResp.Response = admissionError(err)
 	} else {
-		admResp.Response = h.Mutate(admReq.Request)
+		admResp.Response = review(admReq.Request)
 	}
 
 	resp, err := json.Marshal(&admResp)
@@ -277,6 +421,31 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 	// Accumulate any patches here
 	var patches []jsonpatch.JsonPatchOperation
 
+	// Pods that only talk to the Consul client are injected with its
+	// address and an ACL token rather than with the Connect sidecars.
+	if clientInject, err := h.isClientInject(&pod, req.Namespace); err != nil {
+		h.Log.Error("Error parsing client-inject annotation", "err", err, "Request Name", req.Name)
+		return &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("Error parsing client-inject annotation: %s", err),
+			},
+		}
+	} else if clientInject {
+		patches, err := h.clientInjectPatches(&pod, req.Namespace)
+		if err == nil {
+			err = setPatch(resp, patches)
+		}
+		if err != nil {
+			h.Log.Error("Error injecting Consul client config", "err", err, "Request Name", req.Name)
+			return &v1beta1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: fmt.Sprintf("Error injecting Consul client config: %s", err),
+				},
+			}
+		}
+		return resp
+	}
+
 	// Setup the default annotation values that are used for the container.
 	// This MUST be done before shouldInject is called since k.
 	if err := h.defaultAnnotations(&pod, &patches); err != nil {
@@ -301,6 +470,52 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 		return resp
 	}
 
+	// Check up front that the Consul namespace can be determined, e.g. that
+	// the labels of the Kubernetes namespace can be read if the namespace
+	// mapping has selector rules, since the rest of the injection relies on
+	// it.
+	consulNS, err := h.consulNamespace(req.Namespace)
+	if err != nil {
+		h.Log.Error("Error determining Consul namespace", "err", err, "Request Name", req.Name)
+		return &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("Error determining Consul namespace: %s", err),
+			},
+		}
+	}
+
+	connectNative, err := isConnectNative(&pod)
+	if err != nil {
+		h.Log.Error("Error parsing connect-native annotation", "err", err, "Request Name", req.Name)
+		return &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("Error parsing connect-native annotation: %s", err),
+			},
+		}
+	}
+
+	gwKind, err := gatewayKind(&pod)
+	if err == nil && gwKind != "" {
+		err = validateGateway(&pod, gwKind)
+	}
+	if err != nil {
+		h.Log.Error("Error configuring gateway", "err", err, "Request Name", req.Name)
+		return &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("Error configuring gateway: %s", err),
+			},
+		}
+	}
+
+	if err := validateEnvoyAnnotations(&pod); err != nil {
+		h.Log.Error("Error validating Envoy annotations", "err", err, "Request Name", req.Name)
+		return &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("Error validating Envoy annotations: %s", err),
+			},
+		}
+	}
+
 	// Add our volume that will be shared by the init container and
 	// the sidecar for passing data in the pod.
 	patches = append(patches, addVolume(
@@ -317,9 +532,26 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 			fmt.Sprintf("/spec/initContainers/%d/env", i))...)
 	}
 	for i, container := range pod.Spec.Containers {
+		envVars := h.containerEnvVars(&pod)
+		mountSharedVolume := false
+		if connectNative {
+			// Connect-native applications read their certificates from
+			// the shared volume.
+			envVars = append(envVars, connectNativeEnvVars()...)
+			mountSharedVolume = true
+		} else if h.writesUpstreamsFile(&pod) {
+			envVars = append(envVars, upstreamsFileEnvVar())
+			mountSharedVolume = true
+		}
+		if mountSharedVolume {
+			patches = append(patches, addVolumeMount(
+				container.VolumeMounts,
+				[]corev1.VolumeMount{sharedVolumeMount()},
+				fmt.Sprintf("/spec/containers/%d/volumeMounts", i))...)
+		}
 		patches = append(patches, addEnvVar(
 			container.Env,
-			h.containerEnvVars(&pod),
+			envVars,
 			fmt.Sprintf("/spec/containers/%d/env", i))...)
 	}
 
@@ -334,25 +566,43 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 			},
 		}
 	}
+	initContainers := []corev1.Container{container}
+	if _, ok := pod.Annotations[annotationGatewayWANAddressService]; ok && gwKind != "" {
+		// The gateway's WAN address must be known before it's registered.
+		initContainers = append([]corev1.Container{h.containerGatewayAddressInit(&pod, req.Namespace)}, initContainers...)
+	}
 	patches = append(patches, addContainer(
 		pod.Spec.InitContainers,
-		[]corev1.Container{container},
+		initContainers,
 		"/spec/initContainers")...)
 
-	// Add the Envoy and lifecycle sidecars.
-	esContainer, err := h.envoySidecar(&pod, req.Namespace)
+	// Add the Envoy and lifecycle sidecars. Connect-native services don't
+	// have an Envoy sidecar.
+	var sidecars []corev1.Container
+	if !connectNative {
+		esContainer, err := h.envoySidecar(&pod, req.Namespace)
+		if err != nil {
+			h.Log.Error("Error configuring injection sidecar container", "err", err, "Request Name", req.Name)
+			return &v1beta1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: fmt.Sprintf("Error configuring injection sidecar container: %s", err),
+				},
+			}
+		}
+		sidecars = append(sidecars, esContainer)
+	}
+	connectContainer, err := h.lifecycleSidecar(&pod, req.Namespace)
 	if err != nil {
-		h.Log.Error("Error configuring injection sidecar container", "err", err, "Request Name", req.Name)
+		h.Log.Error("Error configuring lifecycle sidecar container", "err", err, "Request Name", req.Name)
 		return &v1beta1.AdmissionResponse{
 			Result: &metav1.Status{
-				Message: fmt.Sprintf("Error configuring injection sidecar container: %s", err),
+				Message: fmt.Sprintf("Error configuring lifecycle sidecar container: %s", err),
 			},
 		}
 	}
-	connectContainer := h.lifecycleSidecar(&pod)
 	patches = append(patches, addContainer(
 		pod.Spec.Containers,
-		[]corev1.Container{esContainer, connectContainer},
+		append(sidecars, connectContainer),
 		"/spec/containers")...)
 
 	// Add annotations so that we know we're injected
@@ -374,36 +624,27 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 		patches = append(patches, updateAnnotation(
 			pod.Annotations,
 			map[string]string{
-				annotationConsulNamespace: h.consulNamespace(req.Namespace),
+				annotationConsulNamespace: consulNS,
 			})...)
 	}
 
 	// Generate the patch
-	var patch []byte
-	if len(patches) > 0 {
-		var err error
-		patch, err = json.Marshal(patches)
-		if err != nil {
-			h.Log.Error("Could not marshal patches", "err", err, "Request Name", req.Name)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: fmt.Sprintf("Could not marshal patches: %s", err),
-				},
-			}
+	if err := setPatch(resp, patches); err != nil {
+		h.Log.Error("Could not marshal patches", "err", err, "Request Name", req.Name)
+		return &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("Could not marshal patches: %s", err),
+			},
 		}
-
-		resp.Patch = patch
-		patchType := v1beta1.PatchTypeJSONPatch
-		resp.PatchType = &patchType
 	}
 
 	// Check and potentially create Consul resources. This is done after
 	// all patches are created to guarantee no errors were encountered in
 	// that process before modifying the Consul cluster.
 	if h.EnableNamespaces {
-		if _, err := namespaces.EnsureExists(h.ConsulClient, h.consulNamespace(req.Namespace), h.CrossNamespaceACLPolicy); err != nil {
+		if err := h.ensureNamespace(consulNS, req.Namespace); err != nil {
 			h.Log.Error("Error checking or creating namespace", "err", err,
-				"Namespace", h.consulNamespace(req.Namespace), "Request Name", req.Name)
+				"Namespace", consulNS, "Request Name", req.Name)
 			return &v1beta1.AdmissionResponse{
 				Result: &metav1.Status{
 					Message: fmt.Sprintf("Error checking or creating namespace: %s", err),
@@ -415,20 +656,23 @@ func (h *Handler) Mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionRespon
 	return resp
 }
 
-func (h *Handler) shouldInject(pod *corev1.Pod, namespace string) (bool, error) {
-	// Don't inject in the Kubernetes system namespaces
-	if kubeSystemNamespaces.Contains(namespace) {
-		return false, nil
+// setPatch sets the JSON patch of resp to patches, if there are any.
+func setPatch(resp *v1beta1.AdmissionResponse, patches []jsonpatch.JsonPatchOperation) error {
+	if len(patches) == 0 {
+		return nil
 	}
-
-	// Namespace logic
-	// If in deny list, don't inject
-	if h.DenyK8sNamespacesSet.Contains(namespace) {
-		return false, nil
+	patch, err := json.Marshal(patches)
+	if err != nil {
+		return err
 	}
+	resp.Patch = patch
+	patchType := v1beta1.PatchTypeJSONPatch
+	resp.PatchType = &patchType
+	return nil
+}
 
-	// If not in allow list or allow list is not *, don't inject
-	if !h.AllowK8sNamespacesSet.Contains("*") && !h.AllowK8sNamespacesSet.Contains(namespace) {
+func (h *Handler) shouldInject(pod *corev1.Pod, namespace string) (bool, error) {
+	if !h.namespaceAllowed(namespace) {
 		return false, nil
 	}
 
@@ -454,6 +698,34 @@ func (h *Handler) shouldInject(pod *corev1.Pod, namespace string) (bool, error)
 	return !h.RequireAnnotation, nil
 }
 
+// namespaceAllowed returns true if pods in the k8s namespace may be
+// injected.
+func (h *Handler) namespaceAllowed(namespace string) bool {
+	// Don't inject in the Kubernetes system namespaces
+	if kubeSystemNamespaces.Contains(namespace) {
+		return false
+	}
+
+	// Namespace logic
+	// If in deny list, don't inject
+	if h.DenyK8sNamespacesSet.Contains(namespace) {
+		return false
+	}
+
+	// If not in allow list or allow list is not *, don't inject
+	return h.AllowK8sNamespacesSet.Contains("*") || h.AllowK8sNamespacesSet.Contains(namespace)
+}
+
+// isConnectNative returns true if the pod is annotated to be registered as
+// a Connect-native service.
+func isConnectNative(pod *corev1.Pod) (bool, error) {
+	raw, ok := pod.Annotations[annotationConnectNative]
+	if !ok {
+		return false, nil
+	}
+	return strconv.ParseBool(raw)
+}
+
 func (h *Handler) defaultAnnotations(pod *corev1.Pod, patches *[]jsonpatch.JsonPatchOperation) error {
 	if pod.ObjectMeta.Annotations == nil {
 		pod.ObjectMeta.Annotations = make(map[string]string)
@@ -519,9 +791,30 @@ func (h *Handler) defaultAnnotations(pod *corev1.Pod, patches *[]jsonpatch.JsonP
 
 // consulNamespace returns the namespace that a service should be
 // registered in based on the namespace options. It returns an
-// empty string if namespaces aren't enabled.
-func (h *Handler) consulNamespace(ns string) string {
-	return namespaces.ConsulNamespace(ns, h.EnableNamespaces, h.ConsulDestinationNamespace, h.EnableK8SNSMirroring, h.K8SNSMirroringPrefix)
+// empty string if namespaces aren't enabled, and an error if the namespace
+// mapping can't be evaluated, e.g. because the Kubernetes namespace's labels
+// can't be read, in which case injection must fail rather than fall back to
+// the default namespace.
+func (h *Handler) consulNamespace(ns string) (string, error) {
+	return namespaces.MappedConsulNamespace(h.NamespaceMapping, h.NamespaceLabels, ns,
+		h.EnableNamespaces, h.ConsulDestinationNamespace, h.EnableK8SNSMirroring, h.K8SNSMirroringPrefix)
+}
+
+// ensureNamespace creates the Consul namespace consulNS of the pods in the
+// k8s namespace k8sNS if it doesn't exist. It's marked as mirrored by
+// ClusterName if it's the namespace k8sNS is mirrored to.
+func (h *Handler) ensureNamespace(consulNS, k8sNS string) error {
+	meta := namespaces.MirroredByClusterMeta(consulNS, k8sNS, h.EnableK8SNSMirroring, h.K8SNSMirroringPrefix, h.ClusterName)
+	_, err := namespaces.EnsureExistsWithMeta(h.ConsulClient, consulNS, h.CrossNamespaceACLPolicy, meta)
+	return err
+}
+
+// authMethodInDefaultNamespace returns true if the auth method is defined in
+// the default Consul namespace rather than the namespace services are
+// registered in, which is the case when services are registered in more
+// than one namespace.
+func (h *Handler) authMethodInDefaultNamespace() bool {
+	return h.EnableK8SNSMirroring || h.NamespaceMapping != nil
 }
 
 func portValue(pod *corev1.Pod, value string) (int32, error) {
@@ -179,6 +179,7 @@ func TestHandler_MutateWithNamespaces(t *testing.T) {
 				ConsulDestinationNamespace: "default", // will be overridden
 				EnableK8SNSMirroring:       true,
 				K8SNSMirroringPrefix:       "k8s-",
+				ClusterName:                "dc1-k8s",
 			},
 			v1beta1.AdmissionRequest{
 				Object: encodeRaw(t, &corev1.Pod{
@@ -233,6 +234,10 @@ func TestHandler_MutateWithNamespaces(t *testing.T) {
 						"namespace %s does not contain external-source metadata key", ns)
 					require.Equalf("kubernetes", actNamespace.Meta["external-source"],
 						"namespace %s has wrong value for external-source metadata key", ns)
+					// Mirrored namespaces are marked with the cluster name
+					// so that the controller can delete them.
+					require.Equalf(tt.Handler.ClusterName, actNamespace.Meta["external-k8s-mirrored-by-cluster"],
+						"namespace %s has wrong value for external-k8s-mirrored-by-cluster metadata key", ns)
 				}
 
 			}
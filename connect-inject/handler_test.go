@@ -2,11 +2,13 @@ package connectinject
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/deckarep/golang-set"
+	"github.com/hashicorp/consul-k8s/namespaces"
 	"github.com/hashicorp/go-hclog"
 	"github.com/mattbaird/jsonpatch"
 	"github.com/stretchr/testify/require"
@@ -144,6 +146,10 @@ func TestHandlerHandle(t *testing.T) {
 					Operation: "add",
 					Path:      "/spec/volumes",
 				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/0/volumeMounts",
+				},
 				{
 					Operation: "add",
 					Path:      "/spec/containers/0/env",
@@ -160,6 +166,10 @@ func TestHandlerHandle(t *testing.T) {
 					Operation: "add",
 					Path:      "/spec/containers/0/env/-",
 				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/0/env/-",
+				},
 				{
 					Operation: "add",
 					Path:      "/spec/initContainers",
@@ -453,6 +463,184 @@ func TestHandlerHandle(t *testing.T) {
 				},
 			},
 		},
+
+		{
+			"connect native pod",
+			Handler{
+				Log:                   hclog.Default().Named("handler"),
+				AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+				DenyK8sNamespacesSet:  mapset.NewSet(),
+			},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							annotationConnectNative: "true",
+						},
+					},
+					Spec: basicSpec,
+				}),
+			},
+			"",
+			[]jsonpatch.JsonPatchOperation{
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationService),
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/volumes",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/0/volumeMounts",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/0/env",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/0/env/-",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/0/env/-",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/-",
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationStatus),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/labels",
+				},
+			},
+		},
+
+		{
+			"gateway pod with WAN address service",
+			Handler{
+				Log:                   hclog.Default().Named("handler"),
+				AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+				DenyK8sNamespacesSet:  mapset.NewSet(),
+			},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							annotationService:                  "mesh-gateway",
+							annotationPort:                     "8443",
+							annotationGatewayKind:              "mesh-gateway",
+							annotationGatewayWANAddressService: "mesh-gateway",
+						},
+					},
+					Spec: basicSpec,
+				}),
+			},
+			"",
+			[]jsonpatch.JsonPatchOperation{
+				{
+					Operation: "add",
+					Path:      "/spec/volumes",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/initContainers/-",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/-",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/-",
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationStatus),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/labels",
+				},
+			},
+		},
+
+		{
+			"invalid gateway kind annotation",
+			Handler{
+				Log:                   hclog.Default().Named("handler"),
+				AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+				DenyK8sNamespacesSet:  mapset.NewSet(),
+			},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							annotationGatewayKind: "api-gateway",
+						},
+					},
+					Spec: basicSpec,
+				}),
+			},
+			"Error configuring gateway",
+			nil,
+		},
+
+		{
+			"invalid envoy JSON annotation",
+			Handler{
+				Log:                   hclog.Default().Named("handler"),
+				AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+				DenyK8sNamespacesSet:  mapset.NewSet(),
+			},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							annotationEnvoyTracingJSON: "{",
+						},
+					},
+					Spec: basicSpec,
+				}),
+			},
+			"Error validating Envoy annotations",
+			nil,
+		},
+
+		{
+			"invalid connect native annotation",
+			Handler{
+				Log:                   hclog.Default().Named("handler"),
+				AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+				DenyK8sNamespacesSet:  mapset.NewSet(),
+			},
+			v1beta1.AdmissionRequest{
+				Object: encodeRaw(t, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							annotationConnectNative: "not-a-bool",
+						},
+					},
+					Spec: basicSpec,
+				}),
+			},
+			"Error parsing connect-native annotation",
+			nil,
+		},
 	}
 
 	for _, tt := range cases {
@@ -863,13 +1051,93 @@ func TestConsulNamespace(t *testing.T) {
 				K8SNSMirroringPrefix:       tt.K8SNSMirroringPrefix,
 			}
 
-			ns := h.consulNamespace(tt.K8sNamespace)
+			ns, err := h.consulNamespace(tt.K8sNamespace)
 
+			require.NoError(err)
 			require.Equal(tt.Expected, ns)
 		})
 	}
 }
 
+// Test that the namespace mapping takes precedence over mirroring and that
+// unmapped namespaces fall back to it.
+func TestConsulNamespace_Mapping(t *testing.T) {
+	mapping, err := namespaces.ParseMapping([]byte(`{
+  "rules": [
+    {"namespace": "payments", "consulNamespace": "billing"},
+    {"selector": "tenant=acme", "consulNamespace": "acme"}
+  ]
+}`))
+	require.NoError(t, err)
+	h := Handler{
+		Log:                  hclog.Default().Named("handler"),
+		EnableNamespaces:     true,
+		EnableK8SNSMirroring: true,
+		K8SNSMirroringPrefix: "k8s-",
+		NamespaceMapping:     mapping,
+		NamespaceLabels: func(kubeNS string) (map[string]string, error) {
+			if kubeNS == "web" {
+				return map[string]string{"tenant": "acme"}, nil
+			}
+			return nil, nil
+		},
+	}
+
+	for k8sNS, expNS := range map[string]string{
+		"payments": "billing",
+		"web":      "acme",
+		"other":    "k8s-other",
+	} {
+		ns, err := h.consulNamespace(k8sNS)
+		require.NoError(t, err)
+		require.Equal(t, expNS, ns)
+	}
+	require.True(t, h.authMethodInDefaultNamespace())
+}
+
+// Test that the containers can't be created if the namespace mapping can't
+// be evaluated rather than registering the service in the default Consul
+// namespace.
+func TestConsulNamespace_MappingError(t *testing.T) {
+	mapping, err := namespaces.ParseMapping([]byte(`{
+  "rules": [
+    {"selector": "tenant=acme", "consulNamespace": "acme"}
+  ]
+}`))
+	require.NoError(t, err)
+	h := Handler{
+		Log:              hclog.Default().Named("handler"),
+		AuthMethod:       "auth-method",
+		EnableNamespaces: true,
+		NamespaceMapping: mapping,
+		NamespaceLabels: func(string) (map[string]string, error) {
+			return nil, errors.New("namespace not found")
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{annotationService: "web"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "web"}},
+			Volumes: []corev1.Volume{
+				{
+					Name: "default-token-podid",
+				},
+			},
+		},
+	}
+
+	_, err = h.consulNamespace("web")
+	require.Error(t, err)
+	_, err = h.containerInit(pod, "web")
+	require.Error(t, err)
+	_, err = h.envoySidecar(pod, "web")
+	require.Error(t, err)
+	_, err = h.lifecycleSidecar(pod, "web")
+	require.Error(t, err)
+}
+
 // Test shouldInject function
 func TestShouldInject(t *testing.T) {
 	cases := []struct {
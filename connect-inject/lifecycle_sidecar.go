@@ -1,20 +1,87 @@
 package connectinject
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-func (h *Handler) lifecycleSidecar(pod *corev1.Pod) corev1.Container {
+// lifecycleSidecarContainerName is the name of the lifecycle sidecar
+// container.
+const lifecycleSidecarContainerName = "consul-connect-lifecycle-sidecar"
+
+// DefaultLifecycleSidecarPort is the default port the lifecycle sidecar
+// serves its health check and metrics endpoints on.
+const DefaultLifecycleSidecarPort = 20300
+
+func (h *Handler) lifecycleSidecar(pod *corev1.Pod, k8sNamespace string) (corev1.Container, error) {
+	port, err := h.lifecycleSidecarPort(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
 	command := []string{
 		"consul-k8s",
 		"lifecycle-sidecar",
 		"-service-config", "/consul/connect-inject/service.hcl",
-		"-consul-binary", "/consul/connect-inject/consul",
+		fmt.Sprintf("-listen=:%d", port),
+	}
+	volMounts := []corev1.VolumeMount{
+		{
+			Name:      volumeName,
+			MountPath: "/consul/connect-inject",
+		},
+	}
+	authMethod := h.authMethod(pod)
+	if authMethod != "" {
+		// The lifecycle sidecar logs in to the auth method again using the
+		// service account token if the ACL token written by the init
+		// container is no longer valid.
+		command = append(command,
+			"-token-file=/consul/connect-inject/acl-token",
+			"-auth-method="+authMethod,
+			// Kubernetes will interpolate POD_NAMESPACE and POD_NAME.
+			"-login-meta=pod=$(POD_NAMESPACE)/$(POD_NAME)",
+		)
+		ns, err := h.consulNamespace(k8sNamespace)
+		if err != nil {
+			return corev1.Container{}, err
+		}
+		if ns != "" {
+			// If namespace mirroring or a namespace mapping is
+			// enabled, the auth method is defined in the default
+			// namespace.
+			if h.authMethodInDefaultNamespace() {
+				ns = "default"
+			}
+			command = append(command, "-auth-method-namespace="+ns)
+		}
+
+		saTokenVolumeMount, err := findServiceAccountVolumeMount(pod)
+		if err != nil {
+			return corev1.Container{}, err
+		}
+		volMounts = append(volMounts, saTokenVolumeMount)
+	}
+
+	// Connect-native services have no Envoy sidecar, so the lifecycle
+	// sidecar writes their certificates and, in place of Envoy's preStop
+	// hook, deregisters them on shutdown.
+	if native, _ := isConnectNative(pod); native {
+		command = append(command,
+			"-connect-certs-dir=/consul/connect-inject",
+			"-deregister-on-shutdown",
+		)
 	}
-	if h.AuthMethod != "" {
-		command = append(command, "-token-file=/consul/connect-inject/acl-token")
+
+	if h.writesUpstreamsFile(pod) {
+		command = append(command, "-upstreams-file="+upstreamsFile)
+	}
+
+	if _, ok := h.statefulSetIdentity(pod); ok {
+		command = append(command, "-write-statefulset-resolvers")
 	}
 
 	if period, ok := pod.Annotations[annotationSyncPeriod]; ok {
@@ -29,6 +96,22 @@ func (h *Handler) lifecycleSidecar(pod *corev1.Pod) corev1.Container {
 			},
 		},
 	}
+	if authMethod != "" {
+		envVariables = append(envVariables,
+			corev1.EnvVar{
+				Name: "POD_NAME",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+				},
+			},
+			corev1.EnvVar{
+				Name: "POD_NAMESPACE",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+				},
+			},
+		)
+	}
 
 	if h.ConsulCACert != "" {
 		envVariables = append(envVariables,
@@ -53,17 +136,56 @@ func (h *Handler) lifecycleSidecar(pod *corev1.Pod) corev1.Container {
 			})
 	}
 
-	return corev1.Container{
-		Name:  "consul-connect-lifecycle-sidecar",
-		Image: h.ImageConsulK8S,
-		Env:   envVariables,
-		VolumeMounts: []corev1.VolumeMount{
-			{
-				Name:      volumeName,
-				MountPath: "/consul/connect-inject",
+	// The readiness check fails once the sidecar has failed to register the
+	// service several times in a row, which takes the pod out of rotation.
+	// The liveness check only fails if the sidecar itself is unresponsive
+	// so that restarting the local Consul agent doesn't restart every
+	// sidecar on the node.
+	readinessProbe := &corev1.Probe{
+		Handler: corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: "/health/ready",
+				Port: intstr.FromInt(port),
+			},
+		},
+		PeriodSeconds:    10,
+		FailureThreshold: 3,
+	}
+	livenessProbe := &corev1.Probe{
+		Handler: corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: "/health/live",
+				Port: intstr.FromInt(port),
 			},
 		},
-		Command:   command,
-		Resources: h.LifecycleSidecarResources,
+		PeriodSeconds:    10,
+		FailureThreshold: 3,
+	}
+
+	return corev1.Container{
+		Name:           lifecycleSidecarContainerName,
+		Image:          h.ImageConsulK8S,
+		Env:            envVariables,
+		VolumeMounts:   volMounts,
+		Command:        command,
+		Resources:      h.LifecycleSidecarResources,
+		ReadinessProbe: readinessProbe,
+		LivenessProbe:  livenessProbe,
+	}, nil
+}
+
+// lifecycleSidecarPort returns the port the lifecycle sidecar listens on
+// from the pod's annotation, falling back to the handler's default.
+func (h *Handler) lifecycleSidecarPort(pod *corev1.Pod) (int, error) {
+	if raw, ok := pod.Annotations[annotationLifecycleSidecarPort]; ok {
+		port, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil || port < 1 || port > 65535 {
+			return 0, fmt.Errorf("%s annotation value of %q is not a valid port", annotationLifecycleSidecarPort, raw)
+		}
+		return port, nil
+	}
+	if h.LifecycleSidecarPort != 0 {
+		return h.LifecycleSidecarPort, nil
 	}
+	return DefaultLifecycleSidecarPort, nil
 }
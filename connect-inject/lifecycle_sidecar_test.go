@@ -1,6 +1,7 @@
 package connectinject
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/hashicorp/go-hclog"
@@ -8,6 +9,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 var (
@@ -21,6 +23,28 @@ var (
 			corev1.ResourceMemory: resource.MustParse("50Mi"),
 		},
 	}
+
+	lifecycleReadinessProbe = &corev1.Probe{
+		Handler: corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: "/health/ready",
+				Port: intstr.FromInt(20300),
+			},
+		},
+		PeriodSeconds:    10,
+		FailureThreshold: 3,
+	}
+
+	lifecycleLivenessProbe = &corev1.Probe{
+		Handler: corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: "/health/live",
+				Port: intstr.FromInt(20300),
+			},
+		},
+		PeriodSeconds:    10,
+		FailureThreshold: 3,
+	}
 )
 
 // NOTE: This is tested here rather than in handler_test because doing it there
@@ -34,7 +58,7 @@ func TestLifecycleSidecar_Default(t *testing.T) {
 		ImageConsulK8S:            "hashicorp/consul-k8s:9.9.9",
 		LifecycleSidecarResources: lifecycleResources,
 	}
-	container := handler.lifecycleSidecar(&corev1.Pod{
+	container, err := handler.lifecycleSidecar(&corev1.Pod{
 		Spec: corev1.PodSpec{
 			Containers: []corev1.Container{
 				{
@@ -42,7 +66,8 @@ func TestLifecycleSidecar_Default(t *testing.T) {
 				},
 			},
 		},
-	})
+	}, "default")
+	require.NoError(t, err)
 	require.Equal(t, corev1.Container{
 		Name:  "consul-connect-lifecycle-sidecar",
 		Image: "hashicorp/consul-k8s:9.9.9",
@@ -67,14 +92,16 @@ func TestLifecycleSidecar_Default(t *testing.T) {
 		Command: []string{
 			"consul-k8s", "lifecycle-sidecar",
 			"-service-config", "/consul/connect-inject/service.hcl",
-			"-consul-binary", "/consul/connect-inject/consul",
+			"-listen=:20300",
 		},
-		Resources: lifecycleResources,
+		Resources:      lifecycleResources,
+		ReadinessProbe: lifecycleReadinessProbe,
+		LivenessProbe:  lifecycleLivenessProbe,
 	}, container)
 }
 
-// Test that if there's an auth method we set the -token-file flag
-// and if there isn't we don't.
+// Test that if there's an auth method we set the flags needed to log in again
+// and mount the service account token, and if there isn't we don't.
 func TestLifecycleSidecar_AuthMethod(t *testing.T) {
 	for _, authMethod := range []string{"", "auth-method"} {
 		t.Run("authmethod: "+authMethod, func(t *testing.T) {
@@ -83,28 +110,122 @@ func TestLifecycleSidecar_AuthMethod(t *testing.T) {
 				AuthMethod:     authMethod,
 				ImageConsulK8S: "hashicorp/consul-k8s:9.9.9",
 			}
-			container := handler.lifecycleSidecar(&corev1.Pod{
+			saVolumeMount := corev1.VolumeMount{
+				Name:      "sa-token",
+				MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+				ReadOnly:  true,
+			}
+			container, err := handler.lifecycleSidecar(&corev1.Pod{
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{
 						{
-							Name: "web",
+							Name:         "web",
+							VolumeMounts: []corev1.VolumeMount{saVolumeMount},
 						},
 					},
 				},
-			})
+			}, "default")
+			require.NoError(t, err)
 
+			authFlags := []string{
+				"-token-file=/consul/connect-inject/acl-token",
+				"-auth-method=auth-method",
+				"-login-meta=pod=$(POD_NAMESPACE)/$(POD_NAME)",
+			}
 			if authMethod == "" {
-				require.NotContains(t, container.Command, "-token-file=/consul/connect-inject/acl-token")
+				for _, flag := range authFlags {
+					require.NotContains(t, container.Command, flag)
+				}
+				require.NotContains(t, container.VolumeMounts, saVolumeMount)
 			} else {
-				require.Contains(t,
-					container.Command,
-					"-token-file=/consul/connect-inject/acl-token",
-				)
+				for _, flag := range authFlags {
+					require.Contains(t, container.Command, flag)
+				}
+				require.Contains(t, container.VolumeMounts, saVolumeMount)
+				require.Contains(t, container.Env, corev1.EnvVar{
+					Name: "POD_NAME",
+					ValueFrom: &corev1.EnvVarSource{
+						FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+					},
+				})
+				require.Contains(t, container.Env, corev1.EnvVar{
+					Name: "POD_NAMESPACE",
+					ValueFrom: &corev1.EnvVarSource{
+						FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+					},
+				})
 			}
 		})
 	}
 }
 
+// Test that we error if there's an auth method and the service account token
+// isn't mounted since we need it to log in.
+func TestLifecycleSidecar_AuthMethodNoServiceAccountToken(t *testing.T) {
+	handler := Handler{
+		Log:            hclog.Default().Named("handler"),
+		AuthMethod:     "auth-method",
+		ImageConsulK8S: "hashicorp/consul-k8s:9.9.9",
+	}
+	_, err := handler.lifecycleSidecar(&corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}, "default")
+	require.EqualError(t, err, "Unable to find service account token volumeMount")
+}
+
+// Test that we pass the namespace of the auth method when namespaces
+// are enabled.
+func TestLifecycleSidecar_AuthMethodNamespace(t *testing.T) {
+	cases := map[string]struct {
+		mirroring bool
+		expFlag   string
+	}{
+		"destination namespace": {
+			mirroring: false,
+			expFlag:   "-auth-method-namespace=dest",
+		},
+		"mirroring": {
+			mirroring: true,
+			expFlag:   "-auth-method-namespace=default",
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			handler := Handler{
+				Log:                        hclog.Default().Named("handler"),
+				AuthMethod:                 "auth-method",
+				ImageConsulK8S:             "hashicorp/consul-k8s:9.9.9",
+				EnableNamespaces:           true,
+				ConsulDestinationNamespace: "dest",
+				EnableK8SNSMirroring:       c.mirroring,
+			}
+			container, err := handler.lifecycleSidecar(&corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "sa-token",
+									MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+								},
+							},
+						},
+					},
+				},
+			}, "k8s-ns")
+			require.NoError(t, err)
+			require.Contains(t, container.Command, c.expFlag)
+		})
+	}
+}
+
 // Test that if there's an annotation on the original pod that changes the sync
 // period we use that value.
 func TestLifecycleSidecar_SyncPeriodAnnotation(t *testing.T) {
@@ -112,7 +233,7 @@ func TestLifecycleSidecar_SyncPeriodAnnotation(t *testing.T) {
 		Log:            hclog.Default().Named("handler"),
 		ImageConsulK8S: "hashicorp/consul-k8s:9.9.9",
 	}
-	container := handler.lifecycleSidecar(&corev1.Pod{
+	container, err := handler.lifecycleSidecar(&corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Annotations: map[string]string{
 				"consul.hashicorp.com/connect-sync-period": "55s",
@@ -125,11 +246,153 @@ func TestLifecycleSidecar_SyncPeriodAnnotation(t *testing.T) {
 				},
 			},
 		},
-	})
+	}, "default")
+	require.NoError(t, err)
 
 	require.Contains(t, container.Command, "-sync-period=55s")
 }
 
+// Test that the listen port and probes use the handler's port, overridden
+// by the pod's annotation, and that an invalid annotation is an error.
+func TestLifecycleSidecar_Port(t *testing.T) {
+	cases := map[string]struct {
+		HandlerPort int
+		Annotation  string
+		ExpPort     int
+		ExpErr      string
+	}{
+		"default": {
+			ExpPort: 20300,
+		},
+		"handler port": {
+			HandlerPort: 21000,
+			ExpPort:     21000,
+		},
+		"annotation overrides handler port": {
+			HandlerPort: 21000,
+			Annotation:  "22000",
+			ExpPort:     22000,
+		},
+		"invalid annotation": {
+			Annotation: "http",
+			ExpErr:     `consul.hashicorp.com/lifecycle-sidecar-port annotation value of "http" is not a valid port`,
+		},
+		"out of range annotation": {
+			Annotation: "70000",
+			ExpErr:     `consul.hashicorp.com/lifecycle-sidecar-port annotation value of "70000" is not a valid port`,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			handler := Handler{
+				Log:                  hclog.Default().Named("handler"),
+				ImageConsulK8S:       "hashicorp/consul-k8s:9.9.9",
+				LifecycleSidecarPort: c.HandlerPort,
+			}
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			if c.Annotation != "" {
+				pod.Annotations = map[string]string{annotationLifecycleSidecarPort: c.Annotation}
+			}
+			container, err := handler.lifecycleSidecar(pod, "default")
+			if c.ExpErr != "" {
+				require.EqualError(t, err, c.ExpErr)
+				return
+			}
+			require.NoError(t, err)
+
+			require.Contains(t, container.Command, fmt.Sprintf("-listen=:%d", c.ExpPort))
+			require.Equal(t, "/health/ready", container.ReadinessProbe.HTTPGet.Path)
+			require.Equal(t, intstr.FromInt(c.ExpPort), container.ReadinessProbe.HTTPGet.Port)
+			require.Equal(t, "/health/live", container.LivenessProbe.HTTPGet.Path)
+			require.Equal(t, intstr.FromInt(c.ExpPort), container.LivenessProbe.HTTPGet.Port)
+		})
+	}
+}
+
+func TestLifecycleSidecar_ConnectNative(t *testing.T) {
+	handler := Handler{
+		Log:            hclog.Default().Named("handler"),
+		ImageConsulK8S: "hashicorp/consul-k8s:9.9.9",
+	}
+	container, err := handler.lifecycleSidecar(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationConnectNative: "true",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}, "default")
+	require.NoError(t, err)
+
+	require.Contains(t, container.Command, "-connect-certs-dir=/consul/connect-inject")
+	require.Contains(t, container.Command, "-deregister-on-shutdown")
+}
+
+func TestLifecycleSidecar_UpstreamsFile(t *testing.T) {
+	cases := map[string]struct {
+		annotations map[string]string
+		expFlag     bool
+	}{
+		"upstreams": {
+			annotations: map[string]string{
+				annotationUpstreams: "db:1234",
+			},
+			expFlag: true,
+		},
+		"no upstreams": {
+			annotations: map[string]string{},
+		},
+		"connect native": {
+			annotations: map[string]string{
+				annotationUpstreams:     "db:1234",
+				annotationConnectNative: "true",
+			},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			handler := Handler{
+				Log:            hclog.Default().Named("handler"),
+				ImageConsulK8S: "hashicorp/consul-k8s:9.9.9",
+			}
+			container, err := handler.lifecycleSidecar(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: c.annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}, "default")
+			require.NoError(t, err)
+
+			if c.expFlag {
+				require.Contains(t, container.Command, "-upstreams-file=/consul/connect-inject/upstreams.json")
+			} else {
+				require.NotContains(t, container.Command, "-upstreams-file=/consul/connect-inject/upstreams.json")
+			}
+		})
+	}
+}
+
 // Test that the Consul address uses HTTPS
 // and that the CA is provided
 func TestLifecycleSidecar_TLS(t *testing.T) {
@@ -139,7 +402,7 @@ func TestLifecycleSidecar_TLS(t *testing.T) {
 		ConsulCACert:              "consul-ca-cert",
 		LifecycleSidecarResources: lifecycleResources,
 	}
-	container := handler.lifecycleSidecar(&corev1.Pod{
+	container, err := handler.lifecycleSidecar(&corev1.Pod{
 		Spec: corev1.PodSpec{
 			Containers: []corev1.Container{
 				{
@@ -147,7 +410,8 @@ func TestLifecycleSidecar_TLS(t *testing.T) {
 				},
 			},
 		},
-	})
+	}, "default")
+	require.NoError(t, err)
 	require.Equal(t, corev1.Container{
 		Name:  "consul-connect-lifecycle-sidecar",
 		Image: "hashicorp/consul-k8s:9.9.9",
@@ -176,8 +440,10 @@ func TestLifecycleSidecar_TLS(t *testing.T) {
 		Command: []string{
 			"consul-k8s", "lifecycle-sidecar",
 			"-service-config", "/consul/connect-inject/service.hcl",
-			"-consul-binary", "/consul/connect-inject/consul",
+			"-listen=:20300",
 		},
-		Resources: lifecycleResources,
+		Resources:      lifecycleResources,
+		ReadinessProbe: lifecycleReadinessProbe,
+		LivenessProbe:  lifecycleLivenessProbe,
 	}, container)
 }
@@ -78,6 +78,30 @@ func addEnvVar(target, add []corev1.EnvVar, base string) []jsonpatch.JsonPatchOp
 	return result
 }
 
+func addVolumeMount(target, add []corev1.VolumeMount, base string) []jsonpatch.JsonPatchOperation {
+	var result []jsonpatch.JsonPatchOperation
+	first := len(target) == 0
+	var value interface{}
+	for _, v := range add {
+		value = v
+		path := base
+		if first {
+			first = false
+			value = []corev1.VolumeMount{v}
+		} else {
+			path = path + "/-"
+		}
+
+		result = append(result, jsonpatch.JsonPatchOperation{
+			Operation: "add",
+			Path:      path,
+			Value:     value,
+		})
+	}
+
+	return result
+}
+
 func updateAnnotation(target, add map[string]string) []jsonpatch.JsonPatchOperation {
 	var result []jsonpatch.JsonPatchOperation
 	if len(target) == 0 {
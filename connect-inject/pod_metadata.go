@@ -0,0 +1,114 @@
+package connectinject
+
+import (
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Pod information that can be added to the service meta via
+// Handler.PodInfoToMeta.
+const (
+	PodInfoNodeName   = "node-name"
+	PodInfoNamespace  = "namespace"
+	PodInfoController = "controller"
+)
+
+// Service meta keys set from pod information.
+const (
+	metaKeyNodeName       = "k8s-node-name"
+	metaKeyNamespace      = "k8s-namespace"
+	metaKeyControllerKind = "k8s-controller-kind"
+	metaKeyControllerName = "k8s-controller-name"
+)
+
+// invalidMetaKeyChars matches the characters that Consul doesn't allow in
+// service meta keys.
+var invalidMetaKeyChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// MetaKeyForLabel returns the service meta key used for a pod label when no
+// key is configured explicitly. Characters Consul doesn't allow in meta keys,
+// e.g. the dots and slash in "app.kubernetes.io/version", are replaced
+// with underscores.
+func MetaKeyForLabel(label string) string {
+	return invalidMetaKeyChars.ReplaceAllString(label, "_")
+}
+
+// IsValidMetaKey returns true if key can be used as a Consul service
+// meta key.
+func IsValidMetaKey(key string) bool {
+	return key != "" && !invalidMetaKeyChars.MatchString(key)
+}
+
+// podMeta returns the service meta built from the pod's labels and
+// information allowed by PodLabelsToMeta and PodInfoToMeta. Values may
+// reference environment variables of the init container since the node
+// isn't known until the pod is scheduled.
+func (h *Handler) podMeta(pod *corev1.Pod) map[string]string {
+	meta := make(map[string]string)
+	for label, key := range h.PodLabelsToMeta {
+		if value, ok := pod.Labels[label]; ok {
+			meta[key] = value
+		}
+	}
+
+	for _, info := range h.PodInfoToMeta {
+		switch info {
+		case PodInfoNodeName:
+			meta[metaKeyNodeName] = "${NODE_NAME}"
+		case PodInfoNamespace:
+			meta[metaKeyNamespace] = "${POD_NAMESPACE}"
+		case PodInfoController:
+			if kind, name := podController(pod); kind != "" {
+				meta[metaKeyControllerKind] = kind
+				meta[metaKeyControllerName] = name
+			}
+		}
+	}
+	return meta
+}
+
+// podLabelTags returns the values of the pod labels allowed by
+// PodLabelsToTags so they can be added as service tags.
+func (h *Handler) podLabelTags(pod *corev1.Pod) []string {
+	var tags []string
+	for _, label := range h.PodLabelsToTags {
+		if value, ok := pod.Labels[label]; ok && value != "" {
+			tags = append(tags, value)
+		}
+	}
+	return tags
+}
+
+// podInfoEnabled returns true if info is in PodInfoToMeta.
+func (h *Handler) podInfoEnabled(info string) bool {
+	for _, i := range h.PodInfoToMeta {
+		if i == info {
+			return true
+		}
+	}
+	return false
+}
+
+// podController returns the kind and name of the controller managing the
+// pod. Pods created by a Deployment are owned by one of its ReplicaSets,
+// whose name is the Deployment's name followed by the pod-template-hash
+// label, so we report the Deployment instead. The webhook doesn't look the
+// owners up in the Kubernetes API so this works even though the pod
+// doesn't exist yet.
+func podController(pod *corev1.Pod) (string, string) {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Controller == nil || !*ref.Controller {
+			continue
+		}
+		if ref.Kind == "ReplicaSet" {
+			suffix := "-" + pod.Labels["pod-template-hash"]
+			if suffix != "-" && strings.HasSuffix(ref.Name, suffix) {
+				return "Deployment", strings.TrimSuffix(ref.Name, suffix)
+			}
+		}
+		return ref.Kind, ref.Name
+	}
+	return "", ""
+}
@@ -0,0 +1,70 @@
+package connectinject
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodController(t *testing.T) {
+	controller := true
+	notController := false
+	cases := map[string]struct {
+		labels  map[string]string
+		owners  []metav1.OwnerReference
+		expKind string
+		expName string
+	}{
+		"no owner": {},
+		"deployment": {
+			labels: map[string]string{"pod-template-hash": "abc123"},
+			owners: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: "web-abc123", Controller: &controller},
+			},
+			expKind: "Deployment",
+			expName: "web",
+		},
+		"bare replicaset": {
+			owners: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: "web", Controller: &controller},
+			},
+			expKind: "ReplicaSet",
+			expName: "web",
+		},
+		"statefulset": {
+			owners: []metav1.OwnerReference{
+				{Kind: "StatefulSet", Name: "db", Controller: &controller},
+			},
+			expKind: "StatefulSet",
+			expName: "db",
+		},
+		"owner that isn't the controller": {
+			owners: []metav1.OwnerReference{
+				{Kind: "StatefulSet", Name: "db", Controller: &notController},
+			},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			kind, name := podController(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:          c.labels,
+					OwnerReferences: c.owners,
+				},
+			})
+			require.Equal(t, c.expKind, kind)
+			require.Equal(t, c.expName, name)
+		})
+	}
+}
+
+func TestMetaKeyForLabel(t *testing.T) {
+	require.Equal(t, "app_kubernetes_io_version", MetaKeyForLabel("app.kubernetes.io/version"))
+	require.Equal(t, "team", MetaKeyForLabel("team"))
+	require.True(t, IsValidMetaKey(MetaKeyForLabel("app.kubernetes.io/version")))
+	require.False(t, IsValidMetaKey("app.version"))
+	require.False(t, IsValidMetaKey(""))
+}
@@ -0,0 +1,64 @@
+package connectinject
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// MetaKeyStatefulSetOrdinal is the service meta key that the ordinal of a
+// StatefulSet pod is registered under when Handler.StatefulSetIdentity is
+// enabled. The lifecycle sidecar uses it to write a service-resolver subset
+// for the pod.
+const MetaKeyStatefulSetOrdinal = "k8s-statefulset-ordinal"
+
+// statefulSetOrdinal returns the ordinal of a pod managed by a StatefulSet,
+// e.g. "0" for kafka-0, and false if the pod isn't managed by a
+// StatefulSet. StatefulSet pods are named by their controller so, unlike
+// pods created by a Deployment, their name is known when they're admitted.
+func statefulSetOrdinal(pod *corev1.Pod) (string, bool) {
+	kind, name := podController(pod)
+	if kind != "StatefulSet" {
+		return "", false
+	}
+	ordinal := strings.TrimPrefix(pod.Name, name+"-")
+	if ordinal == pod.Name {
+		return "", false
+	}
+	if _, err := strconv.ParseUint(ordinal, 10, 32); err != nil {
+		return "", false
+	}
+	return ordinal, true
+}
+
+// statefulSetIdentity returns the ordinal of the pod if it should be
+// registered with its own identity, i.e. Handler.StatefulSetIdentity is
+// enabled and the pod is managed by a StatefulSet. Gateways are never
+// addressed individually.
+func (h *Handler) statefulSetIdentity(pod *corev1.Pod) (string, bool) {
+	if !h.StatefulSetIdentity {
+		return "", false
+	}
+	if kind, _ := gatewayKind(pod); kind != "" {
+		return "", false
+	}
+	return statefulSetOrdinal(pod)
+}
+
+// StatefulSetServiceName returns the name that a single StatefulSet pod can
+// be targeted by as an upstream, e.g. "kafka-0" for the pod with ordinal 0
+// of the kafka service.
+func StatefulSetServiceName(service, ordinal string) string {
+	return fmt.Sprintf("%s-%s", service, ordinal)
+}
+
+// StatefulSetResolverSubset returns the service-resolver subset that
+// selects the instance of a StatefulSet pod with the given ordinal.
+func StatefulSetResolverSubset(ordinal string) api.ServiceResolverSubset {
+	return api.ServiceResolverSubset{
+		Filter: fmt.Sprintf("Service.Meta[%q] == %q", MetaKeyStatefulSetOrdinal, ordinal),
+	}
+}
@@ -0,0 +1,227 @@
+package connectinject
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul-k8s/api/common"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/net/context"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// StatefulSetResolverResource deletes the service-resolver subsets and
+// redirects that the lifecycle sidecars of a StatefulSet's pods wrote for
+// the ordinals that no longer exist after the StatefulSet is scaled down
+// or deleted. It implements controller.Resource.
+type StatefulSetResolverResource struct {
+	Log                 hclog.Logger
+	KubernetesClientset kubernetes.Interface
+
+	// Handler is the injector's handler. Its Consul client is used to
+	// update the service-resolvers and its settings determine the service
+	// name and Consul namespace of a StatefulSet's pods.
+	Handler *Handler
+
+	Ctx context.Context
+
+	lock sync.Mutex
+	// services maps the key of each injected StatefulSet to its service so
+	// that its service-resolvers can be cleaned up once it's deleted.
+	services map[string]statefulSetService
+}
+
+// statefulSetService is the Consul service of a StatefulSet's pods.
+type statefulSetService struct {
+	name      string
+	namespace string
+}
+
+// Informer watches the StatefulSets in all namespaces.
+func (r *StatefulSetResolverResource) Informer() cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return r.KubernetesClientset.AppsV1().StatefulSets(metav1.NamespaceAll).List(r.Ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return r.KubernetesClientset.AppsV1().StatefulSets(metav1.NamespaceAll).Watch(r.Ctx, options)
+			},
+		},
+		&appsv1.StatefulSet{},
+		0,
+		cache.Indexers{},
+	)
+}
+
+// Upsert removes the subsets and redirects of the ordinals greater than or
+// equal to the StatefulSet's replicas.
+func (r *StatefulSetResolverResource) Upsert(key string, raw interface{}) error {
+	sts, ok := raw.(*appsv1.StatefulSet)
+	if !ok {
+		return fmt.Errorf("failed to cast to a statefulset object")
+	}
+	svc, ok, err := r.statefulSetService(sts)
+	if err != nil || !ok {
+		return err
+	}
+
+	r.lock.Lock()
+	if r.services == nil {
+		r.services = make(map[string]statefulSetService)
+	}
+	r.services[key] = svc
+	r.lock.Unlock()
+
+	replicas := 1
+	if sts.Spec.Replicas != nil {
+		replicas = int(*sts.Spec.Replicas)
+	}
+	return r.prune(svc, replicas)
+}
+
+// Delete removes all the subsets and redirects of a deleted StatefulSet.
+// StatefulSets deleted while the injector isn't running aren't cleaned up.
+func (r *StatefulSetResolverResource) Delete(key string) error {
+	r.lock.Lock()
+	svc, ok := r.services[key]
+	r.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := r.prune(svc, 0); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	delete(r.services, key)
+	r.lock.Unlock()
+	return nil
+}
+
+// statefulSetService returns the Consul service the StatefulSet's pods are
+// registered as, and false if they aren't injected with their own
+// identity.
+func (r *StatefulSetResolverResource) statefulSetService(sts *appsv1.StatefulSet) (statefulSetService, bool, error) {
+	h := r.Handler
+	if !h.StatefulSetIdentity || !h.namespaceAllowed(sts.Namespace) {
+		return statefulSetService{}, false, nil
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: sts.Spec.Template.ObjectMeta,
+		Spec:       sts.Spec.Template.Spec,
+	}
+	if kind, _ := gatewayKind(pod); kind != "" {
+		return statefulSetService{}, false, nil
+	}
+	if raw, ok := pod.Annotations[annotationInject]; ok {
+		if inject, err := strconv.ParseBool(raw); err != nil || !inject {
+			return statefulSetService{}, false, nil
+		}
+	} else if h.RequireAnnotation {
+		return statefulSetService{}, false, nil
+	}
+
+	name := pod.Annotations[annotationService]
+	if name == "" {
+		if len(pod.Spec.Containers) == 0 {
+			return statefulSetService{}, false, nil
+		}
+		name = pod.Spec.Containers[0].Name
+	}
+	namespace, err := h.consulNamespace(sts.Namespace)
+	if err != nil {
+		return statefulSetService{}, false, err
+	}
+	return statefulSetService{name: name, namespace: namespace}, true, nil
+}
+
+// prune deletes the redirects to the ordinals greater than or equal to
+// replicas that were written by the lifecycle sidecar and removes their
+// subsets from the service's service-resolver, unless it's managed by a
+// ServiceResolver custom resource. Consul rejects removing a subset that a
+// redirect still targets so the redirects are deleted first, and subsets
+// targeted by other redirects are kept.
+func (r *StatefulSetResolverResource) prune(svc statefulSetService, replicas int) error {
+	client := r.Handler.ConsulClient
+	queryOpts := &api.QueryOptions{Namespace: svc.namespace}
+	writeOpts := &api.WriteOptions{Namespace: svc.namespace}
+
+	entries, _, err := client.ConfigEntries().List(api.ServiceResolver, queryOpts)
+	if err != nil {
+		return fmt.Errorf("listing service-resolvers: %s", err)
+	}
+	targeted := make(map[string]bool)
+	for _, entry := range entries {
+		redirect, ok := entry.(*api.ServiceResolverConfigEntry)
+		if !ok || redirect.Redirect == nil || redirect.Redirect.Service != svc.name {
+			continue
+		}
+		if _, removed := removedOrdinal(svc.name, redirect.Name, replicas); !removed ||
+			redirect.Meta[common.ManagedByKey] != common.ManagedByLifecycleSidecar {
+			targeted[redirect.Redirect.ServiceSubset] = true
+			continue
+		}
+		if _, err := client.ConfigEntries().Delete(api.ServiceResolver, redirect.Name, writeOpts); err != nil {
+			return fmt.Errorf("deleting service-resolver %q: %s", redirect.Name, err)
+		}
+		r.Log.Info("deleted service-resolver", "name", redirect.Name, "namespace", svc.namespace)
+	}
+
+	entry, _, err := client.ConfigEntries().Get(api.ServiceResolver, svc.name, queryOpts)
+	if err != nil && !strings.Contains(err.Error(), "404") {
+		return fmt.Errorf("reading service-resolver %q: %s", svc.name, err)
+	}
+	resolver, ok := entry.(*api.ServiceResolverConfigEntry)
+	if !ok || resolver.Meta[common.SourceKey] == common.SourceValue {
+		return nil
+	}
+	removed := false
+	for subset, def := range resolver.Subsets {
+		ordinal, ok := removedOrdinal(svc.name, subset, replicas)
+		if ok && !targeted[subset] && def == StatefulSetResolverSubset(ordinal) {
+			delete(resolver.Subsets, subset)
+			removed = true
+		}
+	}
+	switch {
+	case removed && len(resolver.Subsets) == 0 && resolver.Meta[common.ManagedByKey] == common.ManagedByLifecycleSidecar:
+		if _, err := client.ConfigEntries().Delete(api.ServiceResolver, svc.name, writeOpts); err != nil {
+			return fmt.Errorf("deleting service-resolver %q: %s", svc.name, err)
+		}
+		r.Log.Info("deleted service-resolver", "name", svc.name, "namespace", svc.namespace)
+	case removed:
+		written, _, err := client.ConfigEntries().CAS(resolver, resolver.ModifyIndex, writeOpts)
+		if err != nil {
+			return fmt.Errorf("updating service-resolver %q: %s", svc.name, err)
+		}
+		if !written {
+			return fmt.Errorf("service-resolver %q was modified concurrently", svc.name)
+		}
+		r.Log.Info("removed scaled down subsets from service-resolver", "name", svc.name, "namespace", svc.namespace)
+	}
+	return nil
+}
+
+// removedOrdinal returns the ordinal of a StatefulSet pod's service name,
+// e.g. "2" for kafka-2, and true if it's greater than or equal to replicas.
+func removedOrdinal(service, name string, replicas int) (string, bool) {
+	ordinal := strings.TrimPrefix(name, service+"-")
+	if ordinal == name {
+		return "", false
+	}
+	n, err := strconv.ParseUint(ordinal, 10, 32)
+	if err != nil || strconv.FormatUint(n, 10) != ordinal {
+		return "", false
+	}
+	return ordinal, int(n) >= replicas
+}
@@ -0,0 +1,210 @@
+package connectinject
+
+import (
+	"testing"
+
+	"github.com/deckarep/golang-set"
+	"github.com/hashicorp/consul-k8s/api/common"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStatefulSetResolverResource_statefulSetService(t *testing.T) {
+	cases := map[string]struct {
+		Annotations       map[string]string
+		RequireAnnotation bool
+		Namespace         string
+		ExpService        string
+		ExpOK             bool
+	}{
+		"defaults to the first container": {
+			Namespace:  "default",
+			ExpService: "kafka",
+			ExpOK:      true,
+		},
+		"service annotation": {
+			Annotations: map[string]string{annotationService: "broker"},
+			Namespace:   "default",
+			ExpService:  "broker",
+			ExpOK:       true,
+		},
+		"not annotated when required": {
+			RequireAnnotation: true,
+			Namespace:         "default",
+		},
+		"annotated when required": {
+			Annotations:       map[string]string{annotationInject: "true"},
+			RequireAnnotation: true,
+			Namespace:         "default",
+			ExpService:        "kafka",
+			ExpOK:             true,
+		},
+		"injection disabled": {
+			Annotations: map[string]string{annotationInject: "false"},
+			Namespace:   "default",
+		},
+		"gateway": {
+			Annotations: map[string]string{annotationGatewayKind: "mesh-gateway"},
+			Namespace:   "default",
+		},
+		"system namespace": {
+			Namespace: metav1.NamespaceSystem,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			resource := StatefulSetResolverResource{
+				Handler: &Handler{
+					StatefulSetIdentity:   true,
+					RequireAnnotation:     c.RequireAnnotation,
+					AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+					DenyK8sNamespacesSet:  mapset.NewSet(),
+				},
+			}
+			svc, ok, err := resource.statefulSetService(&appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "kafka", Namespace: c.Namespace},
+				Spec: appsv1.StatefulSetSpec{
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Annotations: c.Annotations},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{Name: "kafka"}},
+						},
+					},
+				},
+			})
+			require.NoError(t, err)
+			require.Equal(t, c.ExpOK, ok)
+			require.Equal(t, c.ExpService, svc.name)
+		})
+	}
+}
+
+func TestRemovedOrdinal(t *testing.T) {
+	cases := []struct {
+		Name       string
+		ExpOrdinal string
+		ExpRemoved bool
+	}{
+		{"kafka-0", "0", false},
+		{"kafka-2", "2", true},
+		{"kafka-10", "10", true},
+		{"kafka-02", "", false},
+		{"kafka-v1", "", false},
+		{"kafka", "", false},
+		{"zookeeper-3", "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			ordinal, removed := removedOrdinal("kafka", c.Name, 2)
+			require.Equal(t, c.ExpRemoved, removed)
+			if removed {
+				require.Equal(t, c.ExpOrdinal, ordinal)
+			}
+		})
+	}
+}
+
+// Test that scaling down a StatefulSet removes the subsets and redirects of
+// the removed ordinals but leaves those written by others.
+func TestStatefulSetResolverResource_Upsert(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	consul, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(err)
+	defer consul.Stop()
+	consul.WaitForLeader(t)
+	client, err := api.NewClient(&api.Config{Address: consul.HTTPAddr})
+	require.NoError(err)
+
+	sidecarMeta := map[string]string{common.ManagedByKey: common.ManagedByLifecycleSidecar}
+	entries := []api.ConfigEntry{
+		&api.ServiceResolverConfigEntry{
+			Kind: api.ServiceResolver,
+			Name: "kafka",
+			Subsets: map[string]api.ServiceResolverSubset{
+				"v1":      {Filter: "Service.Meta.version == v1"},
+				"kafka-0": StatefulSetResolverSubset("0"),
+				"kafka-1": StatefulSetResolverSubset("1"),
+				"kafka-2": StatefulSetResolverSubset("2"),
+			},
+		},
+		&api.ServiceResolverConfigEntry{
+			Kind:     api.ServiceResolver,
+			Name:     "kafka-0",
+			Redirect: &api.ServiceResolverRedirect{Service: "kafka", ServiceSubset: "kafka-0"},
+			Meta:     sidecarMeta,
+		},
+		&api.ServiceResolverConfigEntry{
+			Kind:     api.ServiceResolver,
+			Name:     "kafka-1",
+			Redirect: &api.ServiceResolverRedirect{Service: "kafka", ServiceSubset: "kafka-1"},
+			Meta:     sidecarMeta,
+		},
+		// Not written by the sidecar so it and its subset are kept.
+		&api.ServiceResolverConfigEntry{
+			Kind:     api.ServiceResolver,
+			Name:     "kafka-2",
+			Redirect: &api.ServiceResolverRedirect{Service: "kafka", ServiceSubset: "kafka-2"},
+		},
+	}
+	for _, entry := range entries {
+		_, _, err := client.ConfigEntries().Set(entry, nil)
+		require.NoError(err)
+	}
+
+	resource := StatefulSetResolverResource{
+		Log: hclog.Default().Named("statefulSetResolverResource"),
+		Handler: &Handler{
+			ConsulClient:          client,
+			StatefulSetIdentity:   true,
+			AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+			DenyK8sNamespacesSet:  mapset.NewSet(),
+		},
+	}
+	replicas := int32(1)
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "kafka", Namespace: "default"},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "kafka"}},
+				},
+			},
+		},
+	}
+	require.NoError(resource.Upsert("default/kafka", sts))
+
+	entry, _, err := client.ConfigEntries().Get(api.ServiceResolver, "kafka", nil)
+	require.NoError(err)
+	require.Equal(map[string]api.ServiceResolverSubset{
+		"v1":      {Filter: "Service.Meta.version == v1"},
+		"kafka-0": StatefulSetResolverSubset("0"),
+		"kafka-2": StatefulSetResolverSubset("2"),
+	}, entry.(*api.ServiceResolverConfigEntry).Subsets)
+
+	_, _, err = client.ConfigEntries().Get(api.ServiceResolver, "kafka-0", nil)
+	require.NoError(err)
+	_, _, err = client.ConfigEntries().Get(api.ServiceResolver, "kafka-1", nil)
+	require.Error(err)
+	require.Contains(err.Error(), "404")
+	_, _, err = client.ConfigEntries().Get(api.ServiceResolver, "kafka-2", nil)
+	require.NoError(err)
+
+	// Deleting the StatefulSet removes the remaining ordinal.
+	require.NoError(resource.Delete("default/kafka"))
+	entry, _, err = client.ConfigEntries().Get(api.ServiceResolver, "kafka", nil)
+	require.NoError(err)
+	require.Equal(map[string]api.ServiceResolverSubset{
+		"v1":      {Filter: "Service.Meta.version == v1"},
+		"kafka-2": StatefulSetResolverSubset("2"),
+	}, entry.(*api.ServiceResolverConfigEntry).Subsets)
+	_, _, err = client.ConfigEntries().Get(api.ServiceResolver, "kafka-0", nil)
+	require.Error(err)
+}
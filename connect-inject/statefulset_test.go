@@ -0,0 +1,134 @@
+package connectinject
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStatefulSetOrdinal(t *testing.T) {
+	isController := true
+	cases := map[string]struct {
+		podName    string
+		ownerKind  string
+		ownerName  string
+		expOrdinal string
+		expOK      bool
+	}{
+		"statefulset pod": {
+			podName:    "kafka-0",
+			ownerKind:  "StatefulSet",
+			ownerName:  "kafka",
+			expOrdinal: "0",
+			expOK:      true,
+		},
+		"statefulset name with dashes": {
+			podName:    "my-kafka-12",
+			ownerKind:  "StatefulSet",
+			ownerName:  "my-kafka",
+			expOrdinal: "12",
+			expOK:      true,
+		},
+		"no owner": {
+			podName: "kafka-0",
+		},
+		"not a statefulset": {
+			podName:   "kafka-0",
+			ownerKind: "ReplicaSet",
+			ownerName: "kafka",
+		},
+		"name doesn't match statefulset": {
+			podName:   "zookeeper-0",
+			ownerKind: "StatefulSet",
+			ownerName: "kafka",
+		},
+		"not an ordinal": {
+			podName:   "kafka-abc",
+			ownerKind: "StatefulSet",
+			ownerName: "kafka",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: c.podName,
+				},
+			}
+			if c.ownerKind != "" {
+				pod.OwnerReferences = []metav1.OwnerReference{
+					{
+						Kind:       c.ownerKind,
+						Name:       c.ownerName,
+						Controller: &isController,
+					},
+				}
+			}
+			ordinal, ok := statefulSetOrdinal(pod)
+			require.Equal(t, c.expOK, ok)
+			require.Equal(t, c.expOrdinal, ordinal)
+		})
+	}
+}
+
+func TestHandlerContainerInit_statefulSetIdentity(t *testing.T) {
+	isController := true
+	pod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "kafka-0",
+				Annotations: map[string]string{
+					annotationService: "kafka",
+					annotationTags:    "broker",
+					annotationMeta + MetaKeyStatefulSetOrdinal: "7",
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						Kind:       "StatefulSet",
+						Name:       "kafka",
+						Controller: &isController,
+					},
+				},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name: "kafka",
+					},
+				},
+			},
+		}
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		require := require.New(t)
+		h := Handler{StatefulSetIdentity: true}
+		container, err := h.containerInit(pod(), k8sNamespace)
+		require.NoError(err)
+		actual := strings.Join(container.Command, " ")
+		require.Equal(2, strings.Count(actual, `tags = ["broker","kafka-0"]`))
+		require.Equal(2, strings.Count(actual, `k8s-statefulset-ordinal = "0"`))
+
+		lifecycle, err := h.lifecycleSidecar(pod(), k8sNamespace)
+		require.NoError(err)
+		require.Contains(lifecycle.Command, "-write-statefulset-resolvers")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		require := require.New(t)
+		var h Handler
+		container, err := h.containerInit(pod(), k8sNamespace)
+		require.NoError(err)
+		actual := strings.Join(container.Command, " ")
+		require.Contains(actual, `tags = ["broker"]`)
+		require.Contains(actual, `k8s-statefulset-ordinal = "7"`)
+
+		lifecycle, err := h.lifecycleSidecar(pod(), k8sNamespace)
+		require.NoError(err)
+		require.NotContains(lifecycle.Command, "-write-statefulset-resolvers")
+	})
+}
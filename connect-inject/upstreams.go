@@ -0,0 +1,120 @@
+package connectinject
+
+import (
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// upstreamsFile is the file in the shared volume that the lifecycle sidecar
+// writes the pod's upstreams to, as JSON, so that applications can discover
+// them without parsing annotations.
+const upstreamsFile = "/consul/connect-inject/upstreams.json"
+
+// invalidEnvVarChars matches the characters that can't be used in the
+// names of the upstreams' environment variables.
+var invalidEnvVarChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// upstreams parses the upstreams annotation of the pod. Upstreams are
+// formatted as <service>[.<namespace>]:<port>[:<datacenter>] or
+// prepared_query:<query>:<port>. The namespace is only parsed if Consul
+// namespaces are enabled, otherwise the dot is part of the service name.
+// Upstreams without a valid port are skipped.
+func upstreams(pod *corev1.Pod, namespacesEnabled bool) []initContainerCommandUpstreamData {
+	raw, ok := pod.Annotations[annotationUpstreams]
+	if !ok || raw == "" {
+		return nil
+	}
+
+	var result []initContainerCommandUpstreamData
+	for _, raw := range strings.Split(raw, ",") {
+		parts := strings.SplitN(raw, ":", 3)
+		if len(parts) < 2 {
+			continue
+		}
+
+		var upstream initContainerCommandUpstreamData
+		if strings.TrimSpace(parts[0]) == "prepared_query" {
+			if len(parts) < 3 {
+				continue
+			}
+			upstream.Query = strings.TrimSpace(parts[1])
+			upstream.LocalPort, _ = portValue(pod, strings.TrimSpace(parts[2]))
+		} else {
+			upstream.Name = strings.TrimSpace(parts[0])
+			upstream.LocalPort, _ = portValue(pod, strings.TrimSpace(parts[1]))
+
+			// Parse the namespace if provided
+			if namespacesEnabled {
+				pieces := strings.SplitN(upstream.Name, ".", 2)
+				upstream.Name = pieces[0]
+				if len(pieces) > 1 {
+					upstream.ConsulUpstreamNamespace = pieces[1]
+				}
+			}
+
+			// parse the optional datacenter
+			if len(parts) > 2 {
+				upstream.Datacenter = strings.TrimSpace(parts[2])
+			}
+		}
+
+		if upstream.LocalPort > 0 {
+			result = append(result, upstream)
+		}
+	}
+	return result
+}
+
+// writesUpstreamsFile returns true if the lifecycle sidecar writes the
+// upstreams file for the pod. Connect-native pods have no proxy and so no
+// upstreams.
+func (h *Handler) writesUpstreamsFile(pod *corev1.Pod) bool {
+	if native, _ := isConnectNative(pod); native {
+		return false
+	}
+	if kind, _ := gatewayKind(pod); kind != "" {
+		return false
+	}
+	return len(upstreams(pod, h.EnableNamespaces)) > 0
+}
+
+// envVarPrefix returns the prefix of the upstream's environment variables,
+// e.g. DB for the db service, or DB_NS for the db service in the ns
+// namespace. Characters that aren't allowed in environment variable names
+// are replaced with underscores.
+func (u initContainerCommandUpstreamData) envVarPrefix() string {
+	name := u.Name
+	if u.Query != "" {
+		name = u.Query
+	}
+	if u.ConsulUpstreamNamespace != "" {
+		name += "_" + u.ConsulUpstreamNamespace
+	}
+	name = invalidEnvVarChars.ReplaceAllString(strings.ToUpper(name), "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// legacyEnvVarPrefix returns the prefix that the upstream's environment
+// variables were named with before envVarPrefix, i.e. the service as
+// written in the annotation, upper-cased and with dashes replaced by
+// underscores, e.g. DB.NS for the db service in the ns namespace. Prepared
+// query upstreams had no variables, so it returns an empty string for them.
+//
+// Deprecated: the variables are still set so that existing applications
+// keep working but will be removed in a future release. Use the names
+// returned by envVarPrefix instead.
+func (u initContainerCommandUpstreamData) legacyEnvVarPrefix() string {
+	if u.Query != "" {
+		return ""
+	}
+	name := u.Name
+	if u.ConsulUpstreamNamespace != "" {
+		name += "." + u.ConsulUpstreamNamespace
+	}
+	return strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
@@ -0,0 +1,172 @@
+package connectinject
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// consulKeyPrefix is the prefix of the Consul annotations and labels that
+// can't be changed once a pod is created.
+const consulKeyPrefix = "consul.hashicorp.com/"
+
+// Validate rejects pods that could otherwise bypass injection. Pods that
+// claim to have been injected, which stops the mutating webhook injecting
+// them, must contain the injected containers, and the Consul annotations
+// and labels of existing pods can't be changed. Requests from users or
+// groups in ValidationAllowList are always allowed.
+func (h *Handler) Validate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
+	resp := &v1beta1.AdmissionResponse{
+		Allowed: true,
+		UID:     req.UID,
+	}
+	if req.Operation != v1beta1.Create && req.Operation != v1beta1.Update {
+		return resp
+	}
+	if h.validationAllowed(req.UserInfo.Username, req.UserInfo.Groups) {
+		return resp
+	}
+
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		h.Log.Error("Could not unmarshal request to pod", "err", err)
+		return &v1beta1.AdmissionResponse{
+			UID: req.UID,
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("Could not unmarshal request to pod: %s", err),
+			},
+		}
+	}
+
+	var err error
+	switch req.Operation {
+	case v1beta1.Create:
+		err = validateInjectionStatus(&pod)
+	case v1beta1.Update:
+		var oldPod corev1.Pod
+		if err := json.Unmarshal(req.OldObject.Raw, &oldPod); err != nil {
+			h.Log.Error("Could not unmarshal request to pod", "err", err)
+			return &v1beta1.AdmissionResponse{
+				UID: req.UID,
+				Result: &metav1.Status{
+					Message: fmt.Sprintf("Could not unmarshal old object to pod: %s", err),
+				},
+			}
+		}
+		err = validateConsulKeysUnchanged(&oldPod, &pod)
+	}
+	if err != nil {
+		h.Log.Info("Rejecting pod", "err", err, "Request Name", req.Name,
+			"Namespace", req.Namespace, "User", req.UserInfo.Username)
+		return &v1beta1.AdmissionResponse{
+			UID: req.UID,
+			Result: &metav1.Status{
+				Message: err.Error(),
+				Reason:  metav1.StatusReasonForbidden,
+				Code:    403,
+			},
+		}
+	}
+	return resp
+}
+
+// validationAllowed returns true if the user or any of its groups is in
+// ValidationAllowList.
+func (h *Handler) validationAllowed(username string, groups []string) bool {
+	if h.ValidationAllowList == nil {
+		return false
+	}
+	if h.ValidationAllowList.Contains(username) {
+		return true
+	}
+	for _, group := range groups {
+		if h.ValidationAllowList.Contains(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateInjectionStatus returns an error if the pod has an injection
+// status but doesn't contain the containers that are injected. The
+// mutating webhook runs before us so pods that it injected always
+// contain them.
+func validateInjectionStatus(pod *corev1.Pod) error {
+	if pod.Annotations[annotationClientInjectStatus] != "" && !hasContainer(pod.Spec.InitContainers, ClientInjectInitContainerName) {
+		return fmt.Errorf("pod has annotation %s but is missing the injected container %s",
+			annotationClientInjectStatus, ClientInjectInitContainerName)
+	}
+	if pod.Annotations[annotationStatus] == "" {
+		return nil
+	}
+
+	var missing []string
+	if !hasContainer(pod.Spec.InitContainers, InjectInitContainerName) {
+		missing = append(missing, InjectInitContainerName)
+	}
+	if !hasContainer(pod.Spec.Containers, lifecycleSidecarContainerName) {
+		missing = append(missing, lifecycleSidecarContainerName)
+	}
+	if native, _ := isConnectNative(pod); !native && !hasContainer(pod.Spec.Containers, envoySidecarContainerName) {
+		missing = append(missing, envoySidecarContainerName)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("pod has annotation %s but is missing the injected containers %s",
+			annotationStatus, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// validateConsulKeysUnchanged returns an error if any Consul annotation or
+// label was added, removed or changed between oldPod and pod. The injected
+// containers are configured from them when the pod is created so changing
+// them afterwards would leave the pod's registration out of sync, or mark
+// it as injected when it isn't.
+func validateConsulKeysUnchanged(oldPod, pod *corev1.Pod) error {
+	if keys := changedConsulKeys(oldPod.Annotations, pod.Annotations); len(keys) > 0 {
+		return fmt.Errorf("Consul annotations can't be changed once a pod is created: %s", strings.Join(keys, ", "))
+	}
+	if keys := changedConsulKeys(oldPod.Labels, pod.Labels); len(keys) > 0 {
+		return fmt.Errorf("Consul labels can't be changed once a pod is created: %s", strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// changedConsulKeys returns the sorted Consul keys whose values differ
+// between oldMap and newMap.
+func changedConsulKeys(oldMap, newMap map[string]string) []string {
+	var changed []string
+	for k, v := range oldMap {
+		if !strings.HasPrefix(k, consulKeyPrefix) {
+			continue
+		}
+		if newV, ok := newMap[k]; !ok || newV != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range newMap {
+		if !strings.HasPrefix(k, consulKeyPrefix) {
+			continue
+		}
+		if _, ok := oldMap[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// hasContainer returns true if containers contains a container named name.
+func hasContainer(containers []corev1.Container, name string) bool {
+	for _, c := range containers {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
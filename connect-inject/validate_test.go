@@ -0,0 +1,196 @@
+package connectinject
+
+import (
+	"testing"
+
+	"github.com/deckarep/golang-set"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHandlerValidate(t *testing.T) {
+	injectedPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					annotationService: "web",
+					annotationStatus:  injected,
+				},
+				Labels: map[string]string{
+					labelInject: injected,
+				},
+			},
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{
+					{Name: InjectInitContainerName},
+				},
+				Containers: []corev1.Container{
+					{Name: "web"},
+					{Name: envoySidecarContainerName},
+					{Name: lifecycleSidecarContainerName},
+				},
+			},
+		}
+	}
+
+	cases := map[string]struct {
+		operation v1beta1.Operation
+		oldPod    func() *corev1.Pod
+		pod       func() *corev1.Pod
+		user      authenticationv1.UserInfo
+		expErr    string
+	}{
+		"create injected pod": {
+			operation: v1beta1.Create,
+			pod:       injectedPod,
+		},
+		"create pod without injection status": {
+			operation: v1beta1.Create,
+			pod: func() *corev1.Pod {
+				return &corev1.Pod{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{Name: "web"}},
+					},
+				}
+			},
+		},
+		"create pod claiming injection": {
+			operation: v1beta1.Create,
+			pod: func() *corev1.Pod {
+				pod := injectedPod()
+				pod.Spec.InitContainers = nil
+				pod.Spec.Containers = pod.Spec.Containers[:1]
+				return pod
+			},
+			expErr: "pod has annotation consul.hashicorp.com/connect-inject-status but is missing the injected containers " +
+				"consul-connect-inject-init, consul-connect-lifecycle-sidecar, consul-connect-envoy-sidecar",
+		},
+		"create Connect-native pod without Envoy": {
+			operation: v1beta1.Create,
+			pod: func() *corev1.Pod {
+				pod := injectedPod()
+				pod.Annotations[annotationConnectNative] = "true"
+				pod.Spec.Containers = []corev1.Container{{Name: "web"}, {Name: lifecycleSidecarContainerName}}
+				return pod
+			},
+		},
+		"create pod claiming client injection": {
+			operation: v1beta1.Create,
+			pod: func() *corev1.Pod {
+				return &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							annotationClientInjectStatus: injected,
+						},
+					},
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{Name: "web"}},
+					},
+				}
+			},
+			expErr: "pod has annotation consul.hashicorp.com/client-inject-status but is missing the injected container " +
+				"consul-client-inject-init",
+		},
+		"create pod claiming injection by allowed user": {
+			operation: v1beta1.Create,
+			pod: func() *corev1.Pod {
+				pod := injectedPod()
+				pod.Spec.InitContainers = nil
+				return pod
+			},
+			user: authenticationv1.UserInfo{Username: "system:serviceaccount:consul:consul-connect-injector"},
+		},
+		"update without changing Consul annotations": {
+			operation: v1beta1.Update,
+			oldPod:    injectedPod,
+			pod: func() *corev1.Pod {
+				pod := injectedPod()
+				pod.Annotations["example.com/owner"] = "team-a"
+				pod.Labels["app"] = "web"
+				return pod
+			},
+		},
+		"update changing Consul annotations": {
+			operation: v1beta1.Update,
+			oldPod:    injectedPod,
+			pod: func() *corev1.Pod {
+				pod := injectedPod()
+				pod.Annotations[annotationService] = "db"
+				pod.Annotations[annotationUpstreams] = "db:1234"
+				return pod
+			},
+			expErr: "Consul annotations can't be changed once a pod is created: " +
+				"consul.hashicorp.com/connect-service, consul.hashicorp.com/connect-service-upstreams",
+		},
+		"update removing Consul label": {
+			operation: v1beta1.Update,
+			oldPod:    injectedPod,
+			pod: func() *corev1.Pod {
+				pod := injectedPod()
+				delete(pod.Labels, labelInject)
+				return pod
+			},
+			expErr: "Consul labels can't be changed once a pod is created: consul.hashicorp.com/connect-inject-status",
+		},
+		"update adding injection status": {
+			operation: v1beta1.Update,
+			oldPod: func() *corev1.Pod {
+				return &corev1.Pod{}
+			},
+			pod: func() *corev1.Pod {
+				return &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							annotationStatus: injected,
+						},
+					},
+				}
+			},
+			expErr: "Consul annotations can't be changed once a pod is created: consul.hashicorp.com/connect-inject-status",
+		},
+		"update changing Consul annotations by allowed group": {
+			operation: v1beta1.Update,
+			oldPod:    injectedPod,
+			pod: func() *corev1.Pod {
+				pod := injectedPod()
+				pod.Annotations[annotationService] = "db"
+				return pod
+			},
+			user: authenticationv1.UserInfo{Username: "admin", Groups: []string{"system:masters"}},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			h := Handler{
+				Log: hclog.Default().Named("handler"),
+				ValidationAllowList: mapset.NewSetWith(
+					"system:serviceaccount:consul:consul-connect-injector",
+					"system:masters",
+				),
+			}
+			req := &v1beta1.AdmissionRequest{
+				UID:       "uid",
+				Operation: c.operation,
+				Object:    encodeRaw(t, c.pod()),
+				UserInfo:  c.user,
+			}
+			if c.oldPod != nil {
+				req.OldObject = encodeRaw(t, c.oldPod())
+			}
+
+			resp := h.Validate(req)
+			require.Equal(t, req.UID, resp.UID)
+			if c.expErr == "" {
+				require.True(t, resp.Allowed, "%v", resp.Result)
+			} else {
+				require.False(t, resp.Allowed)
+				require.Equal(t, c.expErr, resp.Result.Message)
+			}
+		})
+	}
+}
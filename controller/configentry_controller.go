@@ -21,6 +21,7 @@ const (
 	FinalizerName                = "finalizers.consul.hashicorp.com"
 	ConsulAgentError             = "ConsulAgentError"
 	ExternallyManagedConfigError = "ExternallyManagedConfigError"
+	NamespaceMappingError        = "NamespaceMappingError"
 )
 
 // Controller is implemented by CRD-specific controllers. It is used by
@@ -68,10 +69,24 @@ type ConfigEntryController struct {
 	// `k8s-default` namespace.
 	NSMirroringPrefix string
 
+	// NamespaceMapping maps k8s namespaces to Consul namespaces. Its rules
+	// take precedence over ConsulDestinationNamespace and EnableNSMirroring.
+	// May be nil.
+	NamespaceMapping *namespaces.Mapping
+
+	// NamespaceLabels returns the labels of a k8s namespace. Only needed if
+	// NamespaceMapping has selector rules.
+	NamespaceLabels namespaces.LabelsFunc
+
 	// CrossNSACLPolicy is the name of the ACL policy to attach to
 	// any created Consul namespaces to allow cross namespace service discovery.
 	// Only necessary if ACLs are enabled.
 	CrossNSACLPolicy string
+
+	// ClusterName is set as the namespaces.MirroredByClusterKey meta of the
+	// Consul namespaces created while mirroring, so that the
+	// NamespaceController with the same ClusterName can delete them. Optional.
+	ClusterName string
 }
 
 // ReconcileEntry reconciles an update to a resource. CRD-specific controller's
@@ -97,6 +112,11 @@ func (r *ConfigEntryController) ReconcileEntry(
 	}
 
 	consulEntry := configEntry.ToConsul(r.DatacenterName)
+	consulNS, err := r.consulNamespace(consulEntry, configEntry.ConsulMirroringNS(), configEntry.ConsulGlobalResource())
+	if err != nil {
+		return r.syncFailed(ctx, logger, crdCtrl, configEntry, NamespaceMappingError,
+			fmt.Errorf("determining consul namespace: %w", err))
+	}
 
 	if configEntry.GetObjectMeta().DeletionTimestamp.IsZero() {
 		// The object is not being deleted, so if it does not have our finalizer,
@@ -114,7 +134,7 @@ func (r *ConfigEntryController) ReconcileEntry(
 			logger.Info("deletion event")
 			// Check to see if consul has config entry with the same name
 			entry, _, err := r.ConsulClient.ConfigEntries().Get(configEntry.ConsulKind(), configEntry.ConsulName(), &capi.QueryOptions{
-				Namespace: r.consulNamespace(consulEntry, configEntry.ConsulMirroringNS(), configEntry.ConsulGlobalResource()),
+				Namespace: consulNS,
 			})
 
 			// Ignore the error where the config entry isn't found in Consul.
@@ -125,7 +145,7 @@ func (r *ConfigEntryController) ReconcileEntry(
 				// Only delete the resource from Consul if it is owned by our datacenter.
 				if entry.GetMeta()[common.DatacenterKey] == r.DatacenterName {
 					_, err := r.ConsulClient.ConfigEntries().Delete(configEntry.ConsulKind(), configEntry.ConsulName(), &capi.WriteOptions{
-						Namespace: r.consulNamespace(consulEntry, configEntry.ConsulMirroringNS(), configEntry.ConsulGlobalResource()),
+						Namespace: consulNS,
 					})
 					if err != nil {
 						return r.syncFailed(ctx, logger, crdCtrl, configEntry, ConsulAgentError,
@@ -150,7 +170,7 @@ func (r *ConfigEntryController) ReconcileEntry(
 
 	// Check to see if consul has config entry with the same name
 	entry, _, err := r.ConsulClient.ConfigEntries().Get(configEntry.ConsulKind(), configEntry.ConsulName(), &capi.QueryOptions{
-		Namespace: r.consulNamespace(consulEntry, configEntry.ConsulMirroringNS(), configEntry.ConsulGlobalResource()),
+		Namespace: consulNS,
 	})
 	// If a config entry with this name does not exist
 	if isNotFoundErr(err) {
@@ -159,8 +179,8 @@ func (r *ConfigEntryController) ReconcileEntry(
 		// If Consul namespaces are enabled we may need to create the
 		// destination consul namespace first.
 		if r.EnableConsulNamespaces {
-			consulNS := r.consulNamespace(consulEntry, configEntry.ConsulMirroringNS(), configEntry.ConsulGlobalResource())
-			created, err := namespaces.EnsureExists(r.ConsulClient, consulNS, r.CrossNSACLPolicy)
+			nsMeta := namespaces.MirroredByClusterMeta(consulNS, req.Namespace, r.EnableNSMirroring, r.NSMirroringPrefix, r.ClusterName)
+			created, err := namespaces.EnsureExistsWithMeta(r.ConsulClient, consulNS, r.CrossNSACLPolicy, nsMeta)
 			if err != nil {
 				return r.syncFailed(ctx, logger, crdCtrl, configEntry, ConsulAgentError,
 					fmt.Errorf("creating consul namespace %q: %w", consulNS, err))
@@ -172,7 +192,7 @@ func (r *ConfigEntryController) ReconcileEntry(
 
 		// Create the config entry
 		_, writeMeta, err := r.ConsulClient.ConfigEntries().Set(consulEntry, &capi.WriteOptions{
-			Namespace: r.consulNamespace(consulEntry, configEntry.ConsulMirroringNS(), configEntry.ConsulGlobalResource()),
+			Namespace: consulNS,
 		})
 		if err != nil {
 			return r.syncFailed(ctx, logger, crdCtrl, configEntry, ConsulAgentError,
@@ -191,14 +211,18 @@ func (r *ConfigEntryController) ReconcileEntry(
 	// Check if the config entry is managed by our datacenter.
 	// Do not process resource if the entry was not created within our datacenter
 	// as it was created in a different cluster which will be managing that config entry.
-	if entry.GetMeta()[common.DatacenterKey] != r.DatacenterName {
+	// Entries written by the lifecycle sidecar, e.g. the service-resolvers
+	// of StatefulSet pods, are adopted by the custom resource.
+	if entry.GetMeta()[common.ManagedByKey] == common.ManagedByLifecycleSidecar {
+		logger.Info("adopting config entry written by the lifecycle sidecar")
+	} else if entry.GetMeta()[common.DatacenterKey] != r.DatacenterName {
 		return r.syncFailed(ctx, logger, crdCtrl, configEntry, ExternallyManagedConfigError, fmt.Errorf("config entry managed in different datacenter: %q", entry.GetMeta()[common.DatacenterKey]))
 	}
 
 	if !configEntry.MatchesConsul(entry) {
 		logger.Info("config entry does not match consul", "modify-index", entry.GetModifyIndex())
 		_, writeMeta, err := r.ConsulClient.ConfigEntries().Set(consulEntry, &capi.WriteOptions{
-			Namespace: r.consulNamespace(consulEntry, configEntry.ConsulMirroringNS(), configEntry.ConsulGlobalResource()),
+			Namespace: consulNS,
 		})
 		if err != nil {
 			return r.syncUnknownWithError(ctx, logger, crdCtrl, configEntry, ConsulAgentError,
@@ -213,24 +237,24 @@ func (r *ConfigEntryController) ReconcileEntry(
 	return ctrl.Result{}, nil
 }
 
-func (r *ConfigEntryController) consulNamespace(configEntry capi.ConfigEntry, namespace string, globalResource bool) string {
+func (r *ConfigEntryController) consulNamespace(configEntry capi.ConfigEntry, namespace string, globalResource bool) (string, error) {
 	// ServiceIntentions have the appropriate Consul Namespace set on them as the value
 	// is defaulted by the webhook. These are then set on the ServiceIntentions config entry
 	// but not on the others. In case the ConfigEntry has the Consul Namespace set, we just
 	// use the namespace assigned instead of attempting to determine it.
 	if configEntry.GetNamespace() != "" {
-		return configEntry.GetNamespace()
+		return configEntry.GetNamespace(), nil
 	}
 
 	// Does not attempt to parse the namespace for global resources like ProxyDefaults or
 	// wildcard namespace destinations are they will not be prefixed and will remain "default"/"*".
 	if !globalResource && namespace != common.WildcardNamespace {
-		return namespaces.ConsulNamespace(namespace, r.EnableConsulNamespaces, r.ConsulDestinationNamespace, r.EnableNSMirroring, r.NSMirroringPrefix)
+		return namespaces.MappedConsulNamespace(r.NamespaceMapping, r.NamespaceLabels, namespace, r.EnableConsulNamespaces, r.ConsulDestinationNamespace, r.EnableNSMirroring, r.NSMirroringPrefix)
 	}
 	if r.EnableConsulNamespaces {
-		return namespace
+		return namespace, nil
 	}
-	return ""
+	return "", nil
 }
 
 func (r *ConfigEntryController) syncFailed(ctx context.Context, logger logr.Logger, updater Controller, configEntry common.ConfigEntryResource, errType string, err error) (ctrl.Result, error) {
@@ -13,6 +13,7 @@ import (
 	"github.com/hashicorp/consul-k8s/api/common"
 	"github.com/hashicorp/consul-k8s/api/v1alpha1"
 	"github.com/hashicorp/consul-k8s/controller"
+	"github.com/hashicorp/consul-k8s/namespaces"
 	capi "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/sdk/testutil"
 	"github.com/stretchr/testify/require"
@@ -214,6 +215,7 @@ func TestConfigEntryController_createsConfigEntry_consulNamespaces(tt *testing.T
 						EnableNSMirroring:          c.Mirror,
 						NSMirroringPrefix:          c.MirrorPrefix,
 						ConsulDestinationNamespace: c.DestConsulNS,
+						ClusterName:                "dc1-k8s",
 					},
 				)
 
@@ -234,6 +236,18 @@ func TestConfigEntryController_createsConfigEntry_consulNamespaces(tt *testing.T
 				result := in.AssertValidConfig(cfg)
 				req.True(result)
 
+				// Only mirrored namespaces are marked with the cluster so that
+				// the namespace controller can delete them.
+				if in.ConsulNamespace != "default" {
+					ns, _, err := consulClient.Namespaces().Read(in.ConsulNamespace, nil)
+					req.NoError(err)
+					if c.Mirror {
+						req.Equal("dc1-k8s", ns.Meta[namespaces.MirroredByClusterKey])
+					} else {
+						req.NotContains(ns.Meta, namespaces.MirroredByClusterKey)
+					}
+				}
+
 				// Check that the status is "synced".
 				err = fakeClient.Get(ctx, types.NamespacedName{
 					Namespace: c.SourceKubeNS,
@@ -2190,6 +2190,82 @@ func TestConfigEntryControllers_doesNotCreateUnownedConfigEntry(t *testing.T) {
 	}
 }
 
+// Test that a service-resolver written by the lifecycle sidecar is
+// overwritten by a ServiceResolver resource for the same service.
+func TestConfigEntryControllers_adoptsLifecycleSidecarConfigEntry(t *testing.T) {
+	t.Parallel()
+	kubeNS := "default"
+	req := require.New(t)
+	ctx := context.Background()
+
+	svcResolver := &v1alpha1.ServiceResolver{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kafka",
+			Namespace: kubeNS,
+		},
+		Spec: v1alpha1.ServiceResolverSpec{
+			Redirect: &v1alpha1.ServiceResolverRedirect{
+				Service: "redirect",
+			},
+		},
+	}
+	s := runtime.NewScheme()
+	s.AddKnownTypes(v1alpha1.GroupVersion, svcResolver)
+	client := fake.NewFakeClientWithScheme(s, svcResolver)
+
+	consul, err := testutil.NewTestServerConfigT(t, nil)
+	req.NoError(err)
+	defer consul.Stop()
+	consul.WaitForServiceIntentions(t)
+	consulClient, err := capi.NewClient(&capi.Config{
+		Address: consul.HTTPAddr,
+	})
+	req.NoError(err)
+
+	written, _, err := consulClient.ConfigEntries().Set(&capi.ServiceResolverConfigEntry{
+		Kind: capi.ServiceResolver,
+		Name: "kafka",
+		Subsets: map[string]capi.ServiceResolverSubset{
+			"kafka-0": {Filter: `Service.Meta["k8s-statefulset-ordinal"] == "0"`},
+		},
+		Meta: map[string]string{common.ManagedByKey: common.ManagedByLifecycleSidecar},
+	}, nil)
+	req.NoError(err)
+	req.True(written)
+
+	r := ServiceResolverController{
+		Client: client,
+		Log:    logrtest.TestLogger{T: t},
+		ConfigEntryController: &ConfigEntryController{
+			ConsulClient:   consulClient,
+			DatacenterName: datacenterName,
+		},
+	}
+	namespacedName := types.NamespacedName{
+		Namespace: kubeNS,
+		Name:      svcResolver.KubernetesName(),
+	}
+	resp, err := r.Reconcile(ctrl.Request{
+		NamespacedName: namespacedName,
+	})
+	req.NoError(err)
+	req.False(resp.Requeue)
+
+	cfg, _, err := consulClient.ConfigEntries().Get(capi.ServiceResolver, "kafka", nil)
+	req.NoError(err)
+	resolver, ok := cfg.(*capi.ServiceResolverConfigEntry)
+	req.True(ok)
+	req.Equal("redirect", resolver.Redirect.Service)
+	req.Empty(resolver.Subsets)
+	req.Equal(datacenterName, resolver.Meta[common.DatacenterKey])
+	req.NotContains(resolver.Meta, common.ManagedByKey)
+
+	err = client.Get(ctx, namespacedName, svcResolver)
+	req.NoError(err)
+	status, _, _ := svcResolver.SyncedCondition()
+	req.Equal(corev1.ConditionTrue, status)
+}
+
 // Test that if the config entry exists in Consul but is not managed by the
 // controller, deleting the resource does not delete the Consul config entry
 func TestConfigEntryControllers_doesNotDeleteUnownedConfig(t *testing.T) {
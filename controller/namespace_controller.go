@@ -0,0 +1,505 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/consul-k8s/api/common"
+	"github.com/hashicorp/consul-k8s/namespaces"
+	capi "github.com/hashicorp/consul/api"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// namespaceInUseRequeueAfter is how long to wait before checking again
+// whether a Consul namespace whose k8s namespace was deleted still has
+// services or config entries, e.g. because its pods are still terminating.
+const namespaceInUseRequeueAfter = 1 * time.Minute
+
+// namespaceWatchRetryAfter is how long to wait before watching the Consul
+// namespaces again after an error.
+const namespaceWatchRetryAfter = 10 * time.Second
+
+// namespaceMetaValueMaxLength is the maximum length of a Consul namespace
+// meta value.
+const namespaceMetaValueMaxLength = 512
+
+const (
+	// annotationNamespaceACLPolicies and annotationNamespaceACLRoles are the
+	// comma-separated names of the ACL policies and roles to add to the
+	// default ACLs of the Consul namespace a k8s namespace is mirrored to.
+	annotationNamespaceACLPolicies = "consul.hashicorp.com/namespace-acl-policies"
+	annotationNamespaceACLRoles    = "consul.hashicorp.com/namespace-acl-roles"
+
+	// metaKeyNamespaceACLPolicies and metaKeyNamespaceACLRoles record the
+	// policies and roles that were added from the annotations, so that they
+	// can be removed when they're removed from the annotations.
+	metaKeyNamespaceACLPolicies = "k8s-acl-policies"
+	metaKeyNamespaceACLRoles    = "k8s-acl-roles"
+)
+
+// namespacedConfigEntryKinds are the kinds of config entries that can be
+// created in a Consul namespace other than default.
+var namespacedConfigEntryKinds = []string{
+	capi.ServiceDefaults,
+	capi.ServiceResolver,
+	capi.ServiceRouter,
+	capi.ServiceSplitter,
+	capi.ServiceIntentions,
+	capi.IngressGateway,
+	capi.TerminatingGateway,
+}
+
+// NamespaceController manages the Consul namespaces that k8s namespaces are
+// mirrored to. If DeleteNamespaces is set, a Consul namespace is deleted once
+// its k8s namespace has been deleted and it has no services, config entries
+// or ACL tokens, roles or policies left. Only the Consul namespaces created
+// for mirrored k8s namespaces by the controller, injector or catalog sync
+// with the same ClusterName are deleted. If
+// SyncMetadata is set, the meta and default ACL policies and roles of the
+// Consul namespace are kept in sync with the k8s namespace's labels and
+// annotations. Only Consul namespaces created by consul-k8s are changed.
+type NamespaceController struct {
+	client.Client
+	Log          logr.Logger
+	ConsulClient *capi.Client
+
+	// NSMirroringPrefix is the prefix added to k8s namespaces to get the
+	// name of the Consul namespace they're mirrored to.
+	NSMirroringPrefix string
+
+	// ClusterName is the namespaces.MirroredByClusterKey meta value of the
+	// Consul namespaces this controller may delete. Required if
+	// DeleteNamespaces is set.
+	ClusterName string
+
+	// DeleteNamespaces causes Consul namespaces to be deleted along with
+	// their k8s namespace.
+	DeleteNamespaces bool
+
+	// DryRun causes the Consul namespaces that would be deleted to be logged
+	// rather than deleted.
+	DryRun bool
+
+	// SyncMetadata causes the labels and annotations in LabelsToMeta and
+	// AnnotationsToMeta, and the ACL policies and roles in the
+	// consul.hashicorp.com/namespace-acl-policies and
+	// consul.hashicorp.com/namespace-acl-roles annotations, to be synced onto
+	// the Consul namespace.
+	SyncMetadata bool
+
+	// AllowedACLPolicies and AllowedACLRoles are the names of the ACL
+	// policies and roles that the namespace-acl-policies and
+	// namespace-acl-roles annotations may add to a Consul namespace. Other
+	// names are logged and ignored, so the annotations have no effect unless
+	// these are set.
+	AllowedACLPolicies map[string]bool
+	AllowedACLRoles    map[string]bool
+
+	// LabelsToMeta and AnnotationsToMeta map the keys of the k8s namespace
+	// labels and annotations to sync to the Consul namespace meta keys they
+	// are synced as.
+	LabelsToMeta      map[string]string
+	AnnotationsToMeta map[string]string
+}
+
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+func (r *NamespaceController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	consulNS := r.NSMirroringPrefix + req.Name
+	logger := r.Log.WithValues("namespace", req.Name, "consul-namespace", consulNS)
+
+	if consulNS == namespaces.DefaultNamespace || consulNS == namespaces.WildcardNamespace {
+		return ctrl.Result{}, nil
+	}
+
+	var kubeNS corev1.Namespace
+	err := r.Get(ctx, client.ObjectKey{Name: req.Name}, &kubeNS)
+	if k8serr.IsNotFound(err) {
+		if r.DeleteNamespaces {
+			return r.deleteConsulNamespace(logger, consulNS)
+		}
+		return ctrl.Result{}, nil
+	} else if err != nil {
+		logger.Error(err, "retrieving namespace")
+		return ctrl.Result{}, err
+	}
+
+	if r.SyncMetadata && kubeNS.DeletionTimestamp.IsZero() {
+		return r.syncConsulNamespace(logger, consulNS, &kubeNS)
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *NamespaceController) deleteConsulNamespace(logger logr.Logger, consulNS string) (ctrl.Result, error) {
+	ns, _, err := r.ConsulClient.Namespaces().Read(consulNS, nil)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if ns == nil {
+		return ctrl.Result{}, nil
+	}
+	if !r.mirroredByCluster(ns) {
+		logger.Info("consul namespace was not created by this cluster's controller - skipping delete")
+		return ctrl.Result{}, nil
+	}
+
+	inUse, err := r.inUse(consulNS)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if inUse != "" {
+		logger.Info("consul namespace still has "+inUse+" - waiting to delete", "requeue-after", namespaceInUseRequeueAfter)
+		return ctrl.Result{RequeueAfter: namespaceInUseRequeueAfter}, nil
+	}
+
+	if r.DryRun {
+		logger.Info("dry run: would delete consul namespace")
+		return ctrl.Result{}, nil
+	}
+	if _, err := r.ConsulClient.Namespaces().Delete(consulNS, nil); err != nil {
+		return ctrl.Result{}, err
+	}
+	logger.Info("consul namespace deleted")
+	return ctrl.Result{}, nil
+}
+
+func (r *NamespaceController) syncConsulNamespace(logger logr.Logger, consulNS string, kubeNS *corev1.Namespace) (ctrl.Result, error) {
+	ns, _, err := r.ConsulClient.Namespaces().Read(consulNS, nil)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if ns == nil {
+		// It's synced by watchCreatedNamespaces once it's created.
+		return ctrl.Result{}, nil
+	}
+	if !createdByConsulK8s(ns) || ns.DeletedAt != nil {
+		return ctrl.Result{}, nil
+	}
+
+	updated := r.syncedNamespace(logger, ns, kubeNS)
+	if reflect.DeepEqual(updated, ns) {
+		return ctrl.Result{}, nil
+	}
+	if _, _, err := r.ConsulClient.Namespaces().Update(updated, nil); err != nil {
+		return ctrl.Result{}, err
+	}
+	logger.Info("consul namespace metadata updated")
+	return ctrl.Result{}, nil
+}
+
+// syncedNamespace returns a copy of ns with the meta and default ACL policies
+// and roles synced from kubeNS.
+func (r *NamespaceController) syncedNamespace(logger logr.Logger, ns *capi.Namespace, kubeNS *corev1.Namespace) *capi.Namespace {
+	updated := *ns
+	updated.Meta = make(map[string]string, len(ns.Meta))
+	for k, v := range ns.Meta {
+		updated.Meta[k] = v
+	}
+	syncMeta := func(from map[string]string, toMeta map[string]string) {
+		for k, metaKey := range toMeta {
+			if IsReservedNamespaceMetaKey(metaKey) {
+				continue
+			}
+			value, ok := from[k]
+			if ok && len(value) > namespaceMetaValueMaxLength {
+				logger.Info("value is too long for namespace meta - skipping", "key", k)
+				ok = false
+			}
+			if ok {
+				updated.Meta[metaKey] = value
+			} else {
+				delete(updated.Meta, metaKey)
+			}
+		}
+	}
+	syncMeta(kubeNS.Labels, r.LabelsToMeta)
+	syncMeta(kubeNS.Annotations, r.AnnotationsToMeta)
+
+	var acls capi.NamespaceACLConfig
+	if ns.ACLs != nil {
+		acls = *ns.ACLs
+	}
+	var managedPolicies, managedRoles []string
+	acls.PolicyDefaults, managedPolicies = syncACLLinks(acls.PolicyDefaults,
+		splitNames(ns.Meta[metaKeyNamespaceACLPolicies]),
+		allowedNames(logger, annotationNamespaceACLPolicies, kubeNS.Annotations[annotationNamespaceACLPolicies], r.AllowedACLPolicies))
+	acls.RoleDefaults, managedRoles = syncACLLinks(acls.RoleDefaults,
+		splitNames(ns.Meta[metaKeyNamespaceACLRoles]),
+		allowedNames(logger, annotationNamespaceACLRoles, kubeNS.Annotations[annotationNamespaceACLRoles], r.AllowedACLRoles))
+	if ns.ACLs != nil || len(managedPolicies) > 0 || len(managedRoles) > 0 {
+		updated.ACLs = &acls
+	}
+	setOrDelete(updated.Meta, metaKeyNamespaceACLPolicies, strings.Join(managedPolicies, ","))
+	setOrDelete(updated.Meta, metaKeyNamespaceACLRoles, strings.Join(managedRoles, ","))
+	return &updated
+}
+
+// inUse returns a description of what's left in the Consul namespace ns, or
+// an empty string if it has no services, config entries or ACL tokens,
+// roles or policies. ACLs are only checked if they're enabled.
+func (r *NamespaceController) inUse(ns string) (string, error) {
+	opts := &capi.QueryOptions{Namespace: ns}
+	services, _, err := r.ConsulClient.Catalog().Services(opts)
+	if err != nil {
+		return "", err
+	}
+	if len(services) > 0 {
+		return "services", nil
+	}
+	for _, kind := range namespacedConfigEntryKinds {
+		entries, _, err := r.ConsulClient.ConfigEntries().List(kind, opts)
+		if err != nil {
+			return "", err
+		}
+		if len(entries) > 0 {
+			return kind + " config entries", nil
+		}
+	}
+
+	tokens, _, err := r.ConsulClient.ACL().TokenList(opts)
+	if isACLDisabledErr(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if len(tokens) > 0 {
+		return "ACL tokens", nil
+	}
+	roles, _, err := r.ConsulClient.ACL().RoleList(opts)
+	if err != nil {
+		return "", err
+	}
+	if len(roles) > 0 {
+		return "ACL roles", nil
+	}
+	policies, _, err := r.ConsulClient.ACL().PolicyList(opts)
+	if err != nil {
+		return "", err
+	}
+	if len(policies) > 0 {
+		return "ACL policies", nil
+	}
+	return "", nil
+}
+
+// isACLDisabledErr returns true if err is the error returned by the ACL
+// endpoints when ACLs aren't enabled.
+func isACLDisabledErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ACL support disabled")
+}
+
+func (r *NamespaceController) SetupWithManager(mgr ctrl.Manager) error {
+	// k8s namespaces deleted while the controller wasn't running don't
+	// generate events, so the Consul namespaces created by consul-k8s are
+	// enqueued on startup as well. Neither does the creation of a Consul
+	// namespace, so they're watched to sync their metadata.
+	events := make(chan event.GenericEvent)
+	if err := mgr.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+		return r.enqueueExisting(events, stop)
+	})); err != nil {
+		return err
+	}
+	if r.SyncMetadata {
+		if err := mgr.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+			return r.watchCreatedNamespaces(events, stop)
+		})); err != nil {
+			return err
+		}
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Namespace{}).
+		Watches(&source.Channel{Source: events}, &handler.EnqueueRequestForObject{}).
+		Complete(r)
+}
+
+// enqueueExisting sends an event for the k8s namespace of every Consul
+// namespace created by this cluster's controller with the mirroring prefix.
+// It doesn't run without a prefix since any Consul namespace could then be
+// a mirrored one.
+func (r *NamespaceController) enqueueExisting(events chan<- event.GenericEvent, stop <-chan struct{}) error {
+	if !r.DeleteNamespaces || r.ClusterName == "" || r.NSMirroringPrefix == "" {
+		r.Log.Info("not checking for consul namespaces of k8s namespaces deleted while the controller wasn't running: " +
+			"requires namespace deletion, a cluster name and a mirroring prefix")
+		return nil
+	}
+	consulNamespaces, _, err := r.ConsulClient.Namespaces().List(nil)
+	if err != nil {
+		// Not fatal: namespaces are still cleaned up as they're deleted.
+		r.Log.Error(err, "listing consul namespaces")
+		return nil
+	}
+	for _, ns := range consulNamespaces {
+		if !r.mirroredByCluster(ns) || !strings.HasPrefix(ns.Name, r.NSMirroringPrefix) {
+			continue
+		}
+		kubeNS := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: strings.TrimPrefix(ns.Name, r.NSMirroringPrefix)}}
+		select {
+		case events <- event.GenericEvent{Meta: kubeNS, Object: kubeNS}:
+		case <-stop:
+			return nil
+		}
+	}
+	return nil
+}
+
+// watchCreatedNamespaces holds a blocking query for the Consul namespaces
+// and sends an event for the k8s namespace of every Consul namespace
+// created by consul-k8s with the mirroring prefix that it hasn't seen
+// before. Consul namespaces are created on demand, e.g. when the first pod
+// in the k8s namespace is injected, so their metadata is synced once they
+// exist. All of them are sent on the first query in case they were created
+// after the k8s namespace was reconciled.
+func (r *NamespaceController) watchCreatedNamespaces(events chan<- event.GenericEvent, stop <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	seen := make(map[string]bool)
+	opts := &capi.QueryOptions{}
+	for {
+		consulNamespaces, meta, err := r.ConsulClient.Namespaces().List(opts.WithContext(ctx))
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			r.Log.Error(err, "watching consul namespaces", "retry-after", namespaceWatchRetryAfter)
+			select {
+			case <-time.After(namespaceWatchRetryAfter):
+				continue
+			case <-stop:
+				return nil
+			}
+		}
+		opts.WaitIndex = meta.LastIndex
+
+		current := make(map[string]bool)
+		for _, ns := range consulNamespaces {
+			if ns.DeletedAt != nil || !createdByConsulK8s(ns) || !strings.HasPrefix(ns.Name, r.NSMirroringPrefix) {
+				continue
+			}
+			current[ns.Name] = true
+			if seen[ns.Name] {
+				continue
+			}
+			kubeNS := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: strings.TrimPrefix(ns.Name, r.NSMirroringPrefix)}}
+			select {
+			case events <- event.GenericEvent{Meta: kubeNS, Object: kubeNS}:
+			case <-stop:
+				return nil
+			}
+		}
+		seen = current
+	}
+}
+
+// IsReservedNamespaceMetaKey returns true if key is a Consul namespace meta
+// key that consul-k8s uses to track the namespaces it manages, which can't
+// be synced from a k8s namespace's labels or annotations.
+func IsReservedNamespaceMetaKey(key string) bool {
+	switch key {
+	case common.SourceKey, namespaces.MirroredByClusterKey, metaKeyNamespaceACLPolicies, metaKeyNamespaceACLRoles:
+		return true
+	}
+	return false
+}
+
+// createdByConsulK8s returns true if ns was created by namespaces.EnsureExists.
+func createdByConsulK8s(ns *capi.Namespace) bool {
+	return ns.Meta[common.SourceKey] == common.SourceValue
+}
+
+// mirroredByCluster returns true if ns was created for a mirrored k8s
+// namespace by the ConfigEntryController of this controller's cluster.
+func (r *NamespaceController) mirroredByCluster(ns *capi.Namespace) bool {
+	return createdByConsulK8s(ns) && r.ClusterName != "" && ns.Meta[namespaces.MirroredByClusterKey] == r.ClusterName
+}
+
+// syncACLLinks returns links with the names in desired added and the names
+// in prev that are no longer desired removed, along with the names that are
+// now managed. Links that were already present but not added by a previous
+// sync, e.g. the cross namespace policy, are left alone.
+func syncACLLinks(links []capi.ACLLink, prev, desired []string) ([]capi.ACLLink, []string) {
+	prevSet := make(map[string]bool)
+	for _, name := range prev {
+		prevSet[name] = true
+	}
+	desiredSet := make(map[string]bool)
+	for _, name := range desired {
+		desiredSet[name] = true
+	}
+
+	var result []capi.ACLLink
+	present := make(map[string]bool)
+	for _, link := range links {
+		if prevSet[link.Name] && !desiredSet[link.Name] {
+			continue
+		}
+		result = append(result, link)
+		present[link.Name] = true
+	}
+	var managed []string
+	for _, name := range desired {
+		if present[name] {
+			if prevSet[name] {
+				managed = append(managed, name)
+			}
+			continue
+		}
+		result = append(result, capi.ACLLink{Name: name})
+		present[name] = true
+		managed = append(managed, name)
+	}
+	return result, managed
+}
+
+// splitNames splits a comma-separated list of names, ignoring whitespace
+// and empty names.
+func splitNames(raw string) []string {
+	var names []string
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// allowedNames returns the names in the annotation's value that are in
+// allowed, logging the others.
+func allowedNames(logger logr.Logger, annotation, raw string, allowed map[string]bool) []string {
+	var names []string
+	for _, name := range splitNames(raw) {
+		if !allowed[name] {
+			logger.Info("ACL link is not allowed - skipping", "annotation", annotation, "name", name)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func setOrDelete(m map[string]string, key, value string) {
+	if value == "" {
+		delete(m, key)
+	} else {
+		m[key] = value
+	}
+}
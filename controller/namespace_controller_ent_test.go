@@ -0,0 +1,196 @@
+// +build enterprise
+
+package controller_test
+
+import (
+	"testing"
+
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul-k8s/controller"
+	"github.com/hashicorp/consul-k8s/namespaces"
+	capi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestNamespaceController(tt *testing.T) {
+	cases := map[string]struct {
+		// KubeNSExists creates the k8s namespace.
+		KubeNSExists bool
+		// NotConsulK8s creates the Consul namespace without the
+		// external-source meta set by consul-k8s.
+		NotConsulK8s bool
+		// CreatedByCluster is the cluster name the Consul namespace is
+		// created with. Defaults to the controller's cluster.
+		CreatedByCluster string
+		// RegisterService registers a service in the Consul namespace.
+		RegisterService bool
+		// WriteConfigEntry writes a service-defaults in the Consul namespace.
+		WriteConfigEntry bool
+		DryRun           bool
+		ExpRequeue       bool
+		ExpDeleted       bool
+	}{
+		"k8s namespace deleted": {
+			ExpDeleted: true,
+		},
+		"k8s namespace exists": {
+			KubeNSExists: true,
+		},
+		"not created by consul-k8s": {
+			NotConsulK8s: true,
+		},
+		"created by another cluster": {
+			CreatedByCluster: "other",
+		},
+		"created without a cluster, e.g. by the injector": {
+			CreatedByCluster: "-",
+		},
+		"service left": {
+			RegisterService: true,
+			ExpRequeue:      true,
+		},
+		"config entry left": {
+			WriteConfigEntry: true,
+			ExpRequeue:       true,
+		},
+		"dry run": {
+			DryRun: true,
+		},
+	}
+
+	for name, c := range cases {
+		tt.Run(name, func(t *testing.T) {
+			req := require.New(t)
+			const kubeNS = "foo"
+			const consulNS = "k8s-foo"
+
+			consul, err := testutil.NewTestServerConfigT(t, nil)
+			req.NoError(err)
+			defer consul.Stop()
+			consul.WaitForLeader(t)
+			consulClient, err := capi.NewClient(&capi.Config{
+				Address: consul.HTTPAddr,
+			})
+			req.NoError(err)
+
+			if c.NotConsulK8s {
+				_, _, err = consulClient.Namespaces().Create(&capi.Namespace{Name: consulNS}, nil)
+			} else {
+				cluster := "dc1-k8s"
+				if c.CreatedByCluster != "" {
+					cluster = c.CreatedByCluster
+				}
+				var meta map[string]string
+				if cluster != "-" {
+					meta = map[string]string{namespaces.MirroredByClusterKey: cluster}
+				}
+				_, err = namespaces.EnsureExistsWithMeta(consulClient, consulNS, "", meta)
+			}
+			req.NoError(err)
+			if c.RegisterService {
+				req.NoError(consulClient.Agent().ServiceRegister(&capi.AgentServiceRegistration{
+					Name:      "web",
+					Namespace: consulNS,
+				}))
+			}
+			if c.WriteConfigEntry {
+				_, _, err = consulClient.ConfigEntries().Set(&capi.ServiceConfigEntry{
+					Kind:     capi.ServiceDefaults,
+					Name:     "web",
+					Protocol: "http",
+				}, &capi.WriteOptions{Namespace: consulNS})
+				req.NoError(err)
+			}
+
+			s := runtime.NewScheme()
+			req.NoError(clientgoscheme.AddToScheme(s))
+			var objs []runtime.Object
+			if c.KubeNSExists {
+				objs = append(objs, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: kubeNS}})
+			}
+			r := &controller.NamespaceController{
+				Client:            fake.NewFakeClientWithScheme(s, objs...),
+				Log:               logrtest.TestLogger{T: t},
+				ConsulClient:      consulClient,
+				NSMirroringPrefix: "k8s-",
+				ClusterName:       "dc1-k8s",
+				DeleteNamespaces:  true,
+				DryRun:            c.DryRun,
+			}
+
+			resp, err := r.Reconcile(ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: kubeNS},
+			})
+			req.NoError(err)
+			req.Equal(c.ExpRequeue, resp.RequeueAfter > 0)
+
+			ns, _, err := consulClient.Namespaces().Read(consulNS, nil)
+			req.NoError(err)
+			if c.ExpDeleted {
+				// Deleted namespaces are marked for deletion and removed
+				// asynchronously.
+				req.True(ns == nil || ns.DeletedAt != nil)
+			} else {
+				req.NotNil(ns)
+				req.Nil(ns.DeletedAt)
+			}
+		})
+	}
+}
+
+func TestNamespaceController_syncMetadata(t *testing.T) {
+	req := require.New(t)
+	consul, err := testutil.NewTestServerConfigT(t, nil)
+	req.NoError(err)
+	defer consul.Stop()
+	consul.WaitForLeader(t)
+	consulClient, err := capi.NewClient(&capi.Config{
+		Address: consul.HTTPAddr,
+	})
+	req.NoError(err)
+	_, err = namespaces.EnsureExists(consulClient, "k8s-foo", "")
+	req.NoError(err)
+
+	s := runtime.NewScheme()
+	req.NoError(clientgoscheme.AddToScheme(s))
+	kubeNS := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "foo",
+			Labels: map[string]string{"team": "payments"},
+		},
+	}
+	r := &controller.NamespaceController{
+		Client:            fake.NewFakeClientWithScheme(s, kubeNS, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "bar"}}),
+		Log:               logrtest.TestLogger{T: t},
+		ConsulClient:      consulClient,
+		NSMirroringPrefix: "k8s-",
+		SyncMetadata:      true,
+		LabelsToMeta:      map[string]string{"team": "team"},
+	}
+
+	resp, err := r.Reconcile(ctrl.Request{
+		NamespacedName: types.NamespacedName{Name: "foo"},
+	})
+	req.NoError(err)
+	req.Zero(resp.RequeueAfter)
+
+	ns, _, err := consulClient.Namespaces().Read("k8s-foo", nil)
+	req.NoError(err)
+	req.Equal("payments", ns.Meta["team"])
+	req.Equal("kubernetes", ns.Meta["external-source"])
+
+	// Namespaces that haven't been created in Consul yet aren't requeued.
+	resp, err = r.Reconcile(ctrl.Request{
+		NamespacedName: types.NamespacedName{Name: "bar"},
+	})
+	req.NoError(err)
+	req.Zero(resp.RequeueAfter)
+}
@@ -0,0 +1,273 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul-k8s/namespaces"
+	capi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestNamespaceController_syncedNamespace(t *testing.T) {
+	cases := map[string]struct {
+		Labels      map[string]string
+		Annotations map[string]string
+		Namespace   capi.Namespace
+		Expected    capi.Namespace
+	}{
+		"labels and annotations": {
+			Labels:      map[string]string{"team": "payments", "other": "ignored", "source": "reserved"},
+			Annotations: map[string]string{"example.com/owner": "alice"},
+			Namespace: capi.Namespace{
+				Name: "foo",
+				Meta: map[string]string{"external-source": "kubernetes", "team": "old", "owner": "bob"},
+			},
+			Expected: capi.Namespace{
+				Name: "foo",
+				Meta: map[string]string{"external-source": "kubernetes", "team": "payments", "example_com_owner": "alice"},
+			},
+		},
+		"label removed": {
+			Namespace: capi.Namespace{
+				Name: "foo",
+				Meta: map[string]string{"external-source": "kubernetes", "team": "payments"},
+			},
+			Expected: capi.Namespace{
+				Name: "foo",
+				Meta: map[string]string{"external-source": "kubernetes"},
+			},
+		},
+		"acl policies and roles added": {
+			Annotations: map[string]string{
+				annotationNamespaceACLPolicies: "extra, cross-namespace-policy",
+				annotationNamespaceACLRoles:    "reader",
+			},
+			Namespace: capi.Namespace{
+				Name: "foo",
+				Meta: map[string]string{"external-source": "kubernetes"},
+				ACLs: &capi.NamespaceACLConfig{
+					PolicyDefaults: []capi.ACLLink{{ID: "1", Name: "cross-namespace-policy"}},
+				},
+			},
+			Expected: capi.Namespace{
+				Name: "foo",
+				Meta: map[string]string{
+					"external-source":           "kubernetes",
+					metaKeyNamespaceACLPolicies: "extra",
+					metaKeyNamespaceACLRoles:    "reader",
+				},
+				ACLs: &capi.NamespaceACLConfig{
+					PolicyDefaults: []capi.ACLLink{{ID: "1", Name: "cross-namespace-policy"}, {Name: "extra"}},
+					RoleDefaults:   []capi.ACLLink{{Name: "reader"}},
+				},
+			},
+		},
+		"acl policy and role not allowed": {
+			Annotations: map[string]string{
+				annotationNamespaceACLPolicies: "global-management,extra",
+				annotationNamespaceACLRoles:    "admin",
+			},
+			Namespace: capi.Namespace{
+				Name: "foo",
+				Meta: map[string]string{"external-source": "kubernetes"},
+			},
+			Expected: capi.Namespace{
+				Name: "foo",
+				Meta: map[string]string{"external-source": "kubernetes", metaKeyNamespaceACLPolicies: "extra"},
+				ACLs: &capi.NamespaceACLConfig{
+					PolicyDefaults: []capi.ACLLink{{Name: "extra"}},
+				},
+			},
+		},
+		"acl policy no longer allowed": {
+			Annotations: map[string]string{
+				annotationNamespaceACLPolicies: "a,extra",
+			},
+			Namespace: capi.Namespace{
+				Name: "foo",
+				Meta: map[string]string{"external-source": "kubernetes", metaKeyNamespaceACLPolicies: "a,extra"},
+				ACLs: &capi.NamespaceACLConfig{
+					PolicyDefaults: []capi.ACLLink{{ID: "2", Name: "a"}, {ID: "3", Name: "extra"}},
+				},
+			},
+			Expected: capi.Namespace{
+				Name: "foo",
+				Meta: map[string]string{"external-source": "kubernetes", metaKeyNamespaceACLPolicies: "extra"},
+				ACLs: &capi.NamespaceACLConfig{
+					PolicyDefaults: []capi.ACLLink{{ID: "3", Name: "extra"}},
+				},
+			},
+		},
+		"acl policy removed": {
+			Annotations: map[string]string{
+				annotationNamespaceACLPolicies: "b",
+			},
+			Namespace: capi.Namespace{
+				Name: "foo",
+				Meta: map[string]string{"external-source": "kubernetes", metaKeyNamespaceACLPolicies: "a,b"},
+				ACLs: &capi.NamespaceACLConfig{
+					PolicyDefaults: []capi.ACLLink{
+						{ID: "1", Name: "cross-namespace-policy"},
+						{ID: "2", Name: "a"},
+						{ID: "3", Name: "b"},
+					},
+				},
+			},
+			Expected: capi.Namespace{
+				Name: "foo",
+				Meta: map[string]string{"external-source": "kubernetes", metaKeyNamespaceACLPolicies: "b"},
+				ACLs: &capi.NamespaceACLConfig{
+					PolicyDefaults: []capi.ACLLink{
+						{ID: "1", Name: "cross-namespace-policy"},
+						{ID: "3", Name: "b"},
+					},
+				},
+			},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := &NamespaceController{
+				// Reserved meta keys are never synced, even if they're
+				// mapped.
+				LabelsToMeta:       map[string]string{"team": "team", "source": "external-source"},
+				AnnotationsToMeta:  map[string]string{"example.com/owner": "example_com_owner", "owner": "owner"},
+				AllowedACLPolicies: map[string]bool{"extra": true, "b": true},
+				AllowedACLRoles:    map[string]bool{"reader": true},
+			}
+			kubeNS := &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "foo",
+					Labels:      c.Labels,
+					Annotations: c.Annotations,
+				},
+			}
+			actual := r.syncedNamespace(logrtest.TestLogger{T: t}, &c.Namespace, kubeNS)
+			require.Equal(t, &c.Expected, actual)
+
+			// Syncing again is a no-op.
+			require.Equal(t, actual, r.syncedNamespace(logrtest.TestLogger{T: t}, actual, kubeNS))
+		})
+	}
+}
+
+// Test that the startup sweep doesn't run, or talk to Consul, unless only
+// the namespaces mirrored by this cluster can match.
+func TestNamespaceController_enqueueExistingRequiresPrefix(t *testing.T) {
+	cases := map[string]NamespaceController{
+		"no prefix":       {ClusterName: "dc1-k8s", DeleteNamespaces: true},
+		"no cluster name": {NSMirroringPrefix: "k8s-", DeleteNamespaces: true},
+		"deletion is off": {NSMirroringPrefix: "k8s-", ClusterName: "dc1-k8s"},
+	}
+	for name, r := range cases {
+		t.Run(name, func(t *testing.T) {
+			r.Log = logrtest.TestLogger{T: t}
+			events := make(chan event.GenericEvent)
+			require.NoError(t, r.enqueueExisting(events, make(chan struct{})))
+		})
+	}
+}
+
+func TestNamespaceController_mirroredByCluster(t *testing.T) {
+	r := NamespaceController{ClusterName: "dc1-k8s"}
+	cases := map[string]struct {
+		Meta map[string]string
+		Exp  bool
+	}{
+		"this cluster": {
+			Meta: map[string]string{"external-source": "kubernetes", namespaces.MirroredByClusterKey: "dc1-k8s"},
+			Exp:  true,
+		},
+		"other cluster": {
+			Meta: map[string]string{"external-source": "kubernetes", namespaces.MirroredByClusterKey: "other"},
+		},
+		"no cluster": {
+			Meta: map[string]string{"external-source": "kubernetes"},
+		},
+		"not consul-k8s": {
+			Meta: map[string]string{namespaces.MirroredByClusterKey: "dc1-k8s"},
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, c.Exp, r.mirroredByCluster(&capi.Namespace{Name: "k8s-foo", Meta: c.Meta}))
+		})
+	}
+	require.False(t, (&NamespaceController{}).mirroredByCluster(&capi.Namespace{
+		Meta: map[string]string{"external-source": "kubernetes", namespaces.MirroredByClusterKey: ""},
+	}))
+}
+
+// Test that the k8s namespaces of the Consul namespaces created by
+// consul-k8s are enqueued once, as they're created.
+func TestNamespaceController_watchCreatedNamespaces(t *testing.T) {
+	lists := [][]*capi.Namespace{
+		{
+			{Name: "k8s-foo", Meta: map[string]string{"external-source": "kubernetes"}},
+			{Name: "k8s-other"},
+			{Name: "unprefixed", Meta: map[string]string{"external-source": "kubernetes"}},
+		},
+		{
+			{Name: "k8s-foo", Meta: map[string]string{"external-source": "kubernetes"}},
+			{Name: "k8s-bar", Meta: map[string]string{"external-source": "kubernetes"}},
+		},
+	}
+	var lock sync.Mutex
+	calls := 0
+	consulServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		i := calls
+		calls++
+		lock.Unlock()
+		if i >= len(lists) {
+			// Block like a blocking query with no changes.
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", fmt.Sprint(i+1))
+		require.NoError(t, json.NewEncoder(w).Encode(lists[i]))
+	}))
+	defer consulServer.Close()
+	consulClient, err := capi.NewClient(&capi.Config{Address: consulServer.URL})
+	require.NoError(t, err)
+
+	r := NamespaceController{
+		Log:               logrtest.TestLogger{T: t},
+		ConsulClient:      consulClient,
+		NSMirroringPrefix: "k8s-",
+		SyncMetadata:      true,
+	}
+	events := make(chan event.GenericEvent)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- r.watchCreatedNamespaces(events, stop)
+	}()
+
+	for _, exp := range []string{"foo", "bar"} {
+		select {
+		case e := <-events:
+			require.Equal(t, exp, e.Meta.GetName())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", exp)
+		}
+	}
+	close(stop)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch to stop")
+	}
+}
@@ -22,7 +22,16 @@ type Controller struct {
 	Log      hclog.Logger
 	Resource Resource
 
-	informer cache.SharedIndexInformer
+	// informerLock guards informer since HasSynced may be called while
+	// Run is starting.
+	informerLock sync.Mutex
+	informer     cache.SharedIndexInformer
+
+	// initialLock guards initialKeys and ready. initialKeys are the keys of
+	// the objects in the initial list that haven't been processed yet.
+	initialLock sync.Mutex
+	initialKeys map[string]bool
+	ready       bool
 }
 
 // Run starts the Controller and blocks until stopCh is closed.
@@ -34,7 +43,9 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 
 	// Create an informer so we can keep track of all service changes.
 	informer := c.Resource.Informer()
+	c.informerLock.Lock()
 	c.informer = informer
+	c.informerLock.Unlock()
 
 	// Create a queue for storing items to process from the informer.
 	var queueOnce sync.Once
@@ -117,6 +128,7 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 		return
 	}
 	c.Log.Debug("initial cache sync complete")
+	c.setInitialKeys(informer.GetStore().ListKeys())
 
 	// run the runWorker method every second with a stop channel
 	wait.Until(func() {
@@ -128,20 +140,59 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 
 // HasSynced implements cache.Controller
 func (c *Controller) HasSynced() bool {
-	if c.informer == nil {
+	c.informerLock.Lock()
+	informer := c.informer
+	c.informerLock.Unlock()
+	if informer == nil {
 		return false
 	}
 
-	return c.informer.HasSynced()
+	return informer.HasSynced()
+}
+
+// Ready returns true once every object in the initial list has been
+// upserted, or has failed to be after all retries. Unlike HasSynced, it
+// guarantees that the Resource has seen all the objects that existed when
+// the controller started.
+func (c *Controller) Ready() bool {
+	c.initialLock.Lock()
+	defer c.initialLock.Unlock()
+	return c.ready
+}
+
+// setInitialKeys sets the keys of the initial list that must be processed
+// before the controller is ready.
+func (c *Controller) setInitialKeys(keys []string) {
+	c.initialLock.Lock()
+	defer c.initialLock.Unlock()
+	c.initialKeys = make(map[string]bool, len(keys))
+	for _, key := range keys {
+		c.initialKeys[key] = true
+	}
+	c.ready = len(c.initialKeys) == 0
+}
+
+// processed records that key has been processed.
+func (c *Controller) processed(key string) {
+	c.initialLock.Lock()
+	defer c.initialLock.Unlock()
+	if c.ready || !c.initialKeys[key] {
+		return
+	}
+	delete(c.initialKeys, key)
+	c.ready = len(c.initialKeys) == 0
 }
 
 // LastSyncResourceVersion implements cache.Controller
 func (c *Controller) LastSyncResourceVersion() string {
-	if c.informer == nil {
+	c.informerLock.Lock()
+	informer := c.informer
+	c.informerLock.Unlock()
+	if informer == nil {
 		return ""
 	}
 
-	return c.informer.LastSyncResourceVersion()
+	return informer.LastSyncResourceVersion()
 }
 
 func (c *Controller) processSingle(
@@ -177,6 +228,7 @@ func (c *Controller) processSingle(
 
 		if err == nil {
 			queue.Forget(key)
+			c.processed(keyRaw)
 		}
 	}
 
@@ -187,6 +239,7 @@ func (c *Controller) processSingle(
 		} else {
 			c.Log.Error("failed processing item, no more retries", "key", keyRaw, "error", err)
 			queue.Forget(key)
+			c.processed(keyRaw)
 			utilruntime.HandleError(err)
 		}
 	}
@@ -2,10 +2,12 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/stretchr/testify/require"
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -146,6 +148,63 @@ func TestController_update(t *testing.T) {
 	closer()
 }
 
+// Test that the controller is only ready once the initial data has been
+// upserted, even if upserting is slower than listing.
+func TestController_ready(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	client := fake.NewSimpleClientset()
+	_, err := client.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), testService("foo"), metav1.CreateOptions{})
+	require.NoError(err)
+	_, err = client.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), testService("bar"), metav1.CreateOptions{})
+	require.NoError(err)
+
+	var lock sync.Mutex
+	upserted := make(map[string]bool)
+	failed := false
+	resource := NewResource(testInformer(client),
+		func(key string, v interface{}) error {
+			time.Sleep(50 * time.Millisecond)
+			lock.Lock()
+			defer lock.Unlock()
+			// Failed upserts are retried before the controller is ready.
+			if key == "default/bar" && !failed {
+				failed = true
+				return errors.New("failed")
+			}
+			upserted[key] = true
+			return nil
+		},
+		func(key string) error { return nil },
+	)
+	c := &Controller{Log: hclog.Default(), Resource: resource}
+	require.False(c.Ready())
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.Run(stopCh)
+
+	require.True(cache.WaitForCacheSync(stopCh, c.HasSynced))
+	require.True(cache.WaitForCacheSync(stopCh, c.Ready))
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(map[string]bool{"default/foo": true, "default/bar": true}, upserted)
+}
+
+// Test that the controller is ready once it has synced if there's no
+// initial data.
+func TestController_readyEmpty(t *testing.T) {
+	t.Parallel()
+
+	resource, _, _ := testResource(fake.NewSimpleClientset())
+	c := &Controller{Log: hclog.Default(), Resource: resource}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.Run(stopCh)
+	require.True(t, cache.WaitForCacheSync(stopCh, c.Ready))
+}
+
 // Test that backgrounders are started and stopped.
 func TestController_backgrounder(t *testing.T) {
 	t.Parallel()
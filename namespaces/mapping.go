@@ -0,0 +1,182 @@
+package namespaces
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"k8s.io/apimachinery/pkg/labels"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+)
+
+// Mapping maps Kubernetes namespaces to Consul namespaces. It is read from
+// the file passed to the -k8s-namespace-mapping-file flag, e.g.
+//
+//	{
+//	  "rules": [
+//	    {"namespace": "payments", "consulNamespace": "billing"},
+//	    {"glob": "team-a-*", "consulNamespace": "team-a"},
+//	    {"selector": "tenant=acme", "consulNamespace": "acme"}
+//	  ],
+//	  "default": "shared"
+//	}
+//
+// Rules are checked in order and the first match wins. Kubernetes
+// namespaces that don't match any rule are mapped to the default, or if
+// there is no default, to the namespace set by the mirroring or destination
+// namespace flags.
+type Mapping struct {
+	Rules   []MappingRule `json:"rules"`
+	Default string        `json:"default"`
+}
+
+// MappingRule maps the Kubernetes namespaces it matches to ConsulNamespace.
+// Exactly one of Namespace, Glob and Selector must be set.
+type MappingRule struct {
+	// Namespace matches the Kubernetes namespace with this exact name.
+	Namespace string `json:"namespace"`
+
+	// Glob matches the Kubernetes namespaces whose name matches this
+	// pattern, in the syntax of path.Match.
+	Glob string `json:"glob"`
+
+	// Selector matches the Kubernetes namespaces whose labels match this
+	// label selector, e.g. "tenant=acme,env!=dev".
+	Selector string `json:"selector"`
+
+	ConsulNamespace string `json:"consulNamespace"`
+
+	selector labels.Selector
+}
+
+// LabelsFunc returns the labels of the Kubernetes namespace kubeNS. It's
+// only called if the mapping has selector rules.
+type LabelsFunc func(kubeNS string) (map[string]string, error)
+
+// ReadMappingFile reads and validates the mapping in the JSON file at path.
+func ReadMappingFile(path string) (*Mapping, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := ParseMapping(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %s", path, err)
+	}
+	return mapping, nil
+}
+
+// ParseMapping parses and validates a JSON mapping.
+func ParseMapping(data []byte) (*Mapping, error) {
+	var mapping Mapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, err
+	}
+	for i := range mapping.Rules {
+		rule := &mapping.Rules[i]
+		set := 0
+		for _, v := range []string{rule.Namespace, rule.Glob, rule.Selector} {
+			if v != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return nil, fmt.Errorf("rule %d: exactly one of namespace, glob and selector must be set", i)
+		}
+		if rule.ConsulNamespace == "" {
+			return nil, fmt.Errorf("rule %d: consulNamespace must be set", i)
+		}
+		if rule.Glob != "" {
+			if _, err := path.Match(rule.Glob, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid glob %q: %s", i, rule.Glob, err)
+			}
+		}
+		if rule.Selector != "" {
+			selector, err := labels.Parse(rule.Selector)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid selector %q: %s", i, rule.Selector, err)
+			}
+			rule.selector = selector
+		}
+	}
+	return &mapping, nil
+}
+
+// HasSelectors returns true if any rule matches namespaces by their labels,
+// in which case a LabelsFunc must be passed to ConsulNamespace.
+func (m *Mapping) HasSelectors() bool {
+	for _, rule := range m.Rules {
+		if rule.Selector != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ConsulNamespace returns the Consul namespace that kubeNS is mapped to and
+// true, or false if no rule matches and there is no default. The labels of
+// kubeNS are only looked up if a selector rule is reached.
+func (m *Mapping) ConsulNamespace(kubeNS string, nsLabels LabelsFunc) (string, bool, error) {
+	var kubeNSLabels labels.Set
+	for _, rule := range m.Rules {
+		switch {
+		case rule.Namespace != "":
+			if rule.Namespace == kubeNS {
+				return rule.ConsulNamespace, true, nil
+			}
+		case rule.Glob != "":
+			if ok, _ := path.Match(rule.Glob, kubeNS); ok {
+				return rule.ConsulNamespace, true, nil
+			}
+		case rule.selector != nil:
+			if kubeNSLabels == nil {
+				if nsLabels == nil {
+					return "", false, fmt.Errorf("can't match selector %q: namespace labels aren't available", rule.Selector)
+				}
+				l, err := nsLabels(kubeNS)
+				if err != nil {
+					return "", false, fmt.Errorf("getting labels of namespace %q: %s", kubeNS, err)
+				}
+				kubeNSLabels = labels.Set(l)
+			}
+			if rule.selector.Matches(kubeNSLabels) {
+				return rule.ConsulNamespace, true, nil
+			}
+		}
+	}
+	if m.Default != "" {
+		return m.Default, true, nil
+	}
+	return "", false, nil
+}
+
+// MappedConsulNamespace returns the Consul namespace that kubeNS is mapped
+// to by mapping, which may be nil, falling back to ConsulNamespace if it
+// has no matching rule or default. It returns an empty string if namespaces
+// aren't enabled.
+func MappedConsulNamespace(mapping *Mapping, nsLabels LabelsFunc, kubeNS string, enableConsulNamespaces bool, consulDestNS string, enableMirroring bool, mirroringPrefix string) (string, error) {
+	if enableConsulNamespaces && mapping != nil {
+		consulNS, ok, err := mapping.ConsulNamespace(kubeNS, nsLabels)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return consulNS, nil
+		}
+	}
+	return ConsulNamespace(kubeNS, enableConsulNamespaces, consulDestNS, enableMirroring, mirroringPrefix), nil
+}
+
+// ListerLabelsFunc returns a LabelsFunc that reads the labels of Kubernetes
+// namespaces from lister, so that they're read from the informer's cache
+// rather than the Kubernetes API.
+func ListerLabelsFunc(lister corev1listers.NamespaceLister) LabelsFunc {
+	return func(kubeNS string) (map[string]string, error) {
+		ns, err := lister.Get(kubeNS)
+		if err != nil {
+			return nil, err
+		}
+		return ns.Labels, nil
+	}
+}
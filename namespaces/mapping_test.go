@@ -0,0 +1,174 @@
+package namespaces
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testMapping = `{
+  "rules": [
+    {"namespace": "payments", "consulNamespace": "billing"},
+    {"glob": "team-a-*", "consulNamespace": "team-a"},
+    {"selector": "tenant=acme", "consulNamespace": "acme"}
+  ],
+  "default": "shared"
+}`
+
+func TestMapping_ConsulNamespace(t *testing.T) {
+	mapping, err := ParseMapping([]byte(testMapping))
+	require.NoError(t, err)
+	require.True(t, mapping.HasSelectors())
+
+	nsLabels := map[string]map[string]string{
+		"acme-prod": {"tenant": "acme"},
+		"payments":  {"tenant": "acme"},
+	}
+	labelsFunc := func(kubeNS string) (map[string]string, error) {
+		return nsLabels[kubeNS], nil
+	}
+
+	cases := map[string]string{
+		// Rules are checked in order so payments isn't matched by the
+		// selector.
+		"payments":   "billing",
+		"team-a-dev": "team-a",
+		"team-a-prd": "team-a",
+		"acme-prod":  "acme",
+		"other":      "shared",
+	}
+	for kubeNS, exp := range cases {
+		t.Run(kubeNS, func(t *testing.T) {
+			consulNS, ok, err := mapping.ConsulNamespace(kubeNS, labelsFunc)
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, exp, consulNS)
+		})
+	}
+}
+
+func TestMapping_ConsulNamespaceLabelsError(t *testing.T) {
+	mapping, err := ParseMapping([]byte(testMapping))
+	require.NoError(t, err)
+
+	// Labels aren't needed if a rule before the selector matches.
+	consulNS, ok, err := mapping.ConsulNamespace("payments", nil)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "billing", consulNS)
+
+	_, _, err = mapping.ConsulNamespace("other", func(string) (map[string]string, error) {
+		return nil, errors.New("namespace not found")
+	})
+	require.EqualError(t, err, `getting labels of namespace "other": namespace not found`)
+}
+
+func TestMappedConsulNamespace(t *testing.T) {
+	mapping, err := ParseMapping([]byte(`{"rules": [{"namespace": "payments", "consulNamespace": "billing"}]}`))
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		mapping          *Mapping
+		kubeNS           string
+		enableNamespaces bool
+		enableMirroring  bool
+		exp              string
+	}{
+		"namespaces disabled": {
+			mapping: mapping,
+			kubeNS:  "payments",
+			exp:     "",
+		},
+		"matching rule": {
+			mapping:          mapping,
+			kubeNS:           "payments",
+			enableNamespaces: true,
+			enableMirroring:  true,
+			exp:              "billing",
+		},
+		"no matching rule falls back to mirroring": {
+			mapping:          mapping,
+			kubeNS:           "web",
+			enableNamespaces: true,
+			enableMirroring:  true,
+			exp:              "k8s-web",
+		},
+		"no matching rule falls back to destination namespace": {
+			mapping:          mapping,
+			kubeNS:           "web",
+			enableNamespaces: true,
+			exp:              "dest",
+		},
+		"no mapping": {
+			kubeNS:           "payments",
+			enableNamespaces: true,
+			exp:              "dest",
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			consulNS, err := MappedConsulNamespace(c.mapping, nil, c.kubeNS, c.enableNamespaces, "dest", c.enableMirroring, "k8s-")
+			require.NoError(t, err)
+			require.Equal(t, c.exp, consulNS)
+		})
+	}
+}
+
+func TestParseMapping_Errors(t *testing.T) {
+	cases := map[string]struct {
+		mapping string
+		expErr  string
+	}{
+		"invalid json": {
+			mapping: `{`,
+			expErr:  "unexpected end of JSON input",
+		},
+		"no matcher": {
+			mapping: `{"rules": [{"consulNamespace": "a"}]}`,
+			expErr:  "rule 0: exactly one of namespace, glob and selector must be set",
+		},
+		"two matchers": {
+			mapping: `{"rules": [{"namespace": "a", "glob": "a-*", "consulNamespace": "a"}]}`,
+			expErr:  "rule 0: exactly one of namespace, glob and selector must be set",
+		},
+		"no consul namespace": {
+			mapping: `{"rules": [{"namespace": "a"}]}`,
+			expErr:  "rule 0: consulNamespace must be set",
+		},
+		"invalid glob": {
+			mapping: `{"rules": [{"glob": "[", "consulNamespace": "a"}]}`,
+			expErr:  `rule 0: invalid glob "[": syntax error in pattern`,
+		},
+		"invalid selector": {
+			mapping: `{"rules": [{"selector": "tenant in (", "consulNamespace": "a"}]}`,
+			expErr:  `rule 0: invalid selector "tenant in ("`,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseMapping([]byte(c.mapping))
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.expErr)
+		})
+	}
+}
+
+func TestReadMappingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mapping.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(testMapping), 0600))
+	mapping, err := ReadMappingFile(path)
+	require.NoError(t, err)
+	require.Len(t, mapping.Rules, 3)
+	require.Equal(t, "shared", mapping.Default)
+
+	_, err = ReadMappingFile(filepath.Join(dir, "missing.json"))
+	require.Error(t, err)
+}
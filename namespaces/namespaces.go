@@ -11,12 +11,37 @@ import (
 const (
 	WildcardNamespace = "*"
 	DefaultNamespace  = "default"
+
+	// MirroredByClusterKey is the meta key of the Consul namespaces that
+	// consul-k8s creates for mirrored k8s namespaces. Its value is the
+	// -cluster-name of the command that created it. Only namespaces with
+	// this key are deleted by the controller, and only by the cluster that
+	// created them.
+	MirroredByClusterKey = "external-k8s-mirrored-by-cluster"
 )
 
 // EnsureExists ensures a Consul namespace with name ns exists. If it doesn't,
 // it will create it and set crossNSACLPolicy as a policy default.
 // Boolean return value indicates if the namespace was created by this call.
 func EnsureExists(client *capi.Client, ns string, crossNSAClPolicy string) (bool, error) {
+	return EnsureExistsWithMeta(client, ns, crossNSAClPolicy, nil)
+}
+
+// MirroredByClusterMeta returns the meta that marks the Consul namespace
+// consulNS as mirrored from the k8s namespace k8sNS by the cluster named
+// clusterName, to be passed to EnsureExistsWithMeta. It returns nil if
+// mirroring is disabled, clusterName is empty or consulNS isn't the
+// namespace k8sNS is mirrored to.
+func MirroredByClusterMeta(consulNS, k8sNS string, mirroring bool, prefix, clusterName string) map[string]string {
+	if !mirroring || clusterName == "" || consulNS != prefix+k8sNS {
+		return nil
+	}
+	return map[string]string{MirroredByClusterKey: clusterName}
+}
+
+// EnsureExistsWithMeta is EnsureExists but also sets meta on the namespace
+// if it's created. Existing namespaces aren't changed.
+func EnsureExistsWithMeta(client *capi.Client, ns string, crossNSAClPolicy string, meta map[string]string) (bool, error) {
 	if ns == WildcardNamespace || ns == DefaultNamespace {
 		return false, nil
 	}
@@ -41,11 +66,15 @@ func EnsureExists(client *capi.Client, ns string, crossNSAClPolicy string) (bool
 		}
 	}
 
+	nsMeta := map[string]string{"external-source": "kubernetes"}
+	for k, v := range meta {
+		nsMeta[k] = v
+	}
 	consulNamespace := capi.Namespace{
 		Name:        ns,
 		Description: "Auto-generated by consul-k8s",
 		ACLs:        &aclConfig,
-		Meta:        map[string]string{"external-source": "kubernetes"},
+		Meta:        nsMeta,
 	}
 
 	_, _, err = client.Namespaces().Create(&consulNamespace, nil)
@@ -202,3 +202,39 @@ func TestConsulNamespace(t *testing.T) {
 		})
 	}
 }
+
+func TestMirroredByClusterMeta(t *testing.T) {
+	cases := map[string]struct {
+		consulNS        string
+		enableMirroring bool
+		clusterName     string
+		expMeta         map[string]string
+	}{
+		"mirrored": {
+			consulNS:        "prefix-kube",
+			enableMirroring: true,
+			clusterName:     "dc1-k8s",
+			expMeta:         map[string]string{MirroredByClusterKey: "dc1-k8s"},
+		},
+		"mirroring disabled": {
+			consulNS:    "prefix-kube",
+			clusterName: "dc1-k8s",
+		},
+		"no cluster name": {
+			consulNS:        "prefix-kube",
+			enableMirroring: true,
+		},
+		"not the mirrored namespace": {
+			consulNS:        "shared",
+			enableMirroring: true,
+			clusterName:     "dc1-k8s",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			act := MirroredByClusterMeta(c.consulNS, "kube", c.enableMirroring, "prefix-", c.clusterName)
+			require.Equal(t, c.expMeta, act)
+		})
+	}
+}
@@ -1,17 +1,23 @@
 package controller
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/hashicorp/consul-k8s/api/common"
 	"github.com/hashicorp/consul-k8s/api/v1alpha1"
+	connectinject "github.com/hashicorp/consul-k8s/connect-inject"
 	"github.com/hashicorp/consul-k8s/controller"
+	"github.com/hashicorp/consul-k8s/namespaces"
 	"github.com/hashicorp/consul-k8s/subcommand/flags"
 	"github.com/mitchellh/cli"
 	"go.uber.org/zap/zapcore"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/klog/v2"
@@ -39,6 +45,15 @@ type Command struct {
 	flagEnableNSMirroring          bool
 	flagNSMirroringPrefix          string
 	flagCrossNSACLPolicy           string
+	flagK8SNSMappingFile           string
+	flagClusterName                string
+	flagDeleteMirroredNamespaces   bool
+	flagDeleteMirroredNSDryRun     bool
+	flagSyncNamespaceMetadata      bool
+	flagNamespaceLabelsToMeta      []string
+	flagNamespaceAnnotationsToMeta []string
+	flagAllowNamespaceACLPolicies  []string
+	flagAllowNamespaceACLRoles     []string
 
 	once sync.Once
 	help string
@@ -74,6 +89,44 @@ func (c *Command) init() {
 	c.flagSet.StringVar(&c.flagCrossNSACLPolicy, "consul-cross-namespace-acl-policy", "",
 		"[Enterprise Only] Name of the ACL policy to attach to all created Consul namespaces to allow service "+
 			"discovery across Consul namespaces. Only necessary if ACLs are enabled.")
+	c.flagSet.StringVar(&c.flagK8SNSMappingFile, "k8s-namespace-mapping-file", "",
+		"[Enterprise Only] Path to a JSON file mapping k8s namespaces, by name, glob or label selector, to Consul "+
+			"namespaces. Takes precedence over mirroring and -consul-destination-namespace for the k8s namespaces it maps.")
+	c.flagSet.StringVar(&c.flagClusterName, "cluster-name", "",
+		"[Enterprise Only] The name of the Kubernetes cluster. When namespace mirroring is enabled, it's added "+
+			"to the meta of the Consul namespaces the controller creates so that -delete-mirrored-namespaces only "+
+			"deletes the namespaces created by this cluster. Set the same -cluster-name on inject-connect and "+
+			"sync-catalog so that the namespaces they create are deleted too.")
+	c.flagSet.BoolVar(&c.flagDeleteMirroredNamespaces, "delete-mirrored-namespaces", false,
+		"[Enterprise Only] Delete the Consul namespaces created for mirrored k8s namespaces with this cluster's "+
+			"-cluster-name once the k8s namespace is deleted and the Consul namespace has no services, config "+
+			"entries or ACL tokens, roles or policies left. Requires namespace mirroring, -cluster-name and a "+
+			"Consul token with operator:write and acl:read.")
+	c.flagSet.BoolVar(&c.flagDeleteMirroredNSDryRun, "delete-mirrored-namespaces-dry-run", false,
+		"[Enterprise Only] Log the Consul namespaces -delete-mirrored-namespaces would delete instead of deleting them.")
+	c.flagSet.BoolVar(&c.flagSyncNamespaceMetadata, "sync-namespace-metadata", false,
+		"[Enterprise Only] Keep the meta and default ACLs of the Consul namespaces created by consul-k8s for mirrored "+
+			"k8s namespaces in sync with the labels set by -namespace-label-to-meta, the annotations set by "+
+			"-namespace-annotation-to-meta, and the ACL policies and roles allowed by -allow-namespace-acl-policy and "+
+			"-allow-namespace-acl-role that are listed in the consul.hashicorp.com/namespace-acl-policies and "+
+			"consul.hashicorp.com/namespace-acl-roles annotations of the k8s namespace. Requires namespace "+
+			"mirroring and a Consul token with operator:write.")
+	c.flagSet.Var((*flags.AppendSliceValue)(&c.flagNamespaceLabelsToMeta), "namespace-label-to-meta",
+		"[Enterprise Only] Namespace label to add to the Consul namespace meta, formatted as <label>[=<meta-key>]. "+
+			"If no meta key is given, characters Consul doesn't allow in meta keys are replaced with underscores. "+
+			"The meta keys consul-k8s uses to track its namespaces can't be used. May be specified multiple times.")
+	c.flagSet.Var((*flags.AppendSliceValue)(&c.flagNamespaceAnnotationsToMeta), "namespace-annotation-to-meta",
+		"[Enterprise Only] Namespace annotation to add to the Consul namespace meta, formatted as "+
+			"<annotation>[=<meta-key>]. The meta keys consul-k8s uses to track its namespaces can't be used. "+
+			"May be specified multiple times.")
+	c.flagSet.Var((*flags.AppendSliceValue)(&c.flagAllowNamespaceACLPolicies), "allow-namespace-acl-policy",
+		"[Enterprise Only] Name of an ACL policy that the consul.hashicorp.com/namespace-acl-policies annotation "+
+			"may add to the default ACLs of a Consul namespace. Other policies are ignored. Requires "+
+			"-sync-namespace-metadata. May be specified multiple times.")
+	c.flagSet.Var((*flags.AppendSliceValue)(&c.flagAllowNamespaceACLRoles), "allow-namespace-acl-role",
+		"[Enterprise Only] Name of an ACL role that the consul.hashicorp.com/namespace-acl-roles annotation "+
+			"may add to the default ACLs of a Consul namespace. Other roles are ignored. Requires "+
+			"-sync-namespace-metadata. May be specified multiple times.")
 	c.flagSet.StringVar(&c.flagWebhookTLSCertDir, "webhook-tls-cert-dir", "",
 		"Directory that contains the TLS cert and key required for the webhook. The cert and key files must be named 'tls.crt' and 'tls.key' respectively.")
 	c.flagSet.BoolVar(&c.flagEnableWebhooks, "enable-webhooks", true,
@@ -106,6 +159,51 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	if c.flagDeleteMirroredNamespaces && !(c.flagEnableNamespaces && c.flagEnableNSMirroring) {
+		c.UI.Error("Invalid arguments: -delete-mirrored-namespaces requires -enable-namespaces and -enable-k8s-namespace-mirroring")
+		return 1
+	}
+	if c.flagDeleteMirroredNamespaces && c.flagClusterName == "" {
+		c.UI.Error("Invalid arguments: -delete-mirrored-namespaces requires -cluster-name")
+		return 1
+	}
+	if c.flagSyncNamespaceMetadata && !(c.flagEnableNamespaces && c.flagEnableNSMirroring) {
+		c.UI.Error("Invalid arguments: -sync-namespace-metadata requires -enable-namespaces and -enable-k8s-namespace-mirroring")
+		return 1
+	}
+	if (len(c.flagAllowNamespaceACLPolicies) > 0 || len(c.flagAllowNamespaceACLRoles) > 0) && !c.flagSyncNamespaceMetadata {
+		c.UI.Error("Invalid arguments: -allow-namespace-acl-policy and -allow-namespace-acl-role require -sync-namespace-metadata")
+		return 1
+	}
+	// The namespace controller only knows the Consul namespaces of mirrored
+	// k8s namespaces. A mapping can map several k8s namespaces to one Consul
+	// namespace, and its selector rules can't be evaluated once the k8s
+	// namespace is deleted.
+	if c.flagK8SNSMappingFile != "" && (c.flagDeleteMirroredNamespaces || c.flagSyncNamespaceMetadata) {
+		c.UI.Error("Invalid arguments: -k8s-namespace-mapping-file can't be used with -delete-mirrored-namespaces or -sync-namespace-metadata")
+		return 1
+	}
+	nsLabelsToMeta, err := parseToMetaFlag("-namespace-label-to-meta", c.flagNamespaceLabelsToMeta)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Invalid arguments: %s", err))
+		return 1
+	}
+	nsAnnotationsToMeta, err := parseToMetaFlag("-namespace-annotation-to-meta", c.flagNamespaceAnnotationsToMeta)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Invalid arguments: %s", err))
+		return 1
+	}
+
+	var nsMapping *namespaces.Mapping
+	if c.flagK8SNSMappingFile != "" {
+		var err error
+		nsMapping, err = namespaces.ReadMappingFile(c.flagK8SNSMappingFile)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error reading -k8s-namespace-mapping-file: %s", err))
+			return 1
+		}
+	}
+
 	var zapLevel zapcore.Level
 	if err := zapLevel.UnmarshalText([]byte(c.flagLogLevel)); err != nil {
 		c.UI.Error(fmt.Sprintf("Error parsing -log-level %q: %s", c.flagLogLevel, err.Error()))
@@ -135,6 +233,19 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	// The manager's client reads namespaces from its cache, so looking up
+	// their labels for the namespace mapping doesn't hit the API server.
+	var nsLabels namespaces.LabelsFunc
+	if nsMapping != nil && nsMapping.HasSelectors() {
+		nsLabels = func(kubeNS string) (map[string]string, error) {
+			var ns corev1.Namespace
+			if err := mgr.GetClient().Get(context.Background(), types.NamespacedName{Name: kubeNS}, &ns); err != nil {
+				return nil, err
+			}
+			return ns.Labels, nil
+		}
+	}
+
 	configEntryReconciler := &controller.ConfigEntryController{
 		ConsulClient:               consulClient,
 		DatacenterName:             c.flagDatacenter,
@@ -142,7 +253,10 @@ func (c *Command) Run(args []string) int {
 		ConsulDestinationNamespace: c.flagConsulDestinationNamespace,
 		EnableNSMirroring:          c.flagEnableNSMirroring,
 		NSMirroringPrefix:          c.flagNSMirroringPrefix,
+		NamespaceMapping:           nsMapping,
+		NamespaceLabels:            nsLabels,
 		CrossNSACLPolicy:           c.flagCrossNSACLPolicy,
+		ClusterName:                c.flagClusterName,
 	}
 	if err = (&controller.ServiceDefaultsController{
 		ConfigEntryController: configEntryReconciler,
@@ -217,6 +331,26 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	if c.flagDeleteMirroredNamespaces || c.flagSyncNamespaceMetadata {
+		if err = (&controller.NamespaceController{
+			Client:             mgr.GetClient(),
+			Log:                ctrl.Log.WithName("controller").WithName("namespace"),
+			ConsulClient:       consulClient,
+			NSMirroringPrefix:  c.flagNSMirroringPrefix,
+			ClusterName:        c.flagClusterName,
+			DeleteNamespaces:   c.flagDeleteMirroredNamespaces,
+			DryRun:             c.flagDeleteMirroredNSDryRun,
+			SyncMetadata:       c.flagSyncNamespaceMetadata,
+			LabelsToMeta:       nsLabelsToMeta,
+			AnnotationsToMeta:  nsAnnotationsToMeta,
+			AllowedACLPolicies: toSet(c.flagAllowNamespaceACLPolicies),
+			AllowedACLRoles:    toSet(c.flagAllowNamespaceACLRoles),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "namespace")
+			return 1
+		}
+	}
+
 	if c.flagEnableWebhooks {
 		// This webhook server sets up a Cert Watcher on the CertDir. This watches for file changes and updates the webhook certificates
 		// automatically when new certificates are available.
@@ -273,6 +407,8 @@ func (c *Command) Run(args []string) int {
 				EnableNSMirroring:          c.flagEnableNSMirroring,
 				ConsulDestinationNamespace: c.flagConsulDestinationNamespace,
 				NSMirroringPrefix:          c.flagNSMirroringPrefix,
+				NamespaceMapping:           nsMapping,
+				NamespaceLabels:            nsLabels,
 			}})
 		mgr.GetWebhookServer().Register("/mutate-v1alpha1-ingressgateway",
 			&webhook.Admission{Handler: &v1alpha1.IngressGatewayWebhook{
@@ -306,6 +442,40 @@ func (c *Command) Help() string {
 	return c.help
 }
 
+// parseToMetaFlag parses the values of a flag formatted as
+// <key>[=<meta-key>] into a map of keys to the meta keys they're added as.
+func parseToMetaFlag(name string, values []string) (map[string]string, error) {
+	toMeta := make(map[string]string)
+	for _, raw := range values {
+		parts := strings.SplitN(raw, "=", 2)
+		k, metaKey := parts[0], connectinject.MetaKeyForLabel(parts[0])
+		if len(parts) == 2 {
+			metaKey = parts[1]
+		}
+		if k == "" {
+			return nil, fmt.Errorf("%s %q must specify a key", name, raw)
+		}
+		if controller.IsReservedNamespaceMetaKey(metaKey) {
+			return nil, fmt.Errorf("%s %q uses the meta key %q, which is reserved for consul-k8s", name, raw, metaKey)
+		}
+		if !connectinject.IsValidMetaKey(metaKey) {
+			return nil, fmt.Errorf("%s %q has an invalid meta key %q: "+
+				"meta keys may only contain alphanumeric characters, underscores and dashes", name, raw, metaKey)
+		}
+		toMeta[k] = metaKey
+	}
+	return toMeta, nil
+}
+
+// toSet returns the set of the values of a repeatable flag.
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
 func (c *Command) Synopsis() string {
 	return synopsis
 }
@@ -30,6 +30,44 @@ func TestRun_FlagValidation(t *testing.T) {
 			flags:  []string{"-webhook-tls-cert-dir", "/foo", "-datacenter", "foo", "-log-level", "invalid"},
 			expErr: `Error parsing -log-level "invalid": unrecognized level: "invalid"`,
 		},
+		{
+			flags:  []string{"-webhook-tls-cert-dir", "/foo", "-datacenter", "foo", "-delete-mirrored-namespaces", "-enable-namespaces"},
+			expErr: "-delete-mirrored-namespaces requires -enable-namespaces and -enable-k8s-namespace-mirroring",
+		},
+		{
+			flags: []string{"-webhook-tls-cert-dir", "/foo", "-datacenter", "foo", "-delete-mirrored-namespaces",
+				"-enable-namespaces", "-enable-k8s-namespace-mirroring"},
+			expErr: "-delete-mirrored-namespaces requires -cluster-name",
+		},
+		{
+			flags:  []string{"-webhook-tls-cert-dir", "/foo", "-datacenter", "foo", "-sync-namespace-metadata"},
+			expErr: "-sync-namespace-metadata requires -enable-namespaces and -enable-k8s-namespace-mirroring",
+		},
+		{
+			flags: []string{"-webhook-tls-cert-dir", "/foo", "-datacenter", "foo", "-enable-namespaces",
+				"-enable-k8s-namespace-mirroring", "-sync-namespace-metadata", "-k8s-namespace-mapping-file", "/foo.json"},
+			expErr: "-k8s-namespace-mapping-file can't be used with -delete-mirrored-namespaces or -sync-namespace-metadata",
+		},
+		{
+			flags:  []string{"-webhook-tls-cert-dir", "/foo", "-datacenter", "foo", "-allow-namespace-acl-policy", "team-a"},
+			expErr: "-allow-namespace-acl-policy and -allow-namespace-acl-role require -sync-namespace-metadata",
+		},
+		{
+			flags:  []string{"-webhook-tls-cert-dir", "/foo", "-datacenter", "foo", "-namespace-label-to-meta", "team=a.b"},
+			expErr: `-namespace-label-to-meta "team=a.b" has an invalid meta key "a.b"`,
+		},
+		{
+			flags:  []string{"-webhook-tls-cert-dir", "/foo", "-datacenter", "foo", "-namespace-annotation-to-meta", "=owner"},
+			expErr: `-namespace-annotation-to-meta "=owner" must specify a key`,
+		},
+		{
+			flags:  []string{"-webhook-tls-cert-dir", "/foo", "-datacenter", "foo", "-namespace-label-to-meta", "external-source"},
+			expErr: `-namespace-label-to-meta "external-source" uses the meta key "external-source", which is reserved for consul-k8s`,
+		},
+		{
+			flags:  []string{"-webhook-tls-cert-dir", "/foo", "-datacenter", "foo", "-namespace-annotation-to-meta", "owner=k8s-acl-roles"},
+			expErr: `-namespace-annotation-to-meta "owner=k8s-acl-roles" uses the meta key "k8s-acl-roles", which is reserved for consul-k8s`,
+		},
 	}
 
 	for _, c := range cases {
@@ -4,9 +4,11 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -20,6 +22,7 @@ import (
 	connectinject "github.com/hashicorp/consul-k8s/connect-inject"
 	"github.com/hashicorp/consul-k8s/helper/cert"
 	"github.com/hashicorp/consul-k8s/helper/controller"
+	"github.com/hashicorp/consul-k8s/namespaces"
 	"github.com/hashicorp/consul-k8s/subcommand/common"
 	"github.com/hashicorp/consul-k8s/subcommand/flags"
 	"github.com/hashicorp/consul/api"
@@ -28,6 +31,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -37,6 +41,7 @@ type Command struct {
 
 	flagListen               string
 	flagAutoName             string // MutatingWebhookConfiguration for updating
+	flagAutoValidatingName   string // ValidatingWebhookConfiguration for updating
 	flagAutoHosts            string // SANs for the auto-generated TLS cert.
 	flagCertFile             string // TLS cert for listening (PEM)
 	flagKeyFile              string // TLS cert private key (PEM)
@@ -45,6 +50,7 @@ type Command struct {
 	flagEnvoyImage           string // Docker image for Envoy
 	flagConsulK8sImage       string // Docker image for consul-k8s
 	flagACLAuthMethod        string // Auth Method to use for ACLs, if enabled
+	flagACLGatewayAuthMethod string // Auth Method for gateways to use for ACLs, if enabled
 	flagWriteServiceDefaults bool   // True to enable central config injection
 	flagDefaultProtocol      string // Default protocol for use with central config
 	flagConsulCACert         string // [Deprecated] Path to CA Certificate to use when communicating with Consul clients
@@ -59,6 +65,23 @@ type Command struct {
 	flagEnableK8SNSMirroring       bool     // Enables mirroring of k8s namespaces into Consul
 	flagK8SNSMirroringPrefix       string   // Prefix added to Consul namespaces created when mirroring
 	flagCrossNamespaceACLPolicy    string   // The name of the ACL policy to add to every created namespace if ACLs are enabled
+	flagK8SNSMappingFile           string   // Path of the file mapping k8s namespaces to Consul namespaces
+	flagClusterName                string   // Name of the k8s cluster, added to the meta of mirrored namespaces
+
+	// Flags to add pod labels and information to the service meta and tags.
+	flagPodLabelsToMeta []string // Pod labels to add to the service meta, as <label>[=<meta-key>]
+	flagPodLabelsToTags []string // Pod labels whose values are added to the service tags
+	flagPodInfoToMeta   []string // Pod information to add to the service meta
+
+	// Users and groups allowed to bypass the validating webhook.
+	flagValidationAllowList []string
+
+	// Flag to give StatefulSet pods their own identity.
+	flagEnableStatefulSetIdentity bool
+
+	// Flags for the DNS config of pods injected with the Consul client config.
+	flagConsulDNSAddress string
+	flagClusterDomain    string
 
 	// Flags to enable connect-inject health checks.
 	flagEnableHealthChecks          bool          // Start the health check controller.
@@ -75,6 +98,7 @@ type Command struct {
 	flagLifecycleSidecarCPURequest    string
 	flagLifecycleSidecarMemoryLimit   string
 	flagLifecycleSidecarMemoryRequest string
+	flagLifecycleSidecarPort          int
 
 	// Init container resource settings.
 	flagInitContainerCPULimit      string
@@ -100,6 +124,8 @@ func (c *Command) init() {
 	c.flagSet.BoolVar(&c.flagDefaultInject, "default-inject", true, "Inject by default.")
 	c.flagSet.StringVar(&c.flagAutoName, "tls-auto", "",
 		"MutatingWebhookConfiguration name. If specified, will auto generate cert bundle.")
+	c.flagSet.StringVar(&c.flagAutoValidatingName, "tls-auto-validating", "",
+		"ValidatingWebhookConfiguration name. If specified, its cert bundle is updated in the same way as -tls-auto.")
 	c.flagSet.StringVar(&c.flagAutoHosts, "tls-auto-hosts", "",
 		"Comma-separated hosts for auto-generated TLS cert. If specified, will auto generate cert bundle.")
 	c.flagSet.StringVar(&c.flagCertFile, "tls-cert-file", "",
@@ -116,6 +142,9 @@ func (c *Command) init() {
 		"Extra envoy command line args to be set when starting envoy (e.g \"--log-level debug --disable-hot-restart\").")
 	c.flagSet.StringVar(&c.flagACLAuthMethod, "acl-auth-method", "",
 		"The name of the Kubernetes Auth Method to use for connectInjection if ACLs are enabled.")
+	c.flagSet.StringVar(&c.flagACLGatewayAuthMethod, "acl-gateway-auth-method", "",
+		"The name of the Kubernetes Auth Method that gateways use for Connect ACLs. Its binding rules "+
+			"must grant the policies gateways need. If not set, -acl-auth-method is used.")
 	c.flagSet.BoolVar(&c.flagWriteServiceDefaults, "enable-central-config", false,
 		"Write a service-defaults config for every Connect service using protocol from -default-protocol or Pod annotation.")
 	c.flagSet.StringVar(&c.flagDefaultProtocol, "default-protocol", "",
@@ -126,6 +155,35 @@ func (c *Command) init() {
 		"K8s namespaces to explicitly allow. May be specified multiple times.")
 	c.flagSet.Var((*flags.AppendSliceValue)(&c.flagDenyK8sNamespacesList), "deny-k8s-namespace",
 		"K8s namespaces to explicitly deny. Takes precedence over allow. May be specified multiple times.")
+	c.flagSet.Var((*flags.AppendSliceValue)(&c.flagPodLabelsToMeta), "pod-label-to-meta",
+		"Pod label to add to the service meta, formatted as <label>[=<meta-key>]. If no meta key "+
+			"is given, characters Consul doesn't allow in meta keys are replaced with underscores, "+
+			"e.g. app.kubernetes.io/version is added as app_kubernetes_io_version. May be specified multiple times.")
+	c.flagSet.Var((*flags.AppendSliceValue)(&c.flagPodLabelsToTags), "pod-label-to-tag",
+		"Pod label whose value is added to the service tags. May be specified multiple times.")
+	c.flagSet.Var((*flags.AppendSliceValue)(&c.flagPodInfoToMeta), "pod-info-to-meta",
+		fmt.Sprintf("Pod information to add to the service meta. One of %q (as %s), %q (as %s) or %q "+
+			"(the kind and name of the Deployment, StatefulSet, etc. managing the pod, as %s and %s). "+
+			"May be specified multiple times.",
+			connectinject.PodInfoNodeName, "k8s-node-name",
+			connectinject.PodInfoNamespace, "k8s-namespace",
+			connectinject.PodInfoController, "k8s-controller-kind", "k8s-controller-name"))
+	c.flagSet.Var((*flags.AppendSliceValue)(&c.flagValidationAllowList), "validation-allow",
+		"Username or group whose requests are always allowed by the validating webhook served on "+
+			"/validate, e.g. system:serviceaccount:<namespace>:<name>. May be specified multiple times.")
+	c.flagSet.BoolVar(&c.flagEnableStatefulSetIdentity, "enable-statefulset-identity", false,
+		"Register pods managed by a StatefulSet with their ordinal as service meta ("+connectinject.MetaKeyStatefulSetOrdinal+") "+
+			"and a <service>-<ordinal> tag, and write service-resolver subsets and redirects so that "+
+			"a single pod can be used as an upstream, e.g. kafka-0. When ACLs are enabled, the pods' "+
+			"tokens must be allowed to write the <service>-<ordinal> service-resolvers. The injector watches "+
+			"StatefulSets and deletes the subsets and redirects of ordinals removed by a scale-down, for which "+
+			"its token must have service:write on the services (see -enable-statefulset-identity of server-acl-init).")
+	c.flagSet.StringVar(&c.flagConsulDNSAddress, "consul-dns-address", "",
+		"IP address of Consul's DNS interface, e.g. the cluster IP of the consul-dns Service. If set, pods "+
+			"annotated with consul.hashicorp.com/client-inject use it as their nameserver. Consul must be "+
+			"configured with recursors that resolve cluster names.")
+	c.flagSet.StringVar(&c.flagClusterDomain, "cluster-domain", "cluster.local",
+		"Kubernetes cluster domain, used for the search domains of pods that use -consul-dns-address.")
 	c.flagSet.BoolVar(&c.flagEnableHealthChecks, "enable-health-checks-controller", false,
 		"Enables health checks controller.")
 	c.flagSet.DurationVar(&c.flagHealthChecksReconcilePeriod, "health-checks-reconcile-period", 1*time.Minute, "Reconcile period for health checks controller.")
@@ -138,9 +196,16 @@ func (c *Command) init() {
 		"k8s namespace mirroring.")
 	c.flagSet.StringVar(&c.flagK8SNSMirroringPrefix, "k8s-namespace-mirroring-prefix", "",
 		"[Enterprise Only] Prefix that will be added to all k8s namespaces mirrored into Consul if mirroring is enabled.")
+	c.flagSet.StringVar(&c.flagK8SNSMappingFile, "k8s-namespace-mapping-file", "",
+		"[Enterprise Only] Path to a JSON file mapping k8s namespaces, by name, glob or label selector, to Consul "+
+			"namespaces. Takes precedence over mirroring and -consul-destination-namespace for the k8s namespaces it maps.")
 	c.flagSet.StringVar(&c.flagCrossNamespaceACLPolicy, "consul-cross-namespace-acl-policy", "",
 		"[Enterprise Only] Name of the ACL policy to attach to all created Consul namespaces to allow service "+
 			"discovery across Consul namespaces. Only necessary if ACLs are enabled.")
+	c.flagSet.StringVar(&c.flagClusterName, "cluster-name", "",
+		"[Enterprise Only] The name of the Kubernetes cluster. When namespace mirroring is enabled, it's added "+
+			"to the meta of the Consul namespaces the injector creates so that the controller's "+
+			"-delete-mirrored-namespaces can delete them. Must match the controller's -cluster-name.")
 	c.flagSet.StringVar(&c.flagLogLevel, "log-level", "info",
 		"Log verbosity level. Supported values (in order of detail) are \"trace\", "+
 			"\"debug\", \"info\", \"warn\", and \"error\".")
@@ -162,6 +227,9 @@ func (c *Command) init() {
 	c.flagSet.StringVar(&c.flagLifecycleSidecarCPULimit, "lifecycle-sidecar-cpu-limit", "20m", "Lifecycle sidecar CPU limit.")
 	c.flagSet.StringVar(&c.flagLifecycleSidecarMemoryRequest, "lifecycle-sidecar-memory-request", "25Mi", "Lifecycle sidecar memory request.")
 	c.flagSet.StringVar(&c.flagLifecycleSidecarMemoryLimit, "lifecycle-sidecar-memory-limit", "50Mi", "Lifecycle sidecar memory limit.")
+	c.flagSet.IntVar(&c.flagLifecycleSidecarPort, "lifecycle-sidecar-port", connectinject.DefaultLifecycleSidecarPort,
+		"Port the lifecycle sidecar serves its health check and metrics endpoints on. "+
+			"Can be overridden per pod with the consul.hashicorp.com/lifecycle-sidecar-port annotation.")
 
 	c.http = &flags.HTTPFlags{}
 
@@ -196,6 +264,11 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	if c.flagConsulDNSAddress != "" && net.ParseIP(c.flagConsulDNSAddress) == nil {
+		c.UI.Error(fmt.Sprintf("-consul-dns-address %q must be an IP address", c.flagConsulDNSAddress))
+		return 1
+	}
+
 	logger, err := common.Logger(c.flagLogLevel)
 	if err != nil {
 		c.UI.Error(err.Error())
@@ -246,6 +319,11 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	if c.flagLifecycleSidecarPort < 1 || c.flagLifecycleSidecarPort > 65535 {
+		c.UI.Error(fmt.Sprintf("-lifecycle-sidecar-port %d is not a valid port", c.flagLifecycleSidecarPort))
+		return 1
+	}
+
 	// Validate resource request/limit flags and parse into corev1.ResourceRequirements
 	initResources, lifecycleResources, err := c.parseAndValidateResourceFlags()
 	if err != nil {
@@ -253,6 +331,21 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	podLabelsToMeta, err := c.parsePodMetadataFlags()
+	if err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+
+	var nsMapping *namespaces.Mapping
+	if c.flagK8SNSMappingFile != "" {
+		nsMapping, err = namespaces.ReadMappingFile(c.flagK8SNSMappingFile)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error reading -k8s-namespace-mapping-file: %s", err))
+			return 1
+		}
+	}
+
 	// We must have an in-cluster K8S client
 	if c.clientset == nil {
 		config, err := rest.InClusterConfig()
@@ -317,6 +410,17 @@ func (c *Command) Run(args []string) int {
 	defer cancelFunc()
 	go c.certWatcher(ctx, certCh, c.clientset)
 
+	// If the namespace mapping selects namespaces by their labels, watch
+	// the namespaces so that their labels can be read from the cache.
+	var nsLabels namespaces.LabelsFunc
+	if nsMapping != nil && nsMapping.HasSelectors() {
+		factory := informers.NewSharedInformerFactory(c.clientset, 0)
+		nsLister := factory.Core().V1().Namespaces().Lister()
+		factory.Start(ctx.Done())
+		factory.WaitForCacheSync(ctx.Done())
+		nsLabels = namespaces.ListerLabelsFunc(nsLister)
+	}
+
 	// Convert allow/deny lists to sets
 	allowK8sNamespaces := flags.ToSet(c.flagAllowK8sNamespacesList)
 	denyK8sNamespaces := flags.ToSet(c.flagDenyK8sNamespacesList)
@@ -330,6 +434,7 @@ func (c *Command) Run(args []string) int {
 		ImageConsulK8S:             c.flagConsulK8sImage,
 		RequireAnnotation:          !c.flagDefaultInject,
 		AuthMethod:                 c.flagACLAuthMethod,
+		GatewayAuthMethod:          c.flagACLGatewayAuthMethod,
 		WriteServiceDefaults:       c.flagWriteServiceDefaults,
 		DefaultProtocol:            c.flagDefaultProtocol,
 		ConsulCACert:               string(consulCACert),
@@ -339,6 +444,7 @@ func (c *Command) Run(args []string) int {
 		DefaultProxyMemoryLimit:    sidecarProxyMemoryLimit,
 		InitContainerResources:     initResources,
 		LifecycleSidecarResources:  lifecycleResources,
+		LifecycleSidecarPort:       c.flagLifecycleSidecarPort,
 		EnableNamespaces:           c.flagEnableNamespaces,
 		AllowK8sNamespacesSet:      allowK8sNamespaces,
 		DenyK8sNamespacesSet:       denyK8sNamespaces,
@@ -346,10 +452,21 @@ func (c *Command) Run(args []string) int {
 		EnableK8SNSMirroring:       c.flagEnableK8SNSMirroring,
 		K8SNSMirroringPrefix:       c.flagK8SNSMirroringPrefix,
 		CrossNamespaceACLPolicy:    c.flagCrossNamespaceACLPolicy,
+		ClusterName:                c.flagClusterName,
+		NamespaceMapping:           nsMapping,
+		NamespaceLabels:            nsLabels,
+		PodLabelsToMeta:            podLabelsToMeta,
+		PodLabelsToTags:            c.flagPodLabelsToTags,
+		PodInfoToMeta:              c.flagPodInfoToMeta,
+		StatefulSetIdentity:        c.flagEnableStatefulSetIdentity,
+		ConsulDNSAddress:           c.flagConsulDNSAddress,
+		ClusterDomain:              c.flagClusterDomain,
+		ValidationAllowList:        flags.ToSet(c.flagValidationAllowList),
 		Log:                        logger.Named("handler"),
 	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/mutate", injector.Handle)
+	mux.HandleFunc("/validate", injector.HandleValidate)
 	mux.HandleFunc("/health/ready", c.handleReady)
 	var handler http.Handler = mux
 	server := &http.Server{
@@ -358,6 +475,22 @@ func (c *Command) Run(args []string) int {
 		TLSConfig: &tls.Config{GetCertificate: c.getCertificate},
 	}
 
+	if c.flagEnableStatefulSetIdentity {
+		// Clean up the service-resolvers of StatefulSet pods that have been
+		// removed by a scale-down. Failures are retried by the controller
+		// and don't affect injection.
+		stsCtl := &controller.Controller{
+			Log: logger.Named("statefulSetResolverController"),
+			Resource: &connectinject.StatefulSetResolverResource{
+				Log:                 logger.Named("statefulSetResolverResource"),
+				KubernetesClientset: c.clientset,
+				Handler:             &injector,
+				Ctx:                 ctx,
+			},
+		}
+		go stsCtl.Run(ctx.Done())
+	}
+
 	if c.flagEnableHealthChecks {
 		// Channel used for health checks
 		// also check to see if we should enable TLS.
@@ -505,6 +638,26 @@ func (c *Command) certWatcher(ctx context.Context, ch <-chan cert.MetaBundle, cl
 			}
 		}
 
+		// If there is a VWC name set, then update its CA bundle too.
+		if c.flagAutoValidatingName != "" && len(bundle.CACert) > 0 {
+			value := base64.StdEncoding.EncodeToString(bundle.CACert)
+
+			_, err := clientset.AdmissionregistrationV1beta1().
+				ValidatingWebhookConfigurations().
+				Patch(context.TODO(), c.flagAutoValidatingName, types.JSONPatchType, []byte(fmt.Sprintf(
+					`[{
+						"op": "add",
+						"path": "/webhooks/0/clientConfig/caBundle",
+						"value": %q
+					}]`, value)), metav1.PatchOptions{})
+			if err != nil {
+				c.UI.Error(fmt.Sprintf(
+					"Error updating ValidatingWebhookConfiguration: %s",
+					err))
+				continue
+			}
+		}
+
 		// Update the certificate
 		c.cert.Store(&cert)
 	}
@@ -610,6 +763,44 @@ func (c *Command) parseAndValidateResourceFlags() (corev1.ResourceRequirements,
 	return initResources, lifecycleResources, nil
 }
 
+// parsePodMetadataFlags validates the flags controlling which pod labels and
+// information are added to the service meta and tags, and returns the map of
+// pod label keys to the meta keys they're added as.
+func (c *Command) parsePodMetadataFlags() (map[string]string, error) {
+	podLabelsToMeta := make(map[string]string)
+	for _, raw := range c.flagPodLabelsToMeta {
+		parts := strings.SplitN(raw, "=", 2)
+		label, key := parts[0], connectinject.MetaKeyForLabel(parts[0])
+		if len(parts) == 2 {
+			key = parts[1]
+		}
+		if label == "" {
+			return nil, fmt.Errorf("-pod-label-to-meta %q must specify a label", raw)
+		}
+		if !connectinject.IsValidMetaKey(key) {
+			return nil, fmt.Errorf("-pod-label-to-meta %q has an invalid meta key %q: "+
+				"meta keys may only contain alphanumeric characters, underscores and dashes", raw, key)
+		}
+		podLabelsToMeta[label] = key
+	}
+
+	for _, label := range c.flagPodLabelsToTags {
+		if label == "" {
+			return nil, errors.New("-pod-label-to-tag must not be empty")
+		}
+	}
+
+	for _, info := range c.flagPodInfoToMeta {
+		switch info {
+		case connectinject.PodInfoNodeName, connectinject.PodInfoNamespace, connectinject.PodInfoController:
+		default:
+			return nil, fmt.Errorf("-pod-info-to-meta %q is invalid: must be one of %q, %q or %q", info,
+				connectinject.PodInfoNodeName, connectinject.PodInfoNamespace, connectinject.PodInfoController)
+		}
+	}
+	return podLabelsToMeta, nil
+}
+
 func (c *Command) Synopsis() string { return synopsis }
 func (c *Command) Help() string {
 	c.once.Do(c.init)
@@ -31,11 +31,21 @@ func TestRun_FlagValidation(t *testing.T) {
 			flags:  []string{"-consul-k8s-image", "foo", "-consul-image", "foo"},
 			expErr: "-envoy-image must be set",
 		},
+		{
+			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
+				"-consul-dns-address", "consul-dns"},
+			expErr: `-consul-dns-address "consul-dns" must be an IP address`,
+		},
 		{
 			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
 				"-log-level", "invalid"},
 			expErr: "unknown log level: invalid",
 		},
+		{
+			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
+				"-lifecycle-sidecar-port", "0"},
+			expErr: "-lifecycle-sidecar-port 0 is not a valid port",
+		},
 		{
 			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
 				"-ca-file", "bar"},
@@ -143,6 +153,26 @@ func TestRun_FlagValidation(t *testing.T) {
 			},
 			expErr: "request must be <= limit: -lifecycle-sidecar-cpu-request value of \"50m\" is greater than the -lifecycle-sidecar-cpu-limit value of \"25m\"",
 		},
+		{
+			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
+				"-pod-label-to-meta=app.kubernetes.io/version=app.version"},
+			expErr: "-pod-label-to-meta \"app.kubernetes.io/version=app.version\" has an invalid meta key \"app.version\"",
+		},
+		{
+			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
+				"-pod-label-to-meta==version"},
+			expErr: "-pod-label-to-meta \"=version\" must specify a label",
+		},
+		{
+			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
+				"-pod-label-to-tag="},
+			expErr: "-pod-label-to-tag must not be empty",
+		},
+		{
+			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
+				"-pod-info-to-meta=hostname"},
+			expErr: "-pod-info-to-meta \"hostname\" is invalid",
+		},
 		{
 			flags: []string{"-consul-k8s-image", "hashicorpdev/consul-k8s:latest", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
 				"-enable-health-checks-controller=true"},
@@ -0,0 +1,77 @@
+package subcommand
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// File names of the certificates written to -connect-certs-dir.
+const (
+	leafCertFileName  = "leaf-cert.pem"
+	leafKeyFileName   = "leaf-key.pem"
+	rootCertsFileName = "root-certs.pem"
+)
+
+// writeConnectCerts writes the leaf certificate and private key of each
+// Connect-native service, along with the Connect CA roots, to
+// -connect-certs-dir. The local agent caches and renews leaf certificates,
+// so fetching them on every sync keeps the files up to date when the
+// certificate is rotated. Files are only rewritten when their contents
+// change.
+func (c *Command) writeConnectCerts(registrations []*api.AgentServiceRegistration) error {
+	for _, reg := range registrations {
+		if reg.Connect == nil || !reg.Connect.Native {
+			continue
+		}
+
+		leaf, _, err := c.client().Agent().ConnectCALeaf(reg.Name, &api.QueryOptions{Namespace: reg.Namespace})
+		if err != nil {
+			return fmt.Errorf("fetching leaf certificate for service %q: %s", reg.Name, err)
+		}
+		roots, _, err := c.client().Agent().ConnectCARoots(nil)
+		if err != nil {
+			return fmt.Errorf("fetching Connect CA roots: %s", err)
+		}
+		var rootsPEM strings.Builder
+		for _, root := range roots.Roots {
+			rootsPEM.WriteString(strings.TrimSpace(root.RootCertPEM) + "\n")
+		}
+
+		// The files must be readable by the application container which
+		// may run as a different user to us.
+		files := []struct {
+			name     string
+			contents string
+		}{
+			{leafKeyFileName, leaf.PrivateKeyPEM},
+			{leafCertFileName, leaf.CertPEM},
+			{rootCertsFileName, rootsPEM.String()},
+		}
+		for _, f := range files {
+			path := filepath.Join(c.flagConnectCertsDir, f.name)
+			if err := writeFileIfChanged(path, []byte(f.contents), 0444); err != nil {
+				return fmt.Errorf("writing %q: %s", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// writeFileIfChanged atomically writes data to path unless the file
+// already contains data.
+func writeFileIfChanged(path string, data []byte, perm os.FileMode) error {
+	existing, err := ioutil.ReadFile(path)
+	if err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return writeFileAtomic(path, data, perm)
+}
@@ -5,30 +5,61 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/cenkalti/backoff"
 	"github.com/hashicorp/consul-k8s/subcommand/common"
 	"github.com/hashicorp/consul-k8s/subcommand/flags"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
 	"github.com/mitchellh/cli"
 )
 
+const defaultBearerTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
 type Command struct {
 	UI cli.Ui
 
 	http              *flags.HTTPFlags
 	flagServiceConfig string
-	flagConsulBinary  string
 	flagSyncPeriod    time.Duration
 	flagSet           *flag.FlagSet
 	flagLogLevel      string
 
-	consulCommand []string
+	// Flags for the health check and metrics endpoints.
+	flagListen           string
+	flagFailureThreshold int
+	flagLivenessTimeout  time.Duration
+
+	// Flags to support renewing the ACL token by logging in to an auth method.
+	flagAuthMethod          string
+	flagAuthMethodNamespace string
+	flagBearerTokenFile     string
+	flagLoginMeta           []string
+
+	// Flags for Connect-native services, which have no Envoy sidecar.
+	flagConnectCertsDir      string
+	flagDeregisterOnShutdown bool
+
+	// Path to write the proxy's upstreams to.
+	flagUpstreamsFile string
+
+	// Flag for services registered with their StatefulSet ordinal.
+	flagWriteStatefulSetResolvers bool
+
+	consulConfig *api.Config
+
+	// consulClient is re-created by login, possibly while services are
+	// being watched, so it must be read with client().
+	consulClient *api.Client
+	clientLock   sync.Mutex
 
 	once  sync.Once
 	help  string
@@ -38,11 +69,44 @@ type Command struct {
 func (c *Command) init() {
 	c.flagSet = flag.NewFlagSet("", flag.ContinueOnError)
 	c.flagSet.StringVar(&c.flagServiceConfig, "service-config", "", "Path to the service config file")
-	c.flagSet.StringVar(&c.flagConsulBinary, "consul-binary", "consul", "Path to a consul binary")
-	c.flagSet.DurationVar(&c.flagSyncPeriod, "sync-period", 10*time.Second, "Time between syncing the service registration. Defaults to 10s.")
+	c.flagSet.DurationVar(&c.flagSyncPeriod, "sync-period", 10*time.Second,
+		"Maximum time between syncing the service registration. Services are re-registered "+
+			"immediately if they are removed from the Consul agent. Defaults to 10s.")
 	c.flagSet.StringVar(&c.flagLogLevel, "log-level", "info",
 		"Log verbosity level. Supported values (in order of detail) are \"trace\", "+
 			"\"debug\", \"info\", \"warn\", and \"error\". Defaults to info.")
+	c.flagSet.StringVar(&c.flagListen, "listen", "",
+		"Address to serve the health checks (/health/ready, /health/live) and Prometheus metrics (/metrics) "+
+			"endpoints on, e.g. \":20300\". If not set, the endpoints are not served.")
+	c.flagSet.IntVar(&c.flagFailureThreshold, "failure-threshold", 3,
+		"Number of consecutive sync failures after which the health check fails. Defaults to 3.")
+	c.flagSet.DurationVar(&c.flagLivenessTimeout, "liveness-timeout", 5*time.Minute,
+		"Time without a successful sync after which the liveness check fails, so that a sidecar "+
+			"that can't register its services is restarted. Must be longer than -sync-period. Defaults to 5m.")
+	c.flagSet.StringVar(&c.flagAuthMethod, "auth-method", "",
+		"Name of the Kubernetes auth method to log in to if the ACL token in -token-file "+
+			"is no longer valid. If set, -token-file must also be set.")
+	c.flagSet.StringVar(&c.flagAuthMethodNamespace, "auth-method-namespace", "",
+		"[Enterprise Only] Consul namespace the auth method is defined in.")
+	c.flagSet.StringVar(&c.flagBearerTokenFile, "bearer-token-file", defaultBearerTokenFile,
+		"Path to the service account token used to log in to the auth method.")
+	c.flagSet.Var((*flags.AppendSliceValue)(&c.flagLoginMeta), "login-meta",
+		"Metadata to set on the ACL token when logging in, formatted as key=value. "+
+			"May be specified multiple times.")
+
+	c.flagSet.StringVar(&c.flagConnectCertsDir, "connect-certs-dir", "",
+		"Directory to write the leaf certificate, private key and Connect CA roots of "+
+			"Connect-native services to. If not set, certificates are not written.")
+	c.flagSet.BoolVar(&c.flagDeregisterOnShutdown, "deregister-on-shutdown", false,
+		"Deregister the services, and log out the ACL token if -auth-method is set, on "+
+			"shutdown. Used when there is no Envoy sidecar whose preStop hook does this.")
+
+	c.flagSet.StringVar(&c.flagUpstreamsFile, "upstreams-file", "",
+		"Path to write the upstreams of the proxy to, as JSON, including the protocol of "+
+			"each upstream. If not set, the file is not written.")
+	c.flagSet.BoolVar(&c.flagWriteStatefulSetResolvers, "write-statefulset-resolvers", false,
+		"Write the service-resolver subset and redirect that allow services registered with "+
+			"their StatefulSet ordinal to be targeted individually as upstreams.")
 
 	c.help = flags.Usage(help, c.flagSet)
 	c.http = &flags.HTTPFlags{}
@@ -81,53 +145,239 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	registrations, err := parseServiceConfig(c.flagServiceConfig)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error reading -service-config: %s", err))
+		return 1
+	}
+
+	c.consulConfig = api.DefaultConfig()
+	c.http.MergeOntoConfig(c.consulConfig)
+	if c.consulClient == nil {
+		c.consulClient, err = api.NewClient(c.consulConfig)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error creating Consul client: %s", err))
+			return 1
+		}
+	}
+
 	// Log initial configuration
 	logger.Info("Command configuration", "service-config", c.flagServiceConfig,
-		"consul-binary", c.flagConsulBinary,
 		"sync-period", c.flagSyncPeriod,
-		"log-level", c.flagLogLevel)
+		"log-level", c.flagLogLevel,
+		"auth-method", c.flagAuthMethod,
+		"listen", c.flagListen,
+		"connect-certs-dir", c.flagConnectCertsDir,
+		"upstreams-file", c.flagUpstreamsFile)
 
-	c.consulCommand = []string{"services", "register"}
-	c.consulCommand = append(c.consulCommand, c.parseConsulFlags()...)
-	c.consulCommand = append(c.consulCommand, c.flagServiceConfig)
+	status := newSyncStatus(c.flagFailureThreshold, c.flagLivenessTimeout)
+	if c.flagListen != "" {
+		// Listen before serving so that we fail straight away if the
+		// address is already in use.
+		ln, err := net.Listen("tcp", c.flagListen)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error listening on %q: %s", c.flagListen, err))
+			return 1
+		}
+		server := &http.Server{Handler: status.handler()}
+		defer server.Close()
+		go func() {
+			if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+				logger.Error("health check and metrics server exited", "err", err)
+			}
+		}()
+	}
 
-	// ctx that we pass in to the main work loop, signal handling is handled in another thread
-	// due to the length of time it can take for the cmd to complete causing synchronization issues
-	// on shutdown. Also passing a context in so that it can interrupt the cmd and exit cleanly.
+	// ctx is used to interrupt the blocking queries watching our services
+	// when we shut down.
 	ctx, cancelFunc := context.WithCancel(context.Background())
-	go func() {
-		select {
-		case sig := <-c.sigCh:
-			logger.Info(fmt.Sprintf("%s received, shutting down", sig))
-			cancelFunc()
-			return
-		}
-	}()
-	// The main work loop. We continually re-register our service every
-	// syncPeriod. Consul is smart enough to know when the service hasn't changed
-	// and so won't update any indices. This means we won't be causing a lot
-	// of traffic within the cluster. We tolerate Consul Clients going down
+	defer cancelFunc()
+
+	// Back off exponentially on errors so that we don't hammer a Consul
+	// client that is struggling, but never wait longer than the sync period.
+	retryBackoff := backoff.NewExponentialBackOff()
+	retryBackoff.MaxInterval = c.flagSyncPeriod
+	retryBackoff.MaxElapsedTime = 0
+
+	shutdown := func(sig os.Signal) int {
+		logger.Info(fmt.Sprintf("%s received, shutting down", sig))
+		if c.flagDeregisterOnShutdown {
+			c.deregisterServices(logger, registrations)
+		}
+		return 0
+	}
+
+	// The main work loop. We register our services and then watch them on
+	// the agent using blocking queries. If the Consul client is restarted it
+	// loses all its service registrations, so as soon as any of our services
+	// disappears we re-register them. We also re-register every syncPeriod.
+	// Consul is smart enough to know when the service hasn't changed and so
+	// won't update any indices. This means we won't be causing a lot of
+	// traffic within the cluster. We tolerate Consul Clients going down
 	// and will simply re-register once it's back up.
 	//
 	// The loop will only exit when the Pod is shut down and we receive a SIGINT.
 	for {
-		start := time.Now()
-		cmd := exec.CommandContext(ctx, c.flagConsulBinary, c.consulCommand...)
+		// Don't register the services again if we're shutting down, otherwise
+		// we could re-register services that the preStop hook has
+		// just deregistered.
+		select {
+		case sig := <-c.sigCh:
+			return shutdown(sig)
+		default:
+		}
 
-		// Run the command and record the stdout and stderr output
-		output, err := cmd.CombinedOutput()
+		start := time.Now()
+		err := c.registerServices(registrations)
+		if err == nil && c.flagConnectCertsDir != "" {
+			err = c.writeConnectCerts(registrations)
+		}
+		if err == nil && c.flagUpstreamsFile != "" {
+			err = c.writeUpstreamsFile(logger, registrations)
+		}
+		status.record(start, err)
 		if err != nil {
-			logger.Error("failed to sync service", "output", strings.TrimSpace(string(output)), "err", err, "duration", time.Since(start))
-		} else {
-			logger.Info("successfully synced service", "output", strings.TrimSpace(string(output)), "duration", time.Since(start))
+			logger.Error("failed to sync service", "err", err, "duration", time.Since(start))
+
+			// If our ACL token has been deleted or no longer has the
+			// permissions it needs, log in again to get a new one before
+			// retrying. We still back off so that we don't keep logging in
+			// if the new token doesn't have the permissions we need either.
+			if c.flagAuthMethod != "" && isACLError(err) {
+				if err := c.login(logger); err != nil {
+					logger.Error("failed to renew ACL token", "err", err)
+				}
+			}
+
+			select {
+			// Retry after backing off or exit if we receive interrupt or terminate signals.
+			case <-time.After(retryBackoff.NextBackOff()):
+				continue
+			case sig := <-c.sigCh:
+				return shutdown(sig)
+			}
 		}
+		logger.Info("successfully synced service", "duration", time.Since(start))
+		retryBackoff.Reset()
+
+		// The service-resolvers aren't needed for the services to be
+		// reachable so failing to write them doesn't fail the health check.
+		// We'll try again on the next sync.
+		if c.flagWriteStatefulSetResolvers {
+			if err := c.writeStatefulSetResolvers(registrations); err != nil {
+				logger.Error("failed to write StatefulSet service-resolvers", "err", err)
+			}
+		}
+
+		// Block until one of the services is removed from the agent or
+		// the sync period elapses. The watch runs in another goroutine so
+		// that we can exit as soon as we receive a signal.
+		watchCh := make(chan error, 1)
+		go func() {
+			watchCh <- c.watchServices(ctx, registrations)
+		}()
 		select {
-		// Re-loop after syncPeriod or exit if we receive interrupt or terminate signals.
-		case <-time.After(c.flagSyncPeriod):
+		case err := <-watchCh:
+			if err != nil {
+				logger.Info("service registration changed on the agent, re-registering", "err", err)
+			}
+		case sig := <-c.sigCh:
+			return shutdown(sig)
+		}
+	}
+}
+
+// client returns the Consul client.
+func (c *Command) client() *api.Client {
+	c.clientLock.Lock()
+	defer c.clientLock.Unlock()
+	return c.consulClient
+}
+
+// registerServices registers all services with the local Consul agent.
+func (c *Command) registerServices(registrations []*api.AgentServiceRegistration) error {
+	for _, reg := range registrations {
+		if err := c.client().Agent().ServiceRegister(reg); err != nil {
+			return fmt.Errorf("registering service %q: %s", reg.ID, err)
+		}
+	}
+	return nil
+}
+
+// deregisterServices deregisters all services from the local Consul agent
+// and logs out our ACL token if we logged in to an auth method. Errors are
+// logged rather than returned since we're shutting down anyway.
+func (c *Command) deregisterServices(logger hclog.Logger, registrations []*api.AgentServiceRegistration) {
+	for _, reg := range registrations {
+		// The deregister endpoint only takes the namespace from the client's
+		// config.
+		client := c.client()
+		if reg.Namespace != "" {
+			nsConfig := *c.consulConfig
+			nsConfig.Namespace = reg.Namespace
+			var err error
+			if client, err = api.NewClient(&nsConfig); err != nil {
+				logger.Error("failed to deregister service", "id", reg.ID, "err", err)
+				continue
+			}
+		}
+		if err := client.Agent().ServiceDeregister(reg.ID); err != nil {
+			logger.Error("failed to deregister service", "id", reg.ID, "err", err)
 			continue
-		case <-ctx.Done():
-			return 0
 		}
+		logger.Info("deregistered service", "id", reg.ID)
+	}
+
+	if c.flagAuthMethod != "" {
+		if _, err := c.client().ACL().Logout(nil); err != nil {
+			logger.Error("failed to log out ACL token", "err", err)
+		}
+	}
+}
+
+// watchServices blocks until one of the given services can no longer be
+// found on the local agent, the sync period elapses or ctx is cancelled.
+// It returns an error describing why a service watch ended early, or nil if
+// the sync period elapsed or ctx was cancelled.
+func (c *Command) watchServices(ctx context.Context, registrations []*api.AgentServiceRegistration) error {
+	watchCtx, cancel := context.WithTimeout(ctx, c.flagSyncPeriod)
+	defer cancel()
+
+	errCh := make(chan error, len(registrations))
+	for _, reg := range registrations {
+		go func(reg *api.AgentServiceRegistration) {
+			errCh <- c.watchService(watchCtx, reg)
+		}(reg)
+	}
+
+	select {
+	case err := <-errCh:
+		// If our context is done the watch was cancelled rather than
+		// the service having changed.
+		if watchCtx.Err() != nil {
+			return nil
+		}
+		return err
+	case <-watchCtx.Done():
+		return nil
+	}
+}
+
+// watchService uses hash-based blocking queries against the local agent to
+// watch a single service. It only returns when the query fails, for example
+// because the service is no longer registered (the agent returns a 404),
+// or ctx is cancelled.
+func (c *Command) watchService(ctx context.Context, reg *api.AgentServiceRegistration) error {
+	opts := &api.QueryOptions{
+		Namespace: reg.Namespace,
+		WaitTime:  c.flagSyncPeriod,
+	}
+	for {
+		_, meta, err := c.client().Agent().Service(reg.ID, opts.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("watching service %q: %s", reg.ID, err)
+		}
+		opts.WaitHash = meta.LastContentHash
 	}
 }
 
@@ -136,9 +386,6 @@ func (c *Command) validateFlags() error {
 	if c.flagServiceConfig == "" {
 		return errors.New("-service-config must be set")
 	}
-	if c.flagConsulBinary == "" {
-		return errors.New("-consul-binary must be set")
-	}
 	if c.flagSyncPeriod == 0 {
 		// if sync period is 0, then the select loop will
 		// always pick the first case, and it'll be impossible
@@ -146,31 +393,29 @@ func (c *Command) validateFlags() error {
 		return errors.New("-sync-period must be greater than 0")
 	}
 
+	if c.flagFailureThreshold < 1 {
+		return errors.New("-failure-threshold must be greater than 0")
+	}
+	if c.flagLivenessTimeout <= c.flagSyncPeriod {
+		return errors.New("-liveness-timeout must be greater than -sync-period")
+	}
+	if c.flagAuthMethod != "" && c.http.TokenFile() == "" {
+		return errors.New("-token-file must be set when -auth-method is set")
+	}
+	for _, kv := range c.flagLoginMeta {
+		if !strings.Contains(kv, "=") {
+			return fmt.Errorf("-login-meta %q must be formatted as key=value", kv)
+		}
+	}
+
 	_, err := os.Stat(c.flagServiceConfig)
 	if os.IsNotExist(err) {
-		err = fmt.Errorf("-service-config file %q not found", c.flagServiceConfig)
 		return fmt.Errorf("-service-config file %q not found", c.flagServiceConfig)
 	}
-	_, err = exec.LookPath(c.flagConsulBinary)
-	if err != nil {
-		return fmt.Errorf("-consul-binary %q not found: %s", c.flagConsulBinary, err)
-	}
 
 	return nil
 }
 
-// parseConsulFlags creates Consul client command flags
-// from command's HTTP flags and returns them as an array of strings.
-func (c *Command) parseConsulFlags() []string {
-	var consulCommandFlags []string
-	c.http.Flags().VisitAll(func(f *flag.Flag) {
-		if f.Value.String() != "" {
-			consulCommandFlags = append(consulCommandFlags, fmt.Sprintf("-%s=%s", f.Name, f.Value.String()))
-		}
-	})
-	return consulCommandFlags
-}
-
 // interrupt sends os.Interrupt signal to the command
 // so it can exit gracefully. This function is needed for tests
 func (c *Command) interrupt() {
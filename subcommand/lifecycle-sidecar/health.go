@@ -0,0 +1,120 @@
+package subcommand
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "consul_k8s_lifecycle_sidecar"
+
+// syncStatus tracks the result of each sync so that it can be served as a
+// health check and as Prometheus metrics.
+type syncStatus struct {
+	// failureThreshold is the number of consecutive sync failures after
+	// which the health check fails.
+	failureThreshold int
+	// livenessTimeout is the time without a successful sync after which
+	// the liveness check fails.
+	livenessTimeout time.Duration
+
+	lock                sync.Mutex
+	consecutiveFailures int
+	lastErr             error
+	// lastSuccess is the time of the last successful sync, or of the
+	// start if there hasn't been one yet.
+	lastSuccess time.Time
+
+	registry        *prometheus.Registry
+	syncDuration    prometheus.Histogram
+	syncFailures    prometheus.Counter
+	lastSyncSuccess prometheus.Gauge
+}
+
+func newSyncStatus(failureThreshold int, livenessTimeout time.Duration) *syncStatus {
+	s := &syncStatus{
+		failureThreshold: failureThreshold,
+		livenessTimeout:  livenessTimeout,
+		lastSuccess:      time.Now(),
+		registry:         prometheus.NewRegistry(),
+		syncDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "sync_duration_seconds",
+			Help:      "Time taken to register the services with the Consul client.",
+		}),
+		syncFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sync_failures_total",
+			Help:      "Number of times registering the services with the Consul client failed.",
+		}),
+		lastSyncSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_sync_success_timestamp_seconds",
+			Help:      "Unix time of the last successful registration of the services with the Consul client.",
+		}),
+	}
+	s.registry.MustRegister(s.syncDuration, s.syncFailures, s.lastSyncSuccess)
+	return s
+}
+
+// record records the result of a sync that started at start.
+func (s *syncStatus) record(start time.Time, err error) {
+	s.syncDuration.Observe(time.Since(start).Seconds())
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastErr = err
+	if err != nil {
+		s.consecutiveFailures++
+		s.syncFailures.Inc()
+		return
+	}
+	s.consecutiveFailures = 0
+	s.lastSuccess = time.Now()
+	s.lastSyncSuccess.SetToCurrentTime()
+}
+
+// handleHealth responds with a 500 if the last failureThreshold syncs have
+// failed so that it can be used as a readiness probe.
+func (s *syncStatus) handleHealth(rw http.ResponseWriter, _ *http.Request) {
+	s.lock.Lock()
+	failures, lastErr := s.consecutiveFailures, s.lastErr
+	s.lock.Unlock()
+
+	if failures >= s.failureThreshold {
+		rw.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(rw, "%d consecutive sync failures, last error: %s", failures, lastErr)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// handleLive responds with a 500 if there hasn't been a successful sync
+// for livenessTimeout so that it can be used as a liveness probe. The
+// timeout is longer than the readiness check's threshold so that a Consul
+// client restart doesn't restart the sidecars.
+func (s *syncStatus) handleLive(rw http.ResponseWriter, _ *http.Request) {
+	s.lock.Lock()
+	since, lastErr := time.Since(s.lastSuccess), s.lastErr
+	s.lock.Unlock()
+
+	if since > s.livenessTimeout {
+		rw.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(rw, "no successful sync for %s, last error: %s", since.Round(time.Second), lastErr)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// handler returns the HTTP handler serving the health checks and metrics.
+func (s *syncStatus) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health/ready", s.handleHealth)
+	mux.HandleFunc("/health/live", s.handleLive)
+	mux.Handle("/metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+	return mux
+}
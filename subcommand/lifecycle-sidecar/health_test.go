@@ -0,0 +1,94 @@
+package subcommand
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncStatus_Health(t *testing.T) {
+	t.Parallel()
+	status := newSyncStatus(2, time.Minute)
+	server := httptest.NewServer(status.handler())
+	defer server.Close()
+
+	requireHealthCode := func(expCode int) {
+		resp, err := http.Get(server.URL + "/health/ready")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, expCode, resp.StatusCode)
+	}
+
+	// Healthy before the first sync.
+	requireHealthCode(http.StatusNoContent)
+
+	// Still healthy after fewer failures than the threshold.
+	status.record(time.Now(), errors.New("error"))
+	requireHealthCode(http.StatusNoContent)
+
+	// Unhealthy once the threshold is reached.
+	status.record(time.Now(), errors.New("error"))
+	requireHealthCode(http.StatusInternalServerError)
+
+	// A successful sync resets the failures.
+	status.record(time.Now(), nil)
+	requireHealthCode(http.StatusNoContent)
+}
+
+// Test that the liveness check only fails once there hasn't been a
+// successful sync for the liveness timeout.
+func TestSyncStatus_Live(t *testing.T) {
+	t.Parallel()
+	status := newSyncStatus(1, time.Minute)
+	server := httptest.NewServer(status.handler())
+	defer server.Close()
+
+	requireLiveCode := func(expCode int) {
+		resp, err := http.Get(server.URL + "/health/live")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, expCode, resp.StatusCode)
+	}
+
+	// Failures within the timeout don't fail the check.
+	status.record(time.Now(), errors.New("error"))
+	status.record(time.Now(), errors.New("error"))
+	requireLiveCode(http.StatusNoContent)
+
+	// It fails once the last successful sync is older than the timeout.
+	status.lock.Lock()
+	status.lastSuccess = time.Now().Add(-2 * time.Minute)
+	status.lock.Unlock()
+	requireLiveCode(http.StatusInternalServerError)
+
+	// A successful sync makes it pass again.
+	status.record(time.Now(), nil)
+	requireLiveCode(http.StatusNoContent)
+}
+
+func TestSyncStatus_Metrics(t *testing.T) {
+	t.Parallel()
+	status := newSyncStatus(3, time.Minute)
+	server := httptest.NewServer(status.handler())
+	defer server.Close()
+
+	status.record(time.Now(), errors.New("error"))
+	status.record(time.Now(), errors.New("error"))
+	status.record(time.Now(), nil)
+
+	resp, err := http.Get(server.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Contains(t, string(body), "consul_k8s_lifecycle_sidecar_sync_failures_total 2")
+	require.Contains(t, string(body), "consul_k8s_lifecycle_sidecar_sync_duration_seconds_count 3")
+	require.Contains(t, string(body), "consul_k8s_lifecycle_sidecar_last_sync_success_timestamp_seconds")
+	require.NotContains(t, string(body), "consul_k8s_lifecycle_sidecar_last_sync_success_timestamp_seconds 0")
+}
@@ -0,0 +1,109 @@
+package subcommand
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+)
+
+// isACLError returns true if err is the error returned by Consul when the ACL
+// token is not valid, e.g. because it has been deleted, or when the token no
+// longer has the permissions needed to register our services, e.g. because
+// the auth method's binding rules changed.
+func isACLError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Unexpected response code: 403")
+}
+
+// login logs in to the -auth-method using the pod's service account token.
+// The new ACL token is written to the token file, replacing the previous
+// token atomically so that other containers reading the file never see a
+// partially written token, and the previous token is logged out.
+// The Consul client is re-created so that it uses the new token.
+func (c *Command) login(logger hclog.Logger) error {
+	bearerToken, err := ioutil.ReadFile(c.flagBearerTokenFile)
+	if err != nil {
+		return fmt.Errorf("reading bearer token file %q: %s", c.flagBearerTokenFile, err)
+	}
+
+	meta := make(map[string]string)
+	for _, kv := range c.flagLoginMeta {
+		parts := strings.SplitN(kv, "=", 2)
+		meta[parts[0]] = parts[1]
+	}
+
+	// The login request must not use our current token since it may no
+	// longer be valid.
+	loginConfig := *c.consulConfig
+	loginConfig.Token = ""
+	loginConfig.TokenFile = ""
+	loginClient, err := api.NewClient(&loginConfig)
+	if err != nil {
+		return err
+	}
+	token, _, err := loginClient.ACL().Login(&api.ACLLoginParams{
+		AuthMethod:  c.flagAuthMethod,
+		BearerToken: strings.TrimSpace(string(bearerToken)),
+		Meta:        meta,
+	}, &api.WriteOptions{Namespace: c.flagAuthMethodNamespace})
+	if err != nil {
+		return fmt.Errorf("logging in to auth method %q: %s", c.flagAuthMethod, err)
+	}
+
+	tokenFile := c.http.TokenFile()
+	oldToken, err := ioutil.ReadFile(tokenFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading token file %q: %s", tokenFile, err)
+	}
+	if err := writeFileAtomic(tokenFile, []byte(token.SecretID), 0444); err != nil {
+		return fmt.Errorf("writing token file %q: %s", tokenFile, err)
+	}
+	logger.Info("logged in to auth method and wrote new ACL token", "accessor-id", token.AccessorID)
+
+	// The Consul client reads the token from the token file on creation.
+	client, err := api.NewClient(c.consulConfig)
+	if err != nil {
+		return err
+	}
+	c.clientLock.Lock()
+	c.consulClient = client
+	c.clientLock.Unlock()
+
+	// Logging out the old token is best effort since it has most likely
+	// been deleted already.
+	if old := strings.TrimSpace(string(oldToken)); old != "" && old != token.SecretID {
+		if _, err := loginClient.ACL().Logout(&api.WriteOptions{Token: old}); err != nil {
+			logger.Debug("unable to log out previous ACL token", "err", err)
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// path and renames it to path so that readers only ever see the old or the
+// new contents.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	// Clean up the temp file if we fail before the rename. Once renamed,
+	// this is a no-op.
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
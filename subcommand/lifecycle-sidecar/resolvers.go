@@ -0,0 +1,113 @@
+package subcommand
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul-k8s/api/common"
+	connectinject "github.com/hashicorp/consul-k8s/connect-inject"
+	"github.com/hashicorp/consul/api"
+)
+
+// writeStatefulSetResolvers allows each StatefulSet pod registered with its
+// ordinal to be targeted individually as an upstream. The pod's subset,
+// e.g. kafka-0, is added to the service-resolver of its service, e.g.
+// kafka, and a service-resolver for a service named after the subset
+// redirects to it. Other pods of the StatefulSet update the same
+// service-resolver so it is updated with check-and-set and existing
+// subsets and settings are left as they are. Service-resolvers managed by a
+// ServiceResolver custom resource are not changed. The service-resolvers the
+// sidecar creates are marked as managed by it so that a ServiceResolver
+// custom resource for the same service can take them over, and the
+// injector deletes the subsets and redirects of ordinals removed by a
+// scale-down.
+func (c *Command) writeStatefulSetResolvers(registrations []*api.AgentServiceRegistration) error {
+	for _, reg := range registrations {
+		ordinal, ok := reg.Meta[connectinject.MetaKeyStatefulSetOrdinal]
+		if !ok || reg.Kind != api.ServiceKindTypical {
+			continue
+		}
+		subset := connectinject.StatefulSetServiceName(reg.Name, ordinal)
+
+		if err := c.addResolverSubset(reg, subset, ordinal); err != nil {
+			return fmt.Errorf("adding subset %q to service-resolver %q: %s", subset, reg.Name, err)
+		}
+
+		// The redirect only needs to be created once. We don't overwrite
+		// it if it has been changed since.
+		_, _, err := c.client().ConfigEntries().Get(api.ServiceResolver, subset, &api.QueryOptions{Namespace: reg.Namespace})
+		if err == nil {
+			continue
+		}
+		if !isNotFoundErr(err) {
+			return fmt.Errorf("reading service-resolver %q: %s", subset, err)
+		}
+		redirect := &api.ServiceResolverConfigEntry{
+			Kind:      api.ServiceResolver,
+			Name:      subset,
+			Namespace: reg.Namespace,
+			Redirect: &api.ServiceResolverRedirect{
+				Service:       reg.Name,
+				ServiceSubset: subset,
+				Namespace:     reg.Namespace,
+			},
+			Meta: map[string]string{common.ManagedByKey: common.ManagedByLifecycleSidecar},
+		}
+		if _, _, err := c.client().ConfigEntries().CAS(redirect, 0, &api.WriteOptions{Namespace: reg.Namespace}); err != nil {
+			return fmt.Errorf("writing service-resolver %q: %s", subset, err)
+		}
+	}
+	return nil
+}
+
+// addResolverSubset adds a subset selecting the instances of reg's service
+// with the given ordinal to the service's service-resolver, creating the
+// service-resolver if it doesn't exist.
+func (c *Command) addResolverSubset(reg *api.AgentServiceRegistration, subset, ordinal string) error {
+	entry, _, err := c.client().ConfigEntries().Get(api.ServiceResolver, reg.Name, &api.QueryOptions{Namespace: reg.Namespace})
+	if err != nil && !isNotFoundErr(err) {
+		return err
+	}
+
+	var resolver *api.ServiceResolverConfigEntry
+	var index uint64
+	if err == nil {
+		var ok bool
+		resolver, ok = entry.(*api.ServiceResolverConfigEntry)
+		if !ok {
+			return fmt.Errorf("unexpected config entry type %T", entry)
+		}
+		if resolver.Meta[common.SourceKey] == common.SourceValue {
+			return nil
+		}
+		if _, ok := resolver.Subsets[subset]; ok {
+			return nil
+		}
+		index = resolver.ModifyIndex
+	} else {
+		resolver = &api.ServiceResolverConfigEntry{
+			Kind:      api.ServiceResolver,
+			Name:      reg.Name,
+			Namespace: reg.Namespace,
+			Meta:      map[string]string{common.ManagedByKey: common.ManagedByLifecycleSidecar},
+		}
+	}
+
+	if resolver.Subsets == nil {
+		resolver.Subsets = make(map[string]api.ServiceResolverSubset)
+	}
+	resolver.Subsets[subset] = connectinject.StatefulSetResolverSubset(ordinal)
+	written, _, err := c.client().ConfigEntries().CAS(resolver, index, &api.WriteOptions{Namespace: reg.Namespace})
+	if err != nil {
+		return err
+	}
+	if !written {
+		return fmt.Errorf("service-resolver was modified concurrently")
+	}
+	return nil
+}
+
+// isNotFoundErr returns true if err is a 404 response from Consul.
+func isNotFoundErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "404")
+}
@@ -0,0 +1,237 @@
+package subcommand
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+)
+
+// serviceDefinition is the subset of the Consul agent's service definition
+// format that is written to the service config file by the connect-inject
+// init container. It allows us to register the services via the Consul API
+// instead of shelling out to `consul services register`.
+type serviceDefinition struct {
+	ID        string             `hcl:"id"`
+	Name      string             `hcl:"name"`
+	Kind      string             `hcl:"kind"`
+	Address   string             `hcl:"address"`
+	Port      int                `hcl:"port"`
+	Namespace string             `hcl:"namespace"`
+	Tags      []string           `hcl:"tags"`
+	Meta      map[string]string  `hcl:"meta"`
+	Proxy     *proxyDefinition   `hcl:"proxy"`
+	Connect   *connectDefinition `hcl:"connect"`
+	Weights   *weightsDefinition `hcl:"weights"`
+	Checks    []checkDefinition  `hcl:"-"`
+
+	EnableTagOverride bool `hcl:"enable_tag_override"`
+
+	// TaggedAddresses is keyed by the name of the address, e.g. "wan".
+	TaggedAddresses map[string]taggedAddressDefinition `hcl:"-"`
+}
+
+type taggedAddressDefinition struct {
+	Address string `hcl:"address"`
+	Port    int    `hcl:"port"`
+}
+
+type weightsDefinition struct {
+	Passing int `hcl:"passing"`
+	Warning int `hcl:"warning"`
+}
+
+type connectDefinition struct {
+	Native bool `hcl:"native"`
+}
+
+type proxyDefinition struct {
+	DestinationServiceName string                 `hcl:"destination_service_name"`
+	DestinationServiceID   string                 `hcl:"destination_service_id"`
+	LocalServiceAddress    string                 `hcl:"local_service_address"`
+	LocalServicePort       int                    `hcl:"local_service_port"`
+	Config                 map[string]interface{} `hcl:"config"`
+	Upstreams              []upstreamDefinition   `hcl:"-"`
+}
+
+type upstreamDefinition struct {
+	DestinationType      string `hcl:"destination_type"`
+	DestinationName      string `hcl:"destination_name"`
+	DestinationNamespace string `hcl:"destination_namespace"`
+	Datacenter           string `hcl:"datacenter"`
+	LocalBindAddress     string `hcl:"local_bind_address"`
+	LocalBindPort        int    `hcl:"local_bind_port"`
+}
+
+type checkDefinition struct {
+	Name                           string `hcl:"name"`
+	TCP                            string `hcl:"tcp"`
+	HTTP                           string `hcl:"http"`
+	Interval                       string `hcl:"interval"`
+	Timeout                        string `hcl:"timeout"`
+	TTL                            string `hcl:"ttl"`
+	AliasService                   string `hcl:"alias_service"`
+	DeregisterCriticalServiceAfter string `hcl:"deregister_critical_service_after"`
+}
+
+// parseServiceConfig reads the service config file at path and returns
+// the service registrations it defines.
+func parseServiceConfig(path string) ([]*api.AgentServiceRegistration, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := hcl.Parse(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %s", path, err)
+	}
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, fmt.Errorf("parsing %q: file doesn't contain a root object", path)
+	}
+
+	var services []serviceDefinition
+	for _, item := range list.Filter("services").Items {
+		svc, err := decodeService(item.Val)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %q: %s", path, err)
+		}
+		services = append(services, svc)
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("no services defined in %q", path)
+	}
+
+	var registrations []*api.AgentServiceRegistration
+	for _, svc := range services {
+		if svc.ID == "" || svc.Name == "" {
+			return nil, fmt.Errorf("services defined in %q must have an id and a name", path)
+		}
+		registrations = append(registrations, svc.toRegistration())
+	}
+	return registrations, nil
+}
+
+// decodeService decodes a single services block. Repeated blocks (checks,
+// tagged addresses and upstreams) are decoded one at a time because the HCL decoder flattens them
+// into one element per attribute when decoding into a slice of structs.
+func decodeService(node ast.Node) (serviceDefinition, error) {
+	var svc serviceDefinition
+	if err := hcl.DecodeObject(&svc, node); err != nil {
+		return svc, err
+	}
+	obj, ok := node.(*ast.ObjectType)
+	if !ok {
+		return svc, nil
+	}
+
+	for _, item := range obj.List.Filter("checks").Items {
+		var check checkDefinition
+		if err := hcl.DecodeObject(&check, item.Val); err != nil {
+			return svc, err
+		}
+		svc.Checks = append(svc.Checks, check)
+	}
+
+	for _, addrsItem := range obj.List.Filter("tagged_addresses").Items {
+		addrsObj, ok := addrsItem.Val.(*ast.ObjectType)
+		if !ok {
+			continue
+		}
+		for _, item := range addrsObj.List.Items {
+			if len(item.Keys) == 0 {
+				continue
+			}
+			var addr taggedAddressDefinition
+			if err := hcl.DecodeObject(&addr, item.Val); err != nil {
+				return svc, err
+			}
+			if svc.TaggedAddresses == nil {
+				svc.TaggedAddresses = make(map[string]taggedAddressDefinition)
+			}
+			svc.TaggedAddresses[item.Keys[0].Token.Value().(string)] = addr
+		}
+	}
+
+	for _, proxyItem := range obj.List.Filter("proxy").Items {
+		proxyObj, ok := proxyItem.Val.(*ast.ObjectType)
+		if !ok || svc.Proxy == nil {
+			continue
+		}
+		for _, item := range proxyObj.List.Filter("upstreams").Items {
+			var upstream upstreamDefinition
+			if err := hcl.DecodeObject(&upstream, item.Val); err != nil {
+				return svc, err
+			}
+			svc.Proxy.Upstreams = append(svc.Proxy.Upstreams, upstream)
+		}
+	}
+	return svc, nil
+}
+
+func (s serviceDefinition) toRegistration() *api.AgentServiceRegistration {
+	reg := &api.AgentServiceRegistration{
+		Kind:      api.ServiceKind(s.Kind),
+		ID:        s.ID,
+		Name:      s.Name,
+		Address:   s.Address,
+		Port:      s.Port,
+		Namespace: s.Namespace,
+		Tags:      s.Tags,
+		Meta:      s.Meta,
+
+		EnableTagOverride: s.EnableTagOverride,
+	}
+
+	if s.Weights != nil {
+		reg.Weights = &api.AgentWeights{Passing: s.Weights.Passing, Warning: s.Weights.Warning}
+	}
+
+	if proxy := s.Proxy; proxy != nil {
+		reg.Proxy = &api.AgentServiceConnectProxyConfig{
+			DestinationServiceName: proxy.DestinationServiceName,
+			DestinationServiceID:   proxy.DestinationServiceID,
+			LocalServiceAddress:    proxy.LocalServiceAddress,
+			LocalServicePort:       proxy.LocalServicePort,
+			Config:                 proxy.Config,
+		}
+		for _, u := range proxy.Upstreams {
+			reg.Proxy.Upstreams = append(reg.Proxy.Upstreams, api.Upstream{
+				DestinationType:      api.UpstreamDestType(u.DestinationType),
+				DestinationName:      u.DestinationName,
+				DestinationNamespace: u.DestinationNamespace,
+				Datacenter:           u.Datacenter,
+				LocalBindAddress:     u.LocalBindAddress,
+				LocalBindPort:        u.LocalBindPort,
+			})
+		}
+	}
+
+	for name, addr := range s.TaggedAddresses {
+		if reg.TaggedAddresses == nil {
+			reg.TaggedAddresses = make(map[string]api.ServiceAddress)
+		}
+		reg.TaggedAddresses[name] = api.ServiceAddress{Address: addr.Address, Port: addr.Port}
+	}
+
+	if s.Connect != nil {
+		reg.Connect = &api.AgentServiceConnect{Native: s.Connect.Native}
+	}
+
+	for _, check := range s.Checks {
+		reg.Checks = append(reg.Checks, &api.AgentServiceCheck{
+			Name:                           check.Name,
+			TCP:                            check.TCP,
+			HTTP:                           check.HTTP,
+			Interval:                       check.Interval,
+			Timeout:                        check.Timeout,
+			TTL:                            check.TTL,
+			AliasService:                   check.AliasService,
+			DeregisterCriticalServiceAfter: check.DeregisterCriticalServiceAfter,
+		})
+	}
+	return reg
+}
@@ -0,0 +1,375 @@
+package subcommand
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServiceConfig(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, configFile := createServicesTmpFile(t, injectedServicesRegistration)
+	defer os.RemoveAll(tmpDir)
+
+	registrations, err := parseServiceConfig(configFile)
+	require.NoError(t, err)
+	require.Equal(t, []*api.AgentServiceRegistration{
+		{
+			ID:        "web-abc-web",
+			Name:      "web",
+			Address:   "10.0.0.1",
+			Port:      8080,
+			Namespace: "ns",
+			Tags:      []string{"abc", "123"},
+			Meta: map[string]string{
+				"name":     "abc",
+				"pod-name": "web-abc",
+			},
+		},
+		{
+			Kind:      api.ServiceKindConnectProxy,
+			ID:        "web-abc-web-sidecar-proxy",
+			Name:      "web-sidecar-proxy",
+			Address:   "10.0.0.1",
+			Port:      20000,
+			Namespace: "ns",
+			Tags:      []string{"abc", "123"},
+			Meta: map[string]string{
+				"name":     "abc",
+				"pod-name": "web-abc",
+			},
+			Proxy: &api.AgentServiceConnectProxyConfig{
+				DestinationServiceName: "web",
+				DestinationServiceID:   "web-abc-web",
+				LocalServiceAddress:    "127.0.0.1",
+				LocalServicePort:       8080,
+				Upstreams: []api.Upstream{
+					{
+						DestinationType: api.UpstreamDestTypeService,
+						DestinationName: "db",
+						LocalBindPort:   1234,
+						Datacenter:      "dc2",
+					},
+					{
+						DestinationType: api.UpstreamDestTypePreparedQuery,
+						DestinationName: "query",
+						LocalBindPort:   4321,
+					},
+				},
+			},
+			Checks: api.AgentServiceChecks{
+				{
+					Name:                           "Proxy Public Listener",
+					TCP:                            "10.0.0.1:20000",
+					Interval:                       "10s",
+					DeregisterCriticalServiceAfter: "10m",
+				},
+				{
+					Name:         "Destination Alias",
+					AliasService: "web-abc-web",
+				},
+			},
+		},
+	}, registrations)
+}
+
+func TestParseServiceConfig_ConnectNative(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, configFile := createServicesTmpFile(t, connectNativeServiceRegistration)
+	defer os.RemoveAll(tmpDir)
+
+	registrations, err := parseServiceConfig(configFile)
+	require.NoError(t, err)
+	require.Equal(t, []*api.AgentServiceRegistration{
+		{
+			ID:      "web-abc-web",
+			Name:    "web",
+			Address: "10.0.0.1",
+			Port:    8080,
+			Meta: map[string]string{
+				"pod-name": "web-abc",
+			},
+			Connect: &api.AgentServiceConnect{Native: true},
+		},
+	}, registrations)
+}
+
+func TestParseServiceConfig_Gateway(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, configFile := createServicesTmpFile(t, meshGatewayRegistration)
+	defer os.RemoveAll(tmpDir)
+
+	registrations, err := parseServiceConfig(configFile)
+	require.NoError(t, err)
+	require.Equal(t, []*api.AgentServiceRegistration{
+		{
+			Kind:    api.ServiceKindMeshGateway,
+			ID:      "mesh-gateway-abc-mesh-gateway",
+			Name:    "mesh-gateway",
+			Address: "10.0.0.1",
+			Port:    8443,
+			Meta: map[string]string{
+				"pod-name": "mesh-gateway-abc",
+			},
+			TaggedAddresses: map[string]api.ServiceAddress{
+				"lan": {Address: "10.0.0.1", Port: 8443},
+				"wan": {Address: "1.2.3.4", Port: 443},
+			},
+			Checks: api.AgentServiceChecks{
+				{
+					Name:                           "Gateway Listener",
+					TCP:                            "10.0.0.1:8443",
+					Interval:                       "10s",
+					DeregisterCriticalServiceAfter: "6h",
+				},
+			},
+		},
+	}, registrations)
+}
+
+func TestParseServiceConfig_ProxyConfig(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, configFile := createServicesTmpFile(t, `
+services {
+  id   = "web-abc-web-sidecar-proxy"
+  name = "web-sidecar-proxy"
+  kind = "connect-proxy"
+  port = 20000
+  proxy {
+    destination_service_name = "web"
+    destination_service_id = "web-abc-web"
+    config = {
+      envoy_tracing_json = "{\"http\":{\"name\":\"envoy.zipkin\"}}"
+    }
+  }
+}`)
+	defer os.RemoveAll(tmpDir)
+
+	registrations, err := parseServiceConfig(configFile)
+	require.NoError(t, err)
+	require.Len(t, registrations, 1)
+	require.Equal(t, map[string]interface{}{
+		"envoy_tracing_json": `{"http":{"name":"envoy.zipkin"}}`,
+	}, registrations[0].Proxy.Config)
+}
+
+func TestParseServiceConfig_WeightsAndTagOverride(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, configFile := createServicesTmpFile(t, `
+services {
+  id   = "web-abc-web"
+  name = "web"
+  port = 8080
+  tags = ["v1"]
+  enable_tag_override = true
+  weights {
+    passing = 10
+    warning = 0
+  }
+
+  checks {
+    name = "Proxy Public Listener"
+    tcp = "10.0.0.1:20000"
+    interval = "30s"
+    timeout = "5s"
+    deregister_critical_service_after = "1h"
+  }
+}`)
+	defer os.RemoveAll(tmpDir)
+
+	registrations, err := parseServiceConfig(configFile)
+	require.NoError(t, err)
+	require.Len(t, registrations, 1)
+	reg := registrations[0]
+	require.True(t, reg.EnableTagOverride)
+	require.Equal(t, &api.AgentWeights{Passing: 10, Warning: 0}, reg.Weights)
+	require.Len(t, reg.Checks, 1)
+	require.Equal(t, "30s", reg.Checks[0].Interval)
+	require.Equal(t, "5s", reg.Checks[0].Timeout)
+	require.Equal(t, "1h", reg.Checks[0].DeregisterCriticalServiceAfter)
+}
+
+func TestParseServiceConfig_Errors(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		config string
+		expErr string
+	}{
+		"invalid hcl": {
+			config: `services {`,
+			expErr: "parsing",
+		},
+		"no services": {
+			config: ``,
+			expErr: "no services defined",
+		},
+		"missing id": {
+			config: `services { name = "web" }`,
+			expErr: "must have an id and a name",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			tmpDir, configFile := createServicesTmpFile(t, c.config)
+			defer os.RemoveAll(tmpDir)
+
+			_, err := parseServiceConfig(configFile)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.expErr)
+		})
+	}
+}
+
+// injectedServicesRegistration mirrors the service config written by the
+// connect-inject init container once the shell variables have been expanded.
+const injectedServicesRegistration = `
+services {
+  id   = "web-abc-web"
+  name = "web"
+  address = "10.0.0.1"
+  port = 8080
+  namespace = "ns"
+  tags = ["abc","123"]
+  meta = {
+    name = "abc"
+    pod-name = "web-abc"
+  }
+}
+
+services {
+  id   = "web-abc-web-sidecar-proxy"
+  name = "web-sidecar-proxy"
+  kind = "connect-proxy"
+  address = "10.0.0.1"
+  port = 20000
+  namespace = "ns"
+  tags = ["abc","123"]
+  meta = {
+    name = "abc"
+    pod-name = "web-abc"
+  }
+
+  proxy {
+    destination_service_name = "web"
+    destination_service_id = "web-abc-web"
+    local_service_address = "127.0.0.1"
+    local_service_port = 8080
+    upstreams {
+      destination_type = "service"
+      destination_name = "db"
+      local_bind_port = 1234
+      datacenter = "dc2"
+    }
+    upstreams {
+      destination_type = "prepared_query"
+      destination_name = "query"
+      local_bind_port = 4321
+    }
+  }
+
+  checks {
+    name = "Proxy Public Listener"
+    tcp = "10.0.0.1:20000"
+    interval = "10s"
+    deregister_critical_service_after = "10m"
+  }
+
+  checks {
+    name = "Destination Alias"
+    alias_service = "web-abc-web"
+  }
+}
+`
+
+// connectNativeServiceRegistration mirrors the service config written by the
+// connect-inject init container for Connect-native pods.
+const connectNativeServiceRegistration = `
+services {
+  id   = "web-abc-web"
+  name = "web"
+  address = "10.0.0.1"
+  port = 8080
+  meta = {
+    pod-name = "web-abc"
+  }
+  connect {
+    native = true
+  }
+}
+`
+
+// meshGatewayRegistration mirrors the service config written by the
+// connect-inject init container for mesh gateway pods.
+const meshGatewayRegistration = `
+services {
+  id   = "mesh-gateway-abc-mesh-gateway"
+  name = "mesh-gateway"
+  kind = "mesh-gateway"
+  address = "10.0.0.1"
+  port = 8443
+  meta = {
+    pod-name = "mesh-gateway-abc"
+  }
+  tagged_addresses {
+    lan {
+      address = "10.0.0.1"
+      port = 8443
+    }
+    wan {
+      address = "1.2.3.4"
+      port = 443
+    }
+  }
+
+  checks {
+    name = "Gateway Listener"
+    tcp = "10.0.0.1:8443"
+    interval = "10s"
+    deregister_critical_service_after = "6h"
+  }
+}
+`
+
+// statefulSetServiceRegistration mirrors the service config written by the
+// connect-inject init container for StatefulSet pods when StatefulSet
+// identity is enabled.
+const statefulSetServiceRegistration = `
+services {
+  id   = "kafka-0-kafka"
+  name = "kafka"
+  address = "10.0.0.1"
+  port = 9092
+  tags = ["kafka-0"]
+  meta = {
+    k8s-statefulset-ordinal = "0"
+    pod-name = "kafka-0"
+  }
+}
+
+services {
+  id   = "kafka-0-kafka-sidecar-proxy"
+  name = "kafka-sidecar-proxy"
+  kind = "connect-proxy"
+  address = "10.0.0.1"
+  port = 20000
+  tags = ["kafka-0"]
+  meta = {
+    k8s-statefulset-ordinal = "0"
+    pod-name = "kafka-0"
+  }
+
+  proxy {
+    destination_service_name = "kafka"
+    destination_service_id = "kafka-0-kafka"
+  }
+}
+`
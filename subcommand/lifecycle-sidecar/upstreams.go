@@ -0,0 +1,96 @@
+package subcommand
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+)
+
+// upstreamsFile is the format of the file written to -upstreams-file.
+type upstreamsFile struct {
+	Upstreams []upstreamEntry `json:"upstreams"`
+}
+
+// upstreamEntry describes an upstream of the service's proxy.
+type upstreamEntry struct {
+	// Type is either "service" or "prepared_query".
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace,omitempty"`
+	Datacenter string `json:"datacenter,omitempty"`
+
+	// LocalBindAddress and LocalBindPort are the address the application
+	// connects to in order to reach the upstream.
+	LocalBindAddress string `json:"local_bind_address"`
+	LocalBindPort    int    `json:"local_bind_port"`
+
+	// Protocol is the protocol of the upstream's discovery chain, e.g.
+	// "http". Prepared queries are always "tcp". It's omitted if the
+	// discovery chain can't be read.
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// writeUpstreamsFile writes the upstreams of the proxies in registrations
+// to -upstreams-file. The protocol of service upstreams is looked up from
+// their discovery chain on every sync since it's set by config entries that
+// may change at any time. Failing to read a discovery chain, e.g. because
+// the token isn't allowed to read the upstream or the upstream's datacenter
+// is unreachable, only omits the upstream's protocol so that a single
+// upstream doesn't fail the sync. The file is only rewritten when its
+// contents change.
+func (c *Command) writeUpstreamsFile(logger hclog.Logger, registrations []*api.AgentServiceRegistration) error {
+	file := upstreamsFile{Upstreams: []upstreamEntry{}}
+	for _, reg := range registrations {
+		if reg.Proxy == nil {
+			continue
+		}
+		for _, u := range reg.Proxy.Upstreams {
+			entry := upstreamEntry{
+				Type:             string(u.DestinationType),
+				Name:             u.DestinationName,
+				Namespace:        u.DestinationNamespace,
+				Datacenter:       u.Datacenter,
+				LocalBindAddress: u.LocalBindAddress,
+				LocalBindPort:    u.LocalBindPort,
+				Protocol:         "tcp",
+			}
+			if entry.Type == "" {
+				entry.Type = string(api.UpstreamDestTypeService)
+			}
+			if entry.LocalBindAddress == "" {
+				entry.LocalBindAddress = "127.0.0.1"
+			}
+
+			if entry.Type == string(api.UpstreamDestTypeService) {
+				// Upstreams in other namespaces are resolved from the
+				// proxy's namespace when no namespace is given.
+				namespace := entry.Namespace
+				if namespace == "" {
+					namespace = reg.Namespace
+				}
+				chain, _, err := c.client().DiscoveryChain().Get(entry.Name,
+					&api.DiscoveryChainOptions{EvaluateInDatacenter: entry.Datacenter},
+					&api.QueryOptions{Namespace: namespace})
+				if err != nil {
+					logger.Warn("failed to fetch discovery chain of upstream, omitting its protocol",
+						"upstream", entry.Name, "err", err)
+					entry.Protocol = ""
+				} else if chain.Chain != nil && chain.Chain.Protocol != "" {
+					entry.Protocol = chain.Chain.Protocol
+				}
+			}
+			file.Upstreams = append(file.Upstreams, entry)
+		}
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileIfChanged(c.flagUpstreamsFile, append(data, '\n'), 0444); err != nil {
+		return fmt.Errorf("writing %q: %s", c.flagUpstreamsFile, err)
+	}
+	return nil
+}
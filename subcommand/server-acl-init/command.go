@@ -82,6 +82,9 @@ type Command struct {
 	// Flag to indicate that the health checks controller is enabled.
 	flagEnableHealthChecks bool
 
+	// Flag to allow the connect injector to clean up StatefulSet service-resolvers.
+	flagEnableStatefulSetIdentity bool
+
 	flagLogLevel string
 	flagTimeout  time.Duration
 
@@ -196,6 +199,9 @@ func (c *Command) init() {
 
 	c.flags.BoolVar(&c.flagEnableHealthChecks, "enable-health-checks", false,
 		"Toggle for adding ACL rules for the health check controller to the connect ACL token. Requires -create-inject-token to be also be set.")
+	c.flags.BoolVar(&c.flagEnableStatefulSetIdentity, "enable-statefulset-identity", false,
+		"Toggle for adding ACL rules for cleaning up the service-resolvers of StatefulSet pods to the connect ACL token. "+
+			"Requires -create-inject-token to be also be set.")
 
 	c.flags.DurationVar(&c.flagTimeout, "timeout", 10*time.Minute,
 		"How long we'll try to bootstrap ACLs for before timing out, e.g. 1ms, 2s, 3m")
@@ -478,9 +484,9 @@ func (c *Command) Run(args []string) int {
 			return 1
 		}
 
-		// If health checks or namespaces are enabled,
+		// If health checks, StatefulSet identity or namespaces are enabled,
 		// then the connect injector needs an ACL token.
-		if c.flagEnableNamespaces || c.flagEnableHealthChecks {
+		if c.flagEnableNamespaces || c.flagEnableHealthChecks || c.flagEnableStatefulSetIdentity {
 			injectRules, err := c.injectRules()
 			if err != nil {
 				c.log.Error("Error templating inject rules", "err", err)
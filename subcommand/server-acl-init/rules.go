@@ -16,6 +16,7 @@ type rulesData struct {
 	InjectNSMirroringPrefix string
 	SyncConsulNodeName      string
 	EnableHealthChecks      bool
+	EnableStatefulSetID     bool
 }
 
 type gatewayRulesData struct {
@@ -205,8 +206,9 @@ namespace "{{ .SyncConsulDestNS }}" {
 }
 
 func (c *Command) injectRules() (string, error) {
-	// The Connect injector needs permissions to create namespaces when namespaces are enabled
-	// and also create/update service checks when health checks are enabled.
+	// The Connect injector needs permissions to create namespaces when namespaces are enabled,
+	// create/update service checks when health checks are enabled and clean up the
+	// service-resolvers of StatefulSet pods when StatefulSet identity is enabled.
 	injectRulesTpl := `
 {{- if .EnableNamespaces }}
 operator = "write"
@@ -215,6 +217,8 @@ operator = "write"
 node_prefix "" {
   policy = "write"
 }
+{{- end }}
+{{- if or .EnableHealthChecks .EnableStatefulSetID }}
 {{- if .EnableNamespaces }}
 namespace_prefix "" {
 {{- end }}
@@ -265,6 +269,7 @@ operator = "write"
 {{- if .EnableNamespaces }}
 {{- if .InjectEnableNSMirroring }}
 namespace_prefix "{{ .InjectNSMirroringPrefix }}" {
+  acl = "read"
 {{- else }}
 namespace "{{ .InjectConsulDestNS }}" {
 {{- end }}
@@ -291,6 +296,7 @@ func (c *Command) rulesData() rulesData {
 		InjectNSMirroringPrefix: c.flagInjectK8SNSMirroringPrefix,
 		SyncConsulNodeName:      c.flagSyncConsulNodeName,
 		EnableHealthChecks:      c.flagEnableHealthChecks,
+		EnableStatefulSetID:     c.flagEnableStatefulSetIdentity,
 	}
 }
 
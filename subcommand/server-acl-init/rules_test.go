@@ -559,6 +559,50 @@ namespace_prefix "" {
 	}
 }
 
+// Test that the injector can write services to clean up the service-resolvers
+// of StatefulSet pods without the health check controller's node rules.
+func TestInjectRules_StatefulSetIdentity(t *testing.T) {
+	cases := []struct {
+		Name             string
+		EnableNamespaces bool
+		Expected         string
+	}{
+		{
+			"Namespaces are disabled",
+			false,
+			`
+  service_prefix "" {
+    policy = "write"
+  }`,
+		},
+		{
+			"Namespaces are enabled",
+			true,
+			`
+operator = "write"
+namespace_prefix "" {
+  service_prefix "" {
+    policy = "write"
+  }
+}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			cmd := Command{
+				flagEnableNamespaces:          tt.EnableNamespaces,
+				flagEnableStatefulSetIdentity: true,
+			}
+
+			injectorRules, err := cmd.injectRules()
+
+			require.NoError(t, err)
+			require.Equal(t, tt.Expected, injectorRules)
+		})
+	}
+}
+
 func TestReplicationTokenRules(t *testing.T) {
 	cases := []struct {
 		Name             string
@@ -650,6 +694,7 @@ namespace "consul" {
 			Mirroring:        true,
 			Expected: `operator = "write"
 namespace_prefix "" {
+  acl = "read"
   service_prefix "" {
     policy = "write"
     intentions = "write"
@@ -663,6 +708,7 @@ namespace_prefix "" {
 			MirroringPrefix:  "prefix-",
 			Expected: `operator = "write"
 namespace_prefix "prefix-" {
+  acl = "read"
   service_prefix "" {
     policy = "write"
     intentions = "write"
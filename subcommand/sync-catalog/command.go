@@ -2,6 +2,8 @@ package synccatalog
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
@@ -16,6 +18,7 @@ import (
 	catalogtoconsul "github.com/hashicorp/consul-k8s/catalog/to-consul"
 	catalogtok8s "github.com/hashicorp/consul-k8s/catalog/to-k8s"
 	"github.com/hashicorp/consul-k8s/helper/controller"
+	"github.com/hashicorp/consul-k8s/namespaces"
 	"github.com/hashicorp/consul-k8s/subcommand"
 	"github.com/hashicorp/consul-k8s/subcommand/common"
 	"github.com/hashicorp/consul-k8s/subcommand/flags"
@@ -23,8 +26,11 @@ import (
 	"github.com/hashicorp/go-hclog"
 	"github.com/mitchellh/cli"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
 )
 
 // Command is the command for syncing the K8S and Consul service
@@ -41,6 +47,8 @@ type Command struct {
 	flagConsulDomain          string
 	flagConsulK8STag          string
 	flagConsulNodeName        string
+	flagClusterName           string
+	flagAdoptUnnamedCluster   bool
 	flagK8SDefault            bool
 	flagK8SServicePrefix      string
 	flagConsulServicePrefix   string
@@ -50,9 +58,22 @@ type Command struct {
 	flagSyncClusterIPServices bool
 	flagSyncLBEndpoints       bool
 	flagNodePortSyncType      string
+	flagPortSyncMode          string
 	flagAddK8SNamespaceSuffix bool
+	flagEndpointSlices        bool
+	flagSyncNotReady          bool
+	flagRegisterOnK8SNodes    bool
+	flagSyncIngress           bool
+	flagClusterDomain         string
+	flagDryRun                bool
 	flagLogLevel              string
 
+	// Flags to run several replicas with leader election
+	flagEnableLeaderElection        bool
+	flagLeaderElectionNamespace     string
+	flagLeaderElectionLeaseName     string
+	flagLeaderElectionLeaseDuration time.Duration
+
 	// Flags to support namespaces
 	flagEnableNamespaces           bool     // Use namespacing on all components
 	flagConsulDestinationNamespace string   // Consul namespace to register everything if not mirroring
@@ -61,10 +82,15 @@ type Command struct {
 	flagEnableK8SNSMirroring       bool     // Enables mirroring of k8s namespaces into Consul
 	flagK8SNSMirroringPrefix       string   // Prefix added to Consul namespaces created when mirroring
 	flagCrossNamespaceACLPolicy    string   // The name of the ACL policy to add to every created namespace if ACLs are enabled
+	flagK8SNSMappingFile           string   // Path of the file mapping k8s namespaces to Consul namespaces
 
 	consulClient *api.Client
 	clientset    kubernetes.Interface
 
+	// diff prints the changes a sync to Consul would make and exits rather
+	// than syncing. It's set by DiffCommand.
+	diff bool
+
 	once   sync.Once
 	sigCh  chan os.Signal
 	help   string
@@ -102,6 +128,18 @@ func (c *Command) init() {
 	c.flags.StringVar(&c.flagConsulNodeName, "consul-node-name", "k8s-sync",
 		"The Consul node name to register for catalog sync. Defaults to k8s-sync. To be discoverable "+
 			"via DNS, the name should only contain alpha-numerics and dashes.")
+	c.flags.StringVar(&c.flagClusterName, "cluster-name", "",
+		"The name of the Kubernetes cluster, needed if several clusters sync into the same Consul "+
+			"datacenter. It's added to the meta of the services and nodes registered in Consul, and "+
+			"only registrations with the same cluster name are removed. When syncing to Kubernetes, "+
+			"services synced from other named clusters aren't ignored. When namespace mirroring is "+
+			"enabled, it's also added to the meta of the Consul namespaces created, so that the "+
+			"controller's -delete-mirrored-namespaces can delete them.")
+	c.flags.BoolVar(&c.flagAdoptUnnamedCluster, "adopt-unnamed-cluster-registrations", false,
+		"Treat the services and nodes registered in Consul without a cluster name as this cluster's. Set it "+
+			"once when adding -cluster-name to a cluster that synced without one, so that its existing "+
+			"registrations are updated with the cluster name or removed. Don't set it while other clusters "+
+			"without -cluster-name sync into the same Consul datacenter. Requires -cluster-name.")
 	c.flags.DurationVar(&c.flagConsulWritePeriod, "consul-write-interval", 30*time.Second,
 		"The interval to perform syncing operations creating Consul services, formatted "+
 			"as a time.Duration. All changes are merged and write calls are only made "+
@@ -115,10 +153,50 @@ func (c *Command) init() {
 	c.flags.StringVar(&c.flagNodePortSyncType, "node-port-sync-type", "ExternalOnly",
 		"Defines the type of sync for NodePort services. Valid options are ExternalOnly, "+
 			"InternalOnly and ExternalFirst.")
+	c.flags.StringVar(&c.flagPortSyncMode, "port-sync-mode", "single",
+		"Defines how services with more than one port are synced. Valid options are single, which "+
+			"registers a single service with the first port, services, which registers a service named "+
+			"<service>-<port name> for each port, and tags, which registers an instance for each port "+
+			"tagged with the port name. It can be overridden per service with the "+
+			"consul.hashicorp.com/service-port-mode annotation.")
 	c.flags.BoolVar(&c.flagAddK8SNamespaceSuffix, "add-k8s-namespace-suffix", false,
 		"If true, Kubernetes namespace will be appended to service names synced to Consul separated by a dash. "+
 			"If false, no suffix will be appended to the service names in Consul. "+
 			"If the service name annotation is provided, the suffix is not appended.")
+	c.flags.BoolVar(&c.flagEndpointSlices, "enable-endpoint-slices", false,
+		"If true, the endpoints of services are read from their discovery.k8s.io/v1beta1 "+
+			"EndpointSlices rather than their Endpoints, and the node and zone of each endpoint "+
+			"are added to the service meta. Endpoints are used if the cluster doesn't serve the API.")
+	c.flags.BoolVar(&c.flagSyncNotReady, "sync-not-ready-endpoints", false,
+		"If true, endpoints that aren't ready are synced along with ready endpoints, and every service "+
+			"instance synced from an endpoint gets a health check that is passing if the endpoint is ready "+
+			"and critical otherwise.")
+	c.flags.BoolVar(&c.flagRegisterOnK8SNodes, "register-on-k8s-nodes", false,
+		"If true, services synced from endpoints are registered on a Consul node for the Kubernetes "+
+			"node hosting the endpoint, named after the Kubernetes node and the -consul-node-name, "+
+			"with the node's address and zone, rather than on the -consul-node-name node.")
+	c.flags.BoolVar(&c.flagSyncIngress, "sync-ingress", false,
+		"If true, the hosts of Ingresses are registered as Consul services with an instance for each "+
+			"address of the Ingress' load balancer, on port 443 for hosts with TLS and 80 otherwise. "+
+			"Ingresses are synced with the same namespace rules and annotations as Services.")
+	c.flags.StringVar(&c.flagClusterDomain, "cluster-domain", "cluster.local",
+		"The DNS domain of the Kubernetes cluster, used to build the DNS names of the pods of headless "+
+			"services annotated with consul.hashicorp.com/service-pod-hostname.")
+	c.flags.BoolVar(&c.flagDryRun, "dry-run", false,
+		"If true, the services that would be registered in and deregistered from Consul are logged "+
+			"whenever they change and served as JSON at /dry-run on the -listen address, but Consul isn't "+
+			"changed. Syncing to Kubernetes is disabled.")
+	c.flags.BoolVar(&c.flagEnableLeaderElection, "enable-leader-election", false,
+		"If true, replicas elect a leader using a Kubernetes Lease and only the leader writes to Consul "+
+			"and Kubernetes. The other replicas keep watching services so that they can take over without "+
+			"deregistering them. The replica exits if it loses the Lease.")
+	c.flags.StringVar(&c.flagLeaderElectionNamespace, "leader-election-namespace", "",
+		"The Kubernetes namespace of the leader election Lease. Required if -enable-leader-election is true.")
+	c.flags.StringVar(&c.flagLeaderElectionLeaseName, "leader-election-lease-name", "",
+		"The name of the leader election Lease. Defaults to <consul-node-name>-sync-catalog-leader.")
+	c.flags.DurationVar(&c.flagLeaderElectionLeaseDuration, "leader-election-lease-duration", 15*time.Second,
+		"The duration of the leader election Lease, formatted as a time.Duration. A standby takes over "+
+			"at most this long after the leader stops renewing it. Defaults to 15 seconds (15s).")
 	c.flags.StringVar(&c.flagLogLevel, "log-level", "info",
 		"Log verbosity level. Supported values (in order of detail) are \"trace\", "+
 			"\"debug\", \"info\", \"warn\", and \"error\".")
@@ -136,6 +214,9 @@ func (c *Command) init() {
 		"namespace mirroring.")
 	c.flags.StringVar(&c.flagK8SNSMirroringPrefix, "k8s-namespace-mirroring-prefix", "",
 		"[Enterprise Only] Prefix that will be added to all k8s namespaces mirrored into Consul if mirroring is enabled.")
+	c.flags.StringVar(&c.flagK8SNSMappingFile, "k8s-namespace-mapping-file", "",
+		"[Enterprise Only] Path to a JSON file mapping k8s namespaces, by name, glob or label selector, to Consul "+
+			"namespaces. Takes precedence over mirroring and -consul-destination-namespace for the k8s namespaces it maps.")
 	c.flags.StringVar(&c.flagCrossNamespaceACLPolicy, "consul-cross-namespace-acl-policy", "",
 		"[Enterprise Only] Name of the ACL policy to attach to all created Consul namespaces to allow service "+
 			"discovery across Consul namespaces. Only necessary if ACLs are enabled.")
@@ -145,7 +226,11 @@ func (c *Command) init() {
 	flags.Merge(c.flags, c.http.Flags())
 	flags.Merge(c.flags, c.k8s.Flags())
 
-	c.help = flags.Usage(help, c.flags)
+	if c.diff {
+		c.help = flags.Usage(diffHelp, c.flags)
+	} else {
+		c.help = flags.Usage(help, c.flags)
+	}
 
 	// Wait on an interrupt or terminate to exit. This channel must be initialized before
 	// Run() is called so that there are no race conditions where the channel
@@ -172,6 +257,16 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	var nsMapping *namespaces.Mapping
+	if c.flagK8SNSMappingFile != "" {
+		var err error
+		nsMapping, err = namespaces.ReadMappingFile(c.flagK8SNSMappingFile)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error reading -k8s-namespace-mapping-file: %s", err))
+			return 1
+		}
+	}
+
 	// Create the k8s clientset
 	if c.clientset == nil {
 		config, err := subcommand.K8SConfig(c.k8s.KubeConfig())
@@ -221,9 +316,62 @@ func (c *Command) Run(args []string) int {
 	// Create the context we'll use to cancel everything
 	ctx, cancelF := context.WithCancel(context.Background())
 
+	// With leader election, the tasks that write to Consul and Kubernetes
+	// are only run by the leader, until it loses the Lease. The other
+	// replicas keep watching so that their state is up to date if they take
+	// over.
+	var leaderTasks []func(ctx context.Context)
+	var elector *leaderelection.LeaderElector
+	if c.flagEnableLeaderElection && !c.diff {
+		var err error
+		elector, err = c.leaderElector(func(ctx context.Context) {
+			var wg sync.WaitGroup
+			for _, task := range leaderTasks {
+				wg.Add(1)
+				go func(task func(context.Context)) {
+					defer wg.Done()
+					task(ctx)
+				}(task)
+			}
+			wg.Wait()
+		})
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error setting up leader election: %s", err))
+			cancelF()
+			return 1
+		}
+	}
+
+	// If the namespace mapping selects namespaces by their labels, watch
+	// the namespaces so that their labels can be read from the cache.
+	var nsLabels namespaces.LabelsFunc
+	if nsMapping != nil && nsMapping.HasSelectors() {
+		factory := informers.NewSharedInformerFactory(c.clientset, 0)
+		nsLister := factory.Core().V1().Namespaces().Lister()
+		factory.Start(ctx.Done())
+		factory.WaitForCacheSync(ctx.Done())
+		nsLabels = namespaces.ListerLabelsFunc(nsLister)
+	}
+
 	// Start the K8S-to-Consul syncer
 	var toConsulCh chan struct{}
-	if c.flagToConsul {
+	var syncer *catalogtoconsul.ConsulSyncer
+	if c.flagToConsul || c.diff {
+		// Fall back to Endpoints on clusters without EndpointSlices.
+		enableEndpointSlices := c.flagEndpointSlices
+		if enableEndpointSlices {
+			supported, err := catalogtoconsul.EndpointSlicesSupported(c.clientset)
+			if err != nil {
+				c.UI.Error(fmt.Sprintf("Error checking for the EndpointSlice API: %s", err))
+				cancelF()
+				return 1
+			}
+			if !supported {
+				c.logger.Warn("EndpointSlice API not available, syncing from Endpoints instead")
+				enableEndpointSlices = false
+			}
+		}
+
 		// If namespaces are enabled we need to use a new Consul API endpoint
 		// to list node services. This endpoint is only available in Consul
 		// 1.7+. To preserve backwards compatibility, when namespaces are not
@@ -238,42 +386,74 @@ func (c *Command) Run(args []string) int {
 				Client: c.consulClient,
 			}
 		}
-		// Build the Consul sync and start it
-		syncer := &catalogtoconsul.ConsulSyncer{
+		// Build the Consul sync
+		syncer = &catalogtoconsul.ConsulSyncer{
 			Client:                   c.consulClient,
 			Log:                      c.logger.Named("to-consul/sink"),
 			EnableNamespaces:         c.flagEnableNamespaces,
 			CrossNamespaceACLPolicy:  c.flagCrossNamespaceACLPolicy,
+			EnableK8SNSMirroring:     c.flagEnableK8SNSMirroring,
+			K8SNSMirroringPrefix:     c.flagK8SNSMirroringPrefix,
 			SyncPeriod:               c.flagConsulWritePeriod,
-			ServicePollPeriod:        c.flagConsulWritePeriod * 2,
 			ConsulK8STag:             c.flagConsulK8STag,
 			ConsulNodeName:           c.flagConsulNodeName,
+			ClusterName:              c.flagClusterName,
+			AdoptUnnamedCluster:      c.flagAdoptUnnamedCluster,
+			DryRun:                   c.flagDryRun,
 			ConsulNodeServicesClient: svcsClient,
 		}
-		go syncer.Run(ctx)
+
+		resource := &catalogtoconsul.ServiceResource{
+			Log:                        c.logger.Named("to-consul/source"),
+			Client:                     c.clientset,
+			Syncer:                     syncer,
+			AllowK8sNamespacesSet:      allowSet,
+			DenyK8sNamespacesSet:       denySet,
+			ExplicitEnable:             !c.flagK8SDefault,
+			ClusterIPSync:              c.flagSyncClusterIPServices,
+			LoadBalancerEndpointsSync:  c.flagSyncLBEndpoints,
+			NodePortSync:               catalogtoconsul.NodePortSyncType(c.flagNodePortSyncType),
+			PortSyncMode:               catalogtoconsul.PortSyncMode(c.flagPortSyncMode),
+			ConsulK8STag:               c.flagConsulK8STag,
+			ConsulServicePrefix:        c.flagConsulServicePrefix,
+			AddK8SNamespaceSuffix:      c.flagAddK8SNamespaceSuffix,
+			EnableNamespaces:           c.flagEnableNamespaces,
+			ConsulDestinationNamespace: c.flagConsulDestinationNamespace,
+			EnableK8SNSMirroring:       c.flagEnableK8SNSMirroring,
+			K8SNSMirroringPrefix:       c.flagK8SNSMirroringPrefix,
+			NamespaceMapping:           nsMapping,
+			NamespaceLabels:            nsLabels,
+			ConsulNodeName:             c.flagConsulNodeName,
+			ClusterName:                c.flagClusterName,
+			EnableEndpointSlices:       enableEndpointSlices,
+			SyncNotReadyEndpoints:      c.flagSyncNotReady,
+			RegisterOnK8SNodes:         c.flagRegisterOnK8SNodes,
+			SyncIngress:                c.flagSyncIngress,
+			ClusterDomain:              c.flagClusterDomain,
+		}
+
+		if c.diff {
+			defer cancelF()
+			return c.printDiff(ctx, resource, syncer)
+		}
 
 		// Build the controller and start it
 		ctl := &controller.Controller{
-			Log: c.logger.Named("to-consul/controller"),
-			Resource: &catalogtoconsul.ServiceResource{
-				Log:                        c.logger.Named("to-consul/source"),
-				Client:                     c.clientset,
-				Syncer:                     syncer,
-				AllowK8sNamespacesSet:      allowSet,
-				DenyK8sNamespacesSet:       denySet,
-				ExplicitEnable:             !c.flagK8SDefault,
-				ClusterIPSync:              c.flagSyncClusterIPServices,
-				LoadBalancerEndpointsSync:  c.flagSyncLBEndpoints,
-				NodePortSync:               catalogtoconsul.NodePortSyncType(c.flagNodePortSyncType),
-				ConsulK8STag:               c.flagConsulK8STag,
-				ConsulServicePrefix:        c.flagConsulServicePrefix,
-				AddK8SNamespaceSuffix:      c.flagAddK8SNamespaceSuffix,
-				EnableNamespaces:           c.flagEnableNamespaces,
-				ConsulDestinationNamespace: c.flagConsulDestinationNamespace,
-				EnableK8SNSMirroring:       c.flagEnableK8SNSMirroring,
-				K8SNSMirroringPrefix:       c.flagK8SNSMirroringPrefix,
-				ConsulNodeName:             c.flagConsulNodeName,
-			},
+			Log:      c.logger.Named("to-consul/controller"),
+			Resource: resource,
+		}
+
+		if elector != nil {
+			// The leader waits for the initial services, endpoints and
+			// ingresses to be upserted before syncing, otherwise it would
+			// reap the registrations of the ones not upserted yet.
+			leaderTasks = append(leaderTasks, func(ctx context.Context) {
+				if cache.WaitForCacheSync(ctx.Done(), ctl.Ready, resource.Ready) {
+					syncer.Run(ctx)
+				}
+			})
+		} else {
+			go syncer.Run(ctx)
 		}
 
 		toConsulCh = make(chan struct{})
@@ -283,9 +463,10 @@ func (c *Command) Run(args []string) int {
 		}()
 	}
 
-	// Start Consul-to-K8S sync
+	// Start Consul-to-K8S sync. It's disabled in a dry run since it writes
+	// to Kubernetes.
 	var toK8SCh chan struct{}
-	if c.flagToK8S {
+	if c.flagToK8S && !c.flagDryRun {
 		sink := &catalogtok8s.K8SSink{
 			Client:    c.clientset,
 			Namespace: c.flagK8SWriteNamespace,
@@ -299,6 +480,7 @@ func (c *Command) Run(args []string) int {
 			Prefix:       c.flagK8SServicePrefix,
 			Log:          c.logger.Named("to-k8s/source"),
 			ConsulK8STag: c.flagConsulK8STag,
+			ClusterName:  c.flagClusterName,
 		}
 		go source.Run(ctx)
 
@@ -308,6 +490,19 @@ func (c *Command) Run(args []string) int {
 			Resource: sink,
 		}
 
+		if elector != nil {
+			// The controller would run the sink's writes in the background,
+			// so it's given a resource without them and they're run by the
+			// leader. The leader waits for the services in Consul and
+			// Kubernetes, otherwise it would delete the ones not seen yet.
+			ctl.Resource = controller.NewResource(sink.Informer(), sink.Upsert, sink.Delete)
+			leaderTasks = append(leaderTasks, func(ctx context.Context) {
+				if cache.WaitForCacheSync(ctx.Done(), ctl.Ready, sink.HasSynced) {
+					sink.Run(ctx.Done())
+				}
+			})
+		}
+
 		toK8SCh = make(chan struct{})
 		go func() {
 			defer close(toK8SCh)
@@ -315,10 +510,28 @@ func (c *Command) Run(args []string) int {
 		}()
 	}
 
+	// Start the leader election
+	var leaderCh chan struct{}
+	if elector != nil {
+		leaderCh = make(chan struct{})
+		go func() {
+			defer close(leaderCh)
+			elector.Run(ctx)
+		}()
+	}
+
 	// Start healthcheck handler
 	go func() {
 		mux := http.NewServeMux()
 		mux.HandleFunc("/health/ready", c.handleReady)
+		if c.flagDryRun && syncer != nil {
+			mux.HandleFunc("/dry-run", func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "application/json")
+				if err := json.NewEncoder(rw).Encode(syncer.Plan()); err != nil {
+					c.UI.Error(fmt.Sprintf("[GET /dry-run] Error encoding changes: %s", err))
+				}
+			})
+		}
 		var handler http.Handler = mux
 
 		c.UI.Info(fmt.Sprintf("Listening on %q...", c.flagListen))
@@ -334,6 +547,9 @@ func (c *Command) Run(args []string) int {
 		if toK8SCh != nil {
 			<-toK8SCh
 		}
+		if leaderCh != nil {
+			<-leaderCh
+		}
 		return 1
 
 	// Unexpected exit
@@ -342,6 +558,21 @@ func (c *Command) Run(args []string) int {
 		if toConsulCh != nil {
 			<-toConsulCh
 		}
+		if leaderCh != nil {
+			<-leaderCh
+		}
+		return 1
+
+	// Lost the Lease. Exit so that the replica restarts as a standby.
+	case <-leaderCh:
+		c.logger.Error("lost the leader election lease, shutting down")
+		cancelF()
+		if toConsulCh != nil {
+			<-toConsulCh
+		}
+		if toK8SCh != nil {
+			<-toK8SCh
+		}
 		return 1
 
 	// Interrupted/terminated, gracefully exit
@@ -354,6 +585,11 @@ func (c *Command) Run(args []string) int {
 		if toK8SCh != nil {
 			<-toK8SCh
 		}
+		// Wait for the Lease to be released so that a standby can take
+		// over straight away.
+		if leaderCh != nil {
+			<-leaderCh
+		}
 		return 0
 	}
 }
@@ -406,6 +642,27 @@ func (c *Command) validateFlags() error {
 		)
 	}
 
+	switch catalogtoconsul.PortSyncMode(c.flagPortSyncMode) {
+	case catalogtoconsul.SinglePort, catalogtoconsul.ServicePerPort, catalogtoconsul.TaggedPorts:
+	default:
+		return fmt.Errorf("-port-sync-mode=%s is invalid: valid options are single, services and tags",
+			c.flagPortSyncMode)
+	}
+
+	if c.flagAdoptUnnamedCluster && c.flagClusterName == "" {
+		return errors.New("-cluster-name must be set if -adopt-unnamed-cluster-registrations is true")
+	}
+
+	if c.flagEnableLeaderElection {
+		if c.flagLeaderElectionNamespace == "" {
+			return errors.New("-leader-election-namespace must be set if -enable-leader-election is true")
+		}
+		if c.flagLeaderElectionLeaseDuration < time.Second {
+			return fmt.Errorf("-leader-election-lease-duration=%s is invalid: it must be at least 1s",
+				c.flagLeaderElectionLeaseDuration)
+		}
+	}
+
 	return nil
 }
 
@@ -2,6 +2,7 @@ package synccatalog
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"syscall"
 	"testing"
@@ -36,6 +37,22 @@ func TestRun_FlagValidation(t *testing.T) {
 			ExpErr: "-consul-node-name=5r9OPGfSRXUdGzNjBdAwmhCBrzHDNYs4XjZVR4wp7lSLIzqwS0ta51nBLIN0TMPV-too-long is invalid: node name will not be discoverable " +
 				"via DNS due to it being too long. Valid lengths are between 1 and 63 bytes",
 		},
+		{
+			Flags:  []string{"-port-sync-mode=all"},
+			ExpErr: "-port-sync-mode=all is invalid: valid options are single, services and tags",
+		},
+		{
+			Flags:  []string{"-adopt-unnamed-cluster-registrations"},
+			ExpErr: "-cluster-name must be set if -adopt-unnamed-cluster-registrations is true",
+		},
+		{
+			Flags:  []string{"-enable-leader-election"},
+			ExpErr: "-leader-election-namespace must be set if -enable-leader-election is true",
+		},
+		{
+			Flags:  []string{"-enable-leader-election", "-leader-election-namespace=default", "-leader-election-lease-duration=500ms"},
+			ExpErr: "-leader-election-lease-duration=500ms is invalid: it must be at least 1s",
+		},
 	}
 
 	for _, c := range cases {
@@ -170,6 +187,178 @@ func TestRun_ToConsulWithAddK8SNamespaceSuffix(t *testing.T) {
 	})
 }
 
+// Test that the diff command prints the instances it would register without
+// registering them.
+func TestRun_Diff(t *testing.T) {
+	t.Parallel()
+
+	k8s, testServer := completeSetup(t)
+	defer testServer.Stop()
+
+	consulClient, err := api.NewClient(&api.Config{
+		Address: testServer.HTTPAddr,
+	})
+	require.NoError(t, err)
+
+	ui := cli.NewMockUi()
+	cmd := Command{
+		UI:           ui,
+		clientset:    k8s,
+		consulClient: consulClient,
+		logger: hclog.New(&hclog.LoggerOptions{
+			Name:  t.Name(),
+			Level: hclog.Debug,
+		}),
+		flagAllowK8sNamespacesList: []string{"*"},
+		diff:                       true,
+	}
+
+	// create a service in k8s
+	_, err = k8s.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), lbService("foo", "1.1.1.1"), metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	responseCode := cmd.Run(nil)
+	require.Equal(t, 0, responseCode, ui.ErrorWriter.String())
+	require.Contains(t, ui.OutputWriter.String(), "(foo 1.1.1.1:0) on node k8s-sync")
+	require.Contains(t, ui.OutputWriter.String(), "1 to register, 0 to deregister, 0 nodes to deregister")
+
+	services, _, err := consulClient.Catalog().Services(nil)
+	require.NoError(t, err)
+	require.NotContains(t, services, "foo")
+}
+
+// Test that with leader election a standby replica takes over the sync when
+// the leader stops, without deregistering the services.
+func TestRun_LeaderElection(t *testing.T) {
+	t.Parallel()
+
+	k8s, testServer := completeSetup(t)
+	defer testServer.Stop()
+
+	consulClient, err := api.NewClient(&api.Config{
+		Address: testServer.HTTPAddr,
+	})
+	require.NoError(t, err)
+
+	// create a service in k8s
+	_, err = k8s.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), lbService("foo", "1.1.1.1"), metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// Run two replicas of the command.
+	args := []string{
+		"-consul-write-interval", "100ms",
+		"-to-k8s=false",
+		"-enable-leader-election",
+		"-leader-election-namespace", metav1.NamespaceDefault,
+		"-leader-election-lease-duration", "1s",
+	}
+	var cmds []*Command
+	var exitChans []chan int
+	for i := 0; i < 2; i++ {
+		cmd := &Command{
+			UI:           cli.NewMockUi(),
+			clientset:    k8s,
+			consulClient: consulClient,
+			logger: hclog.New(&hclog.LoggerOptions{
+				Name:  fmt.Sprintf("%s-%d", t.Name(), i),
+				Level: hclog.Debug,
+			}),
+			flagAllowK8sNamespacesList: []string{"*"},
+		}
+		cmds = append(cmds, cmd)
+		exitChans = append(exitChans, runCommandAsynchronously(cmd, args))
+	}
+	defer stopCommand(t, cmds[1], exitChans[1])
+
+	retry.Run(t, func(r *retry.R) {
+		lease, err := k8s.CoordinationV1().Leases(metav1.NamespaceDefault).Get(context.Background(), "k8s-sync-sync-catalog-leader", metav1.GetOptions{})
+		require.NoError(r, err)
+		require.NotNil(r, lease.Spec.HolderIdentity)
+		require.NotEmpty(r, *lease.Spec.HolderIdentity)
+
+		instances, _, err := consulClient.Catalog().Service("foo", "", nil)
+		require.NoError(r, err)
+		require.Len(r, instances, 1)
+	})
+
+	// Stop the first replica. Whether or not it was the leader, the second
+	// replica must be syncing afterwards.
+	stopCommand(t, cmds[0], exitChans[0])
+	_, err = k8s.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), lbService("bar", "2.2.2.2"), metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	retry.Run(t, func(r *retry.R) {
+		instances, _, err := consulClient.Catalog().Service("bar", "", nil)
+		require.NoError(r, err)
+		require.Len(r, instances, 1)
+	})
+	instances, _, err := consulClient.Catalog().Service("foo", "", nil)
+	require.NoError(t, err)
+	require.Len(t, instances, 1)
+}
+
+// Test that -enable-endpoint-slices falls back to syncing from Endpoints on
+// clusters that don't serve the EndpointSlice API.
+func TestRun_ToConsulEndpointSlicesFallback(t *testing.T) {
+	t.Parallel()
+
+	k8s, testServer := completeSetup(t)
+	defer testServer.Stop()
+
+	consulClient, err := api.NewClient(&api.Config{
+		Address: testServer.HTTPAddr,
+	})
+	require.NoError(t, err)
+
+	// Run the command.
+	ui := cli.NewMockUi()
+	cmd := Command{
+		UI:           ui,
+		clientset:    k8s,
+		consulClient: consulClient,
+		logger: hclog.New(&hclog.LoggerOptions{
+			Name:  t.Name(),
+			Level: hclog.Debug,
+		}),
+		flagAllowK8sNamespacesList: []string{"*"},
+	}
+
+	// create a ClusterIP service and its endpoints in k8s
+	_, err = k8s.CoreV1().Services(metav1.NamespaceDefault).Create(context.Background(), &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: metav1.NamespaceDefault},
+		Spec: apiv1.ServiceSpec{
+			Type:  apiv1.ServiceTypeClusterIP,
+			Ports: []apiv1.ServicePort{{Name: "http", Port: 80}},
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = k8s.CoreV1().Endpoints(metav1.NamespaceDefault).Create(context.Background(), &apiv1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: metav1.NamespaceDefault},
+		Subsets: []apiv1.EndpointSubset{
+			{
+				Addresses: []apiv1.EndpointAddress{{IP: "1.1.1.1"}},
+				Ports:     []apiv1.EndpointPort{{Name: "http", Port: 8080}},
+			},
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	exitChan := runCommandAsynchronously(&cmd, []string{
+		// change the write interval, so we can see changes in Consul quicker
+		"-consul-write-interval", "100ms",
+		"-enable-endpoint-slices",
+	})
+	defer stopCommand(t, &cmd, exitChan)
+
+	retry.Run(t, func(r *retry.R) {
+		instances, _, err := consulClient.Catalog().Service("foo", "", nil)
+		require.NoError(r, err)
+		require.Len(r, instances, 1)
+		require.Equal(r, "1.1.1.1", instances[0].ServiceAddress)
+		require.Equal(r, 8080, instances[0].ServicePort)
+	})
+}
+
 // Test that switching AddK8SNamespaceSuffix from false to true
 // results in re-registering services in Consul with namespaced names
 func TestCommand_Run_ToConsulChangeAddK8SNamespaceSuffixToTrue(t *testing.T) {
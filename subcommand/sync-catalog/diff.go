@@ -0,0 +1,86 @@
+package synccatalog
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	catalogtoconsul "github.com/hashicorp/consul-k8s/catalog/to-consul"
+	"github.com/mitchellh/cli"
+)
+
+// DiffCommand is the command that prints the changes sync-catalog would
+// make to the Consul catalog, without making them. It takes the same flags
+// as sync-catalog.
+type DiffCommand struct {
+	UI cli.Ui
+
+	cmd  *Command
+	once sync.Once
+}
+
+func (c *DiffCommand) init() {
+	c.cmd = &Command{UI: c.UI, diff: true}
+}
+
+func (c *DiffCommand) Run(args []string) int {
+	c.once.Do(c.init)
+	return c.cmd.Run(args)
+}
+
+func (c *DiffCommand) Synopsis() string { return diffSynopsis }
+func (c *DiffCommand) Help() string {
+	c.once.Do(c.init)
+	return c.cmd.Help()
+}
+
+// printDiff generates the registrations of the Kubernetes services once,
+// compares them with the Consul catalog and prints the changes a sync would
+// make.
+func (c *Command) printDiff(ctx context.Context, resource *catalogtoconsul.ServiceResource, syncer *catalogtoconsul.ConsulSyncer) int {
+	if err := resource.SyncAll(ctx); err != nil {
+		c.UI.Error(fmt.Sprintf("Error listing Kubernetes services: %s", err))
+		return 1
+	}
+	plan, err := syncer.Diff(ctx)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Error reading the Consul catalog: %s", err))
+		return 1
+	}
+
+	for _, node := range plan.NodeDeregistrations {
+		c.UI.Output(fmt.Sprintf("- node %s", node))
+	}
+	for _, d := range plan.Deregistrations {
+		c.UI.Output(fmt.Sprintf("- %s on node %s", serviceInstanceName(d.Namespace, d.ServiceID), d.Node))
+	}
+	for _, r := range plan.Registrations {
+		c.UI.Output(fmt.Sprintf("+ %s (%s %s:%d) on node %s",
+			serviceInstanceName(r.Service.Namespace, r.Service.ID),
+			r.Service.Service, r.Service.Address, r.Service.Port, r.Node))
+	}
+	c.UI.Info(fmt.Sprintf("%d to register, %d to deregister, %d nodes to deregister",
+		len(plan.Registrations), len(plan.Deregistrations), len(plan.NodeDeregistrations)))
+	return 0
+}
+
+// serviceInstanceName returns the ID of the service instance prefixed with
+// its Consul namespace if it has one.
+func serviceInstanceName(namespace, id string) string {
+	if namespace == "" {
+		return id
+	}
+	return namespace + "/" + id
+}
+
+const diffSynopsis = "Print the changes sync-catalog would make to the Consul catalog."
+const diffHelp = `
+Usage: consul-k8s sync-catalog diff [options]
+
+  Print the service instances that sync-catalog would register in and
+  deregister from the Consul catalog with the given options, based on the
+  current Kubernetes services and Consul catalog, and exit. Nothing is
+  written to Consul. Removed entries are prefixed with "-" and added or
+  updated entries with "+".
+
+`
@@ -0,0 +1,72 @@
+package synccatalog
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/go-uuid"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaderElector returns an elector for the Lease that lets a single replica
+// of sync-catalog write to Consul and Kubernetes. lead is called when the
+// replica acquires the Lease with a context that is cancelled when it loses
+// it.
+func (c *Command) leaderElector(lead func(ctx context.Context)) (*leaderelection.LeaderElector, error) {
+	// The identity must be unique even if replicas share a hostname.
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("getting hostname: %s", err)
+	}
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, fmt.Errorf("generating identity: %s", err)
+	}
+	identity := hostname + "_" + id
+
+	log := c.logger.Named("leader-election")
+	return leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      c.leaseName(),
+				Namespace: c.flagLeaderElectionNamespace,
+			},
+			Client:     c.clientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration: c.flagLeaderElectionLeaseDuration,
+		RenewDeadline: c.flagLeaderElectionLeaseDuration * 2 / 3,
+		RetryPeriod:   c.flagLeaderElectionLeaseDuration / 5,
+		// Release the Lease when shutting down so that a standby takes
+		// over without waiting for it to expire.
+		ReleaseOnCancel: true,
+		Name:            c.leaseName(),
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Info("acquired lease, starting sync", "identity", identity)
+				lead(ctx)
+			},
+			OnStoppedLeading: func() {
+				log.Info("leader election stopped", "identity", identity)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Info("following leader", "leader", leader)
+				}
+			},
+		},
+	})
+}
+
+// leaseName returns the name of the Lease used for leader election. It
+// defaults to one per Consul node name so that syncs to different nodes
+// don't share it.
+func (c *Command) leaseName() string {
+	if c.flagLeaderElectionLeaseName != "" {
+		return c.flagLeaderElectionLeaseName
+	}
+	return c.flagConsulNodeName + "-sync-catalog-leader"
+}